@@ -0,0 +1,107 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"github.com/fluxcd/pkg/apis/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// WorkloadPoliciesAnnotation is the annotation with which a workload
+// selected by .spec.cluster.workloadSelector says which image policy
+// is for which of its containers, as a comma-separated list of
+// `<container>=<policy>`; e.g., `app=podinfo,proxy=envoy`.
+const WorkloadPoliciesAnnotation = "image.toolkit.fluxcd.io/policies"
+
+// ClusterTargetSpec gives the objects in the cluster to which updates
+// are applied directly, rather than committed to git.
+type ClusterTargetSpec struct {
+	// Substitutions lists variables in the post-build substitutions
+	// of Kustomizations, to set from the latest images of image
+	// policies.
+	// +optional
+	Substitutions []SubstitutionTarget `json:"substitutions,omitempty"`
+
+	// WorkloadSelector selects the Deployments, StatefulSets and
+	// DaemonSets, in the same namespace, whose container images are
+	// updated. Each workload says which image policy is for which of
+	// its containers with the annotation
+	// `image.toolkit.fluxcd.io/policies`; e.g.,
+	// `app=podinfo,proxy=envoy`.
+	// +optional
+	WorkloadSelector *metav1.LabelSelector `json:"workloadSelector,omitempty"`
+}
+
+// SubstitutionTarget refers to a variable in the post-build
+// substitutions of a Kustomization, and the image policy to set it
+// from.
+type SubstitutionTarget struct {
+	// KustomizationRef refers to the Kustomization, in the same
+	// namespace.
+	// +required
+	KustomizationRef meta.LocalObjectReference `json:"kustomizationRef"`
+
+	// Variable names the variable in .spec.postBuild.substitute of
+	// the Kustomization.
+	// +kubebuilder:validation:Pattern="^[_a-zA-Z][_a-zA-Z0-9]*$"
+	// +required
+	Variable string `json:"variable"`
+
+	// Policy names the image policy, in the same namespace, whose
+	// latest image the variable is set from.
+	// +required
+	Policy string `json:"policy"`
+
+	// Value says what the variable is set to: the whole image
+	// reference (Image), the image name without the tag (Name), or
+	// only the tag (Tag). Defaults to Image.
+	// +kubebuilder:validation:Enum=Image;Name;Tag
+	// +optional
+	Value SubstitutionValue `json:"value,omitempty"`
+}
+
+// SubstitutionValue is the type for the values that go in
+// .spec.cluster.substitutions[].value. NB the values in the enum
+// annotation for the field.
+type SubstitutionValue string
+
+const (
+	// SubstituteImage sets a variable to the whole image reference;
+	// e.g., `ghcr.io/stefanprodan/podinfo:5.0.1`. This is the
+	// default.
+	SubstituteImage SubstitutionValue = "Image"
+	// SubstituteName sets a variable to the image name; e.g.,
+	// `ghcr.io/stefanprodan/podinfo`.
+	SubstituteName SubstitutionValue = "Name"
+	// SubstituteTag sets a variable to the image tag; e.g., `5.0.1`.
+	SubstituteTag SubstitutionValue = "Tag"
+)
+
+// ClusterUpdateResult records the updates applied directly to objects
+// in the cluster by a run.
+type ClusterUpdateResult struct {
+	// Time is when the updates were applied.
+	// +required
+	Time metav1.Time `json:"time"`
+	// Objects lists the objects updated, as `<kind>/<name>`.
+	// +optional
+	Objects []string `json:"objects,omitempty"`
+	// Images records the values changed, with the image policy
+	// responsible for each.
+	// +optional
+	Images []ImageUpdate `json:"images,omitempty"`
+}
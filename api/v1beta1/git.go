@@ -19,6 +19,7 @@ package v1beta1
 import (
 	"github.com/fluxcd/pkg/apis/meta"
 	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type GitSpec struct {
@@ -37,6 +38,14 @@ type GitSpec struct {
 	// `.spec.checkout.branch` or its default.
 	// +optional
 	Push *PushSpec `json:"push,omitempty"`
+
+	// Identity gives a cloud identity with which to get credentials
+	// for cloning from and pushing to the git repository, in place of
+	// the username and password in the secret referred to by the
+	// `GitRepository`. This lets automations sharing a controller
+	// push as different identities.
+	// +optional
+	Identity *CloudIdentity `json:"identity,omitempty"`
 }
 
 type GitCheckoutSpec struct {
@@ -49,9 +58,15 @@ type GitCheckoutSpec struct {
 // CommitSpec specifies how to commit changes to the git repository
 type CommitSpec struct {
 	// Author gives the email and optionally the name to use as the
-	// author of commits.
-	// +required
-	Author CommitUser `json:"author"`
+	// author of commits. Either this or AuthorFrom must be given.
+	// +optional
+	Author CommitUser `json:"author,omitempty"`
+	// AuthorFrom refers to a Secret or ConfigMap holding the name and
+	// email to use as the author of commits, so that they needn't be
+	// repeated in every automation. It cannot be used together with
+	// Author.
+	// +optional
+	AuthorFrom *CommitAuthorReference `json:"authorFrom,omitempty"`
 	// SigningKey provides the option to sign commits with a GPG key
 	// +optional
 	SigningKey *SigningKey `json:"signingKey,omitempty"`
@@ -59,6 +74,83 @@ type CommitSpec struct {
 	// into which will be interpolated the details of the change made.
 	// +optional
 	MessageTemplate string `json:"messageTemplate,omitempty"`
+	// MessageTemplateFrom refers to a ConfigMap holding the template
+	// for the commit message, so that one template can be shared by
+	// many automations. It cannot be used together with
+	// MessageTemplate.
+	// +optional
+	MessageTemplateFrom *MessageTemplateReference `json:"messageTemplateFrom,omitempty"`
+	// SubjectTemplate provides a template for the subject line of the
+	// commit message. If given, the message template (if any) gives
+	// the body of the commit message, which follows the subject after
+	// a blank line.
+	// +optional
+	SubjectTemplate string `json:"subjectTemplate,omitempty"`
+	// SubjectMaxLength gives the greatest number of characters
+	// allowed in the subject line of the commit message; a longer
+	// subject is shortened, and ends with "...". If zero, there is no
+	// limit.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	SubjectMaxLength int `json:"subjectMaxLength,omitempty"`
+	// UpdatesTrailer, if true, appends a trailer to the commit
+	// message listing each image policy used in the update with the
+	// old and new values of the fields it changed, in JSON; e.g.,
+	// `Flux-Image-Updates: [{"policy":"ns/app","old":"app:v1","new":"app:v2"}]`.
+	// This is so that tools can parse commits made by automation.
+	// +optional
+	UpdatesTrailer bool `json:"updatesTrailer,omitempty"`
+	// UpdateManifest, if given, has each commit also record the
+	// updates it makes in a file in the repository, so that there's
+	// a record of them that survives the commits being squashed or
+	// rebased, and that tools can read.
+	// +optional
+	UpdateManifest *UpdateManifestSpec `json:"updateManifest,omitempty"`
+}
+
+// UpdateManifestSpec says where in the repository to record the
+// updates committed by an automation.
+type UpdateManifestSpec struct {
+	// Path gives the file in which to record the updates, relative to
+	// the root of the repository. Defaults to
+	// `.flux/image-updates.yaml`.
+	// +optional
+	Path string `json:"path,omitempty"`
+	// MaxEntries gives the greatest number of commits for which the
+	// updates are kept in the file; the oldest are dropped to make
+	// room for the newest. If zero, all are kept.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxEntries int `json:"maxEntries,omitempty"`
+}
+
+// MessageTemplateReference locates a commit message template held in
+// a ConfigMap.
+type MessageTemplateReference struct {
+	// ConfigMapRef refers to the ConfigMap holding the template. If
+	// the namespace is not given, the ConfigMap is expected to be in
+	// the same namespace as the ImageUpdateAutomation.
+	// +required
+	ConfigMapRef meta.NamespacedObjectReference `json:"configMapRef"`
+	// Key gives the key in the ConfigMap's data under which the
+	// template is stored.
+	// +kubebuilder:default=messageTemplate
+	// +optional
+	Key string `json:"key,omitempty"`
+}
+
+// CommitAuthorReference locates the author of commits, held in a
+// Secret or a ConfigMap under the keys `name` (optional) and `email`.
+type CommitAuthorReference struct {
+	// SecretRef refers to a Secret holding the author. It must be in
+	// the same namespace as the ImageUpdateAutomation.
+	// +optional
+	SecretRef *meta.LocalObjectReference `json:"secretRef,omitempty"`
+	// ConfigMapRef refers to a ConfigMap holding the author. If the
+	// namespace is not given, the ConfigMap is expected to be in the
+	// same namespace as the ImageUpdateAutomation.
+	// +optional
+	ConfigMapRef *meta.NamespacedObjectReference `json:"configMapRef,omitempty"`
 }
 
 type CommitUser struct {
@@ -85,6 +177,201 @@ type PushSpec struct {
 	// Branch specifies that commits should be pushed to the branch
 	// named. The branch is created using `.spec.checkout.branch` as the
 	// starting point, if it doesn't already exist.
+	// +optional
+	Branch string `json:"branch,omitempty"`
+
+	// Refspec specifies the Git refspec to use when pushing, e.g.,
+	// `HEAD:refs/for/main`. If both Branch and Refspec are given,
+	// commits are pushed to the branch and also using the refspec.
+	// For more details about refspecs, see
+	// https://git-scm.com/book/en/v2/Git-Internals-The-Refspec.
+	// +optional
+	Refspec string `json:"refspec,omitempty"`
+
+	// ResetToBase, if true, has the push branch recreated from the
+	// checkout ref when the branch has diverged from it; that is, when
+	// the checkout ref has commits the branch doesn't. The updates are
+	// then made afresh, and the branch is force-pushed, which discards
+	// any commits that were only on the branch. Otherwise, commits are
+	// made on top of the branch as it is.
+	// +optional
+	ResetToBase bool `json:"resetToBase,omitempty"`
+
+	// DeleteBranchOnRemoval, if true, has the push branch deleted from
+	// the git repository when the ImageUpdateAutomation is deleted. The
+	// branch is left alone if it's the branch of the checkout ref, or
+	// the checkout ref doesn't give a branch.
+	// +optional
+	DeleteBranchOnRemoval bool `json:"deleteBranchOnRemoval,omitempty"`
+
+	// Canary, if given, has each commit pushed to the push branch
+	// promoted to another branch, by cherry-picking it, once it has
+	// been on the push branch for the soak time without being
+	// reverted. The push branch is then a canary for the branch
+	// promoted to.
+	// +optional
+	Canary *CanarySpec `json:"canary,omitempty"`
+}
+
+// CanarySpec gives the branch commits pushed are promoted to, and how
+// long they are left on the push branch first.
+type CanarySpec struct {
+	// Branch names the branch commits are promoted to. It must
+	// already exist, and be other than the push branch.
 	// +required
 	Branch string `json:"branch"`
+
+	// SoakTime is how long a commit must have been on the push
+	// branch before it is promoted.
+	// +required
+	SoakTime metav1.Duration `json:"soakTime"`
 }
+
+// CommitStatusSpec gives how to set a status on each commit pushed,
+// with the git provider hosting the repository.
+type CommitStatusSpec struct {
+	// Provider names the git provider hosting the repository. If not
+	// given, it is worked out from the URL of the repository, for
+	// repositories on github.com, gitlab.com and bitbucket.org.
+	// +kubebuilder:validation:Enum=github;gitlab;bitbucket
+	// +optional
+	Provider CommitStatusProvider `json:"provider,omitempty"`
+
+	// Address is the base URL of the provider's API, for providers
+	// hosted elsewhere than the public services; e.g.,
+	// `https://github.example.com/api/v3`.
+	// +optional
+	Address string `json:"address,omitempty"`
+
+	// Context names the status, so that branch protection rules can
+	// require it. Defaults to `flux/image-automation`.
+	// +optional
+	Context string `json:"context,omitempty"`
+
+	// SecretRef refers to a Secret, in the same namespace, with the
+	// API token to set statuses with, in the field `token`.
+	// +required
+	SecretRef meta.LocalObjectReference `json:"secretRef"`
+}
+
+// CommitStatusProvider is the type for the values that go in
+// .spec.commitStatus.provider. NB the values in the enum annotation
+// for the field.
+type CommitStatusProvider string
+
+const (
+	// CommitStatusGitHub is for GitHub, and GitHub Enterprise.
+	CommitStatusGitHub CommitStatusProvider = "github"
+	// CommitStatusGitLab is for GitLab, whether gitlab.com or
+	// self-managed.
+	CommitStatusGitLab CommitStatusProvider = "gitlab"
+	// CommitStatusBitbucket is for Bitbucket Cloud.
+	CommitStatusBitbucket CommitStatusProvider = "bitbucket"
+)
+
+// FailureIssueSpec gives when and how to report an automation that
+// keeps failing.
+type FailureIssueSpec struct {
+	// Failures is the number of runs in a row that must fail before
+	// the failures are reported. Defaults to 5.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Failures int64 `json:"failures,omitempty"`
+
+	// Provider says how to report the failures: by opening an issue
+	// on the git repository with github or gitlab, or by POSTing the
+	// details to the webhook at Address. If not given, it is worked
+	// out from the URL of the repository, for repositories on
+	// github.com and gitlab.com.
+	// +kubebuilder:validation:Enum=github;gitlab;webhook
+	// +optional
+	Provider FailureIssueProvider `json:"provider,omitempty"`
+
+	// Address is the base URL of the provider's API, for providers
+	// hosted elsewhere than the public services, or the URL of the
+	// webhook.
+	// +optional
+	Address string `json:"address,omitempty"`
+
+	// Labels are given to the issue opened.
+	// +optional
+	Labels []string `json:"labels,omitempty"`
+
+	// SecretRef refers to a Secret, in the same namespace, with the
+	// API token to open issues with, in the field `token`. It must be
+	// given for github and gitlab; for a webhook, the token, if
+	// given, is sent as a bearer token.
+	// +optional
+	SecretRef *meta.LocalObjectReference `json:"secretRef,omitempty"`
+}
+
+// FailureIssueProvider is the type for the values that go in
+// .spec.failureIssue.provider. NB the values in the enum annotation
+// for the field.
+type FailureIssueProvider string
+
+const (
+	// FailureIssueGitHub is for GitHub, and GitHub Enterprise.
+	FailureIssueGitHub FailureIssueProvider = "github"
+	// FailureIssueGitLab is for GitLab, whether gitlab.com or
+	// self-managed.
+	FailureIssueGitLab FailureIssueProvider = "gitlab"
+	// FailureIssueWebhook is for any other service, to which the
+	// details of the failures are POSTed as JSON.
+	FailureIssueWebhook FailureIssueProvider = "webhook"
+)
+
+// CloudIdentity gives a cloud identity to get git credentials with,
+// and the provider that issues them.
+type CloudIdentity struct {
+	// Provider is the cloud provider of the identity: aws, to assume
+	// an IAM role and push to AWS CodeCommit; gcp, to act as a Google
+	// service account and push to Cloud Source Repositories; or azure,
+	// to act as an Azure AD application and push to Azure DevOps.
+	// +kubebuilder:validation:Enum=aws;gcp;azure
+	// +required
+	Provider CloudIdentityProvider `json:"provider"`
+
+	// RoleARN is the ARN of the IAM role to assume, for aws. The role
+	// must trust the cluster's OIDC provider for the service account
+	// of the automation, or of the controller if none is given.
+	// +optional
+	RoleARN string `json:"roleARN,omitempty"`
+
+	// ServiceAccountEmail is the email of the Google service account
+	// to act as, for gcp. The service account of the automation must
+	// be allowed to act as it, through the workload identity provider
+	// the controller is configured with; or, if none is given, the
+	// controller's own identity must be allowed to create tokens for
+	// it.
+	// +optional
+	ServiceAccountEmail string `json:"serviceAccountEmail,omitempty"`
+
+	// ClientID is the client ID of the Azure AD application to act
+	// as, for azure. The application must have a federated credential
+	// for the service account of the automation, or of the controller
+	// if none is given.
+	// +optional
+	ClientID string `json:"clientID,omitempty"`
+
+	// TenantID is the ID of the Azure AD tenant of the application,
+	// for azure.
+	// +optional
+	TenantID string `json:"tenantID,omitempty"`
+}
+
+// CloudIdentityProvider is the type for the values that go in
+// .spec.git.identity.provider. NB the values in the enum annotation
+// for the field.
+type CloudIdentityProvider string
+
+const (
+	// CloudIdentityAWS is for an IAM role, assumed with a web
+	// identity token.
+	CloudIdentityAWS CloudIdentityProvider = "aws"
+	// CloudIdentityGCP is for a Google service account.
+	CloudIdentityGCP CloudIdentityProvider = "gcp"
+	// CloudIdentityAzure is for an Azure AD application, with a
+	// federated credential.
+	CloudIdentityAzure CloudIdentityProvider = "azure"
+)
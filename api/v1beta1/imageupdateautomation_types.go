@@ -17,6 +17,7 @@ limitations under the License.
 package v1beta1
 
 import (
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/fluxcd/pkg/apis/meta"
@@ -27,15 +28,22 @@ const ImageUpdateAutomationKind = "ImageUpdateAutomation"
 // ImageUpdateAutomationSpec defines the desired state of ImageUpdateAutomation
 type ImageUpdateAutomationSpec struct {
 	// SourceRef refers to the resource giving access details
-	// to a git repository.
-	// +required
+	// to a git repository. It must be given unless Cluster is.
+	// +optional
 	SourceRef SourceReference `json:"sourceRef"`
 	// GitSpec contains all the git-specific definitions. This is
-	// technically optional, but in practice mandatory until there are
-	// other kinds of source allowed.
+	// technically optional, but in practice mandatory unless Cluster
+	// is given.
 	// +optional
 	GitSpec *GitSpec `json:"git,omitempty"`
 
+	// Cluster, if given, has the updates applied directly to objects
+	// in the cluster, instead of committed to git; SourceRef and
+	// GitSpec are then not used. This is for clusters run without a
+	// git repository to write back to.
+	// +optional
+	Cluster *ClusterTargetSpec `json:"cluster,omitempty"`
+
 	// Interval gives an lower bound for how often the automation
 	// run should be attempted.
 	// +required
@@ -51,8 +59,174 @@ type ImageUpdateAutomationSpec struct {
 	// it is unset (or set to false). Defaults to false.
 	// +optional
 	Suspend bool `json:"suspend,omitempty"`
+
+	// DependsOn gives a list of objects that must be ready before
+	// this automation will run; e.g., another automation which
+	// updates an earlier stage in a promotion pipeline, or the
+	// Kustomization that applies it.
+	// +optional
+	DependsOn []DependencyReference `json:"dependsOn,omitempty"`
+
+	// PriorityClass says how urgently this automation should be run
+	// when the controller has more automations to run than it can
+	// run at once. Automations in the class High are run before those
+	// in the class Normal, which are run before those in the class
+	// Low. Defaults to Normal.
+	// +kubebuilder:validation:Enum=High;Normal;Low
+	// +optional
+	PriorityClass PriorityClassName `json:"priorityClass,omitempty"`
+
+	// Timeout gives a deadline for the whole of an automation run,
+	// including cloning, fetching, updating files and pushing. Each
+	// git operation is also subject to the timeout given in the
+	// referenced GitRepository. If not given, there is no deadline
+	// for the run as a whole.
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+
+	// EventVerbosity says how many events are emitted about
+	// successful runs. With Errors, only failures are reported; with
+	// Run, there is also an event for each commit pushed; and with
+	// File, there is an event for each file updated as well. Defaults
+	// to Run.
+	// +kubebuilder:validation:Enum=Errors;Run;File
+	// +optional
+	EventVerbosity EventVerbosity `json:"eventVerbosity,omitempty"`
+
+	// CommitLinkTemplate gives the web address of a commit in the git
+	// repository, as a template into which `{{ .Revision }}` (the
+	// commit's SHA1) and `{{ .Branch }}` are interpolated; e.g.,
+	// `https://git.example.com/org/repo/commit/{{ .Revision }}`. It
+	// is used to link to commits from the events sent about them. If
+	// not given, the address is worked out for repositories on
+	// github.com, gitlab.com and bitbucket.org.
+	// +optional
+	CommitLinkTemplate string `json:"commitLinkTemplate,omitempty"`
+
+	// CommitStatus, if given, has a status set on each commit pushed,
+	// with the git provider hosting the repository, saying how many
+	// updates the commit applied; e.g., so that branch protection
+	// rules and dashboards can take account of the automation.
+	// +optional
+	CommitStatus *CommitStatusSpec `json:"commitStatus,omitempty"`
+
+	// FailureIssue, if given, has an issue opened on the git
+	// repository, or a webhook called, once the automation has failed
+	// a number of runs in a row, with the details of the last
+	// failure, so that a broken automation doesn't go unnoticed.
+	// +optional
+	FailureIssue *FailureIssueSpec `json:"failureIssue,omitempty"`
+
+	// DryRun tells the controller to make the updates and the commit
+	// as usual, but not to push the commit. What would have been
+	// pushed is recorded in .status.lastDryRun, and reported in an
+	// event. Defaults to false.
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// PreviewWhileSuspended tells the controller to keep working out
+	// the updates the automation would make while it is suspended,
+	// and record them in .status.pendingUpdates, without committing
+	// or pushing anything. Defaults to false.
+	// +optional
+	PreviewWhileSuspended bool `json:"previewWhileSuspended,omitempty"`
+
+	// RequireApproval tells the controller not to commit the updates
+	// the automation makes until they have been approved. The updates
+	// waiting for approval are recorded in .status.pendingUpdates,
+	// with a token; they are approved by setting the annotation
+	// `image.toolkit.fluxcd.io/approve` to the token. Updates that
+	// differ from those approved have to be approved afresh. A dry run
+	// doesn't need approval. Defaults to false.
+	// +optional
+	RequireApproval bool `json:"requireApproval,omitempty"`
+
+	// ApprovalMethod says how updates are approved, if the automation
+	// requires approval. With Annotation, they are approved by
+	// setting the approve annotation to their token; with
+	// ChangeRequest, an ImageUpdateChangeRequest is created for the
+	// updates waiting, and they are approved by setting its
+	// .spec.approved to true. Defaults to Annotation.
+	// +kubebuilder:validation:Enum=Annotation;ChangeRequest
+	// +optional
+	ApprovalMethod ApprovalMethod `json:"approvalMethod,omitempty"`
+
+	// HealthGates lists objects that apply the commits this
+	// automation pushes; e.g., the Kustomization that applies the
+	// push branch. Before committing more updates, the controller
+	// checks that each is ready, and, if it records the revision it
+	// applied, that it has applied the last commit pushed. Until
+	// then, the updates are held back.
+	// +optional
+	HealthGates []HealthGateReference `json:"healthGates,omitempty"`
+
+	// WebhookSecretRef refers to a Secret, in the same namespace,
+	// holding under the key `token` the key used to check the
+	// signature of requests to run this automation, made to the
+	// controller's webhook receiver. Requests to run an automation
+	// without it are refused.
+	// +optional
+	WebhookSecretRef *meta.LocalObjectReference `json:"webhookSecretRef,omitempty"`
+
+	// ServiceAccountName gives the name of a service account, in the
+	// same namespace, which the controller impersonates to read the
+	// objects the automation refers to; e.g., the GitRepository, the
+	// image policies and secrets; and to patch the objects a cluster
+	// target updates. If not given, the controller reads and patches
+	// them with its own service account.
+	// +optional
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
 }
 
+// PriorityClassName is the type for the names that go in
+// .spec.priorityClass. NB the values in the enum annotation for the
+// field.
+type PriorityClassName string
+
+const (
+	// PriorityClassHigh is for automations that should be run before
+	// any others; e.g., those for production environments.
+	PriorityClassHigh PriorityClassName = "High"
+	// PriorityClassNormal is for automations with no particular
+	// urgency. This is the default.
+	PriorityClassNormal PriorityClassName = "Normal"
+	// PriorityClassLow is for automations that can wait until others
+	// have been run; e.g., those for sandbox environments.
+	PriorityClassLow PriorityClassName = "Low"
+)
+
+// EventVerbosity is the type for the values that go in
+// .spec.eventVerbosity. NB the values in the enum annotation for the
+// field.
+type EventVerbosity string
+
+const (
+	// EventVerbosityErrors means only failed runs are reported in
+	// events.
+	EventVerbosityErrors EventVerbosity = "Errors"
+	// EventVerbosityRun means failed runs and each commit pushed are
+	// reported in events. This is the default.
+	EventVerbosityRun EventVerbosity = "Run"
+	// EventVerbosityFile means that, as well as what's reported for
+	// Run, each file updated is reported in an event of its own.
+	EventVerbosityFile EventVerbosity = "File"
+)
+
+// ApprovalMethod is the type for the values that go in
+// .spec.approvalMethod. NB the values in the enum annotation for the
+// field.
+type ApprovalMethod string
+
+const (
+	// ApprovalAnnotation means updates are approved by setting the
+	// approve annotation of the automation to their approval token.
+	// This is the default.
+	ApprovalAnnotation ApprovalMethod = "Annotation"
+	// ApprovalChangeRequest means updates are approved by approving
+	// the ImageUpdateChangeRequest created for them.
+	ApprovalChangeRequest ApprovalMethod = "ChangeRequest"
+)
+
 // UpdateStrategyName is the type for names that go in
 // .update.strategy. NB the value in the const immediately below.
 // +kubebuilder:validation:Enum=Setters
@@ -65,6 +239,39 @@ const (
 	UpdateStrategySetters UpdateStrategyName = "Setters"
 )
 
+// SymlinkPolicy is the type for the values that go in
+// .update.symlinks. NB the values in the enum annotation for the
+// type.
+// +kubebuilder:validation:Enum=Skip;Fail
+type SymlinkPolicy string
+
+const (
+	// SymlinksSkip means files that are symlinks to outside the
+	// repository are left out of updates, and reported as skipped.
+	// This is the default.
+	SymlinksSkip SymlinkPolicy = "Skip"
+	// SymlinksFail means a run fails if a file to be considered for
+	// updates is a symlink to outside the repository.
+	SymlinksFail SymlinkPolicy = "Fail"
+)
+
+// ImageFormat is the type for the values that go in
+// .update.imageFormat. NB the values in the enum annotation for the
+// type.
+// +kubebuilder:validation:Enum=Tag;Digest;TagAndDigest
+type ImageFormat string
+
+const (
+	// ImageFormatTag means images are written as `name:tag`.
+	ImageFormatTag ImageFormat = "Tag"
+	// ImageFormatDigest means images are written as `name@digest`,
+	// when the policy gives a digest.
+	ImageFormatDigest ImageFormat = "Digest"
+	// ImageFormatTagAndDigest means images are written as
+	// `name:tag@digest`, when the policy gives a digest.
+	ImageFormatTagAndDigest ImageFormat = "TagAndDigest"
+)
+
 // UpdateStrategy is a union of the various strategies for updating
 // the Git repository. Parameters for each strategy (if any) can be
 // inlined here.
@@ -79,6 +286,135 @@ type UpdateStrategy struct {
 	// of the GitRepositoryRef.
 	// +optional
 	Path string `json:"path,omitempty"`
+
+	// Paths gives a list of directories containing manifests to be
+	// updated, each with optional patterns for including or
+	// excluding files. It cannot be used together with Path.
+	// +optional
+	Paths []UpdatePath `json:"paths,omitempty"`
+
+	// Stages gives an ordered list of directories, one for each
+	// environment an image is promoted through; e.g., dev, then
+	// staging, then prod. The first stage is updated as usual; each
+	// stage after it is only given an image once the image has been
+	// in the stage before it for that stage's soak time, and that
+	// stage's health gates are healthy. It cannot be used together
+	// with Path or Paths.
+	// +optional
+	Stages []PromotionStage `json:"stages,omitempty"`
+
+	// Ignore gives patterns, in the .gitignore format, for files
+	// and directories to leave out when looking for files to
+	// update. The patterns are relative to the root of the
+	// repository, and are applied in addition to those in the
+	// `.spec.ignore` field of the referenced GitRepository, and in
+	// any `.sourceignore` files in the repository.
+	// +optional
+	Ignore *string `json:"ignore,omitempty"`
+
+	// Symlinks says what to do about files that are symlinks to
+	// somewhere outside the repository: `Skip` (the default) leaves
+	// them out of the update, and `Fail` fails the run. Symlinks to
+	// files within the repository are followed.
+	// +optional
+	Symlinks SymlinkPolicy `json:"symlinks,omitempty"`
+
+	// InitSubmodules has the git submodules that contain any of the
+	// paths to update checked out, so that the files in them are
+	// scanned. Changes to files in a submodule are reported, but not
+	// committed; nor is a change to the commit a submodule refers to
+	// ever committed.
+	// +optional
+	InitSubmodules bool `json:"initSubmodules,omitempty"`
+
+	// ImageFormat says how markers without a suffix write images:
+	// `Tag` writes `name:tag`, `Digest` writes `name@digest`, and
+	// `TagAndDigest` writes `name:tag@digest`. By default, images are
+	// written as the image policy gives them. An image policy can be
+	// given a format of its own with the annotation
+	// `image.toolkit.fluxcd.io/image-format`, which takes precedence.
+	// +optional
+	ImageFormat ImageFormat `json:"imageFormat,omitempty"`
+
+	// RegistryRewrites gives the registries, or repositories within
+	// them, to write in place of others when writing the name of an
+	// image; e.g., to have images pulled through a mirror. The first
+	// rewrite that matches an image is applied; the tag and digest are
+	// written as usual.
+	// +optional
+	RegistryRewrites []RegistryRewrite `json:"registryRewrites,omitempty"`
+
+	// DetectImages has image fields updated without a marker, when the
+	// image they give is in the repository of exactly one image
+	// policy: the image of each container, and the tag and digest of
+	// each image in a Kustomization. Fields with a marker are updated
+	// as the marker says.
+	// +optional
+	DetectImages bool `json:"detectImages,omitempty"`
+}
+
+// RegistryRewrite maps images from a registry, or a repository within
+// one, to another.
+type RegistryRewrite struct {
+	// From gives the registry of the images to rewrite, optionally
+	// followed by a path within it; e.g., `docker.io` or
+	// `ghcr.io/org`. Images that don't give a registry are taken to be
+	// in `docker.io`.
+	// +required
+	From string `json:"from"`
+
+	// To gives what to write in place of From; e.g.,
+	// `registry.internal.example.com/dockerhub`.
+	// +required
+	To string `json:"to"`
+}
+
+// UpdatePath names a directory in the repository to update, and
+// optionally which files within it are to be considered.
+type UpdatePath struct {
+	// Path to the directory containing the manifests to be updated,
+	// relative to the root of the repository.
+	// +required
+	Path string `json:"path"`
+
+	// Include gives glob patterns for the files to consider for
+	// updates, relative to the path. A pattern without a slash is
+	// matched against file names in any directory, and `**` matches
+	// any number of directories. If empty, all files are considered.
+	// +optional
+	Include []string `json:"include,omitempty"`
+
+	// Exclude gives glob patterns, in the same form as Include, for
+	// files to leave alone. Exclusions take precedence over
+	// inclusions.
+	// +optional
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// PromotionStage names a directory in the repository holding the
+// manifests of one stage of a promotion, and says when an image can be
+// promoted from it to the next stage.
+type PromotionStage struct {
+	// Name of the stage; e.g., "staging". Each stage must have a
+	// different name.
+	// +required
+	Name string `json:"name"`
+
+	// Path to the directory containing the manifests of the stage,
+	// relative to the root of the repository.
+	// +required
+	Path string `json:"path"`
+
+	// SoakTime is how long an image must have been in this stage
+	// before it is promoted to the next. Defaults to no time at all.
+	// +optional
+	SoakTime *metav1.Duration `json:"soakTime,omitempty"`
+
+	// HealthGates lists objects that apply the manifests of this
+	// stage, which must be healthy before an image is promoted from
+	// it to the next, as for the health gates of the automation.
+	// +optional
+	HealthGates []HealthGateReference `json:"healthGates,omitempty"`
 }
 
 // ImageUpdateAutomationStatus defines the observed state of ImageUpdateAutomation
@@ -95,6 +431,104 @@ type ImageUpdateAutomationStatus struct {
 	// LastPushTime records the time of the last pushed change.
 	// +optional
 	LastPushTime *metav1.Time `json:"lastPushTime,omitempty"`
+	// LastPushImages records the field values changed in the last
+	// pushed commit, with the image policy responsible for each.
+	// +optional
+	LastPushImages []ImageUpdate `json:"lastPushImages,omitempty"`
+	// LastPushFiles lists the files changed by the last pushed
+	// commit, relative to the root of the repository. At most 100
+	// files are listed.
+	// +kubebuilder:validation:MaxItems=100
+	// +optional
+	LastPushFiles []string `json:"lastPushFiles,omitempty"`
+	// LastDryRun records the commit the last run would have pushed,
+	// if the automation is a dry run and the run made a commit.
+	// +optional
+	LastDryRun *DryRunResult `json:"lastDryRun,omitempty"`
+	// LastClusterUpdate records the last updates applied directly to
+	// objects in the cluster; see .spec.cluster.
+	// +optional
+	LastClusterUpdate *ClusterUpdateResult `json:"lastClusterUpdate,omitempty"`
+	// PendingUpdates records the updates the automation would make
+	// if it were not suspended, as of the last preview, or the
+	// updates waiting for approval.
+	// +optional
+	PendingUpdates *PendingUpdates `json:"pendingUpdates,omitempty"`
+	// LastRevert records the last revert of a pushed commit, made on
+	// request with the revert annotation.
+	// +optional
+	LastRevert *RevertResult `json:"lastRevert,omitempty"`
+	// LastHandledRevertAt holds the value of the most recent revert
+	// request annotation, so a new request can be detected.
+	// +optional
+	LastHandledRevertAt string `json:"lastHandledRevertAt,omitempty"`
+	// LastHandledApproval holds the approval token of the last
+	// updates approved, so that an approval is acted on only once.
+	// +optional
+	LastHandledApproval string `json:"lastHandledApproval,omitempty"`
+	// Stages records, for each stage of a promotion, the image each
+	// image policy has put in the stage, and since when, as of the
+	// last run that made no changes or pushed its commit.
+	// +optional
+	Stages []StageStatus `json:"stages,omitempty"`
+	// Canary records the commits pushed that are yet to be promoted
+	// to the canary branch, and the last promotion.
+	// +optional
+	Canary *CanaryStatus `json:"canary,omitempty"`
+	// AppliedPolicies records, for each image policy that has led to
+	// a pushed update, the image last written because of it.
+	// +optional
+	AppliedPolicies []AppliedPolicy `json:"appliedPolicies,omitempty"`
+	// PushRefs records the outcome of pushing to each ref the
+	// automation pushes to (i.e., the push branch and the ref given
+	// by the push refspec), so that a push which succeeded for one ref
+	// and failed for another can be seen.
+	// +optional
+	PushRefs []PushRefStatus `json:"pushRefs,omitempty"`
+	// ConsecutiveNoChangeRuns counts the automation runs in a row,
+	// since the last push, that made no changes.
+	// +optional
+	ConsecutiveNoChangeRuns int64 `json:"consecutiveNoChangeRuns,omitempty"`
+	// LastNoChangeReason gives the reason the last run made no
+	// changes, if it made none.
+	// +optional
+	LastNoChangeReason NoChangeReason `json:"lastNoChangeReason,omitempty"`
+	// ConsecutivePushFailures counts the pushes in a row that have
+	// failed, since the last push that succeeded or run that had
+	// nothing to push.
+	// +optional
+	ConsecutivePushFailures int64 `json:"consecutivePushFailures,omitempty"`
+	// ConsecutiveFailures counts the runs in a row that have failed,
+	// since the last run that succeeded.
+	// +optional
+	ConsecutiveFailures int64 `json:"consecutiveFailures,omitempty"`
+	// FailureReport records the report made of the runs in a row that
+	// have failed, once there have been enough to report; see
+	// .spec.failureIssue. It is cleared when a run succeeds.
+	// +optional
+	FailureReport *FailureReport `json:"failureReport,omitempty"`
+	// ObservedPolicies lists the image policies that markers referred
+	// to in the last run, with the latest image of each at the time,
+	// in order of name.
+	// +optional
+	ObservedPolicies []ObservedPolicy `json:"observedPolicies,omitempty"`
+	// SkippedFiles lists the files left out of the last run that
+	// scanned for updates; e.g., because they couldn't be parsed. At
+	// most 100 files are listed.
+	// +kubebuilder:validation:MaxItems=100
+	// +optional
+	SkippedFiles []SkippedFile `json:"skippedFiles,omitempty"`
+	// ReferencedPolicies lists the names of the image policies that
+	// markers in the files updated referred to, as of the last run, in
+	// order. A change to any other policy doesn't set off a run.
+	// +optional
+	ReferencedPolicies []string `json:"referencedPolicies,omitempty"`
+	// LastRunDigest is a digest of the generation of the automation,
+	// the revision of the git repository, and the latest images of
+	// the image policies, as of the last successful run. A run with
+	// the same digest would make no changes, and is skipped.
+	// +optional
+	LastRunDigest string `json:"lastRunDigest,omitempty"`
 	// +optional
 	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
 	// +optional
@@ -102,6 +536,274 @@ type ImageUpdateAutomationStatus struct {
 	meta.ReconcileRequestStatus `json:",inline"`
 }
 
+// ImageUpdate records a field value changed by an automation run.
+type ImageUpdate struct {
+	// Policy refers to the image policy that gave the new value.
+	// +required
+	Policy meta.NamespacedObjectReference `json:"policy"`
+	// OldValue is the value of the field before the update.
+	// +optional
+	OldValue string `json:"oldValue,omitempty"`
+	// NewValue is the value of the field after the update.
+	// +required
+	NewValue string `json:"newValue"`
+}
+
+// DryRunResult records the commit a dry run made, but did not push.
+type DryRunResult struct {
+	// Commit is the SHA1 of the commit that would have been pushed.
+	// +required
+	Commit string `json:"commit"`
+	// Message is the message of the commit.
+	// +optional
+	Message string `json:"message,omitempty"`
+	// Branch is the branch the commit would have been pushed to, if
+	// any.
+	// +optional
+	Branch string `json:"branch,omitempty"`
+	// Refspec is the refspec the commit would have been pushed with,
+	// if any.
+	// +optional
+	Refspec string `json:"refspec,omitempty"`
+	// Time is when the commit was made.
+	// +required
+	Time metav1.Time `json:"time"`
+	// Images records the field values the commit changes, with the
+	// image policy responsible for each.
+	// +optional
+	Images []ImageUpdate `json:"images,omitempty"`
+	// Files lists the files the commit changes, relative to the root
+	// of the repository. At most 100 files are listed.
+	// +kubebuilder:validation:MaxItems=100
+	// +optional
+	Files []string `json:"files,omitempty"`
+}
+
+// PendingUpdates records the updates a suspended automation would
+// make, as worked out by a preview run, or the updates an automation
+// requiring approval is waiting to make.
+type PendingUpdates struct {
+	// Revision is the commit the updates would be made on top of.
+	// +required
+	Revision string `json:"revision"`
+	// Time is when the updates were worked out.
+	// +required
+	Time metav1.Time `json:"time"`
+	// Images records the field values that would be changed, with
+	// the image policy responsible for each.
+	// +optional
+	Images []ImageUpdate `json:"images,omitempty"`
+	// Files lists the files that would be changed, relative to the
+	// root of the repository. At most 100 files are listed.
+	// +kubebuilder:validation:MaxItems=100
+	// +optional
+	Files []string `json:"files,omitempty"`
+	// Diff shows the lines of the files that would be changed, before
+	// and after, if the automation requires approval. It is cut short
+	// if it is longer than 16KiB.
+	// +optional
+	Diff string `json:"diff,omitempty"`
+	// ApprovalToken is the value to set the approve annotation to, to
+	// approve the updates, if the automation requires approval. It
+	// changes whenever the updates do.
+	// +optional
+	ApprovalToken string `json:"approvalToken,omitempty"`
+}
+
+// RevertResult records a revert of a commit pushed by an automation.
+type RevertResult struct {
+	// Commit is the SHA1 of the revert commit.
+	// +required
+	Commit string `json:"commit"`
+	// Reverted is the SHA1 of the commit reverted.
+	// +required
+	Reverted string `json:"reverted"`
+	// Time is when the revert was pushed.
+	// +required
+	Time metav1.Time `json:"time"`
+}
+
+// CanaryStatus records the commits going through the push branch
+// on their way to the canary branch.
+type CanaryStatus struct {
+	// Pending lists the commits pushed that are yet to be promoted,
+	// oldest first.
+	// +optional
+	Pending []CanaryCommit `json:"pending,omitempty"`
+	// LastPromotion records the last promotion of commits to the
+	// canary branch.
+	// +optional
+	LastPromotion *CanaryPromotion `json:"lastPromotion,omitempty"`
+}
+
+// CanaryCommit records a commit pushed, to be promoted to the canary
+// branch.
+type CanaryCommit struct {
+	// Commit is the SHA1 of the commit pushed.
+	// +required
+	Commit string `json:"commit"`
+	// PushedAt is when the commit was pushed.
+	// +required
+	PushedAt metav1.Time `json:"pushedAt"`
+}
+
+// CanaryPromotion records a promotion of commits to the canary branch.
+type CanaryPromotion struct {
+	// Commit is the SHA1 of the commit pushed to the canary branch.
+	// +required
+	Commit string `json:"commit"`
+	// Promoted lists the SHA1s of the commits promoted, in the order
+	// they were cherry-picked.
+	// +required
+	Promoted []string `json:"promoted"`
+	// Time is when the promotion was pushed.
+	// +required
+	Time metav1.Time `json:"time"`
+}
+
+// StageStatus records the images in a stage of a promotion.
+type StageStatus struct {
+	// Name of the stage.
+	// +required
+	Name string `json:"name"`
+	// Images lists the image each image policy has put in the stage,
+	// in order of policy.
+	// +optional
+	Images []StageImage `json:"images,omitempty"`
+}
+
+// StageImage records an image put in a stage of a promotion because
+// of an image policy.
+type StageImage struct {
+	// Policy refers to the image policy.
+	// +required
+	Policy meta.NamespacedObjectReference `json:"policy"`
+	// Image is the image ref in the stage.
+	// +required
+	Image string `json:"image"`
+	// Since is when the image was first seen in the stage.
+	// +required
+	Since metav1.Time `json:"since"`
+}
+
+// AppliedPolicy records the image an image policy last caused to be
+// written, so it can be compared with the image the policy currently
+// selects.
+type AppliedPolicy struct {
+	// Policy refers to the image policy.
+	// +required
+	Policy meta.NamespacedObjectReference `json:"policy"`
+	// LastAppliedImage is the image ref last written because of the
+	// policy.
+	// +required
+	LastAppliedImage string `json:"lastAppliedImage"`
+	// LastAppliedTime is the time at which the image ref was pushed.
+	// +required
+	LastAppliedTime metav1.Time `json:"lastAppliedTime"`
+}
+
+// ObservedPolicy records an image policy as considered by an
+// automation run.
+type ObservedPolicy struct {
+	// Policy refers to the image policy.
+	// +required
+	Policy meta.NamespacedObjectReference `json:"policy"`
+	// LatestImage is the latest image given by the policy, if any.
+	// +optional
+	LatestImage string `json:"latestImage,omitempty"`
+}
+
+// SkippedFile records a file left out of an automation run.
+type SkippedFile struct {
+	// Path is the path of the file, relative to the root of the
+	// repository.
+	// +required
+	Path string `json:"path"`
+	// Reason says why the file was left out; e.g., ParseError, or
+	// TooLarge.
+	// +required
+	Reason string `json:"reason"`
+	// Message gives more detail, if there is any; e.g., the error
+	// from parsing the file.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// NoChangeReason categorises why an automation run made no changes.
+// +kubebuilder:validation:Enum=NoPolicies;NoMarkersMatched;ImagesCurrent
+type NoChangeReason string
+
+const (
+	// NoChangeNoPolicies means there were no image policies with a
+	// latest image to apply.
+	NoChangeNoPolicies NoChangeReason = "NoPolicies"
+	// NoChangeNoMarkersMatched means no field in the files considered
+	// was marked with any of the image policies.
+	NoChangeNoMarkersMatched NoChangeReason = "NoMarkersMatched"
+	// NoChangeImagesCurrent means the marked fields already had the
+	// latest images.
+	NoChangeImagesCurrent NoChangeReason = "ImagesCurrent"
+)
+
+// FailureReport records the report made of runs in a row that failed.
+type FailureReport struct {
+	// Time is when the failures were reported.
+	// +required
+	Time metav1.Time `json:"time"`
+	// Failures is how many runs in a row had failed when the failures
+	// were reported.
+	// +required
+	Failures int64 `json:"failures"`
+	// IssueURL is the web address of the issue opened, if an issue
+	// was opened.
+	// +optional
+	IssueURL string `json:"issueURL,omitempty"`
+}
+
+// PushRefStatus records the last push to a particular ref.
+type PushRefStatus struct {
+	// Ref is the name of the ref pushed to in the remote repository;
+	// e.g., "refs/heads/main".
+	// +required
+	Ref string `json:"ref"`
+	// LastPushCommit records the SHA1 of the last commit successfully
+	// pushed to the ref.
+	// +optional
+	LastPushCommit string `json:"lastPushCommit,omitempty"`
+	// LastPushTime records the time of the last successful push to
+	// the ref.
+	// +optional
+	LastPushTime *metav1.Time `json:"lastPushTime,omitempty"`
+	// LastPushError gives the reason the most recent attempt to push to
+	// the ref failed. It's empty if the most recent attempt succeeded.
+	// +optional
+	LastPushError string `json:"lastPushError,omitempty"`
+}
+
+// ImageUpdateAutomationFinalizer is the finalizer put on an
+// ImageUpdateAutomation that has something to clean up in the git
+// repository when it's deleted; e.g., a push branch to delete.
+const ImageUpdateAutomationFinalizer = "finalizers.fluxcd.io"
+
+// ApproveAnnotation is the annotation used to approve the updates an
+// automation requiring approval is waiting to make. Its value is the
+// approval token of the updates, from .status.pendingUpdates.
+const ApproveAnnotation = "image.toolkit.fluxcd.io/approve"
+
+// RevertRequestAnnotation is the annotation used to ask for the last
+// commit pushed by an automation to be reverted. Its value is a token
+// (e.g., the time it was set); each time it changes, a revert is made.
+const RevertRequestAnnotation = "image.toolkit.fluxcd.io/revertRequestedAt"
+
+// ShardKeyLabel is the label giving the shard an automation is in,
+// for controllers that elect a leader for each shard. An automation
+// without it is in the shard DefaultShardKey.
+const ShardKeyLabel = "sharding.fluxcd.io/key"
+
+// DefaultShardKey is the shard of an automation without the
+// ShardKeyLabel.
+const DefaultShardKey = "default"
+
 const (
 	// GitNotAvailableReason is used for ConditionReady when the
 	// automation run cannot proceed because the git repository is
@@ -111,6 +813,84 @@ const (
 	// run cannot proceed because there is no update strategy given in
 	// the spec.
 	NoStrategyReason = "MissingUpdateStrategy"
+	// InvalidCommitTemplateReason is used for ConditionReady when the
+	// automation run cannot proceed because the commit message
+	// template cannot be parsed or run.
+	InvalidCommitTemplateReason = "InvalidCommitTemplate"
+	// InvalidSpecReason is used for ConditionReady and the stalled
+	// condition when the automation run cannot proceed because of a
+	// mistake in the spec, e.g., an unsupported source kind.
+	InvalidSpecReason = "InvalidSpec"
+	// InvalidPushBranchReason is used for ConditionReady and the
+	// stalled condition when there's no branch to push to, or the
+	// push branch can't be used with the checkout ref; e.g., when the
+	// checkout ref gives a tag, and no push branch is given.
+	InvalidPushBranchReason = "InvalidPushBranch"
+	// BranchProtectedReason is used for ConditionReady and the stalled
+	// condition when a push was rejected because the branch pushed to
+	// is protected. The automation isn't run again until it's changed,
+	// or a reconciliation is requested.
+	BranchProtectedReason = "BranchProtected"
+	// HealthGateNotReadyReason is used for ConditionReady and
+	// PushedCondition when updates were held back, because an object
+	// listed in the health gates is not ready, or has not applied the
+	// last commit pushed.
+	HealthGateNotReadyReason = "HealthGateNotReady"
+	// AwaitingApprovalReason is used for ConditionReady and
+	// PushedCondition when the automation requires approval, and the
+	// updates it made have not been approved.
+	AwaitingApprovalReason = "AwaitingApproval"
+	// AccessDeniedReason is used for ConditionReady and the stalled
+	// condition when the automation refers to an object in another
+	// namespace, and the controller has been told not to allow that.
+	AccessDeniedReason = "AccessDenied"
+)
+
+const (
+	// PushedCondition records the outcome of the last automation run
+	// as far as pushing is concerned; it's `True` when a commit was
+	// pushed, and `False` when there was nothing to push or the push
+	// failed.
+	PushedCondition = "Pushed"
+	// PushSucceededReason is used for PushedCondition when a commit
+	// was pushed.
+	PushSucceededReason = "PushSucceeded"
+	// NoChangesReason is used for PushedCondition when the automation
+	// ran, but made no changes, so there was nothing to push.
+	NoChangesReason = "NoChanges"
+	// PushFailedReason is used for PushedCondition when a commit was
+	// made, but could not be pushed.
+	PushFailedReason = "PushFailed"
+	// PushRejectedReason is used for PushedCondition and ConditionReady
+	// when the remote refused to update a ref pushed to; e.g., because
+	// the branch is protected. It's also the reason given for the event
+	// sent about the rejection.
+	PushRejectedReason = "PushRejected"
+	// PushRateLimitedReason is used for PushedCondition when the
+	// automation did not run, because the git repository has had as
+	// many pushes as the controller allows it for the time being.
+	PushRateLimitedReason = "PushRateLimited"
+	// DryRunReason is used for PushedCondition when a commit was
+	// made, but not pushed, because the automation is a dry run.
+	DryRunReason = "DryRun"
+)
+
+const (
+	// RevertSucceededReason is the reason given for the event sent
+	// when a revert asked for with the revert annotation is pushed.
+	RevertSucceededReason = "RevertSucceeded"
+	// RevertFailedReason is the reason given for the event sent when
+	// a revert asked for with the revert annotation can't be made.
+	RevertFailedReason = "RevertFailed"
+)
+
+const (
+	// CanaryPromotedReason is the reason given for the event sent
+	// when commits are promoted to the canary branch.
+	CanaryPromotedReason = "CanaryPromoted"
+	// CanaryPromotionFailedReason is the reason given for the event
+	// sent when a commit can't be promoted to the canary branch.
+	CanaryPromotionFailedReason = "CanaryPromotionFailed"
 )
 
 // SetImageUpdateAutomationReadiness sets the ready condition with the given status, reason and message.
@@ -119,6 +899,31 @@ func SetImageUpdateAutomationReadiness(auto *ImageUpdateAutomation, status metav
 	meta.SetResourceCondition(auto, meta.ReadyCondition, status, reason, message)
 }
 
+// SetImageUpdateAutomationStalled sets the stalled condition, for when
+// the automation cannot run until its spec (or something it refers to)
+// is changed.
+func SetImageUpdateAutomationStalled(auto *ImageUpdateAutomation, reason, message string) {
+	auto.Status.ObservedGeneration = auto.ObjectMeta.Generation
+	apimeta.SetStatusCondition(auto.GetStatusConditions(), metav1.Condition{
+		Type:               meta.StalledCondition,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: auto.ObjectMeta.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// SetImageUpdateAutomationReconciling sets the reconciling condition,
+// with a message giving the stage an automation run has reached.
+func SetImageUpdateAutomationReconciling(auto *ImageUpdateAutomation, message string) {
+	meta.SetResourceCondition(auto, meta.ReconcilingCondition, metav1.ConditionTrue, meta.ProgressingReason, message)
+}
+
+// SetImageUpdateAutomationPushed sets the pushed condition with the given status, reason and message.
+func SetImageUpdateAutomationPushed(auto *ImageUpdateAutomation, status metav1.ConditionStatus, reason, message string) {
+	meta.SetResourceCondition(auto, PushedCondition, status, reason, message)
+}
+
 //+kubebuilder:storageversion
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
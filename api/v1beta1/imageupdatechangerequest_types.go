@@ -0,0 +1,123 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fluxcd/pkg/apis/meta"
+)
+
+const ImageUpdateChangeRequestKind = "ImageUpdateChangeRequest"
+
+// ChangeRequestAutomationLabel is the label given to each change
+// request, naming the automation it was created for.
+const ChangeRequestAutomationLabel = "image.toolkit.fluxcd.io/automation"
+
+// ImageUpdateChangeRequestSpec gives the updates an automation is
+// waiting to commit and push, and whether they are approved. All but
+// Approved are set by the controller.
+type ImageUpdateChangeRequestSpec struct {
+	// AutomationRef refers to the ImageUpdateAutomation that made the
+	// updates, in the same namespace.
+	// +required
+	AutomationRef meta.LocalObjectReference `json:"automationRef"`
+	// Revision is the commit the updates are made on top of.
+	// +required
+	Revision string `json:"revision"`
+	// ApprovalToken identifies the updates; it's the token with which
+	// they can also be approved using the approve annotation.
+	// +required
+	ApprovalToken string `json:"approvalToken"`
+	// Images records the field values changed, with the image policy
+	// responsible for each.
+	// +optional
+	Images []ImageUpdate `json:"images,omitempty"`
+	// Files lists the files changed, relative to the root of the
+	// repository. At most 100 files are listed.
+	// +kubebuilder:validation:MaxItems=100
+	// +optional
+	Files []string `json:"files,omitempty"`
+	// Patch shows the lines of the files changed, before and after.
+	// It is cut short if it is longer than 16KiB.
+	// +optional
+	Patch string `json:"patch,omitempty"`
+	// Approved, when set to true by a person or another controller,
+	// lets the automation commit and push the updates.
+	// +optional
+	Approved bool `json:"approved,omitempty"`
+}
+
+// ImageUpdateChangeRequestStatus records what became of the updates.
+type ImageUpdateChangeRequestStatus struct {
+	// Commit is the SHA1 of the commit pushed with the updates, once
+	// they have been approved and pushed.
+	// +optional
+	Commit string `json:"commit,omitempty"`
+	// PushTime is when the commit was pushed.
+	// +optional
+	PushTime *metav1.Time `json:"pushTime,omitempty"`
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+const (
+	// ChangeRequestPendingReason is used for ConditionReady of a
+	// change request whose updates are waiting for approval, or,
+	// once approved, to be pushed.
+	ChangeRequestPendingReason = "Pending"
+)
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Automation",type=string,JSONPath=`.spec.automationRef.name`
+//+kubebuilder:printcolumn:name="Approved",type=boolean,JSONPath=`.spec.approved`
+//+kubebuilder:printcolumn:name="Commit",type=string,JSONPath=`.status.commit`
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// ImageUpdateChangeRequest holds updates an ImageUpdateAutomation
+// requiring approval is waiting to commit and push, so that they can
+// be reviewed and approved.
+type ImageUpdateChangeRequest struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ImageUpdateChangeRequestSpec   `json:"spec,omitempty"`
+	Status ImageUpdateChangeRequestStatus `json:"status,omitempty"`
+}
+
+func (change *ImageUpdateChangeRequest) GetStatusConditions() *[]metav1.Condition {
+	return &change.Status.Conditions
+}
+
+// Pushed says whether the updates have been pushed.
+func (change *ImageUpdateChangeRequest) Pushed() bool {
+	return change.Status.Commit != ""
+}
+
+//+kubebuilder:object:root=true
+
+// ImageUpdateChangeRequestList contains a list of ImageUpdateChangeRequest
+type ImageUpdateChangeRequestList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ImageUpdateChangeRequest `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ImageUpdateChangeRequest{}, &ImageUpdateChangeRequestList{})
+}
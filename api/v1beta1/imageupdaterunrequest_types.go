@@ -0,0 +1,120 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fluxcd/pkg/apis/meta"
+)
+
+const ImageUpdateRunRequestKind = "ImageUpdateRunRequest"
+
+// ImageUpdateRunRequestSpec asks for a one-off run of an automation.
+type ImageUpdateRunRequestSpec struct {
+	// AutomationRef refers to the ImageUpdateAutomation to run, in
+	// the same namespace.
+	// +required
+	AutomationRef meta.LocalObjectReference `json:"automationRef"`
+
+	// DryRun makes the run commit the updates, but not push the
+	// commit, whether or not the automation is a dry run. Only a dry
+	// run can be asked for of a suspended automation.
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// Policies names the image policies, in the same namespace, whose
+	// images the run is to update; fields marked for other policies
+	// are left as they are. If empty, all the marked fields are
+	// updated, as in any other run.
+	// +optional
+	Policies []string `json:"policies,omitempty"`
+}
+
+// ImageUpdateRunRequestStatus records the outcome of the run asked
+// for.
+type ImageUpdateRunRequestStatus struct {
+	// CompletionTime is when the run finished, whether or not it
+	// succeeded. A request is not acted on again once it has
+	// finished.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// Commit is the SHA1 of the commit the run made, if it made one.
+	// +optional
+	Commit string `json:"commit,omitempty"`
+	// Pushed says whether the commit was pushed; a dry run makes the
+	// commit, but doesn't push it.
+	// +optional
+	Pushed bool `json:"pushed,omitempty"`
+	// Images records the field values the run changed, with the
+	// image policy responsible for each.
+	// +optional
+	Images []ImageUpdate `json:"images,omitempty"`
+	// Files lists the files the run changed, relative to the root of
+	// the repository. At most 100 files are listed.
+	// +kubebuilder:validation:MaxItems=100
+	// +optional
+	Files []string `json:"files,omitempty"`
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+const (
+	// RunRequestRefusedReason is used for ConditionReady of a run
+	// request that can't be acted on as it is; e.g., one asking for
+	// a run of a suspended automation that isn't a dry run.
+	RunRequestRefusedReason = "RunRequestRefused"
+)
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Automation",type=string,JSONPath=`.spec.automationRef.name`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Commit",type=string,JSONPath=`.status.commit`
+//+kubebuilder:printcolumn:name="Completed",type=string,JSONPath=`.status.completionTime`
+
+// ImageUpdateRunRequest asks for a one-off run of an
+// ImageUpdateAutomation, with overrides, and records its outcome.
+type ImageUpdateRunRequest struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ImageUpdateRunRequestSpec   `json:"spec,omitempty"`
+	Status ImageUpdateRunRequestStatus `json:"status,omitempty"`
+}
+
+func (run *ImageUpdateRunRequest) GetStatusConditions() *[]metav1.Condition {
+	return &run.Status.Conditions
+}
+
+// Finished says whether the run asked for has been made, or refused.
+func (run *ImageUpdateRunRequest) Finished() bool {
+	return run.Status.CompletionTime != nil
+}
+
+//+kubebuilder:object:root=true
+
+// ImageUpdateRunRequestList contains a list of ImageUpdateRunRequest
+type ImageUpdateRunRequestList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ImageUpdateRunRequest `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ImageUpdateRunRequest{}, &ImageUpdateRunRequestList{})
+}
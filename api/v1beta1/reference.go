@@ -27,9 +27,57 @@ type SourceReference struct {
 	// +kubebuilder:validation:Enum=GitRepository
 	// +kubebuilder:default=GitRepository
 	// +required
+	Kind string `json:"kind,omitempty"`
+
+	// Name of the referent
+	// +required
+	Name string `json:"name"`
+}
+
+// DependencyReference refers to an object that must be ready before
+// an automation will run.
+type DependencyReference struct {
+	// API version of the referent; if not given, this defaults to
+	// the version of the API for the kind given.
+	// +optional
+	APIVersion string `json:"apiVersion,omitempty"`
+
+	// Kind of the referent
+	// +kubebuilder:validation:Enum=ImageUpdateAutomation;Kustomization
+	// +kubebuilder:default=ImageUpdateAutomation
+	// +optional
+	Kind string `json:"kind,omitempty"`
+
+	// Name of the referent
+	// +required
+	Name string `json:"name"`
+
+	// Namespace of the referent; if not given, this defaults to the
+	// namespace of the automation object.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// HealthGateReference refers to an object that applies the commits an
+// automation pushes, and must be healthy before the automation pushes
+// more.
+type HealthGateReference struct {
+	// API version of the referent; if not given, this defaults to
+	// the version of the API for the kind given.
+	// +optional
+	APIVersion string `json:"apiVersion,omitempty"`
+
+	// Kind of the referent
+	// +kubebuilder:validation:Enum=Kustomization;HelmRelease
+	// +required
 	Kind string `json:"kind"`
 
 	// Name of the referent
 	// +required
 	Name string `json:"name"`
+
+	// Namespace of the referent; if not given, this defaults to the
+	// namespace of the automation object.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
 }
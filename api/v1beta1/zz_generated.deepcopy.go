@@ -21,19 +21,223 @@ limitations under the License.
 package v1beta1
 
 import (
+	"github.com/fluxcd/pkg/apis/meta"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AppliedPolicy) DeepCopyInto(out *AppliedPolicy) {
+	*out = *in
+	out.Policy = in.Policy
+	in.LastAppliedTime.DeepCopyInto(&out.LastAppliedTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AppliedPolicy.
+func (in *AppliedPolicy) DeepCopy() *AppliedPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(AppliedPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CanaryCommit) DeepCopyInto(out *CanaryCommit) {
+	*out = *in
+	in.PushedAt.DeepCopyInto(&out.PushedAt)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CanaryCommit.
+func (in *CanaryCommit) DeepCopy() *CanaryCommit {
+	if in == nil {
+		return nil
+	}
+	out := new(CanaryCommit)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CanaryPromotion) DeepCopyInto(out *CanaryPromotion) {
+	*out = *in
+	if in.Promoted != nil {
+		in, out := &in.Promoted, &out.Promoted
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CanaryPromotion.
+func (in *CanaryPromotion) DeepCopy() *CanaryPromotion {
+	if in == nil {
+		return nil
+	}
+	out := new(CanaryPromotion)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CanarySpec) DeepCopyInto(out *CanarySpec) {
+	*out = *in
+	out.SoakTime = in.SoakTime
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CanarySpec.
+func (in *CanarySpec) DeepCopy() *CanarySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(CanarySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CanaryStatus) DeepCopyInto(out *CanaryStatus) {
+	*out = *in
+	if in.Pending != nil {
+		in, out := &in.Pending, &out.Pending
+		*out = make([]CanaryCommit, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.LastPromotion != nil {
+		in, out := &in.LastPromotion, &out.LastPromotion
+		*out = new(CanaryPromotion)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CanaryStatus.
+func (in *CanaryStatus) DeepCopy() *CanaryStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CanaryStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudIdentity) DeepCopyInto(out *CloudIdentity) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudIdentity.
+func (in *CloudIdentity) DeepCopy() *CloudIdentity {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudIdentity)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterTargetSpec) DeepCopyInto(out *ClusterTargetSpec) {
+	*out = *in
+	if in.Substitutions != nil {
+		in, out := &in.Substitutions, &out.Substitutions
+		*out = make([]SubstitutionTarget, len(*in))
+		copy(*out, *in)
+	}
+	if in.WorkloadSelector != nil {
+		in, out := &in.WorkloadSelector, &out.WorkloadSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterTargetSpec.
+func (in *ClusterTargetSpec) DeepCopy() *ClusterTargetSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterTargetSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterUpdateResult) DeepCopyInto(out *ClusterUpdateResult) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+	if in.Objects != nil {
+		in, out := &in.Objects, &out.Objects
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Images != nil {
+		in, out := &in.Images, &out.Images
+		*out = make([]ImageUpdate, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterUpdateResult.
+func (in *ClusterUpdateResult) DeepCopy() *ClusterUpdateResult {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterUpdateResult)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CommitAuthorReference) DeepCopyInto(out *CommitAuthorReference) {
+	*out = *in
+	if in.SecretRef != nil {
+		in, out := &in.SecretRef, &out.SecretRef
+		*out = new(meta.LocalObjectReference)
+		**out = **in
+	}
+	if in.ConfigMapRef != nil {
+		in, out := &in.ConfigMapRef, &out.ConfigMapRef
+		*out = new(meta.NamespacedObjectReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CommitAuthorReference.
+func (in *CommitAuthorReference) DeepCopy() *CommitAuthorReference {
+	if in == nil {
+		return nil
+	}
+	out := new(CommitAuthorReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CommitSpec) DeepCopyInto(out *CommitSpec) {
 	*out = *in
 	out.Author = in.Author
+	if in.AuthorFrom != nil {
+		in, out := &in.AuthorFrom, &out.AuthorFrom
+		*out = new(CommitAuthorReference)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.SigningKey != nil {
 		in, out := &in.SigningKey, &out.SigningKey
 		*out = new(SigningKey)
 		**out = **in
 	}
+	if in.MessageTemplateFrom != nil {
+		in, out := &in.MessageTemplateFrom, &out.MessageTemplateFrom
+		*out = new(MessageTemplateReference)
+		**out = **in
+	}
+	if in.UpdateManifest != nil {
+		in, out := &in.UpdateManifest, &out.UpdateManifest
+		*out = new(UpdateManifestSpec)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CommitSpec.
@@ -46,6 +250,22 @@ func (in *CommitSpec) DeepCopy() *CommitSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CommitStatusSpec) DeepCopyInto(out *CommitStatusSpec) {
+	*out = *in
+	out.SecretRef = in.SecretRef
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CommitStatusSpec.
+func (in *CommitStatusSpec) DeepCopy() *CommitStatusSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(CommitStatusSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CommitUser) DeepCopyInto(out *CommitUser) {
 	*out = *in
@@ -61,6 +281,88 @@ func (in *CommitUser) DeepCopy() *CommitUser {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DependencyReference) DeepCopyInto(out *DependencyReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DependencyReference.
+func (in *DependencyReference) DeepCopy() *DependencyReference {
+	if in == nil {
+		return nil
+	}
+	out := new(DependencyReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DryRunResult) DeepCopyInto(out *DryRunResult) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+	if in.Images != nil {
+		in, out := &in.Images, &out.Images
+		*out = make([]ImageUpdate, len(*in))
+		copy(*out, *in)
+	}
+	if in.Files != nil {
+		in, out := &in.Files, &out.Files
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DryRunResult.
+func (in *DryRunResult) DeepCopy() *DryRunResult {
+	if in == nil {
+		return nil
+	}
+	out := new(DryRunResult)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FailureIssueSpec) DeepCopyInto(out *FailureIssueSpec) {
+	*out = *in
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.SecretRef != nil {
+		in, out := &in.SecretRef, &out.SecretRef
+		*out = new(meta.LocalObjectReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FailureIssueSpec.
+func (in *FailureIssueSpec) DeepCopy() *FailureIssueSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(FailureIssueSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FailureReport) DeepCopyInto(out *FailureReport) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FailureReport.
+func (in *FailureReport) DeepCopy() *FailureReport {
+	if in == nil {
+		return nil
+	}
+	out := new(FailureReport)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GitCheckoutSpec) DeepCopyInto(out *GitCheckoutSpec) {
 	*out = *in
@@ -89,6 +391,11 @@ func (in *GitSpec) DeepCopyInto(out *GitSpec) {
 	if in.Push != nil {
 		in, out := &in.Push, &out.Push
 		*out = new(PushSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Identity != nil {
+		in, out := &in.Identity, &out.Identity
+		*out = new(CloudIdentity)
 		**out = **in
 	}
 }
@@ -103,6 +410,37 @@ func (in *GitSpec) DeepCopy() *GitSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HealthGateReference) DeepCopyInto(out *HealthGateReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HealthGateReference.
+func (in *HealthGateReference) DeepCopy() *HealthGateReference {
+	if in == nil {
+		return nil
+	}
+	out := new(HealthGateReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageUpdate) DeepCopyInto(out *ImageUpdate) {
+	*out = *in
+	out.Policy = in.Policy
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageUpdate.
+func (in *ImageUpdate) DeepCopy() *ImageUpdate {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageUpdate)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ImageUpdateAutomation) DeepCopyInto(out *ImageUpdateAutomation) {
 	*out = *in
@@ -171,10 +509,45 @@ func (in *ImageUpdateAutomationSpec) DeepCopyInto(out *ImageUpdateAutomationSpec
 		*out = new(GitSpec)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Cluster != nil {
+		in, out := &in.Cluster, &out.Cluster
+		*out = new(ClusterTargetSpec)
+		(*in).DeepCopyInto(*out)
+	}
 	out.Interval = in.Interval
 	if in.Update != nil {
 		in, out := &in.Update, &out.Update
 		*out = new(UpdateStrategy)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.DependsOn != nil {
+		in, out := &in.DependsOn, &out.DependsOn
+		*out = make([]DependencyReference, len(*in))
+		copy(*out, *in)
+	}
+	if in.Timeout != nil {
+		in, out := &in.Timeout, &out.Timeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.CommitStatus != nil {
+		in, out := &in.CommitStatus, &out.CommitStatus
+		*out = new(CommitStatusSpec)
+		**out = **in
+	}
+	if in.FailureIssue != nil {
+		in, out := &in.FailureIssue, &out.FailureIssue
+		*out = new(FailureIssueSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.HealthGates != nil {
+		in, out := &in.HealthGates, &out.HealthGates
+		*out = make([]HealthGateReference, len(*in))
+		copy(*out, *in)
+	}
+	if in.WebhookSecretRef != nil {
+		in, out := &in.WebhookSecretRef, &out.WebhookSecretRef
+		*out = new(meta.LocalObjectReference)
 		**out = **in
 	}
 }
@@ -200,6 +573,82 @@ func (in *ImageUpdateAutomationStatus) DeepCopyInto(out *ImageUpdateAutomationSt
 		in, out := &in.LastPushTime, &out.LastPushTime
 		*out = (*in).DeepCopy()
 	}
+	if in.LastPushImages != nil {
+		in, out := &in.LastPushImages, &out.LastPushImages
+		*out = make([]ImageUpdate, len(*in))
+		copy(*out, *in)
+	}
+	if in.LastPushFiles != nil {
+		in, out := &in.LastPushFiles, &out.LastPushFiles
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.LastDryRun != nil {
+		in, out := &in.LastDryRun, &out.LastDryRun
+		*out = new(DryRunResult)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LastClusterUpdate != nil {
+		in, out := &in.LastClusterUpdate, &out.LastClusterUpdate
+		*out = new(ClusterUpdateResult)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PendingUpdates != nil {
+		in, out := &in.PendingUpdates, &out.PendingUpdates
+		*out = new(PendingUpdates)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LastRevert != nil {
+		in, out := &in.LastRevert, &out.LastRevert
+		*out = new(RevertResult)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Stages != nil {
+		in, out := &in.Stages, &out.Stages
+		*out = make([]StageStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Canary != nil {
+		in, out := &in.Canary, &out.Canary
+		*out = new(CanaryStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.AppliedPolicies != nil {
+		in, out := &in.AppliedPolicies, &out.AppliedPolicies
+		*out = make([]AppliedPolicy, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PushRefs != nil {
+		in, out := &in.PushRefs, &out.PushRefs
+		*out = make([]PushRefStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.FailureReport != nil {
+		in, out := &in.FailureReport, &out.FailureReport
+		*out = new(FailureReport)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ObservedPolicies != nil {
+		in, out := &in.ObservedPolicies, &out.ObservedPolicies
+		*out = make([]ObservedPolicy, len(*in))
+		copy(*out, *in)
+	}
+	if in.SkippedFiles != nil {
+		in, out := &in.SkippedFiles, &out.SkippedFiles
+		*out = make([]SkippedFile, len(*in))
+		copy(*out, *in)
+	}
+	if in.ReferencedPolicies != nil {
+		in, out := &in.ReferencedPolicies, &out.ReferencedPolicies
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	if in.Conditions != nil {
 		in, out := &in.Conditions, &out.Conditions
 		*out = make([]v1.Condition, len(*in))
@@ -221,21 +670,386 @@ func (in *ImageUpdateAutomationStatus) DeepCopy() *ImageUpdateAutomationStatus {
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *PushSpec) DeepCopyInto(out *PushSpec) {
+func (in *ImageUpdateChangeRequest) DeepCopyInto(out *ImageUpdateChangeRequest) {
 	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PushSpec.
-func (in *PushSpec) DeepCopy() *PushSpec {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageUpdateChangeRequest.
+func (in *ImageUpdateChangeRequest) DeepCopy() *ImageUpdateChangeRequest {
 	if in == nil {
 		return nil
 	}
-	out := new(PushSpec)
+	out := new(ImageUpdateChangeRequest)
 	in.DeepCopyInto(out)
 	return out
 }
 
-// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ImageUpdateChangeRequest) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageUpdateChangeRequestList) DeepCopyInto(out *ImageUpdateChangeRequestList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ImageUpdateChangeRequest, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageUpdateChangeRequestList.
+func (in *ImageUpdateChangeRequestList) DeepCopy() *ImageUpdateChangeRequestList {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageUpdateChangeRequestList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ImageUpdateChangeRequestList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageUpdateChangeRequestSpec) DeepCopyInto(out *ImageUpdateChangeRequestSpec) {
+	*out = *in
+	out.AutomationRef = in.AutomationRef
+	if in.Images != nil {
+		in, out := &in.Images, &out.Images
+		*out = make([]ImageUpdate, len(*in))
+		copy(*out, *in)
+	}
+	if in.Files != nil {
+		in, out := &in.Files, &out.Files
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageUpdateChangeRequestSpec.
+func (in *ImageUpdateChangeRequestSpec) DeepCopy() *ImageUpdateChangeRequestSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageUpdateChangeRequestSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageUpdateChangeRequestStatus) DeepCopyInto(out *ImageUpdateChangeRequestStatus) {
+	*out = *in
+	if in.PushTime != nil {
+		in, out := &in.PushTime, &out.PushTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageUpdateChangeRequestStatus.
+func (in *ImageUpdateChangeRequestStatus) DeepCopy() *ImageUpdateChangeRequestStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageUpdateChangeRequestStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageUpdateRunRequest) DeepCopyInto(out *ImageUpdateRunRequest) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageUpdateRunRequest.
+func (in *ImageUpdateRunRequest) DeepCopy() *ImageUpdateRunRequest {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageUpdateRunRequest)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ImageUpdateRunRequest) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageUpdateRunRequestList) DeepCopyInto(out *ImageUpdateRunRequestList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ImageUpdateRunRequest, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageUpdateRunRequestList.
+func (in *ImageUpdateRunRequestList) DeepCopy() *ImageUpdateRunRequestList {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageUpdateRunRequestList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ImageUpdateRunRequestList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageUpdateRunRequestSpec) DeepCopyInto(out *ImageUpdateRunRequestSpec) {
+	*out = *in
+	out.AutomationRef = in.AutomationRef
+	if in.Policies != nil {
+		in, out := &in.Policies, &out.Policies
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageUpdateRunRequestSpec.
+func (in *ImageUpdateRunRequestSpec) DeepCopy() *ImageUpdateRunRequestSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageUpdateRunRequestSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageUpdateRunRequestStatus) DeepCopyInto(out *ImageUpdateRunRequestStatus) {
+	*out = *in
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Images != nil {
+		in, out := &in.Images, &out.Images
+		*out = make([]ImageUpdate, len(*in))
+		copy(*out, *in)
+	}
+	if in.Files != nil {
+		in, out := &in.Files, &out.Files
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageUpdateRunRequestStatus.
+func (in *ImageUpdateRunRequestStatus) DeepCopy() *ImageUpdateRunRequestStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageUpdateRunRequestStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MessageTemplateReference) DeepCopyInto(out *MessageTemplateReference) {
+	*out = *in
+	out.ConfigMapRef = in.ConfigMapRef
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MessageTemplateReference.
+func (in *MessageTemplateReference) DeepCopy() *MessageTemplateReference {
+	if in == nil {
+		return nil
+	}
+	out := new(MessageTemplateReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ObservedPolicy) DeepCopyInto(out *ObservedPolicy) {
+	*out = *in
+	out.Policy = in.Policy
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ObservedPolicy.
+func (in *ObservedPolicy) DeepCopy() *ObservedPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(ObservedPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PendingUpdates) DeepCopyInto(out *PendingUpdates) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+	if in.Images != nil {
+		in, out := &in.Images, &out.Images
+		*out = make([]ImageUpdate, len(*in))
+		copy(*out, *in)
+	}
+	if in.Files != nil {
+		in, out := &in.Files, &out.Files
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PendingUpdates.
+func (in *PendingUpdates) DeepCopy() *PendingUpdates {
+	if in == nil {
+		return nil
+	}
+	out := new(PendingUpdates)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PromotionStage) DeepCopyInto(out *PromotionStage) {
+	*out = *in
+	if in.SoakTime != nil {
+		in, out := &in.SoakTime, &out.SoakTime
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.HealthGates != nil {
+		in, out := &in.HealthGates, &out.HealthGates
+		*out = make([]HealthGateReference, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PromotionStage.
+func (in *PromotionStage) DeepCopy() *PromotionStage {
+	if in == nil {
+		return nil
+	}
+	out := new(PromotionStage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PushRefStatus) DeepCopyInto(out *PushRefStatus) {
+	*out = *in
+	if in.LastPushTime != nil {
+		in, out := &in.LastPushTime, &out.LastPushTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PushRefStatus.
+func (in *PushRefStatus) DeepCopy() *PushRefStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PushRefStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PushSpec) DeepCopyInto(out *PushSpec) {
+	*out = *in
+	if in.Canary != nil {
+		in, out := &in.Canary, &out.Canary
+		*out = new(CanarySpec)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PushSpec.
+func (in *PushSpec) DeepCopy() *PushSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PushSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistryRewrite) DeepCopyInto(out *RegistryRewrite) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistryRewrite.
+func (in *RegistryRewrite) DeepCopy() *RegistryRewrite {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistryRewrite)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RevertResult) DeepCopyInto(out *RevertResult) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RevertResult.
+func (in *RevertResult) DeepCopy() *RevertResult {
+	if in == nil {
+		return nil
+	}
+	out := new(RevertResult)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SigningKey) DeepCopyInto(out *SigningKey) {
 	*out = *in
 	out.SecretRef = in.SecretRef
@@ -251,6 +1065,21 @@ func (in *SigningKey) DeepCopy() *SigningKey {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SkippedFile) DeepCopyInto(out *SkippedFile) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SkippedFile.
+func (in *SkippedFile) DeepCopy() *SkippedFile {
+	if in == nil {
+		return nil
+	}
+	out := new(SkippedFile)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SourceReference) DeepCopyInto(out *SourceReference) {
 	*out = *in
@@ -266,9 +1095,128 @@ func (in *SourceReference) DeepCopy() *SourceReference {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StageImage) DeepCopyInto(out *StageImage) {
+	*out = *in
+	out.Policy = in.Policy
+	in.Since.DeepCopyInto(&out.Since)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StageImage.
+func (in *StageImage) DeepCopy() *StageImage {
+	if in == nil {
+		return nil
+	}
+	out := new(StageImage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StageStatus) DeepCopyInto(out *StageStatus) {
+	*out = *in
+	if in.Images != nil {
+		in, out := &in.Images, &out.Images
+		*out = make([]StageImage, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StageStatus.
+func (in *StageStatus) DeepCopy() *StageStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(StageStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SubstitutionTarget) DeepCopyInto(out *SubstitutionTarget) {
+	*out = *in
+	out.KustomizationRef = in.KustomizationRef
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SubstitutionTarget.
+func (in *SubstitutionTarget) DeepCopy() *SubstitutionTarget {
+	if in == nil {
+		return nil
+	}
+	out := new(SubstitutionTarget)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpdateManifestSpec) DeepCopyInto(out *UpdateManifestSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpdateManifestSpec.
+func (in *UpdateManifestSpec) DeepCopy() *UpdateManifestSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(UpdateManifestSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpdatePath) DeepCopyInto(out *UpdatePath) {
+	*out = *in
+	if in.Include != nil {
+		in, out := &in.Include, &out.Include
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Exclude != nil {
+		in, out := &in.Exclude, &out.Exclude
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpdatePath.
+func (in *UpdatePath) DeepCopy() *UpdatePath {
+	if in == nil {
+		return nil
+	}
+	out := new(UpdatePath)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *UpdateStrategy) DeepCopyInto(out *UpdateStrategy) {
 	*out = *in
+	if in.Paths != nil {
+		in, out := &in.Paths, &out.Paths
+		*out = make([]UpdatePath, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Stages != nil {
+		in, out := &in.Stages, &out.Stages
+		*out = make([]PromotionStage, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Ignore != nil {
+		in, out := &in.Ignore, &out.Ignore
+		*out = new(string)
+		**out = **in
+	}
+	if in.RegistryRewrites != nil {
+		in, out := &in.RegistryRewrites, &out.RegistryRewrites
+		*out = make([]RegistryRewrite, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpdateStrategy.
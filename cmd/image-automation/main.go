@@ -0,0 +1,240 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// image-automation makes, in a local directory, the updates the
+// controller would make to it, so that the markers in a repository
+// can be checked before it's pushed. The images are taken from image
+// policies given in files, or on the command line, or looked up in
+// the cluster.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/go-logr/logr"
+	flag "github.com/spf13/pflag"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	imagev1_reflect "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+	"github.com/fluxcd/pkg/runtime/logger"
+	"github.com/fluxcd/source-controller/pkg/sourceignore"
+
+	"github.com/fluxcd/image-automation-controller/pkg/update"
+)
+
+const usage = `Usage: image-automation [flags] <directory>
+
+Makes, in the directory given, the updates the image automation
+controller would make, and prints them. Files are only written with
+--write. The images are taken from the image policies in the files
+given with --policies, from --set, and, with --cluster, from the image
+policies in the cluster.
+
+Flags:
+`
+
+// exitUpdates is the exit status, with --exit-code, when there are
+// updates to make.
+const exitUpdates = 2
+
+// options holds what's given on the command line.
+type options struct {
+	policyPaths []string
+	images      []string
+	useCluster  bool
+	kubeconfig  string
+	kubecontext string
+	include     []string
+	exclude     []string
+	write       bool
+	exitCode    bool
+	verbose     bool
+}
+
+func main() {
+	var o options
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.StringSliceVar(&o.policyPaths, "policies", nil,
+		"Files, or directories of YAML and JSON files, holding the image policies to use; e.g., the output of `kubectl get imagepolicies -A -o yaml`. Objects of other kinds are passed over.")
+	flag.StringArrayVar(&o.images, "set", nil,
+		"The latest image of a policy, as <namespace>:<name>=<image>; this overrides the policy's image from elsewhere. May be given more than once.")
+	flag.BoolVar(&o.useCluster, "cluster", false,
+		"Look up in the cluster the image policies named by markers that are not given otherwise.")
+	flag.StringVar(&o.kubeconfig, "kubeconfig", "", "With --cluster, the kubeconfig file to use; by default, as kubectl does.")
+	flag.StringVar(&o.kubecontext, "context", "", "With --cluster, the kubeconfig context to use; by default, the current context.")
+	flag.StringSliceVar(&o.include, "include", nil, "Glob patterns of the files to update, as in .spec.update.include; by default, all files.")
+	flag.StringSliceVar(&o.exclude, "exclude", nil, "Glob patterns of the files not to update, as in .spec.update.exclude.")
+	flag.BoolVar(&o.write, "write", false, "Write the updates to the files, rather than only printing them.")
+	flag.BoolVar(&o.exitCode, "exit-code", false,
+		fmt.Sprintf("Exit with status %d if there are updates to make, as well as printing them; e.g., to fail a CI check.", exitUpdates))
+	flag.BoolVar(&o.verbose, "verbose", false, "Log the details of the update.")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	result, err := run(flag.Arg(0), o)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "image-automation: %s\n", err)
+		os.Exit(1)
+	}
+	report(os.Stdout, os.Stderr, result)
+	if o.exitCode && len(result.Files) > 0 {
+		os.Exit(exitUpdates)
+	}
+}
+
+// run makes the updates to the directory given.
+func run(dir string, o options) (update.Result, error) {
+	policies, err := loadPolicies(o.policyPaths)
+	if err != nil {
+		return update.Result{}, err
+	}
+	if policies, err = setImages(policies, o.images); err != nil {
+		return update.Result{}, err
+	}
+
+	opts := []update.Option{
+		update.WithInclude(o.include...),
+		update.WithExclude(o.exclude...),
+	}
+	// the files the source-controller leaves out of the artifact are
+	// left out, as the controller does
+	patterns, err := sourceignore.LoadIgnorePatterns(dir, nil)
+	if err != nil {
+		return update.Result{}, err
+	}
+	opts = append(opts, update.WithIgnore(dir, append(sourceignore.VCSPatterns(nil), patterns...)))
+	if o.useCluster {
+		lookup, err := clusterLookup(o.kubeconfig, o.kubecontext)
+		if err != nil {
+			return update.Result{}, err
+		}
+		opts = append(opts, update.WithPolicyLookup(lookup))
+	}
+
+	tracelog := logr.Discard()
+	if o.verbose {
+		tracelog = logger.NewLogger(logger.Options{LogEncoding: "console", LogLevel: "trace"}).V(logger.TraceLevel)
+	}
+
+	// without --write, the updated files are written elsewhere and
+	// only the result is kept
+	outdir := dir
+	if !o.write {
+		if outdir, err = os.MkdirTemp("", "image-automation-"); err != nil {
+			return update.Result{}, err
+		}
+		defer os.RemoveAll(outdir)
+	}
+	return update.UpdateWithSetters(tracelog, dir, outdir, policies, opts...)
+}
+
+// report prints the changes in the result given to out, and what may
+// need looking at (files skipped, and markers for policies that
+// weren't found or have no image) to warn.
+func report(out, warn io.Writer, result update.Result) {
+	for _, skipped := range result.Skipped {
+		if skipped.Message != "" {
+			fmt.Fprintf(warn, "skipped %s (%s): %s\n", skipped.Path, skipped.Reason, skipped.Message)
+		} else {
+			fmt.Fprintf(warn, "skipped %s (%s)\n", skipped.Path, skipped.Reason)
+		}
+	}
+	var unmatched []types.NamespacedName
+	for policy := range result.MarkedPolicies {
+		if _, ok := result.MatchedPolicies[policy]; !ok {
+			unmatched = append(unmatched, policy)
+		}
+	}
+	sort.Slice(unmatched, func(i, j int) bool {
+		return unmatched[i].String() < unmatched[j].String()
+	})
+	for _, policy := range unmatched {
+		fmt.Fprintf(warn, "no image for policy %s:%s, named by a marker\n", policy.Namespace, policy.Name)
+	}
+
+	files := make([]string, 0, len(result.Files))
+	for file := range result.Files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		fmt.Fprintln(out, file)
+		for _, change := range result.Files[file].Changes {
+			fmt.Fprintf(out, "  %s: %s (%s)\n", objectName(change.Object), change, change.Setter)
+		}
+	}
+	if len(files) == 0 {
+		fmt.Fprintf(out, "no updates to make (%d fields marked)\n", result.Matched)
+	}
+}
+
+// objectName gives the kind and name of the object given; e.g.,
+// "Deployment apps/podinfo".
+func objectName(id update.ObjectIdentifier) string {
+	switch {
+	case id.Name == "":
+		return id.Kind
+	case id.Namespace == "":
+		return id.Kind + " " + id.Name
+	}
+	return id.Kind + " " + id.Namespace + "/" + id.Name
+}
+
+// clusterLookup gives a lookup of image policies in the cluster the
+// kubeconfig given, or kubectl's default, and the context given,
+// points at.
+func clusterLookup(kubeconfig, kubecontext string) (update.PolicyLookup, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules,
+		&clientcmd.ConfigOverrides{CurrentContext: kubecontext}).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	scheme := runtime.NewScheme()
+	if err := imagev1_reflect.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	c, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+	return func(name types.NamespacedName) (*imagev1_reflect.ImagePolicy, error) {
+		var policy imagev1_reflect.ImagePolicy
+		if err := c.Get(context.Background(), name, &policy); err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return &policy, nil
+	}, nil
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	imagev1_reflect "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+)
+
+// loadPolicies reads the image policies in the files given, and in
+// the YAML and JSON files under the directories given. Objects of
+// other kinds are passed over, so that the files can be, e.g., the
+// output of `kubectl get imagepolicies -A -o yaml`, or a directory of
+// manifests.
+func loadPolicies(paths []string) ([]imagev1_reflect.ImagePolicy, error) {
+	var policies []imagev1_reflect.ImagePolicy
+	for _, root := range paths {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			if path != root {
+				switch filepath.Ext(path) {
+				case ".yaml", ".yml", ".json":
+				default:
+					return nil
+				}
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			found, err := readPolicies(f)
+			if err != nil {
+				return fmt.Errorf("reading %s: %w", path, err)
+			}
+			policies = append(policies, found...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return policies, nil
+}
+
+// readPolicies reads the image policies in the YAML or JSON stream
+// given, including those in lists.
+func readPolicies(r io.Reader) ([]imagev1_reflect.ImagePolicy, error) {
+	var policies []imagev1_reflect.ImagePolicy
+	decoder := yaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var doc json.RawMessage
+		if err := decoder.Decode(&doc); err != nil {
+			if err == io.EOF {
+				return policies, nil
+			}
+			return nil, err
+		}
+		found, err := policiesIn(doc)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, found...)
+	}
+}
+
+func policiesIn(doc json.RawMessage) ([]imagev1_reflect.ImagePolicy, error) {
+	var typeMeta metav1.TypeMeta
+	if err := json.Unmarshal(doc, &typeMeta); err != nil {
+		return nil, err
+	}
+	switch {
+	case typeMeta.Kind == imagev1_reflect.ImagePolicyKind:
+		var policy imagev1_reflect.ImagePolicy
+		if err := json.Unmarshal(doc, &policy); err != nil {
+			return nil, err
+		}
+		return []imagev1_reflect.ImagePolicy{policy}, nil
+	case strings.HasSuffix(typeMeta.Kind, "List"):
+		var list struct {
+			Items []json.RawMessage `json:"items"`
+		}
+		if err := json.Unmarshal(doc, &list); err != nil {
+			return nil, err
+		}
+		var policies []imagev1_reflect.ImagePolicy
+		for _, item := range list.Items {
+			found, err := policiesIn(item)
+			if err != nil {
+				return nil, err
+			}
+			policies = append(policies, found...)
+		}
+		return policies, nil
+	}
+	return nil, nil
+}
+
+// setImages gives the policies given with the images set, each given
+// as `<namespace>:<name>=<image>`, as their latest images. A policy
+// not among those given is added.
+func setImages(policies []imagev1_reflect.ImagePolicy, images []string) ([]imagev1_reflect.ImagePolicy, error) {
+	for _, set := range images {
+		parts := strings.SplitN(set, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("%q is not in the form <namespace>:<name>=<image>", set)
+		}
+		nameParts := strings.SplitN(parts[0], ":", 2)
+		if len(nameParts) != 2 || nameParts[0] == "" || nameParts[1] == "" {
+			return nil, fmt.Errorf("%q is not in the form <namespace>:<name>=<image>", set)
+		}
+		name := types.NamespacedName{Namespace: nameParts[0], Name: nameParts[1]}
+		found := false
+		for i := range policies {
+			if policies[i].Namespace == name.Namespace && policies[i].Name == name.Name {
+				policies[i].Status.LatestImage = parts[1]
+				found = true
+			}
+		}
+		if !found {
+			var policy imagev1_reflect.ImagePolicy
+			policy.Namespace, policy.Name = name.Namespace, name.Name
+			policy.Status.LatestImage = parts[1]
+			policies = append(policies, policy)
+		}
+	}
+	return policies, nil
+}
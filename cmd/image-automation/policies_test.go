@@ -0,0 +1,105 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const policiesYAML = `---
+apiVersion: image.toolkit.fluxcd.io/v1beta1
+kind: ImagePolicy
+metadata:
+  namespace: flux-system
+  name: podinfo
+status:
+  latestImage: ghcr.io/stefanprodan/podinfo:5.0.1
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unrelated
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: image.toolkit.fluxcd.io/v1beta1
+  kind: ImagePolicy
+  metadata:
+    namespace: apps
+    name: web
+  status:
+    latestImage: web:v2
+`
+
+func TestLoadPolicies(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "policies.yaml"), []byte(policiesYAML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// files in a directory that aren't YAML or JSON are passed over
+	if err := os.WriteFile(filepath.Join(dir, "README.md"), []byte("# Policies\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	policies, err := loadPolicies([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 2 {
+		t.Fatalf("expected two policies, got %d", len(policies))
+	}
+	if p := policies[0]; p.Namespace != "flux-system" || p.Name != "podinfo" || p.Status.LatestImage != "ghcr.io/stefanprodan/podinfo:5.0.1" {
+		t.Errorf("unexpected first policy %s/%s with image %q", p.Namespace, p.Name, p.Status.LatestImage)
+	}
+	if p := policies[1]; p.Namespace != "apps" || p.Name != "web" || p.Status.LatestImage != "web:v2" {
+		t.Errorf("unexpected policy from list %s/%s with image %q", p.Namespace, p.Name, p.Status.LatestImage)
+	}
+
+	if _, err := readPolicies(strings.NewReader("kind: [")); err == nil {
+		t.Error("expected an error reading YAML that can't be parsed")
+	}
+}
+
+func TestSetImages(t *testing.T) {
+	policies, err := loadPolicies(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies, err = setImages(policies, []string{"apps:web=web:v2", "apps:web=web:v3", "apps:api=api:v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 2 {
+		t.Fatalf("expected two policies, got %d", len(policies))
+	}
+	if policies[0].Name != "web" || policies[0].Status.LatestImage != "web:v3" {
+		t.Errorf("expected the last image given for web to be kept, got %q", policies[0].Status.LatestImage)
+	}
+	if policies[1].Name != "api" || policies[1].Status.LatestImage != "api:v1" {
+		t.Errorf("expected a policy for api, got %s with %q", policies[1].Name, policies[1].Status.LatestImage)
+	}
+
+	for _, bad := range []string{"web=web:v1", "apps:web", "apps:web=", ":web=web:v1"} {
+		if _, err := setImages(nil, []string{bad}); err == nil {
+			t.Errorf("expected %q to be refused", bad)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/go-logr/logr"
+	"github.com/sergi/go-diff/diffmatchpatch"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/fluxcd/pkg/runtime/events"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// An automation can be made to wait for the updates it makes to be
+// approved before committing them (.spec.requireApproval). The updates
+// are worked out as usual, and recorded in .status.pendingUpdates,
+// with a diff and a token derived from it; setting the approve
+// annotation (imagev1.ApproveAnnotation) to the token lets the next
+// run commit and push the updates, as long as they are the same
+// updates. An approval is used only once. With the approval method
+// ChangeRequest, the updates can also be approved with a change
+// request; see changerequest.go.
+
+// maxDiffBytes is the greatest length of the diff recorded with
+// updates waiting for approval.
+const maxDiffBytes = 16 * 1024
+
+// approvalMetadataKey is the key of the approval token in the
+// metadata of the event sent about updates waiting for approval.
+const approvalMetadataKey = "approvalToken"
+
+// approvalRequest gives the approval token of the updates that were
+// waiting as of the last run of the automation given, and whether they
+// have been approved since, with the approve annotation or a change
+// request, and the approval hasn't been acted on.
+func (r *ImageUpdateAutomationReconciler) approvalRequest(ctx context.Context, auto *imagev1.ImageUpdateAutomation) (string, bool, error) {
+	pending := auto.Status.PendingUpdates
+	if pending == nil || pending.ApprovalToken == "" || pending.ApprovalToken == auto.Status.LastHandledApproval {
+		return "", false, nil
+	}
+	if token, ok := auto.GetAnnotations()[imagev1.ApproveAnnotation]; ok && token == pending.ApprovalToken {
+		return token, true, nil
+	}
+	if auto.Spec.ApprovalMethod == imagev1.ApprovalChangeRequest {
+		approved, err := r.changeRequestApproved(ctx, auto, pending.ApprovalToken)
+		return pending.ApprovalToken, approved, err
+	}
+	return pending.ApprovalToken, false, nil
+}
+
+// approvalPredicate passes on updates that change the approve
+// annotation, so that updates are committed as soon as they're
+// approved.
+type approvalPredicate struct {
+	predicate.Funcs
+}
+
+func (approvalPredicate) Update(e event.UpdateEvent) bool {
+	if e.ObjectOld == nil || e.ObjectNew == nil {
+		return false
+	}
+	token, ok := e.ObjectNew.GetAnnotations()[imagev1.ApproveAnnotation]
+	return ok && token != e.ObjectOld.GetAnnotations()[imagev1.ApproveAnnotation]
+}
+
+// pendingDiff gives the lines of the files given, in the working
+// directory given, that differ from the lines in the HEAD commit of
+// the repository, as removed and added lines under a header naming
+// each file.
+func pendingDiff(repo *gogit.Repository, dir string, files []string) (string, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, file := range files {
+		var before, after string
+		f, err := commit.File(file)
+		switch err {
+		case nil:
+			if before, err = f.Contents(); err != nil {
+				return "", err
+			}
+		case object.ErrFileNotFound:
+		default:
+			return "", err
+		}
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		after = string(data)
+
+		fmt.Fprintf(&b, "--- %s\n+++ %s\n", file, file)
+		for _, d := range diff.Do(before, after) {
+			var prefix string
+			switch d.Type {
+			case diffmatchpatch.DiffDelete:
+				prefix = "-"
+			case diffmatchpatch.DiffInsert:
+				prefix = "+"
+			default:
+				continue
+			}
+			for _, line := range strings.Split(strings.TrimSuffix(d.Text, "\n"), "\n") {
+				fmt.Fprintf(&b, "%s%s\n", prefix, line)
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// diffToken gives the approval token for the diff given. It's derived
+// from the whole diff, so that it changes whenever the updates do.
+func diffToken(diff string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(diff)))[:16]
+}
+
+// shortDiff gives the diff given cut short, at the end of a line, if
+// it's longer than maxDiffBytes.
+func shortDiff(diff string) string {
+	if len(diff) <= maxDiffBytes {
+		return diff
+	}
+	cut := diff[:maxDiffBytes]
+	if i := strings.LastIndex(cut, "\n"); i >= 0 {
+		cut = cut[:i+1]
+	}
+	return cut + "... (diff cut short)\n"
+}
+
+// awaitApproval records the updates given as waiting for approval, and
+// ends the run. An event is sent when updates start waiting, rather
+// than on each run.
+func (r *ImageUpdateAutomationReconciler) awaitApproval(ctx context.Context, req ctrl.Request, auto *imagev1.ImageUpdateAutomation,
+	pending *imagev1.PendingUpdates, digest string) (ctrl.Result, error) {
+	msg := fmt.Sprintf("updates to %d file(s) awaiting approval; approve by setting the annotation %s to %s",
+		len(pending.Files), imagev1.ApproveAnnotation, pending.ApprovalToken)
+	if auto.Spec.ApprovalMethod == imagev1.ApprovalChangeRequest {
+		if err := r.requestChange(ctx, auto, pending); err != nil {
+			return ctrl.Result{}, err
+		}
+		msg = fmt.Sprintf("updates to %d file(s) awaiting approval; approve by setting .spec.approved of %s %s to true",
+			len(pending.Files), imagev1.ImageUpdateChangeRequestKind, changeRequestName(auto, pending.ApprovalToken))
+	}
+	if previous := auto.Status.PendingUpdates; previous == nil || previous.ApprovalToken != pending.ApprovalToken {
+		logr.FromContext(ctx).Info("updates awaiting approval", "token", pending.ApprovalToken, "files", len(pending.Files))
+		r.eventWithReason(ctx, *auto, events.EventSeverityInfo, imagev1.AwaitingApprovalReason,
+			fmt.Sprintf("Updates awaiting approval with token %s\n%s", pending.ApprovalToken, pushSummary(pending.Files, pending.Images)),
+			addChangeSummary(map[string]string{approvalMetadataKey: pending.ApprovalToken}, pending.Images, ""))
+	}
+	auto.Status.PendingUpdates = pending
+	auto.Status.LastRunDigest = digest
+	imagev1.SetImageUpdateAutomationPushed(auto, metav1.ConditionFalse, imagev1.AwaitingApprovalReason, msg)
+	imagev1.SetImageUpdateAutomationReadiness(auto, metav1.ConditionTrue, imagev1.AwaitingApprovalReason, msg)
+	if err := r.patchStatus(ctx, req, auto.Status); err != nil {
+		return ctrl.Result{Requeue: true}, err
+	}
+	return ctrl.Result{RequeueAfter: intervalOrDefault(auto)}, nil
+}
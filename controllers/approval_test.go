@@ -0,0 +1,165 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestApprovalRequest(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := imagev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	r := &ImageUpdateAutomationReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).Build(), Scheme: scheme}
+	ctx := context.Background()
+	approved := func(auto *imagev1.ImageUpdateAutomation) bool {
+		_, ok, err := r.approvalRequest(ctx, auto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	auto := &imagev1.ImageUpdateAutomation{}
+	auto.Namespace, auto.Name = "apps", "podinfo"
+	auto.SetAnnotations(map[string]string{imagev1.ApproveAnnotation: "abc"})
+	if approved(auto) {
+		t.Error("expected no approval without updates waiting")
+	}
+	auto.Status.PendingUpdates = &imagev1.PendingUpdates{ApprovalToken: "def"}
+	if approved(auto) {
+		t.Error("expected no approval with the token of other updates")
+	}
+	auto.Status.PendingUpdates.ApprovalToken = "abc"
+	if token, ok, _ := r.approvalRequest(ctx, auto); !ok || token != "abc" {
+		t.Errorf("expected approval with the token %q, got %q (%v)", "abc", token, ok)
+	}
+	auto.Status.LastHandledApproval = "abc"
+	if approved(auto) {
+		t.Error("expected an approval to be acted on only once")
+	}
+
+	// with a change request
+	auto.SetAnnotations(nil)
+	auto.Spec.ApprovalMethod = imagev1.ApprovalChangeRequest
+	auto.Status.PendingUpdates.ApprovalToken = "def"
+	if approved(auto) {
+		t.Error("expected no approval without a change request")
+	}
+	change := &imagev1.ImageUpdateChangeRequest{}
+	change.Namespace, change.Name = "apps", changeRequestName(auto, "def")
+	change.Spec.ApprovalToken = "def"
+	if err := r.Create(ctx, change); err != nil {
+		t.Fatal(err)
+	}
+	if approved(auto) {
+		t.Error("expected no approval before the change request is approved")
+	}
+	change.Spec.Approved = true
+	if err := r.Update(ctx, change); err != nil {
+		t.Fatal(err)
+	}
+	if !approved(auto) {
+		t.Error("expected approval once the change request is approved")
+	}
+}
+
+func TestApprovalPredicate(t *testing.T) {
+	old := &imagev1.ImageUpdateAutomation{}
+	updated := old.DeepCopy()
+	updated.SetAnnotations(map[string]string{imagev1.ApproveAnnotation: "abc"})
+	if !(approvalPredicate{}).Update(event.UpdateEvent{ObjectOld: old, ObjectNew: updated}) {
+		t.Error("expected setting the approve annotation to be passed on")
+	}
+	if (approvalPredicate{}).Update(event.UpdateEvent{ObjectOld: updated, ObjectNew: updated}) {
+		t.Error("expected an update leaving the approve annotation as it was to be passed over")
+	}
+}
+
+func TestPendingDiff(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := gogit.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	working, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, contents string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("deploy.yaml", "kind: Deployment\nimage: app:v1\nreplicas: 1\n")
+	if _, err := working.Add("deploy.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := working.Commit("initial", &gogit.CommitOptions{
+		Author: &object.Signature{Name: "Testbot", Email: "test@example.com", When: time.Now()},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	write("deploy.yaml", "kind: Deployment\nimage: app:v2\nreplicas: 1\n")
+	write("new.yaml", "image: db:v1\n")
+	diff, err := pendingDiff(repo, dir, []string{"deploy.yaml", "new.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `--- deploy.yaml
++++ deploy.yaml
+-image: app:v1
++image: app:v2
+--- new.yaml
++++ new.yaml
++image: db:v1
+`
+	if diff != expected {
+		t.Errorf("expected diff %q, got %q", expected, diff)
+	}
+
+	token := diffToken(diff)
+	if len(token) != 16 || token == diffToken(strings.Replace(diff, "v2", "v3", 1)) {
+		t.Errorf("expected a token that changes with the diff, got %q", token)
+	}
+}
+
+func TestShortDiff(t *testing.T) {
+	if diff := shortDiff("+image: app:v2\n"); diff != "+image: app:v2\n" {
+		t.Errorf("expected a short diff to be left as it is, got %q", diff)
+	}
+	long := strings.Repeat("+image: app:v2\n", maxDiffBytes/10)
+	diff := shortDiff(long)
+	if len(diff) > maxDiffBytes+len("... (diff cut short)\n") || !strings.HasSuffix(diff, "+image: app:v2\n... (diff cut short)\n") {
+		t.Errorf("expected the diff to be cut short at the end of a line, got %d bytes ending %q", len(diff), diff[len(diff)-40:])
+	}
+}
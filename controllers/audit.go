@@ -0,0 +1,155 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// PushRecord is the audit record of a single push made by the
+// controller.
+type PushRecord struct {
+	// Namespace and Name identify the automation that made the push.
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Revision is the SHA of the commit pushed.
+	Revision string `json:"revision"`
+	// Branch and Refspec give where the commit was pushed to.
+	Branch  string `json:"branch,omitempty"`
+	Refspec string `json:"refspec,omitempty"`
+	// Images lists the image updates in the commit.
+	Images []imagev1.ImageUpdate `json:"images,omitempty"`
+	// Author is the author of the commit, as "Name <email>".
+	Author string `json:"author"`
+	// Controller identifies the controller instance (i.e., the pod)
+	// that made the push.
+	Controller string `json:"controller"`
+	// Time is when the push was made.
+	Time time.Time `json:"time"`
+}
+
+// AuditSink is where the record of each push is sent. Records are only
+// ever added to a sink; they're never updated or removed.
+type AuditSink interface {
+	RecordPush(ctx context.Context, record PushRecord) error
+}
+
+// NewAuditSink creates the sink for the address given, which is
+// either the path of a file (optionally as a file:// URL), to which
+// records are appended one JSON object per line, or an http:// or
+// https:// URL, to which records are POSTed as JSON.
+func NewAuditSink(address string) (AuditSink, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit sink address %q: %w", address, err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &webhookAuditSink{url: address, client: &http.Client{Timeout: 15 * time.Second}}, nil
+	case "file":
+		return newFileAuditSink(u.Path)
+	case "":
+		return newFileAuditSink(address)
+	default:
+		return nil, fmt.Errorf("unsupported audit sink scheme %q", u.Scheme)
+	}
+}
+
+// fileAuditSink appends records to a file.
+type fileAuditSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newFileAuditSink(path string) (*fileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit file: %w", err)
+	}
+	return &fileAuditSink{file: f}, nil
+}
+
+func (s *fileAuditSink) RecordPush(_ context.Context, record PushRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// a single write, so that a record is never interleaved with
+	// another
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// webhookAuditSink POSTs records to a URL.
+type webhookAuditSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookAuditSink) RecordPush(ctx context.Context, record PushRecord) error {
+	return postJSON(ctx, s.client, s.url, nil, record)
+}
+
+// postJSON POSTs the value given, encoded as JSON, to a URL, with the
+// headers given as well as the content type, and checks that the
+// response is a success.
+func postJSON(ctx context.Context, client *http.Client, url string, header http.Header, value interface{}) error {
+	return exchangeJSON(ctx, client, url, header, value, nil)
+}
+
+// exchangeJSON is postJSON, also decoding the response, which must be
+// JSON, into the value given as response, unless it's nil.
+func exchangeJSON(ctx context.Context, client *http.Client, url string, header http.Header, value, response interface{}) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with status %s", url, res.Status)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(response)
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func testPushRecord(rev string) PushRecord {
+	return PushRecord{
+		Namespace: "apps",
+		Name:      "auto",
+		Revision:  rev,
+		Branch:    "main",
+		Images: []imagev1.ImageUpdate{
+			{Policy: meta.NamespacedObjectReference{Namespace: "apps", Name: "app"}, OldValue: "app:v1.0.0", NewValue: "app:v1.0.1"},
+		},
+		Author:     "Flux <flux@example.com>",
+		Controller: "image-automation-controller-abc",
+		Time:       time.Date(2021, 10, 1, 10, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	records := []PushRecord{testPushRecord("abc123"), testPushRecord("def456")}
+
+	// each sink appends to what's already there
+	for _, record := range records {
+		sink, err := NewAuditSink("file://" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.RecordPush(context.TODO(), record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var found []PushRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record PushRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		found = append(found, record)
+	}
+	if !reflect.DeepEqual(found, records) {
+		t.Errorf("expected records %v, got %v", records, found)
+	}
+}
+
+func TestWebhookAuditSink(t *testing.T) {
+	received := make(chan PushRecord, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var record PushRecord
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- record
+	}))
+	defer server.Close()
+
+	sink, err := NewAuditSink(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := testPushRecord("abc123")
+	if err := sink.RecordPush(context.TODO(), record); err != nil {
+		t.Fatal(err)
+	}
+	if found := <-received; !reflect.DeepEqual(found, record) {
+		t.Errorf("expected record %v, got %v", record, found)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	sink, err = NewAuditSink(failing.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.RecordPush(context.TODO(), record); err == nil {
+		t.Error("expected an error when the webhook fails")
+	}
+}
+
+func TestNewAuditSinkUnsupported(t *testing.T) {
+	if _, err := NewAuditSink("s3://bucket/audit"); err == nil {
+		t.Error("expected an error for an unsupported scheme")
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+)
+
+// The backoff used for push failures when none is given in the
+// options.
+const (
+	defaultPushFailureBackoff    = 10 * time.Second
+	defaultMaxPushFailureBackoff = 10 * time.Minute
+)
+
+// pushBackoff gives how long to wait before trying again to push,
+// after a number of failures in a row. The wait doubles with each
+// failure, from initial, until it reaches max. The zero value uses
+// the defaults.
+type pushBackoff struct {
+	initial, max time.Duration
+}
+
+// newPushBackoff creates a backoff starting at initial and capped at
+// max, using the defaults for either if it's zero or less.
+func newPushBackoff(initial, max time.Duration) pushBackoff {
+	if initial <= 0 {
+		initial = defaultPushFailureBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxPushFailureBackoff
+	}
+	if max < initial {
+		max = initial
+	}
+	return pushBackoff{initial: initial, max: max}
+}
+
+// after gives the wait after the number of failures given, which is
+// at least one.
+func (b pushBackoff) after(failures int64) time.Duration {
+	if b.initial <= 0 {
+		b = newPushBackoff(0, b.max)
+	}
+	wait := b.initial
+	for i := int64(1); i < failures && wait < b.max; i++ {
+		wait *= 2
+	}
+	if wait > b.max {
+		return b.max
+	}
+	return wait
+}
+
+// escalates says whether the number of failures given is the one at
+// which the wait first reaches its cap. An event is sent for the
+// first failure, and another for this one, rather than one for every
+// failure.
+func (b pushBackoff) escalates(failures int64) bool {
+	if b.initial <= 0 {
+		b = newPushBackoff(0, b.max)
+	}
+	return failures > 1 && b.after(failures) == b.max && b.after(failures-1) < b.max
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPushBackoff(t *testing.T) {
+	b := newPushBackoff(10*time.Second, time.Minute)
+	for _, c := range []struct {
+		failures  int64
+		wait      time.Duration
+		escalates bool
+	}{
+		{1, 10 * time.Second, false},
+		{2, 20 * time.Second, false},
+		{3, 40 * time.Second, false},
+		{4, time.Minute, true},
+		{5, time.Minute, false},
+		{100, time.Minute, false},
+	} {
+		if wait := b.after(c.failures); wait != c.wait {
+			t.Errorf("expected a wait of %v after %d failures, got %v", c.wait, c.failures, wait)
+		}
+		if escalates := b.escalates(c.failures); escalates != c.escalates {
+			t.Errorf("expected escalation %v at %d failures, got %v", c.escalates, c.failures, escalates)
+		}
+	}
+
+	var zero pushBackoff
+	if wait := zero.after(1); wait != defaultPushFailureBackoff {
+		t.Errorf("expected the zero value to use the default backoff, got %v", wait)
+	}
+}
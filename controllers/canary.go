@@ -0,0 +1,312 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/events"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+	"github.com/fluxcd/image-automation-controller/pkg/update"
+)
+
+// An automation with a canary records each commit it pushes as
+// pending, and once the commit has been on the push branch for the
+// soak time, cherry-picks it on to the canary branch and pushes that.
+// A commit reverted (see revert.go) while pending is never promoted.
+// Commits are promoted in the order they were pushed, in place of a
+// run.
+
+// cannotPromoteError is returned when a commit can't be promoted, and
+// trying again won't change that.
+type cannotPromoteError struct {
+	commit string
+	reason string
+}
+
+func (e *cannotPromoteError) Error() string {
+	return e.reason
+}
+
+// canaryPushed gives the canary status, with the commit pushed added
+// to those pending.
+func canaryPushed(status *imagev1.CanaryStatus, rev string, now time.Time) *imagev1.CanaryStatus {
+	if status == nil {
+		status = &imagev1.CanaryStatus{}
+	}
+	status.Pending = append(status.Pending, imagev1.CanaryCommit{
+		Commit:   rev,
+		PushedAt: metav1.Time{Time: now},
+	})
+	return status
+}
+
+// dropCanaryCommit removes the commit given from those pending, so
+// that it's not promoted.
+func dropCanaryCommit(status *imagev1.CanaryStatus, rev string) bool {
+	if status == nil {
+		return false
+	}
+	for i := range status.Pending {
+		if status.Pending[i].Commit == rev {
+			status.Pending = append(status.Pending[:i], status.Pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// canaryDue gives the commits pending that have been on the push
+// branch for the soak time, oldest first.
+func canaryDue(canary *imagev1.CanarySpec, status *imagev1.CanaryStatus, now time.Time) []imagev1.CanaryCommit {
+	if canary == nil || status == nil {
+		return nil
+	}
+	var due []imagev1.CanaryCommit
+	for _, pending := range status.Pending {
+		if now.Sub(pending.PushedAt.Time) < canary.SoakTime.Duration {
+			break
+		}
+		due = append(due, pending)
+	}
+	return due
+}
+
+// nextCanaryPromotion gives how long it will be until the oldest
+// commit pending has been on the push branch for the soak time, or
+// zero if no commit is pending.
+func nextCanaryPromotion(canary *imagev1.CanarySpec, status *imagev1.CanaryStatus, now time.Time) time.Duration {
+	if canary == nil || status == nil || len(status.Pending) == 0 {
+		return 0
+	}
+	wait := status.Pending[0].PushedAt.Add(canary.SoakTime.Duration).Sub(now)
+	if wait <= 0 {
+		return time.Second
+	}
+	return wait
+}
+
+// promoteCanary cherry-picks the commits given on to the canary
+// branch, and pushes it.
+func (r *ImageUpdateAutomationReconciler) promoteCanary(ctx context.Context, req ctrl.Request, auto *imagev1.ImageUpdateAutomation,
+	origin *sourcev1.GitRepository, pushBranch string, due []imagev1.CanaryCommit) (ctrl.Result, error) {
+	log := logr.FromContext(ctx)
+	now := time.Now()
+	canary := auto.Spec.GitSpec.Push.Canary
+
+	// giveUp drops the commit that can't be promoted, so that those
+	// after it can be.
+	giveUp := func(commit, reason string) (ctrl.Result, error) {
+		log.Info("unable to promote commit to the canary branch", "commit", commit, "branch", canary.Branch, "reason", reason)
+		r.eventWithReason(ctx, *auto, events.EventSeverityError, imagev1.CanaryPromotionFailedReason,
+			fmt.Sprintf("unable to promote commit %s to %s: %s; it will not be promoted", commit, canary.Branch, reason), nil)
+		dropCanaryCommit(auto.Status.Canary, commit)
+		if err := r.patchStatus(ctx, req, auto.Status); err != nil {
+			return ctrl.Result{Requeue: true}, err
+		}
+		return ctrl.Result{Requeue: true}, nil
+	}
+	// fail leaves the commits to be promoted later, with backoff.
+	fail := func(err error) (ctrl.Result, error) {
+		if cannot, ok := err.(*cannotPromoteError); ok {
+			return giveUp(cannot.commit, cannot.reason)
+		}
+		r.eventWithReason(ctx, *auto, events.EventSeverityError, imagev1.CanaryPromotionFailedReason,
+			fmt.Sprintf("unable to promote commits to %s: %s", canary.Branch, err), nil)
+		imagev1.SetImageUpdateAutomationReadiness(auto, metav1.ConditionFalse, meta.ReconciliationFailedReason, err.Error())
+		if err := r.patchStatus(ctx, req, auto.Status); err != nil {
+			log.Error(err, "failed to reconcile")
+		}
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	// the branch is held until the push is done, even if it's given up on
+	ctx = withGitOperations(ctx)
+	releasePush, wait, err := r.pushLeases.acquire(ctx, origin.Spec.URL, canary.Branch)
+	if err != nil {
+		return fail(err)
+	}
+	if wait > 0 {
+		return ctrl.Result{RequeueAfter: wait.Round(time.Second)}, nil
+	}
+	defer whenGitOperationsDone(ctx, releasePush)
+
+	gitSpec := auto.Spec.GitSpec
+	var signingEntity *openpgp.Entity
+	if gitSpec.Commit.SigningKey != nil {
+		if signingEntity, err = r.getSigningEntity(ctx, *auto); err != nil {
+			return fail(err)
+		}
+	}
+
+	access, err := r.getRepoAccess(ctx, auto, origin)
+	if err != nil {
+		return fail(err)
+	}
+	ctx, tmp, removeWorkspace, err := r.workspaces.create(ctx, fmt.Sprintf("%s-%s", origin.GetNamespace(), origin.GetName()))
+	if err != nil {
+		return fail(err)
+	}
+	defer removeWorkspace()
+
+	// the canary branch is checked out, and the push branch fetched,
+	// so its commits can be cherry-picked
+	cloneCtx, cancel := gitOperationContext(ctx, origin)
+	defer cancel()
+	repo, err := cloneInto(cloneCtx, access, &sourcev1.GitRepositoryRef{Branch: canary.Branch}, tmp, nil)
+	if err != nil {
+		return fail(err)
+	}
+	if err := r.workspaces.checkSize(tmp); err != nil {
+		return fail(err)
+	}
+	fetchCtx, cancel := gitOperationContext(ctx, origin)
+	defer cancel()
+	access, err = r.withRotatedAuth(ctx, auto, origin, access, func(access repoAccess) error {
+		return fetch(fetchCtx, tmp, pushBranch, access, nil)
+	})
+	if err != nil && err != errRemoteBranchMissing {
+		return fail(err)
+	}
+
+	commitAuthor, err := r.getCommitAuthor(ctx, auto)
+	if err != nil {
+		return fail(err)
+	}
+	author := &object.Signature{
+		Name:  commitAuthor.Name,
+		Email: commitAuthor.Email,
+		When:  now,
+	}
+	var rev string
+	promoted := make([]string, len(due))
+	for i := range due {
+		promoted[i] = due[i].Commit
+		if rev, err = cherryPick(repo, tmp, due[i].Commit, signingEntity, author); err != nil {
+			return fail(err)
+		}
+	}
+
+	pushCtx, cancel := gitOperationContext(ctx, origin)
+	defer cancel()
+	refspecs := pushRefspecs(canary.Branch, "", false)
+	_, err = r.withRotatedAuth(ctx, auto, origin, access, func(access repoAccess) error {
+		return push(pushCtx, tmp, refspecs, access)
+	})
+	if err != nil {
+		return fail(err)
+	}
+	r.pushLimiter.record(origin.Spec.URL, now)
+
+	log.Info("promoted commits to the canary branch", "commits", promoted, "revision", rev, "branch", canary.Branch)
+	r.eventWithReason(ctx, *auto, events.EventSeverityInfo, imagev1.CanaryPromotedReason,
+		fmt.Sprintf("Promoted %s from %s to %s, as %s", strings.Join(promoted, ", "), pushBranch, canary.Branch, rev),
+		pushMetadata(rev, canary.Branch, "", update.Result{}, nil))
+	auto.Status.Canary.Pending = auto.Status.Canary.Pending[len(due):]
+	auto.Status.Canary.LastPromotion = &imagev1.CanaryPromotion{
+		Commit:   rev,
+		Promoted: promoted,
+		Time:     metav1.Time{Time: now},
+	}
+	if err := r.patchStatus(ctx, req, auto.Status); err != nil {
+		return ctrl.Result{Requeue: true}, err
+	}
+	// the run put off for the promotion follows
+	return ctrl.Result{Requeue: true}, nil
+}
+
+// cherryPick commits, on top of HEAD, the changes made by the commit
+// given, and returns the SHA1 of the new commit. The files the commit
+// changed must be at HEAD as they were before the commit; otherwise,
+// the changes can't be made as they were.
+func cherryPick(repo *gogit.Repository, path, hash string, ent *openpgp.Entity, author *object.Signature) (string, error) {
+	commit, err := repo.CommitObject(plumbing.NewHash(hash))
+	if err == plumbing.ErrObjectNotFound {
+		return "", &cannotPromoteError{hash, fmt.Sprintf("commit %s is not in the repository", hash)}
+	}
+	if err != nil {
+		return "", err
+	}
+	if commit.NumParents() != 1 {
+		return "", &cannotPromoteError{hash, fmt.Sprintf("commit %s has %d parents, so cannot be cherry-picked", hash, commit.NumParents())}
+	}
+	parent, err := commit.Parent(0)
+	if err != nil {
+		return "", err
+	}
+	parentTree, err := parent.Tree()
+	if err != nil {
+		return "", err
+	}
+	commitTree, err := commit.Tree()
+	if err != nil {
+		return "", err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+	headCommit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return "", err
+	}
+	headTree, err := headCommit.Tree()
+	if err != nil {
+		return "", err
+	}
+
+	working, err := repo.Worktree()
+	if err != nil {
+		return "", err
+	}
+	changed, err := applyChanges(working, path, headTree, parentTree, commitTree)
+	if err != nil {
+		return "", err
+	}
+	if changed != "" {
+		return "", &cannotPromoteError{hash, fmt.Sprintf("%s is not as it was before commit %s", changed, hash)}
+	}
+
+	rev, err := working.Commit(cherryPickMessage(hash, commit.Message), &gogit.CommitOptions{
+		Author:  author,
+		SignKey: ent,
+	})
+	if err != nil {
+		return "", err
+	}
+	return rev.String(), nil
+}
+
+// cherryPickMessage gives the message for the cherry-pick of the
+// commit given, in the form `git cherry-pick -x` uses.
+func cherryPickMessage(hash, message string) string {
+	return fmt.Sprintf("%s\n\n(cherry picked from commit %s)\n", strings.TrimRight(message, "\n"), hash)
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestCanaryDue(t *testing.T) {
+	now := time.Now()
+	canary := &imagev1.CanarySpec{Branch: "main", SoakTime: metav1.Duration{Duration: time.Hour}}
+	status := canaryPushed(nil, "first", now.Add(-2*time.Hour))
+	status = canaryPushed(status, "second", now.Add(-90*time.Minute))
+	status = canaryPushed(status, "third", now.Add(-30*time.Minute))
+
+	due := canaryDue(canary, status, now)
+	if len(due) != 2 || due[0].Commit != "first" || due[1].Commit != "second" {
+		t.Errorf("expected the first two commits to be due, got %v", due)
+	}
+	if wait := nextCanaryPromotion(canary, status, now); wait != time.Second {
+		t.Errorf("expected a promotion to be due now, got %s", wait)
+	}
+
+	// a commit reverted isn't promoted
+	if !dropCanaryCommit(status, "second") {
+		t.Error("expected the reverted commit to be dropped")
+	}
+	if dropCanaryCommit(status, "second") {
+		t.Error("expected a commit not pending to be left alone")
+	}
+	status.Pending = status.Pending[1:]
+	if due := canaryDue(canary, status, now); len(due) != 0 {
+		t.Errorf("expected no commits to be due, got %v", due)
+	}
+	if wait := nextCanaryPromotion(canary, status, now); wait != 30*time.Minute {
+		t.Errorf("expected the next promotion to be in 30m, got %s", wait)
+	}
+}
+
+func TestCherryPick(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := gogit.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	working, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	author := &object.Signature{Name: "Testbot", Email: "test@example.com", When: time.Now()}
+	write := func(name, contents string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := working.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(name string) string {
+		contents, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(contents)
+	}
+	commit := func(msg string) string {
+		rev, err := working.Commit(msg, &gogit.CommitOptions{Author: author})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rev.String()
+	}
+	checkout := func(branch string, create bool) {
+		if err := working.Checkout(&gogit.CheckoutOptions{Branch: plumbing.NewBranchReferenceName(branch), Create: create}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("apps/app.yaml", "image: app:v1\n")
+	write("apps/other.yaml", "image: other:v1\n")
+	commit("Initial commit")
+	checkout("canary", true)
+	write("apps/app.yaml", "image: app:v2\n")
+	target := commit("Update app to v2")
+	write("apps/other.yaml", "image: other:v2\n")
+	conflicting := commit("Update other to v2")
+
+	// the production branch has moved on in the meantime, though not
+	// in the file changed
+	checkout("master", false)
+	write("apps/other.yaml", "image: other:v1.1\n")
+	commit("Update other to v1.1")
+
+	rev, err := cherryPick(repo, dir, target, nil, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := read("apps/app.yaml"); got != "image: app:v2\n" {
+		t.Errorf("expected the change to be made, got %q", got)
+	}
+	if got := read("apps/other.yaml"); got != "image: other:v1.1\n" {
+		t.Errorf("expected the other file to be left alone, got %q", got)
+	}
+	picked, err := repo.CommitObject(plumbing.NewHash(rev))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Update app to v2\n\n(cherry picked from commit " + target + ")\n"
+	if picked.Message != expected {
+		t.Errorf("expected message %q, got %q", expected, picked.Message)
+	}
+
+	// the file is no longer as the commit found it
+	var cannot *cannotPromoteError
+	if _, err := cherryPick(repo, dir, conflicting, nil, author); !errors.As(err, &cannot) || cannot.commit != conflicting {
+		t.Errorf("expected the cherry-pick of a commit whose files have changed to be refused, got %v", err)
+	}
+	if got := read("apps/other.yaml"); got != "image: other:v1.1\n" {
+		t.Errorf("expected nothing to be changed by a refused cherry-pick, got %q", got)
+	}
+}
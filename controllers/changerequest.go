@@ -0,0 +1,191 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// With the approval method ChangeRequest, the updates an automation
+// requiring approval is waiting to make are put in an
+// ImageUpdateChangeRequest, named for the automation and the approval
+// token of the updates, and owned by the automation. The updates are
+// pushed once the change request is approved, by a person or another
+// controller setting .spec.approved, and the commit pushed is recorded
+// in its status. Change requests for updates superseded before being
+// pushed are deleted; those pushed are kept as a record, up to
+// maxChangeRequestHistory for each automation.
+
+const maxChangeRequestHistory = 10
+
+// changeRequestName gives the name of the change request for the
+// updates with the approval token given.
+func changeRequestName(auto *imagev1.ImageUpdateAutomation, token string) string {
+	name := auto.GetName()
+	if max := validation.DNS1123SubdomainMaxLength - len(token) - 1; len(name) > max {
+		name = name[:max]
+	}
+	return name + "-" + token
+}
+
+// changeRequestApproved says whether the change request for the
+// updates with the approval token given has been approved, and not
+// yet pushed.
+func (r *ImageUpdateAutomationReconciler) changeRequestApproved(ctx context.Context, auto *imagev1.ImageUpdateAutomation, token string) (bool, error) {
+	var change imagev1.ImageUpdateChangeRequest
+	if err := r.Get(ctx, types.NamespacedName{
+		Namespace: auto.GetNamespace(),
+		Name:      changeRequestName(auto, token),
+	}, &change); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	return change.Spec.Approved && change.Spec.ApprovalToken == token && !change.Pushed(), nil
+}
+
+// changeRequests gives the change requests created for the automation
+// given.
+func (r *ImageUpdateAutomationReconciler) changeRequests(ctx context.Context, auto *imagev1.ImageUpdateAutomation) ([]imagev1.ImageUpdateChangeRequest, error) {
+	var changes imagev1.ImageUpdateChangeRequestList
+	if err := r.List(ctx, &changes, client.InNamespace(auto.GetNamespace()),
+		client.MatchingLabels{imagev1.ChangeRequestAutomationLabel: auto.GetName()}); err != nil {
+		return nil, err
+	}
+	return changes.Items, nil
+}
+
+// requestChange creates the change request for the updates given, if
+// there isn't one already, and deletes those for updates that were
+// waiting before and haven't been pushed.
+func (r *ImageUpdateAutomationReconciler) requestChange(ctx context.Context, auto *imagev1.ImageUpdateAutomation, pending *imagev1.PendingUpdates) error {
+	name := changeRequestName(auto, pending.ApprovalToken)
+	changes, err := r.changeRequests(ctx, auto)
+	if err != nil {
+		return err
+	}
+	found := false
+	for i := range changes {
+		change := &changes[i]
+		switch {
+		case change.GetName() == name:
+			found = true
+		case !change.Pushed():
+			if err := r.Delete(ctx, change); client.IgnoreNotFound(err) != nil {
+				return err
+			}
+		}
+	}
+	if found {
+		return nil
+	}
+
+	change := &imagev1.ImageUpdateChangeRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: auto.GetNamespace(),
+			Name:      name,
+			Labels:    map[string]string{imagev1.ChangeRequestAutomationLabel: auto.GetName()},
+		},
+		Spec: imagev1.ImageUpdateChangeRequestSpec{
+			AutomationRef: meta.LocalObjectReference{Name: auto.GetName()},
+			Revision:      pending.Revision,
+			ApprovalToken: pending.ApprovalToken,
+			Images:        pending.Images,
+			Files:         pending.Files,
+			Patch:         pending.Diff,
+		},
+	}
+	if err := controllerutil.SetControllerReference(auto, change, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Create(ctx, change); err != nil {
+		return err
+	}
+	apimeta.SetStatusCondition(&change.Status.Conditions, metav1.Condition{
+		Type:    meta.ReadyCondition,
+		Status:  metav1.ConditionFalse,
+		Reason:  imagev1.ChangeRequestPendingReason,
+		Message: "waiting for approval",
+	})
+	return r.Status().Update(ctx, change)
+}
+
+// changePushed records the commit pushed in the change request for the
+// updates with the approval token given, and deletes the oldest change
+// requests pushed beyond those kept.
+func (r *ImageUpdateAutomationReconciler) changePushed(ctx context.Context, auto *imagev1.ImageUpdateAutomation, token, rev string, now time.Time) error {
+	var change imagev1.ImageUpdateChangeRequest
+	if err := r.Get(ctx, types.NamespacedName{
+		Namespace: auto.GetNamespace(),
+		Name:      changeRequestName(auto, token),
+	}, &change); err != nil {
+		return err
+	}
+	patch := client.MergeFrom(change.DeepCopy())
+	change.Status.Commit = rev
+	change.Status.PushTime = &metav1.Time{Time: now}
+	apimeta.SetStatusCondition(&change.Status.Conditions, metav1.Condition{
+		Type:    meta.ReadyCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  imagev1.PushSucceededReason,
+		Message: fmt.Sprintf("pushed %s", rev),
+	})
+	if err := r.Status().Patch(ctx, &change, patch); err != nil {
+		return err
+	}
+
+	changes, err := r.changeRequests(ctx, auto)
+	if err != nil {
+		return err
+	}
+	for _, old := range expiredChangeRequests(changes) {
+		if err := r.Delete(ctx, &old); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expiredChangeRequests gives those of the change requests given that
+// were pushed, other than the most recent maxChangeRequestHistory.
+func expiredChangeRequests(changes []imagev1.ImageUpdateChangeRequest) []imagev1.ImageUpdateChangeRequest {
+	var pushed []imagev1.ImageUpdateChangeRequest
+	for _, change := range changes {
+		if change.Pushed() && change.Status.PushTime != nil {
+			pushed = append(pushed, change)
+		}
+	}
+	if len(pushed) <= maxChangeRequestHistory {
+		return nil
+	}
+	sort.Slice(pushed, func(i, j int) bool {
+		return pushed[j].Status.PushTime.Before(pushed[i].Status.PushTime)
+	})
+	return pushed[maxChangeRequestHistory:]
+}
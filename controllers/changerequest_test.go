@@ -0,0 +1,125 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestChangeRequestName(t *testing.T) {
+	auto := &imagev1.ImageUpdateAutomation{}
+	auto.Name = "podinfo"
+	if name := changeRequestName(auto, "0123456789abcdef"); name != "podinfo-0123456789abcdef" {
+		t.Errorf("unexpected name %q", name)
+	}
+	auto.Name = strings.Repeat("a", 253)
+	if name := changeRequestName(auto, "0123456789abcdef"); len(name) != 253 || !strings.HasSuffix(name, "-0123456789abcdef") {
+		t.Errorf("expected a long name to be shortened to make room for the token, got %q", name)
+	}
+}
+
+func TestRequestChange(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := imagev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	r := &ImageUpdateAutomationReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).Build(), Scheme: scheme}
+	ctx := context.Background()
+
+	auto := &imagev1.ImageUpdateAutomation{}
+	auto.Namespace, auto.Name, auto.UID = "apps", "podinfo", "uid"
+	first := &imagev1.PendingUpdates{Revision: "abc123", ApprovalToken: "first", Files: []string{"deploy.yaml"}, Diff: "+image: app:v2\n"}
+	if err := r.requestChange(ctx, auto, first); err != nil {
+		t.Fatal(err)
+	}
+	// asking again leaves the change request as it is
+	if err := r.requestChange(ctx, auto, first); err != nil {
+		t.Fatal(err)
+	}
+	var change imagev1.ImageUpdateChangeRequest
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "apps", Name: "podinfo-first"}, &change); err != nil {
+		t.Fatal(err)
+	}
+	if change.Spec.Patch != first.Diff || change.Spec.AutomationRef.Name != "podinfo" || len(change.OwnerReferences) != 1 {
+		t.Errorf("unexpected change request %+v", change)
+	}
+	if !apimeta.IsStatusConditionFalse(change.Status.Conditions, meta.ReadyCondition) {
+		t.Error("expected the change request to be waiting")
+	}
+
+	// updates that supersede those waiting replace their change
+	// request
+	second := &imagev1.PendingUpdates{Revision: "abc123", ApprovalToken: "second"}
+	if err := r.requestChange(ctx, auto, second); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := r.changeRequests(ctx, auto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Name != "podinfo-second" {
+		t.Fatalf("expected only the change request for the second updates, got %d", len(changes))
+	}
+
+	if err := r.changePushed(ctx, auto, "second", "def456", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "apps", Name: "podinfo-second"}, &change); err != nil {
+		t.Fatal(err)
+	}
+	if change.Status.Commit != "def456" || !apimeta.IsStatusConditionTrue(change.Status.Conditions, meta.ReadyCondition) {
+		t.Errorf("expected the push to be recorded, got %+v", change.Status)
+	}
+	// a change request pushed is kept when others are waiting
+	if err := r.requestChange(ctx, auto, first); err != nil {
+		t.Fatal(err)
+	}
+	if changes, _ := r.changeRequests(ctx, auto); len(changes) != 2 {
+		t.Errorf("expected the change request pushed to be kept, got %d change requests", len(changes))
+	}
+}
+
+func TestExpiredChangeRequests(t *testing.T) {
+	now := time.Now()
+	var changes []imagev1.ImageUpdateChangeRequest
+	for i := 0; i < maxChangeRequestHistory+2; i++ {
+		var change imagev1.ImageUpdateChangeRequest
+		change.Name = fmt.Sprintf("change-%d", i)
+		change.Status.Commit = "abc123"
+		change.Status.PushTime = &metav1.Time{Time: now.Add(time.Duration(i) * time.Minute)}
+		changes = append(changes, change)
+	}
+	changes = append(changes, imagev1.ImageUpdateChangeRequest{})
+	expired := expiredChangeRequests(changes)
+	if len(expired) != 2 || expired[0].Name != "change-1" || expired[1].Name != "change-0" {
+		t.Errorf("expected the two oldest change requests pushed to expire, got %v", expired)
+	}
+}
@@ -0,0 +1,318 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-logr/logr"
+	libgit2 "github.com/libgit2/git2go/v31"
+	"k8s.io/apimachinery/pkg/types"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+)
+
+// cacheRefspecs are fetched into each repository in the clone cache,
+// so that it mirrors the branches and tags of the remote.
+var cacheRefspecs = []string{
+	"+refs/heads/*:refs/heads/*",
+	"+refs/tags/*:refs/tags/*",
+}
+
+// cloneCache keeps a bare copy of the git repository of each
+// GitRepository used by automations. Rather than cloning the remote
+// afresh, a run fetches what's new into the cached copy and clones
+// from that, which is all local.
+//
+// Runs that use the same GitRepository take turns with its cached
+// copy; runs that use different GitRepositories don't wait for each
+// other. When the cache grows beyond its maximum size, the copies
+// least recently used are removed.
+type cloneCache struct {
+	dir     string
+	maxSize int64
+
+	// mu guards locks and inUse, and is held while evicting, so that
+	// a copy can't be removed from under a run.
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+	inUse map[string]int
+}
+
+// newCloneCache creates a clone cache in the directory given, which
+// is created if necessary. A maxSize of zero means the cache can grow
+// without bound.
+func newCloneCache(dir string, maxSize int64) (*cloneCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create clone cache directory: %w", err)
+	}
+	return &cloneCache{
+		dir:     dir,
+		maxSize: maxSize,
+		locks:   make(map[string]*sync.Mutex),
+		inUse:   make(map[string]int),
+	}, nil
+}
+
+// entryPath gives the path of the cached copy of a GitRepository.
+func (c *cloneCache) entryPath(repository types.NamespacedName) string {
+	return filepath.Join(c.dir, repository.Namespace, repository.Name)
+}
+
+// acquire waits for exclusive use of the cached copy at the path
+// given. The function returned gives it up.
+func (c *cloneCache) acquire(path string) func() {
+	c.mu.Lock()
+	lock, ok := c.locks[path]
+	if !ok {
+		lock = &sync.Mutex{}
+		c.locks[path] = lock
+	}
+	c.inUse[path]++
+	c.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.inUse[path]--; c.inUse[path] == 0 {
+			delete(c.inUse, path)
+			delete(c.locks, path)
+		}
+	}
+}
+
+// cloneInto brings the cached copy of the GitRepository up to date
+// with the remote, and clones it at the ref given into path (only
+// checking out the directories in `sparse`, if any are given). The
+// origin of the clone is the remote, as though it had been cloned
+// from there, so fetches and pushes still go to the remote.
+func (c *cloneCache) cloneInto(ctx context.Context, repository types.NamespacedName, access repoAccess, ref *sourcev1.GitRepositoryRef, path string, sparse []string) (*gogit.Repository, error) {
+	// If the operation is given up on, it keeps the cached copy
+	// until it's done with it.
+	entry := c.entryPath(repository)
+	err := runGitOperation(ctx, func() error {
+		release := c.acquire(entry)
+		defer release()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := c.refresh(ctx, entry, access); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return checkout(ctx, entry, nil, ref, path, sparse)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.evict(); err != nil {
+		logr.FromContext(ctx).Error(err, "unable to evict from clone cache")
+	}
+
+	if err := setOriginURL(path, access.url); err != nil {
+		return nil, err
+	}
+	return gogit.PlainOpen(path)
+}
+
+// prefetch brings the cached copy of the GitRepository up to date with
+// the remote, ahead of a run.
+func (c *cloneCache) prefetch(ctx context.Context, repository types.NamespacedName, access repoAccess) error {
+	entry := c.entryPath(repository)
+	return runGitOperation(ctx, func() error {
+		release := c.acquire(entry)
+		defer release()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return c.refresh(ctx, entry, access)
+	})
+}
+
+// refresh fetches from the remote into the cached copy at the path
+// given, first making the copy if there isn't one, or if the one
+// there is unusable or of a different remote.
+func (c *cloneCache) refresh(ctx context.Context, entry string, access repoAccess) error {
+	repo, err := openCacheEntry(entry, access.url)
+	if err != nil {
+		return err
+	}
+	defer repo.Free()
+	origin, err := repo.Remotes.Lookup(originRemote)
+	if err != nil {
+		return err
+	}
+	defer origin.Free()
+
+	err = origin.Fetch(cacheRefspecs, &libgit2.FetchOptions{
+		RemoteCallbacks: access.remoteCallbacks(ctx),
+		Prune:           libgit2.FetchPruneOn,
+		DownloadTags:    libgit2.DownloadTagsAll,
+	}, "")
+	if err != nil {
+		return fmt.Errorf("unable to fetch into clone cache: %w", err)
+	}
+	// the modification time of the copy records when it was last
+	// used, for eviction
+	now := time.Now()
+	return os.Chtimes(entry, now, now)
+}
+
+// openCacheEntry opens the cached copy at the path given, replacing
+// it with a fresh (empty) one if it can't be opened or isn't a copy
+// of the remote given.
+func openCacheEntry(entry, url string) (*libgit2.Repository, error) {
+	if repo, err := libgit2.OpenRepository(entry); err == nil {
+		if origin, err := repo.Remotes.Lookup(originRemote); err == nil {
+			sameRemote := origin.Url() == url
+			origin.Free()
+			if sameRemote {
+				return repo, nil
+			}
+		}
+		repo.Free()
+	}
+
+	if err := os.RemoveAll(entry); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(entry, 0o700); err != nil {
+		return nil, err
+	}
+	repo, err := libgit2.InitRepository(entry, true)
+	if err != nil {
+		return nil, err
+	}
+	origin, err := repo.Remotes.CreateWithFetchspec(originRemote, url, cacheRefspecs[0])
+	if err != nil {
+		repo.Free()
+		return nil, err
+	}
+	origin.Free()
+	return repo, nil
+}
+
+// setOriginURL points the origin remote of the repository at path to
+// the URL given.
+func setOriginURL(path, url string) error {
+	repo, err := libgit2.OpenRepository(path)
+	if err != nil {
+		return err
+	}
+	defer repo.Free()
+	return repo.Remotes.SetUrl(originRemote, url)
+}
+
+// cacheEntry is a cached copy, as considered for eviction.
+type cacheEntry struct {
+	path     string
+	size     int64
+	lastUsed time.Time
+}
+
+// evict removes the least recently used copies that aren't in use,
+// until the cache is no bigger than its maximum size.
+func (c *cloneCache) evict() error {
+	if c.maxSize <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := c.entries()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUsed.Before(entries[j].lastUsed)
+	})
+	for _, e := range entries {
+		if total <= c.maxSize {
+			break
+		}
+		if c.inUse[e.path] > 0 {
+			continue
+		}
+		if err := os.RemoveAll(e.path); err != nil {
+			return err
+		}
+		total -= e.size
+	}
+	return nil
+}
+
+// entries lists the cached copies, which are at <namespace>/<name>
+// under the cache directory.
+func (c *cloneCache) entries() ([]cacheEntry, error) {
+	paths, err := filepath.Glob(filepath.Join(c.dir, "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []cacheEntry
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			continue
+		}
+		size, err := dirSize(path)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, cacheEntry{path: path, size: size, lastUsed: info.ModTime()})
+	}
+	return entries, nil
+}
+
+// dirSize gives the total size of the files under the directory
+// given.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
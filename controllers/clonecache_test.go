@@ -0,0 +1,75 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestCloneCacheEvict(t *testing.T) {
+	cache, err := newCloneCache(t.TempDir(), 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each copy is 100 bytes; the oldest is first
+	names := []string{"oldest", "older", "newest"}
+	start := time.Now().Add(-time.Hour)
+	var paths []string
+	for i, name := range names {
+		path := cache.entryPath(types.NamespacedName{Namespace: "apps", Name: name})
+		if err := os.MkdirAll(filepath.Join(path, "objects"), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(path, "objects", "pack"), make([]byte, 100), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		used := start.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(path, used, used); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	// the oldest copy is in use, so the next oldest goes instead
+	release := cache.acquire(paths[0])
+	if err := cache.evict(); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	for i, want := range []bool{true, false, true} {
+		if _, err := os.Stat(paths[i]); (err == nil) != want {
+			t.Errorf("expected copy %s to be kept (%v), got err %v", names[i], want, err)
+		}
+	}
+
+	// under the limit now, so nothing more is removed
+	if err := cache.evict(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(paths[0]); err != nil {
+		t.Errorf("expected %s to be kept once the cache is within its size: %v", names[0], err)
+	}
+	if len(cache.locks) != 0 || len(cache.inUse) != 0 {
+		t.Errorf("expected no locks to be left after release, got %v", cache.inUse)
+	}
+}
@@ -0,0 +1,431 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/fluxcd/source-controller/pkg/git"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// An automation can give a cloud identity with which to get git
+// credentials, rather than using those in the GitRepository's secret.
+// The credentials are short-lived, so they are got afresh each time
+// access to the repository is set up. The identity is got by
+// exchanging a token for the automation's service account, if it
+// gives one, so that which tenant can act as which identity is up to
+// the cloud provider's trust policies and bindings for the service
+// accounts, and tenants sharing a controller can each push as their
+// own identity. An automation that doesn't give a service account
+// uses the controller's own identity, unless the controller keeps
+// tenants apart (with --no-cross-namespace-refs), in which case it
+// can't use a cloud identity at all.
+
+const (
+	cloudIdentityTimeout = 15 * time.Second
+
+	awsTokenAudience   = "sts.amazonaws.com"
+	awsTokenFileEnv    = "AWS_WEB_IDENTITY_TOKEN_FILE"
+	azureTokenAudience = "api://AzureADTokenExchange"
+	azureTokenFileEnv  = "AZURE_FEDERATED_TOKEN_FILE"
+	azureAuthorityEnv  = "AZURE_AUTHORITY_HOST"
+	// azureDevOpsScope is the scope for the Azure DevOps API, which
+	// includes its git repositories.
+	azureDevOpsScope = "499b84ac-1321-427f-aa17-267ca6975798/.default"
+)
+
+// cloudEndpoints gives where to get credentials from. They are
+// variables so that tests can point them elsewhere.
+var cloudEndpoints = struct {
+	// awsSTS is formatted with the region.
+	awsSTS            string
+	gcpMetadataToken  string
+	gcpSTS            string
+	gcpIAMCredentials string
+	azureAuthority    string
+}{
+	awsSTS:            "https://sts.%s.amazonaws.com/",
+	gcpMetadataToken:  "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token",
+	gcpSTS:            "https://sts.googleapis.com/v1/token",
+	gcpIAMCredentials: "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken",
+	azureAuthority:    "https://login.microsoftonline.com/",
+}
+
+// cloudIdentityAuth gives auth options for the repository URL given,
+// with credentials got using the cloud identity the automation gives.
+func (r *ImageUpdateAutomationReconciler) cloudIdentityAuth(ctx context.Context, auto *imagev1.ImageUpdateAutomation, repoURL string) (*git.AuthOptions, error) {
+	identity := auto.Spec.GitSpec.Identity
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("a cloud identity can only be used with an https URL, not %q", repoURL)
+	}
+
+	client := &http.Client{Timeout: cloudIdentityTimeout}
+	var username, password string
+	switch identity.Provider {
+	case imagev1.CloudIdentityAWS:
+		if identity.RoleARN == "" {
+			return nil, fmt.Errorf("a role ARN must be given for an aws identity")
+		}
+		token, err := r.webIdentityToken(ctx, auto, awsTokenAudience, awsTokenFileEnv)
+		if err != nil {
+			return nil, err
+		}
+		username, password, err = codeCommitCredentials(ctx, client, u, identity.RoleARN, roleSessionName(auto), token, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	case imagev1.CloudIdentityGCP:
+		if identity.ServiceAccountEmail == "" {
+			return nil, fmt.Errorf("a service account email must be given for a gcp identity")
+		}
+		source, err := r.gcpSourceToken(ctx, client, auto)
+		if err != nil {
+			return nil, err
+		}
+		username = identity.ServiceAccountEmail
+		if password, err = gcpAccessToken(ctx, client, source, identity.ServiceAccountEmail); err != nil {
+			return nil, err
+		}
+	case imagev1.CloudIdentityAzure:
+		if identity.ClientID == "" || identity.TenantID == "" {
+			return nil, fmt.Errorf("a client ID and tenant ID must be given for an azure identity")
+		}
+		token, err := r.webIdentityToken(ctx, auto, azureTokenAudience, azureTokenFileEnv)
+		if err != nil {
+			return nil, err
+		}
+		// Azure DevOps takes the access token as the password, with
+		// any username
+		username = identity.ClientID
+		if password, err = azureAccessToken(ctx, client, identity.TenantID, identity.ClientID, token); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown cloud identity provider %q", identity.Provider)
+	}
+	return &git.AuthOptions{
+		Transport: git.HTTPS,
+		Host:      u.Host,
+		Username:  username,
+		Password:  password,
+	}, nil
+}
+
+// webIdentityToken gives a token for the automation's service account
+// with the audience given, or if it doesn't give a service account,
+// the controller's own token from the file named by the environment
+// variable given.
+func (r *ImageUpdateAutomationReconciler) webIdentityToken(ctx context.Context, auto *imagev1.ImageUpdateAutomation, audience, fileEnv string) (string, error) {
+	if auto.Spec.ServiceAccountName == "" {
+		if err := r.ownCloudIdentityAllowed(); err != nil {
+			return "", err
+		}
+		path := os.Getenv(fileEnv)
+		if path == "" {
+			return "", fmt.Errorf("no service account given, and %s is not set for the controller", fileEnv)
+		}
+		token, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+	return r.serviceAccountToken(ctx, auto, audience)
+}
+
+// ownCloudIdentityAllowed returns an error if automations that don't
+// give a service account may not use the controller's own cloud
+// identity; i.e., if tenants are kept apart, since any tenant could
+// otherwise act as whatever the controller can.
+func (r *ImageUpdateAutomationReconciler) ownCloudIdentityAllowed() error {
+	if r.noCrossNamespaceRefs {
+		return fmt.Errorf("a service account must be given to use a cloud identity, since tenants are kept apart")
+	}
+	return nil
+}
+
+// serviceAccountToken gives a token for the automation's service
+// account, with the audience given.
+func (r *ImageUpdateAutomationReconciler) serviceAccountToken(ctx context.Context, auto *imagev1.ImageUpdateAutomation, audience string) (string, error) {
+	if r.restConfig == nil {
+		return "", fmt.Errorf("unable to get a token for service account '%s': no client configuration", auto.Spec.ServiceAccountName)
+	}
+	clientset, err := kubernetes.NewForConfig(r.restConfig)
+	if err != nil {
+		return "", err
+	}
+	expiry := int64(time.Hour / time.Second)
+	request, err := clientset.CoreV1().ServiceAccounts(auto.GetNamespace()).CreateToken(ctx, auto.Spec.ServiceAccountName, &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences:         []string{audience},
+			ExpirationSeconds: &expiry,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("unable to get a token for service account '%s': %w", auto.Spec.ServiceAccountName, err)
+	}
+	return request.Status.Token, nil
+}
+
+// sessionNameInvalid matches the characters that can't be in the name
+// of a role session.
+var sessionNameInvalid = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// roleSessionName gives the name of the session in which the
+// automation given assumes a role, which shows up in AWS's logs.
+func roleSessionName(auto *imagev1.ImageUpdateAutomation) string {
+	name := sessionNameInvalid.ReplaceAllString(fmt.Sprintf("image-automation-%s-%s", auto.GetNamespace(), auto.GetName()), "-")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// codeCommitHost matches the host of a CodeCommit repository, and
+// picks out its region.
+var codeCommitHost = regexp.MustCompile(`^git-codecommit(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// codeCommitRegion gives the region of the CodeCommit host given.
+func codeCommitRegion(host string) (string, error) {
+	m := codeCommitHost.FindStringSubmatch(host)
+	if m == nil {
+		return "", fmt.Errorf("%q is not an AWS CodeCommit host", host)
+	}
+	return m[1], nil
+}
+
+// codeCommitCredentials assumes the role given with the web identity
+// token given, and gives the username and password with which to use
+// the role to get at the CodeCommit repository at the URL given. The
+// password is a signature of the request, as made by
+// git-remote-codecommit, so it's good for a limited time from now.
+func codeCommitCredentials(ctx context.Context, client *http.Client, u *url.URL, roleARN, sessionName, token string, now time.Time) (string, string, error) {
+	region, err := codeCommitRegion(u.Hostname())
+	if err != nil {
+		return "", "", err
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {token},
+	}
+	var response struct {
+		Credentials struct {
+			AccessKeyID     string `xml:"AccessKeyId"`
+			SecretAccessKey string `xml:"SecretAccessKey"`
+			SessionToken    string `xml:"SessionToken"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	err = postForm(ctx, client, fmt.Sprintf(cloudEndpoints.awsSTS, region), form, func(res *http.Response) error {
+		return xml.NewDecoder(res.Body).Decode(&response)
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("unable to assume role %s: %w", roleARN, err)
+	}
+	creds := response.Credentials
+
+	timestamp := now.UTC().Format("20060102T150405")
+	date := timestamp[:8]
+	canonicalRequest := fmt.Sprintf("GIT\n%s\n\nhost:%s\n\nhost\n", u.EscapedPath(), u.Hostname())
+	scope := fmt.Sprintf("%s/%s/codecommit/aws4_request", date, region)
+	stringToSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%s", timestamp, scope, sha256Hex(canonicalRequest))
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, "codecommit", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	username := creds.AccessKeyID
+	if creds.SessionToken != "" {
+		username += "%" + creds.SessionToken
+	}
+	return username, timestamp + "Z" + signature, nil
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// gcpSourceToken gives a Google access token with which to act as the
+// service account of a gcp identity. If the automation gives a
+// service account, it's got by exchanging a token for that service
+// account with the workload identity provider the controller is
+// configured with; otherwise, it's the controller's own, from the
+// metadata server.
+func (r *ImageUpdateAutomationReconciler) gcpSourceToken(ctx context.Context, client *http.Client, auto *imagev1.ImageUpdateAutomation) (string, error) {
+	if auto.Spec.ServiceAccountName == "" {
+		if err := r.ownCloudIdentityAllowed(); err != nil {
+			return "", err
+		}
+		return gcpMetadataToken(ctx, client)
+	}
+	provider := r.gcpWorkloadIdentityProvider
+	if provider == "" {
+		return "", fmt.Errorf("no workload identity provider is configured for the controller, with which to act as service account '%s'", auto.Spec.ServiceAccountName)
+	}
+	// the default audience of a workload identity provider is its
+	// name as a URL
+	token, err := r.serviceAccountToken(ctx, auto, "https:"+provider)
+	if err != nil {
+		return "", err
+	}
+	return gcpFederatedToken(ctx, client, provider, token)
+}
+
+// gcpMetadataToken gives the controller's own Google access token,
+// from the metadata server.
+func gcpMetadataToken(ctx context.Context, client *http.Client) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cloudEndpoints.gcpMetadataToken, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to get a token from the metadata server: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to get a token from the metadata server: %s", res.Status)
+	}
+	var own struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&own); err != nil {
+		return "", err
+	}
+	return own.AccessToken, nil
+}
+
+// gcpFederatedToken exchanges the Kubernetes service account token
+// given for a federated Google access token, with the workload
+// identity provider given (e.g.,
+// //iam.googleapis.com/projects/<number>/locations/global/workloadIdentityPools/<pool>/providers/<provider>).
+func gcpFederatedToken(ctx context.Context, client *http.Client, provider, token string) (string, error) {
+	form := url.Values{
+		"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"audience":             {provider},
+		"scope":                {"https://www.googleapis.com/auth/cloud-platform"},
+		"requested_token_type": {"urn:ietf:params:oauth:token-type:access_token"},
+		"subject_token_type":   {"urn:ietf:params:oauth:token-type:jwt"},
+		"subject_token":        {token},
+	}
+	var response struct {
+		AccessToken string `json:"access_token"`
+	}
+	err := postForm(ctx, client, cloudEndpoints.gcpSTS, form, func(res *http.Response) error {
+		return json.NewDecoder(res.Body).Decode(&response)
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to exchange the service account token with %s: %w", provider, err)
+	}
+	return response.AccessToken, nil
+}
+
+// gcpAccessToken gives an access token for the Google service account
+// given, got with the Google access token given.
+func gcpAccessToken(ctx context.Context, client *http.Client, source, email string) (string, error) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+source)
+	body := map[string]interface{}{
+		"scope": []string{"https://www.googleapis.com/auth/cloud-platform"},
+	}
+	var token struct {
+		AccessToken string `json:"accessToken"`
+	}
+	if err := exchangeJSON(ctx, client, fmt.Sprintf(cloudEndpoints.gcpIAMCredentials, url.PathEscape(email)), header, body, &token); err != nil {
+		return "", fmt.Errorf("unable to act as service account %s: %w", email, err)
+	}
+	return token.AccessToken, nil
+}
+
+// azureAccessToken gives an access token for Azure DevOps, for the
+// application given, by exchanging the federated token given.
+func azureAccessToken(ctx context.Context, client *http.Client, tenantID, clientID, token string) (string, error) {
+	authority := os.Getenv(azureAuthorityEnv)
+	if authority == "" {
+		authority = cloudEndpoints.azureAuthority
+	}
+	address := strings.TrimSuffix(authority, "/") + "/" + url.PathEscape(tenantID) + "/oauth2/v2.0/token"
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {clientID},
+		"scope":                 {azureDevOpsScope},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {token},
+	}
+	var response struct {
+		AccessToken string `json:"access_token"`
+	}
+	err := postForm(ctx, client, address, form, func(res *http.Response) error {
+		return json.NewDecoder(res.Body).Decode(&response)
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to act as application %s: %w", clientID, err)
+	}
+	return response.AccessToken, nil
+}
+
+// postForm POSTs the form given to a URL, checks that the response is
+// a success, and has it decoded with the function given.
+func postForm(ctx context.Context, client *http.Client, address string, form url.Values, decode func(*http.Response) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with status %s", address, res.Status)
+	}
+	return decode(res)
+}
@@ -0,0 +1,301 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestCodeCommitRegion(t *testing.T) {
+	for host, expected := range map[string]string{
+		"git-codecommit.eu-west-1.amazonaws.com":      "eu-west-1",
+		"git-codecommit-fips.us-east-2.amazonaws.com": "us-east-2",
+		"git-codecommit.cn-north-1.amazonaws.com.cn":  "cn-north-1",
+		"github.com": "",
+		"git-codecommit.eu-west-1.amazonaws.com.example": "",
+	} {
+		region, err := codeCommitRegion(host)
+		if region != expected || (err == nil) != (expected != "") {
+			t.Errorf("expected region %q for %s, got %q, %v", expected, host, region, err)
+		}
+	}
+}
+
+func TestRoleSessionName(t *testing.T) {
+	auto := &imagev1.ImageUpdateAutomation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "podinfo:latest"},
+	}
+	if name := roleSessionName(auto); name != "image-automation-apps-podinfo-latest" {
+		t.Errorf("expected characters not allowed to be replaced, got %q", name)
+	}
+	auto.Name = "a-very-long-name-for-an-automation-that-goes-on-and-on-and-on"
+	if name := roleSessionName(auto); len(name) != 64 {
+		t.Errorf("expected the name to be cut to 64 characters, got %q", name)
+	}
+}
+
+func TestCodeCommitCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/eu-west-1" || r.FormValue("Action") != "AssumeRoleWithWebIdentity" ||
+			r.FormValue("RoleArn") != "arn:aws:iam::123456789012:role/automation" || r.FormValue("WebIdentityToken") != "jwt" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>AKIA</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>session</SessionToken>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer server.Close()
+	defer func(endpoint string) { cloudEndpoints.awsSTS = endpoint }(cloudEndpoints.awsSTS)
+	cloudEndpoints.awsSTS = server.URL + "/%s"
+
+	u, _ := url.Parse("https://git-codecommit.eu-west-1.amazonaws.com/v1/repos/podinfo")
+	now := time.Date(2021, 10, 20, 12, 0, 0, 0, time.UTC)
+	username, password, err := codeCommitCredentials(context.TODO(), server.Client(), u, "arn:aws:iam::123456789012:role/automation", "session", "jwt", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "AKIA%session" {
+		t.Errorf("expected the access key and session token as the username, got %q", username)
+	}
+	if expected := "20211020T120000Z4059364b7493df56b082fc556792453c35bc38d9c798b10344a420283930e5f4"; password != expected {
+		t.Errorf("expected the signed request as the password, got %q", password)
+	}
+
+	other, _ := url.Parse("https://github.com/org/repo")
+	if _, _, err := codeCommitCredentials(context.TODO(), server.Client(), other, "arn", "session", "jwt", now); err == nil {
+		t.Error("expected an error for a repository not in CodeCommit")
+	}
+}
+
+func TestGCPAccessToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/metadata" && r.Header.Get("Metadata-Flavor") == "Google":
+			json.NewEncoder(w).Encode(map[string]string{"access_token": "controller"})
+		case r.URL.Path == "/iam/automation@project.iam.gserviceaccount.com" && r.Header.Get("Authorization") == "Bearer controller":
+			json.NewEncoder(w).Encode(map[string]string{"accessToken": "automation"})
+		default:
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	defer func(metadata, iam string) {
+		cloudEndpoints.gcpMetadataToken, cloudEndpoints.gcpIAMCredentials = metadata, iam
+	}(cloudEndpoints.gcpMetadataToken, cloudEndpoints.gcpIAMCredentials)
+	cloudEndpoints.gcpMetadataToken = server.URL + "/metadata"
+	cloudEndpoints.gcpIAMCredentials = server.URL + "/iam/%s"
+
+	source, err := gcpMetadataToken(context.TODO(), server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := gcpAccessToken(context.TODO(), server.Client(), source, "automation@project.iam.gserviceaccount.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "automation" {
+		t.Errorf("expected a token for the service account, got %q", token)
+	}
+}
+
+// TestGCPIdentityForTenant checks that an automation can only act as
+// the Google service accounts its own service account is bound to.
+func TestGCPIdentityForTenant(t *testing.T) {
+	const provider = "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/cluster/providers/cluster"
+	// each tenant's service account may act as the tenant's Google
+	// service account; the controller may act as any
+	bindings := map[string]string{
+		"Bearer federated-system:serviceaccount:tenant-a:automation": "tenant-a@project.iam.gserviceaccount.com",
+		"Bearer federated-system:serviceaccount:tenant-b:automation": "tenant-b@project.iam.gserviceaccount.com",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/"):
+			// a TokenRequest, answered with a token naming the
+			// service account, if it's for the provider
+			parts := strings.Split(r.URL.Path, "/")
+			var request struct {
+				Spec struct {
+					Audiences []string `json:"audiences"`
+				} `json:"spec"`
+			}
+			json.NewDecoder(r.Body).Decode(&request)
+			if len(parts) != 8 || len(request.Spec.Audiences) != 1 || request.Spec.Audiences[0] != "https:"+provider {
+				http.Error(w, "unexpected request", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"apiVersion": "authentication.k8s.io/v1",
+				"kind":       "TokenRequest",
+				"status":     map[string]string{"token": fmt.Sprintf("system:serviceaccount:%s:%s", parts[4], parts[6])},
+			})
+		case r.URL.Path == "/sts" && r.FormValue("audience") == provider:
+			json.NewEncoder(w).Encode(map[string]string{"access_token": "federated-" + r.FormValue("subject_token")})
+		case r.URL.Path == "/metadata":
+			json.NewEncoder(w).Encode(map[string]string{"access_token": "controller"})
+		case strings.HasPrefix(r.URL.Path, "/iam/"):
+			auth := r.Header.Get("Authorization")
+			email := strings.TrimPrefix(r.URL.Path, "/iam/")
+			if auth != "Bearer controller" && bindings[auth] != email {
+				http.Error(w, "permission denied", http.StatusForbidden)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"accessToken": "token-for-" + email})
+		default:
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	defer func(metadata, sts, iam string) {
+		cloudEndpoints.gcpMetadataToken, cloudEndpoints.gcpSTS, cloudEndpoints.gcpIAMCredentials = metadata, sts, iam
+	}(cloudEndpoints.gcpMetadataToken, cloudEndpoints.gcpSTS, cloudEndpoints.gcpIAMCredentials)
+	cloudEndpoints.gcpMetadataToken = server.URL + "/metadata"
+	cloudEndpoints.gcpSTS = server.URL + "/sts"
+	cloudEndpoints.gcpIAMCredentials = server.URL + "/iam/%s"
+
+	r := &ImageUpdateAutomationReconciler{
+		restConfig:                  &rest.Config{Host: server.URL},
+		gcpWorkloadIdentityProvider: provider,
+	}
+	automation := func(namespace, serviceAccount, email string) *imagev1.ImageUpdateAutomation {
+		auto := &imagev1.ImageUpdateAutomation{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "podinfo"}}
+		auto.Spec.ServiceAccountName = serviceAccount
+		auto.Spec.GitSpec = &imagev1.GitSpec{
+			Identity: &imagev1.CloudIdentity{Provider: imagev1.CloudIdentityGCP, ServiceAccountEmail: email},
+		}
+		return auto
+	}
+	const repoURL = "https://source.developers.google.com/p/project/r/repo"
+
+	auth, err := r.cloudIdentityAuth(context.TODO(), automation("tenant-a", "automation", "tenant-a@project.iam.gserviceaccount.com"), repoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Password != "token-for-tenant-a@project.iam.gserviceaccount.com" {
+		t.Errorf("expected a token for tenant A's service account, got %q", auth.Password)
+	}
+	if _, err := r.cloudIdentityAuth(context.TODO(), automation("tenant-a", "automation", "tenant-b@project.iam.gserviceaccount.com"), repoURL); err == nil {
+		t.Error("expected tenant A to be refused tenant B's service account")
+	}
+
+	// without a service account, the controller's own identity is
+	// used, unless tenants are kept apart
+	if _, err := r.cloudIdentityAuth(context.TODO(), automation("tenant-a", "", "tenant-b@project.iam.gserviceaccount.com"), repoURL); err != nil {
+		t.Errorf("expected the controller's own identity to be used, got %v", err)
+	}
+	r.noCrossNamespaceRefs = true
+	if _, err := r.cloudIdentityAuth(context.TODO(), automation("tenant-a", "", "tenant-b@project.iam.gserviceaccount.com"), repoURL); err == nil {
+		t.Error("expected the controller's own identity to be refused when tenants are kept apart")
+	}
+
+	r.gcpWorkloadIdentityProvider = ""
+	if _, err := r.cloudIdentityAuth(context.TODO(), automation("tenant-a", "automation", "tenant-a@project.iam.gserviceaccount.com"), repoURL); err == nil {
+		t.Error("expected an error without a workload identity provider")
+	}
+}
+
+func TestAzureAccessToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tenant/oauth2/v2.0/token" || r.FormValue("client_id") != "client" ||
+			r.FormValue("client_assertion") != "jwt" || r.FormValue("scope") != azureDevOpsScope {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "automation"})
+	}))
+	defer server.Close()
+	defer func(authority string) { cloudEndpoints.azureAuthority = authority }(cloudEndpoints.azureAuthority)
+	cloudEndpoints.azureAuthority = server.URL
+
+	token, err := azureAccessToken(context.TODO(), server.Client(), "tenant", "client", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "automation" {
+		t.Errorf("expected a token for the application, got %q", token)
+	}
+	if _, err := azureAccessToken(context.TODO(), server.Client(), "tenant", "other", "jwt"); err == nil {
+		t.Error("expected an error when the token is refused")
+	}
+}
+
+func TestWebIdentityTokenFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("jwt\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r := &ImageUpdateAutomationReconciler{}
+	auto := &imagev1.ImageUpdateAutomation{}
+	if _, err := r.webIdentityToken(context.TODO(), auto, awsTokenAudience, "IMAGE_AUTOMATION_TEST_TOKEN_FILE"); err == nil {
+		t.Error("expected an error without a token file")
+	}
+	os.Setenv("IMAGE_AUTOMATION_TEST_TOKEN_FILE", path)
+	defer os.Unsetenv("IMAGE_AUTOMATION_TEST_TOKEN_FILE")
+	token, err := r.webIdentityToken(context.TODO(), auto, awsTokenAudience, "IMAGE_AUTOMATION_TEST_TOKEN_FILE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "jwt" {
+		t.Errorf("expected the controller's own token, got %q", token)
+	}
+	r.noCrossNamespaceRefs = true
+	if _, err := r.webIdentityToken(context.TODO(), auto, awsTokenAudience, "IMAGE_AUTOMATION_TEST_TOKEN_FILE"); err == nil {
+		t.Error("expected the controller's own token to be refused when tenants are kept apart")
+	}
+
+	auto.Spec.ServiceAccountName = "automation"
+	if _, err := r.webIdentityToken(context.TODO(), auto, awsTokenAudience, "IMAGE_AUTOMATION_TEST_TOKEN_FILE"); err == nil {
+		t.Error("expected an error getting a token for a service account with no client configuration")
+	}
+}
+
+func TestCloudIdentityAuth(t *testing.T) {
+	r := &ImageUpdateAutomationReconciler{}
+	auto := &imagev1.ImageUpdateAutomation{}
+	auto.Spec.GitSpec = &imagev1.GitSpec{
+		Identity: &imagev1.CloudIdentity{Provider: imagev1.CloudIdentityGCP},
+	}
+	if _, err := r.cloudIdentityAuth(context.TODO(), auto, "ssh://git@github.com/org/repo"); err == nil {
+		t.Error("expected an error for an ssh URL")
+	}
+	if _, err := r.cloudIdentityAuth(context.TODO(), auto, "https://source.developers.google.com/p/project/r/repo"); err == nil {
+		t.Error("expected an error for a gcp identity without a service account email")
+	}
+}
@@ -0,0 +1,303 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// An automation with .spec.cluster applies updates directly to objects
+// in the cluster, rather than committing them to git: it sets
+// variables in the post-build substitutions of Kustomizations, and the
+// container images of workloads, from the latest images of image
+// policies. Nothing is cloned or pushed, so the fields to do with git
+// don't apply. A policy without a latest image is skipped, as it is
+// when updating files.
+
+// clusterUpdates records what applying updates to the cluster did.
+type clusterUpdates struct {
+	// objects lists the objects updated, as "<kind>/<name>"
+	objects []string
+	// images lists the values changed
+	images []imagev1.ImageUpdate
+	// policies lists the names of the image policies referred to,
+	// whether or not they exist or have an image
+	policies []string
+}
+
+// applyToCluster updates the objects the automation given targets in
+// the cluster, with the latest images of the policies that runs, and
+// records what it updated. A dry run records what it would update,
+// without updating anything.
+func (r *ImageUpdateAutomationReconciler) applyToCluster(ctx context.Context, auto *imagev1.ImageUpdateAutomation, runs func(policy string) bool, dryRun bool) (clusterUpdates, error) {
+	var result clusterUpdates
+	target := auto.Spec.Cluster
+	namespace := auto.GetNamespace()
+
+	referenced := make(map[string]bool)
+	latest := make(map[string]string)
+	latestImage := func(policyName string) (string, error) {
+		if image, ok := latest[policyName]; ok {
+			return image, nil
+		}
+		referenced[policyName] = true
+		var image string
+		if runs(policyName) {
+			policy, err := r.getPolicy(ctx, types.NamespacedName{Namespace: namespace, Name: policyName})
+			if err != nil {
+				return "", err
+			}
+			if policy != nil {
+				image = policy.Status.LatestImage
+			}
+		}
+		latest[policyName] = image
+		return image, nil
+	}
+	seen := make(map[imagev1.ImageUpdate]bool)
+	record := func(policyName, oldValue, newValue string) {
+		u := imagev1.ImageUpdate{
+			Policy:   meta.NamespacedObjectReference{Namespace: namespace, Name: policyName},
+			OldValue: oldValue,
+			NewValue: newValue,
+		}
+		if !seen[u] {
+			seen[u] = true
+			result.images = append(result.images, u)
+		}
+	}
+
+	// the substitutions are grouped by Kustomization, so each is
+	// patched once
+	var kustomizations []string
+	substitutions := make(map[string][]imagev1.SubstitutionTarget)
+	for _, sub := range target.Substitutions {
+		ks := sub.KustomizationRef.Name
+		if _, ok := substitutions[ks]; !ok {
+			kustomizations = append(kustomizations, ks)
+		}
+		substitutions[ks] = append(substitutions[ks], sub)
+	}
+	for _, ks := range kustomizations {
+		var obj unstructured.Unstructured
+		obj.SetAPIVersion(dependencyAPIVersions["Kustomization"])
+		obj.SetKind("Kustomization")
+		if err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ks}, &obj); err != nil {
+			return result, fmt.Errorf("unable to get Kustomization '%s': %w", ks, err)
+		}
+		vars, _, err := unstructured.NestedStringMap(obj.Object, "spec", "postBuild", "substitute")
+		if err != nil {
+			return result, fmt.Errorf("unable to read the substitutions of Kustomization '%s': %w", ks, err)
+		}
+		if vars == nil {
+			vars = make(map[string]string)
+		}
+		var changed bool
+		for _, sub := range substitutions[ks] {
+			image, err := latestImage(sub.Policy)
+			if err != nil {
+				return result, err
+			}
+			if image == "" {
+				continue
+			}
+			value, err := substitutionValue(image, sub.Value)
+			if err != nil {
+				return result, fmt.Errorf("unable to set variable %s of Kustomization '%s': %w", sub.Variable, ks, err)
+			}
+			if vars[sub.Variable] != value {
+				record(sub.Policy, vars[sub.Variable], value)
+				vars[sub.Variable] = value
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		result.objects = append(result.objects, "Kustomization/"+ks)
+		if dryRun {
+			continue
+		}
+		patch := client.MergeFrom(obj.DeepCopy())
+		if err := unstructured.SetNestedStringMap(obj.Object, vars, "spec", "postBuild", "substitute"); err != nil {
+			return result, err
+		}
+		if err := r.Patch(ctx, &obj, patch); err != nil {
+			return result, fmt.Errorf("unable to update the substitutions of Kustomization '%s': %w", ks, err)
+		}
+	}
+
+	if target.WorkloadSelector != nil {
+		workloads, err := r.selectWorkloads(ctx, namespace, target.WorkloadSelector)
+		if err != nil {
+			return result, err
+		}
+		for _, w := range workloads {
+			containerPolicies, err := parseWorkloadPolicies(w.obj.GetAnnotations()[imagev1.WorkloadPoliciesAnnotation])
+			if err != nil {
+				return result, fmt.Errorf("%s '%s': %w", w.kind, w.obj.GetName(), err)
+			}
+			patch := client.MergeFrom(w.obj.DeepCopyObject().(client.Object))
+			var changed bool
+			for _, containers := range [][]corev1.Container{w.template.Spec.InitContainers, w.template.Spec.Containers} {
+				for i := range containers {
+					policyName, ok := containerPolicies[containers[i].Name]
+					if !ok {
+						continue
+					}
+					image, err := latestImage(policyName)
+					if err != nil {
+						return result, err
+					}
+					if image != "" && containers[i].Image != image {
+						record(policyName, containers[i].Image, image)
+						containers[i].Image = image
+						changed = true
+					}
+				}
+			}
+			if !changed {
+				continue
+			}
+			result.objects = append(result.objects, w.kind+"/"+w.obj.GetName())
+			if dryRun {
+				continue
+			}
+			if err := r.Patch(ctx, w.obj, patch); err != nil {
+				return result, fmt.Errorf("unable to update the images of %s '%s': %w", w.kind, w.obj.GetName(), err)
+			}
+		}
+	}
+
+	for policyName := range referenced {
+		result.policies = append(result.policies, policyName)
+	}
+	sort.Strings(result.policies)
+	return result, nil
+}
+
+// workload is a Deployment, StatefulSet or DaemonSet, with its pod
+// template.
+type workload struct {
+	kind     string
+	obj      client.Object
+	template *corev1.PodTemplateSpec
+}
+
+// selectWorkloads gives the workloads in the namespace given that the
+// selector given selects, in order of kind then name.
+func (r *ImageUpdateAutomationReconciler) selectWorkloads(ctx context.Context, namespace string, labelSelector *metav1.LabelSelector) ([]workload, error) {
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid workload selector: %w", err)
+	}
+	opts := []client.ListOption{client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector}}
+
+	var workloads []workload
+	var deployments appsv1.DeploymentList
+	if err := r.List(ctx, &deployments, opts...); err != nil {
+		return nil, fmt.Errorf("unable to list Deployments: %w", err)
+	}
+	for i := range deployments.Items {
+		workloads = append(workloads, workload{"Deployment", &deployments.Items[i], &deployments.Items[i].Spec.Template})
+	}
+	var statefulSets appsv1.StatefulSetList
+	if err := r.List(ctx, &statefulSets, opts...); err != nil {
+		return nil, fmt.Errorf("unable to list StatefulSets: %w", err)
+	}
+	for i := range statefulSets.Items {
+		workloads = append(workloads, workload{"StatefulSet", &statefulSets.Items[i], &statefulSets.Items[i].Spec.Template})
+	}
+	var daemonSets appsv1.DaemonSetList
+	if err := r.List(ctx, &daemonSets, opts...); err != nil {
+		return nil, fmt.Errorf("unable to list DaemonSets: %w", err)
+	}
+	for i := range daemonSets.Items {
+		workloads = append(workloads, workload{"DaemonSet", &daemonSets.Items[i], &daemonSets.Items[i].Spec.Template})
+	}
+	return workloads, nil
+}
+
+// parseWorkloadPolicies parses the value of the annotation saying
+// which image policy is for which container of a workload, giving the
+// policy name for each container name.
+func parseWorkloadPolicies(annotation string) (map[string]string, error) {
+	policies := make(map[string]string)
+	for _, entry := range strings.Split(annotation, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid entry %q in annotation %s; expected <container>=<policy>", entry, imagev1.WorkloadPoliciesAnnotation)
+		}
+		policies[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	if len(policies) == 0 {
+		return nil, fmt.Errorf("annotation %s is missing or empty", imagev1.WorkloadPoliciesAnnotation)
+	}
+	return policies, nil
+}
+
+// substitutionValue gives the part of the image given that a variable
+// is set to.
+func substitutionValue(image string, value imagev1.SubstitutionValue) (string, error) {
+	if value == "" || value == imagev1.SubstituteImage {
+		return image, nil
+	}
+	ref, err := name.ParseReference(image, name.WeakValidation)
+	if err != nil {
+		return "", err
+	}
+	tag := ref.Identifier()
+	switch value {
+	case imagev1.SubstituteName:
+		return strings.TrimSuffix(strings.TrimSuffix(image, ":"+tag), "@"+tag), nil
+	case imagev1.SubstituteTag:
+		return tag, nil
+	}
+	return "", fmt.Errorf("unsupported substitution value %q", value)
+}
+
+// clusterStatusMessage gives the message for the Ready condition after
+// applying the updates given to the cluster.
+func clusterStatusMessage(updates clusterUpdates, dryRun bool) string {
+	if len(updates.objects) == 0 {
+		return "no updates made"
+	}
+	verb := "updated"
+	if dryRun {
+		verb = "dry run: would have updated"
+	}
+	return fmt.Sprintf("%s %s in the cluster", verb, strings.Join(updates.objects, ", "))
+}
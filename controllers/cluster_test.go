@@ -0,0 +1,189 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	imagev1_reflect "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+	"github.com/fluxcd/pkg/apis/meta"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestSubstitutionValue(t *testing.T) {
+	for _, c := range []struct {
+		image    string
+		value    imagev1.SubstitutionValue
+		expected string
+	}{
+		{"ghcr.io/stefanprodan/podinfo:5.0.1", "", "ghcr.io/stefanprodan/podinfo:5.0.1"},
+		{"ghcr.io/stefanprodan/podinfo:5.0.1", imagev1.SubstituteName, "ghcr.io/stefanprodan/podinfo"},
+		{"ghcr.io/stefanprodan/podinfo:5.0.1", imagev1.SubstituteTag, "5.0.1"},
+		{"localhost:5000/podinfo:5.0.1", imagev1.SubstituteName, "localhost:5000/podinfo"},
+	} {
+		value, err := substitutionValue(c.image, c.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != c.expected {
+			t.Errorf("expected %s of %s to be %q, got %q", c.value, c.image, c.expected, value)
+		}
+	}
+}
+
+func TestParseWorkloadPolicies(t *testing.T) {
+	policies, err := parseWorkloadPolicies("app=podinfo, proxy = envoy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"app": "podinfo", "proxy": "envoy"}; !reflect.DeepEqual(policies, expected) {
+		t.Errorf("expected %v, got %v", expected, policies)
+	}
+	for _, annotation := range []string{"", "app", "app=", "=podinfo"} {
+		if _, err := parseWorkloadPolicies(annotation); err == nil {
+			t.Errorf("expected an error for annotation %q", annotation)
+		}
+	}
+}
+
+func TestApplyToCluster(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := imagev1_reflect.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := &imagev1_reflect.ImagePolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "podinfo"},
+	}
+	policy.Status.LatestImage = "ghcr.io/stefanprodan/podinfo:5.0.1"
+	ks := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"postBuild": map[string]interface{}{
+				"substitute": map[string]interface{}{
+					"podinfo_tag": "5.0.0",
+					"cluster":     "staging",
+				},
+			},
+		},
+	}}
+	ks.SetAPIVersion(dependencyAPIVersions["Kustomization"])
+	ks.SetKind("Kustomization")
+	ks.SetNamespace("apps")
+	ks.SetName("podinfo")
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "apps",
+			Name:        "podinfo",
+			Labels:      map[string]string{"app": "podinfo"},
+			Annotations: map[string]string{imagev1.WorkloadPoliciesAnnotation: "app=podinfo"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "app", Image: "ghcr.io/stefanprodan/podinfo:5.0.0"},
+						{Name: "proxy", Image: "envoyproxy/envoy:v1.18.3"},
+					},
+				},
+			},
+		},
+	}
+	r := &ImageUpdateAutomationReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(policy, ks, deployment).Build(),
+	}
+
+	var auto imagev1.ImageUpdateAutomation
+	auto.Namespace = "apps"
+	auto.Name = "podinfo"
+	auto.Spec.Cluster = &imagev1.ClusterTargetSpec{
+		Substitutions: []imagev1.SubstitutionTarget{
+			{KustomizationRef: meta.LocalObjectReference{Name: "podinfo"}, Variable: "podinfo_tag", Policy: "podinfo", Value: imagev1.SubstituteTag},
+			{KustomizationRef: meta.LocalObjectReference{Name: "podinfo"}, Variable: "sidecar", Policy: "missing"},
+		},
+		WorkloadSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "podinfo"}},
+	}
+	runsAll := func(string) bool { return true }
+
+	updates, err := r.applyToCluster(context.TODO(), &auto, runsAll, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"Kustomization/podinfo", "Deployment/podinfo"}; !reflect.DeepEqual(updates.objects, expected) {
+		t.Errorf("expected a dry run to report updating %v, got %v", expected, updates.objects)
+	}
+	if expected := []string{"missing", "podinfo"}; !reflect.DeepEqual(updates.policies, expected) {
+		t.Errorf("expected policies %v to be referenced, got %v", expected, updates.policies)
+	}
+	var found appsv1.Deployment
+	if err := r.Get(context.TODO(), types.NamespacedName{Namespace: "apps", Name: "podinfo"}, &found); err != nil {
+		t.Fatal(err)
+	}
+	if image := found.Spec.Template.Spec.Containers[0].Image; image != "ghcr.io/stefanprodan/podinfo:5.0.0" {
+		t.Errorf("expected a dry run to leave the deployment alone, got image %s", image)
+	}
+
+	updates, err = r.applyToCluster(context.TODO(), &auto, runsAll, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []imagev1.ImageUpdate{
+		{Policy: meta.NamespacedObjectReference{Namespace: "apps", Name: "podinfo"}, OldValue: "5.0.0", NewValue: "5.0.1"},
+		{Policy: meta.NamespacedObjectReference{Namespace: "apps", Name: "podinfo"}, OldValue: "ghcr.io/stefanprodan/podinfo:5.0.0", NewValue: "ghcr.io/stefanprodan/podinfo:5.0.1"},
+	}
+	if !reflect.DeepEqual(updates.images, expected) {
+		t.Errorf("expected updates %v, got %v", expected, updates.images)
+	}
+	if err := r.Get(context.TODO(), types.NamespacedName{Namespace: "apps", Name: "podinfo"}, &found); err != nil {
+		t.Fatal(err)
+	}
+	if containers := found.Spec.Template.Spec.Containers; containers[0].Image != "ghcr.io/stefanprodan/podinfo:5.0.1" || containers[1].Image != "envoyproxy/envoy:v1.18.3" {
+		t.Errorf("expected only the app container to be updated, got %v", containers)
+	}
+	var foundKs unstructured.Unstructured
+	foundKs.SetAPIVersion(dependencyAPIVersions["Kustomization"])
+	foundKs.SetKind("Kustomization")
+	if err := r.Get(context.TODO(), types.NamespacedName{Namespace: "apps", Name: "podinfo"}, &foundKs); err != nil {
+		t.Fatal(err)
+	}
+	vars, _, _ := unstructured.NestedStringMap(foundKs.Object, "spec", "postBuild", "substitute")
+	if expected := map[string]string{"podinfo_tag": "5.0.1", "cluster": "staging"}; !reflect.DeepEqual(vars, expected) {
+		t.Errorf("expected substitutions %v, got %v", expected, vars)
+	}
+
+	updates, err = r.applyToCluster(context.TODO(), &auto, runsAll, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates.objects) != 0 {
+		t.Errorf("expected nothing more to update, got %v", updates.objects)
+	}
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// Automations that use the same GitRepository, and have the same
+// .spec.git (so they check out, commit and push in the same way), are
+// run together when coalescing is turned on: the run of any one of
+// them makes the updates of all of them, in a single commit.
+//
+// A run first waits for a short window, so that the runs of the
+// other automations, when set off by the same change (e.g., a new
+// image, which changes several policies), find the repository busy
+// and are put off (see repolock.go). Those runs then find they've been
+// served by a run that started after they were first due, and finish
+// without cloning.
+
+// coalescer records which automation runs have been served by the
+// run of another automation.
+type coalescer struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	served map[types.NamespacedName]servedRun
+	// putOff holds when the first run put off of each automation was
+	// due.
+	putOff map[types.NamespacedName]time.Time
+}
+
+// servedRun records a run made on behalf of an automation.
+type servedRun struct {
+	// by is the automation that made the run
+	by types.NamespacedName
+	// start is when the run started; it saw the state of the
+	// policies and of the repository as they were then, or later
+	start time.Time
+	// message is the status message of the run
+	message string
+}
+
+// newCoalescer creates a coalescer that waits for the window given
+// before each run. If the window is zero or less, automations are not
+// coalesced, and the coalescer returned is nil (which is ready to
+// use).
+func newCoalescer(window time.Duration) *coalescer {
+	if window <= 0 {
+		return nil
+	}
+	return &coalescer{
+		window: window,
+		served: make(map[types.NamespacedName]servedRun),
+		putOff: make(map[types.NamespacedName]time.Time),
+	}
+}
+
+// wait waits for the coalescing window to pass, or the context to be
+// done.
+func (c *coalescer) wait(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	timer := time.NewTimer(c.window)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// servedSince gives the run made on behalf of the automation, if it
+// started after the time given; i.e., if it has done everything a run
+// of the automation due at that time would do.
+func (c *coalescer) servedSince(name types.NamespacedName, due time.Time) (servedRun, bool) {
+	if c == nil {
+		return servedRun{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	run, ok := c.served[name]
+	if !ok || !run.start.After(due) {
+		return servedRun{}, false
+	}
+	return run, true
+}
+
+// putOffRun records that the run of the automation due at the time
+// given was put off, e.g., because its repository was busy, unless an
+// earlier run already was.
+func (c *coalescer) putOffRun(name types.NamespacedName, due time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if first, ok := c.putOff[name]; !ok || due.Before(first) {
+		c.putOff[name] = due
+	}
+}
+
+// due gives when the run of the automation being made at the time
+// given was first due: then, or when the first run put off was due.
+// The runs put off are forgotten, since this run takes their place.
+func (c *coalescer) due(name types.NamespacedName, now time.Time) time.Time {
+	if c == nil {
+		return now
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if first, ok := c.putOff[name]; ok {
+		delete(c.putOff, name)
+		return first
+	}
+	return now
+}
+
+// markServed records a run made on behalf of the automations given.
+func (c *coalescer) markServed(names []types.NamespacedName, run servedRun) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range names {
+		c.served[name] = run
+	}
+}
+
+// forget drops the record for an automation, e.g., once it's deleted.
+func (c *coalescer) forget(name types.NamespacedName) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.served, name)
+	delete(c.putOff, name)
+}
+
+// coalescable reports whether the automation other can be run along
+// with auto.
+func coalescable(auto, other *imagev1.ImageUpdateAutomation) bool {
+	return other.GetNamespace() == auto.GetNamespace() &&
+		other.GetName() != auto.GetName() &&
+		!other.Spec.Suspend &&
+		// an automation with dependencies must wait for them, so it
+		// can't be run at another automation's convenience
+		len(other.Spec.DependsOn) == 0 &&
+		// the updates of an automation requiring approval are
+		// approved by themselves
+		!other.Spec.RequireApproval &&
+		// an automation updating the cluster has no commit to share
+		other.Spec.Cluster == nil && auto.Spec.Cluster == nil &&
+		other.Spec.SourceRef == auto.Spec.SourceRef &&
+		other.Spec.DryRun == auto.Spec.DryRun &&
+		// what's read for the run is read as one service account
+		other.Spec.ServiceAccountName == auto.Spec.ServiceAccountName &&
+		// another shard may be led by another controller
+		shardKey(other) == shardKey(auto) &&
+		other.Spec.Update != nil && other.Spec.Update.Strategy == imagev1.UpdateStrategySetters &&
+		// a promotion keeps track of its own stages
+		len(other.Spec.Update.Stages) == 0 &&
+		equality.Semantic.DeepEqual(other.Spec.GitSpec, auto.Spec.GitSpec)
+}
+
+// coalescedAutomations gives the automations that can be run along
+// with the automation given, in order of name.
+func (r *ImageUpdateAutomationReconciler) coalescedAutomations(ctx context.Context, auto *imagev1.ImageUpdateAutomation) ([]imagev1.ImageUpdateAutomation, error) {
+	// a preview (of a suspended automation), a promotion, or updates
+	// waiting for approval, is only of its own updates
+	if r.coalescer == nil || auto.Spec.Suspend || auto.Spec.RequireApproval || auto.Spec.Update == nil ||
+		auto.Spec.Update.Strategy != imagev1.UpdateStrategySetters || len(auto.Spec.Update.Stages) > 0 {
+		return nil, nil
+	}
+	var autos imagev1.ImageUpdateAutomationList
+	if err := r.List(ctx, &autos, client.InNamespace(auto.GetNamespace())); err != nil {
+		return nil, err
+	}
+	var coalesced []imagev1.ImageUpdateAutomation
+	for i := range autos.Items {
+		if coalescable(auto, &autos.Items[i]) {
+			coalesced = append(coalesced, autos.Items[i])
+		}
+	}
+	sort.Slice(coalesced, func(i, j int) bool {
+		return coalesced[i].GetName() < coalesced[j].GetName()
+	})
+	return coalesced, nil
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestCoalescedAutomations(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := imagev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	gitSpec := func(branch string) *imagev1.GitSpec {
+		return &imagev1.GitSpec{
+			Push:   &imagev1.PushSpec{Branch: branch},
+			Commit: imagev1.CommitSpec{Author: imagev1.CommitUser{Email: "flux@example.com"}},
+		}
+	}
+	automation := func(name, repo string, git *imagev1.GitSpec, mutate ...func(*imagev1.ImageUpdateAutomation)) *imagev1.ImageUpdateAutomation {
+		auto := &imagev1.ImageUpdateAutomation{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: name},
+			Spec: imagev1.ImageUpdateAutomationSpec{
+				SourceRef: imagev1.SourceReference{Kind: sourcev1.GitRepositoryKind, Name: repo},
+				GitSpec:   git,
+				Update:    &imagev1.UpdateStrategy{Strategy: imagev1.UpdateStrategySetters, Path: "./" + name},
+			},
+		}
+		for _, m := range mutate {
+			m(auto)
+		}
+		return auto
+	}
+
+	leader := automation("leader", "repo", gitSpec("main"))
+	r := &ImageUpdateAutomationReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			leader,
+			automation("same", "repo", gitSpec("main")),
+			automation("also-same", "repo", gitSpec("main")),
+			automation("other-branch", "repo", gitSpec("staging")),
+			automation("other-repo", "other", gitSpec("main")),
+			automation("suspended", "repo", gitSpec("main"), func(a *imagev1.ImageUpdateAutomation) {
+				a.Spec.Suspend = true
+			}),
+			automation("dependent", "repo", gitSpec("main"), func(a *imagev1.ImageUpdateAutomation) {
+				a.Spec.DependsOn = []imagev1.DependencyReference{{Kind: "Kustomization", Name: "infra"}}
+			}),
+			automation("promotion", "repo", gitSpec("main"), func(a *imagev1.ImageUpdateAutomation) {
+				a.Spec.Update = &imagev1.UpdateStrategy{
+					Strategy: imagev1.UpdateStrategySetters,
+					Stages:   []imagev1.PromotionStage{{Name: "dev", Path: "./dev"}, {Name: "prod", Path: "./prod"}},
+				}
+			}),
+		).Build(),
+		Scheme:    scheme,
+		coalescer: newCoalescer(time.Second),
+	}
+
+	coalesced, err := r.coalescedAutomations(context.TODO(), leader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, auto := range coalesced {
+		names = append(names, auto.GetName())
+	}
+	if len(names) != 2 || names[0] != "also-same" || names[1] != "same" {
+		t.Errorf("expected only the automations with the same repository and git spec, got %v", names)
+	}
+
+	// a suspended automation previewing its updates runs by itself
+	previewing := leader.DeepCopy()
+	previewing.Spec.Suspend = true
+	previewing.Spec.PreviewWhileSuspended = true
+	if coalesced, err := r.coalescedAutomations(context.TODO(), previewing); err != nil || len(coalesced) != 0 {
+		t.Errorf("expected no automations to be coalesced with a preview, got %v (err %v)", coalesced, err)
+	}
+
+	// as does a promotion
+	promotion := &imagev1.ImageUpdateAutomation{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Namespace: "apps", Name: "promotion"}, promotion); err != nil {
+		t.Fatal(err)
+	}
+	if coalesced, err := r.coalescedAutomations(context.TODO(), promotion); err != nil || len(coalesced) != 0 {
+		t.Errorf("expected no automations to be coalesced with a promotion, got %v (err %v)", coalesced, err)
+	}
+
+	// without coalescing, an automation runs by itself
+	r.coalescer = nil
+	if coalesced, err := r.coalescedAutomations(context.TODO(), leader); err != nil || len(coalesced) != 0 {
+		t.Errorf("expected no automations to be coalesced when turned off, got %v (err %v)", coalesced, err)
+	}
+}
+
+func TestCoalescerServedSince(t *testing.T) {
+	c := newCoalescer(time.Second)
+	name := types.NamespacedName{Namespace: "apps", Name: "same"}
+	start := time.Date(2021, 10, 1, 10, 0, 0, 0, time.UTC)
+	c.markServed([]types.NamespacedName{name}, servedRun{
+		by:      types.NamespacedName{Namespace: "apps", Name: "leader"},
+		start:   start,
+		message: "no updates made",
+	})
+
+	if run, ok := c.servedSince(name, start.Add(-time.Second)); !ok || run.by.Name != "leader" {
+		t.Errorf("expected a run due before the coalesced run started to have been served, got %v", run)
+	}
+	if _, ok := c.servedSince(name, start.Add(time.Second)); ok {
+		t.Error("expected a run due after the coalesced run started not to have been served")
+	}
+	c.forget(name)
+	if _, ok := c.servedSince(name, start.Add(-time.Second)); ok {
+		t.Error("expected nothing to be served once forgotten")
+	}
+}
+
+func TestCoalescerPutOff(t *testing.T) {
+	c := newCoalescer(time.Second)
+	name := types.NamespacedName{Namespace: "apps", Name: "same"}
+	first := time.Date(2021, 10, 1, 10, 0, 0, 0, time.UTC)
+	later := first.Add(5 * time.Second)
+
+	if due := c.due(name, first); !due.Equal(first) {
+		t.Errorf("expected a run not put off to be due when it's made, got %s", due)
+	}
+	c.putOffRun(name, first)
+	c.putOffRun(name, later)
+	if due := c.due(name, later.Add(5*time.Second)); !due.Equal(first) {
+		t.Errorf("expected the run to be due when the first run put off was, got %s", due)
+	}
+	if due := c.due(name, later); !due.Equal(later) {
+		t.Errorf("expected the runs put off to be forgotten once made, got %s", due)
+	}
+
+	var none *coalescer
+	none.putOffRun(name, first)
+	if due := none.due(name, later); !due.Equal(later) {
+		t.Errorf("expected runs not to be put off without coalescing, got %s", due)
+	}
+}
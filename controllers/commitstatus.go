@@ -0,0 +1,209 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/fluxcd/pkg/runtime/events"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// An automation with .spec.commitStatus has a status set on each
+// commit it pushes, with the git provider hosting the repository, so
+// that branch protection rules and dashboards can take account of it.
+// The status is always a success, since it's only set once the commit
+// has been pushed.
+
+const (
+	// defaultCommitStatusContext is the name given to commit statuses
+	// when the automation doesn't give one.
+	defaultCommitStatusContext = "flux/image-automation"
+	// commitStatusTimeout bounds how long setting a commit status may
+	// take, so that a slow provider doesn't hold up the automation.
+	commitStatusTimeout = 15 * time.Second
+	// maxStatusDescription is the greatest length of the description
+	// of a commit status that GitHub accepts; the other providers
+	// accept longer descriptions.
+	maxStatusDescription = 140
+)
+
+// commitStatus is the status to set on a commit.
+type commitStatus struct {
+	Context     string
+	Description string
+	// TargetURL, if not empty, is linked to from the status.
+	TargetURL string
+}
+
+// statusDescription gives the description of the status of a commit
+// that applied the number of updates given.
+func statusDescription(updates int) string {
+	if updates == 1 {
+		return "applied 1 update"
+	}
+	return fmt.Sprintf("applied %d updates", updates)
+}
+
+// commitStatusProvider gives the provider to set commit statuses with,
+// for a repository on the host given: the provider given in the spec,
+// or else the one for the host, if it's one of the public services.
+func commitStatusProvider(spec *imagev1.CommitStatusSpec, host string) (imagev1.CommitStatusProvider, error) {
+	if spec.Provider != "" {
+		return spec.Provider, nil
+	}
+	if provider := knownProvider(host); provider != "" {
+		return imagev1.CommitStatusProvider(provider), nil
+	}
+	return "", fmt.Errorf("no commit status provider given, and the provider for host %q is not known", host)
+}
+
+// commitStatusRequest gives the URL to POST the status given to, for
+// the commit given in the repository with the path given (e.g.,
+// `org/repo`), and the body to POST.
+func commitStatusRequest(provider imagev1.CommitStatusProvider, address, repoPath, rev string, status commitStatus) (string, interface{}, error) {
+	description := status.Description
+	if len(description) > maxStatusDescription {
+		description = description[:maxStatusDescription]
+	}
+	switch provider {
+	case imagev1.CommitStatusGitHub:
+		if address == "" {
+			address = "https://api.github.com"
+		}
+		body := map[string]string{
+			"state":       "success",
+			"context":     status.Context,
+			"description": description,
+		}
+		if status.TargetURL != "" {
+			body["target_url"] = status.TargetURL
+		}
+		return fmt.Sprintf("%s/repos/%s/statuses/%s", strings.TrimRight(address, "/"), repoPath, rev), body, nil
+	case imagev1.CommitStatusGitLab:
+		if address == "" {
+			address = "https://gitlab.com/api/v4"
+		}
+		body := map[string]string{
+			"state":       "success",
+			"name":        status.Context,
+			"description": description,
+		}
+		if status.TargetURL != "" {
+			body["target_url"] = status.TargetURL
+		}
+		return fmt.Sprintf("%s/projects/%s/statuses/%s", strings.TrimRight(address, "/"), url.PathEscape(repoPath), rev), body, nil
+	case imagev1.CommitStatusBitbucket:
+		if address == "" {
+			address = "https://api.bitbucket.org/2.0"
+		}
+		// Bitbucket requires a link; the key is what identifies the
+		// status, and is limited to 40 characters
+		if status.TargetURL == "" {
+			return "", nil, fmt.Errorf("a link to the commit is needed to set a commit status with Bitbucket")
+		}
+		key := status.Context
+		if len(key) > 40 {
+			key = key[:40]
+		}
+		body := map[string]string{
+			"state":       "SUCCESSFUL",
+			"key":         key,
+			"name":        status.Context,
+			"description": description,
+			"url":         status.TargetURL,
+		}
+		return fmt.Sprintf("%s/repositories/%s/commit/%s/statuses/build", strings.TrimRight(address, "/"), repoPath, rev), body, nil
+	}
+	return "", nil, fmt.Errorf("unsupported commit status provider %q", provider)
+}
+
+// setCommitStatus sets the status of a commit pushed by the automation
+// given, if the automation asks for it, saying how many updates the
+// commit applied and linking to the commit, if there's a link. As with
+// auditPush, the push has already happened, so failing to set the
+// status is reported, but doesn't fail the run.
+func (r *ImageUpdateAutomationReconciler) setCommitStatus(ctx context.Context, auto imagev1.ImageUpdateAutomation, repoURL, rev string, updates int, link string) {
+	spec := auto.Spec.CommitStatus
+	if spec == nil {
+		return
+	}
+	status := commitStatus{
+		Context:     spec.Context,
+		Description: statusDescription(updates),
+		TargetURL:   link,
+	}
+	if status.Context == "" {
+		status.Context = defaultCommitStatusContext
+	}
+	ctx, cancel := context.WithTimeout(ctx, commitStatusTimeout)
+	defer cancel()
+	if err := r.postCommitStatus(ctx, auto.GetNamespace(), spec, repoURL, rev, status); err != nil {
+		logr.FromContext(ctx).Error(err, "unable to set commit status", "revision", rev)
+		r.event(ctx, auto, events.EventSeverityError, fmt.Sprintf("unable to set status of commit %s: %s", rev, err), nil)
+	}
+}
+
+// postCommitStatus sets the status given on a commit, with the API
+// token from the secret the spec refers to.
+func (r *ImageUpdateAutomationReconciler) postCommitStatus(ctx context.Context, namespace string, spec *imagev1.CommitStatusSpec,
+	repoURL, rev string, status commitStatus) error {
+	host, repoPath := repoHostPath(repoURL)
+	if repoPath == "" {
+		return fmt.Errorf("unable to work out the repository from the URL %q", repoURL)
+	}
+	provider, err := commitStatusProvider(spec, host)
+	if err != nil {
+		return err
+	}
+	address, body, err := commitStatusRequest(provider, spec.Address, repoPath, rev, status)
+	if err != nil {
+		return err
+	}
+
+	header, err := r.tokenHeader(ctx, types.NamespacedName{Namespace: namespace, Name: spec.SecretRef.Name})
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, &http.Client{Timeout: commitStatusTimeout}, address, header, body)
+}
+
+// tokenHeader gives the header with which to authenticate to a git
+// provider's API, using the token in the secret given.
+func (r *ImageUpdateAutomationReconciler) tokenHeader(ctx context.Context, secretName types.NamespacedName) (http.Header, error) {
+	var secret corev1.Secret
+	if err := r.Get(ctx, secretName, &secret); err != nil {
+		return nil, fmt.Errorf("unable to get token secret: %w", err)
+	}
+	token, ok := secret.Data["token"]
+	if !ok {
+		return nil, fmt.Errorf("token secret %s has no field 'token'", secretName)
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	return header, nil
+}
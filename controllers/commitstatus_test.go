@@ -0,0 +1,144 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestCommitStatusProvider(t *testing.T) {
+	spec := &imagev1.CommitStatusSpec{}
+	for host, expected := range map[string]imagev1.CommitStatusProvider{
+		"github.com":    imagev1.CommitStatusGitHub,
+		"gitlab.com":    imagev1.CommitStatusGitLab,
+		"bitbucket.org": imagev1.CommitStatusBitbucket,
+	} {
+		if provider, err := commitStatusProvider(spec, host); err != nil || provider != expected {
+			t.Errorf("expected provider %q for %s, got %q (error %v)", expected, host, provider, err)
+		}
+	}
+	if _, err := commitStatusProvider(spec, "git.example.com"); err == nil {
+		t.Error("expected an error for an unknown host without a provider given")
+	}
+	spec.Provider = imagev1.CommitStatusGitLab
+	if provider, err := commitStatusProvider(spec, "git.example.com"); err != nil || provider != imagev1.CommitStatusGitLab {
+		t.Errorf("expected the provider given, got %q (error %v)", provider, err)
+	}
+}
+
+func TestCommitStatusRequest(t *testing.T) {
+	status := commitStatus{Context: defaultCommitStatusContext, Description: statusDescription(3)}
+	for _, c := range []struct {
+		provider imagev1.CommitStatusProvider
+		address  string
+		expected string
+	}{
+		{provider: imagev1.CommitStatusGitHub, expected: "https://api.github.com/repos/org/repo/statuses/abc123"},
+		{provider: imagev1.CommitStatusGitHub, address: "https://github.example.com/api/v3/",
+			expected: "https://github.example.com/api/v3/repos/org/repo/statuses/abc123"},
+		{provider: imagev1.CommitStatusGitLab, expected: "https://gitlab.com/api/v4/projects/org%2Frepo/statuses/abc123"},
+	} {
+		address, body, err := commitStatusRequest(c.provider, c.address, "org/repo", "abc123", status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if address != c.expected {
+			t.Errorf("expected status for %s to be POSTed to %s, got %s", c.provider, c.expected, address)
+		}
+		if description := body.(map[string]string)["description"]; description != "applied 3 updates" {
+			t.Errorf("unexpected description %q", description)
+		}
+	}
+
+	if _, _, err := commitStatusRequest(imagev1.CommitStatusBitbucket, "", "team/repo", "abc123", status); err == nil {
+		t.Error("expected an error for Bitbucket without a link to the commit")
+	}
+	status.TargetURL = "https://bitbucket.org/team/repo/commits/abc123"
+	address, body, err := commitStatusRequest(imagev1.CommitStatusBitbucket, "", "team/repo", "abc123", status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != "https://api.bitbucket.org/2.0/repositories/team/repo/commit/abc123/statuses/build" {
+		t.Errorf("unexpected address for Bitbucket %s", address)
+	}
+	if fields := body.(map[string]string); fields["state"] != "SUCCESSFUL" || fields["url"] != status.TargetURL {
+		t.Errorf("unexpected body for Bitbucket %v", fields)
+	}
+}
+
+func TestPostCommitStatus(t *testing.T) {
+	type request struct {
+		path, auth string
+		body       map[string]string
+	}
+	received := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- request{path: r.URL.Path, auth: r.Header.Get("Authorization"), body: body}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "status-token"},
+		Data:       map[string][]byte{"token": []byte("s3cr3t\n")},
+	}
+	r := &ImageUpdateAutomationReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret).Build(),
+	}
+	spec := &imagev1.CommitStatusSpec{
+		Provider: imagev1.CommitStatusGitHub,
+		Address:  server.URL,
+	}
+	spec.SecretRef.Name = "status-token"
+	status := commitStatus{Context: "flux/image-automation", Description: statusDescription(1)}
+	if err := r.postCommitStatus(context.TODO(), "apps", spec, "ssh://git@git.example.com/org/repo.git", "abc123", status); err != nil {
+		t.Fatal(err)
+	}
+	found := <-received
+	if found.path != "/repos/org/repo/statuses/abc123" || found.auth != "Bearer s3cr3t" {
+		t.Errorf("unexpected request to %s with authorization %q", found.path, found.auth)
+	}
+	if found.body["state"] != "success" || found.body["context"] != "flux/image-automation" || found.body["description"] != "applied 1 update" {
+		t.Errorf("unexpected status %v", found.body)
+	}
+
+	spec.SecretRef.Name = "missing"
+	if err := r.postCommitStatus(context.TODO(), "apps", spec, "ssh://git@git.example.com/org/repo.git", "abc123", status); err == nil {
+		t.Error("expected an error when the secret is missing")
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestDependencyReady(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		status map[string]interface{}
+		ready  bool
+	}{
+		{"no status", nil, false},
+		{"ready", map[string]interface{}{
+			"observedGeneration": int64(2),
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "Ready", "status": "True", "reason": "ReconciliationSucceeded", "lastTransitionTime": "2021-10-01T10:00:00Z"},
+			},
+		}, true},
+		{"not ready", map[string]interface{}{
+			"observedGeneration": int64(2),
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "Ready", "status": "False", "reason": "ReconciliationFailed", "lastTransitionTime": "2021-10-01T10:00:00Z"},
+			},
+		}, false},
+		{"ready at an old generation", map[string]interface{}{
+			"observedGeneration": int64(1),
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "Ready", "status": "True", "reason": "ReconciliationSucceeded", "lastTransitionTime": "2021-10-01T10:00:00Z"},
+			},
+		}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			obj := unstructured.Unstructured{Object: map[string]interface{}{}}
+			obj.SetGeneration(2)
+			if c.status != nil {
+				obj.Object["status"] = c.status
+			}
+			if ready := dependencyReady(&obj); ready != c.ready {
+				t.Errorf("expected ready to be %v, got %v", c.ready, ready)
+			}
+		})
+	}
+}
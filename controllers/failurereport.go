@@ -0,0 +1,224 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/fluxcd/pkg/runtime/events"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// Each failed run of an automation is counted, and the count reset by
+// a run that succeeds. An automation with .spec.failureIssue has its
+// failures reported once the count reaches the threshold given, by
+// opening an issue on the git repository, or calling a webhook, so
+// that a broken automation doesn't go unnoticed. The failures are
+// reported once for each run of them; a report that fails is tried
+// again at the next failure.
+
+const (
+	// defaultFailureThreshold is the number of runs in a row that
+	// must fail before the failures are reported, if the automation
+	// doesn't say.
+	defaultFailureThreshold = 5
+	// failureReportTimeout bounds how long reporting failures may
+	// take, so that a slow provider doesn't hold up the automation.
+	failureReportTimeout = 15 * time.Second
+)
+
+// FailureNotice is what's POSTed to a webhook to report the failures
+// of an automation.
+type FailureNotice struct {
+	// Namespace and Name identify the automation that's failing.
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Failures is how many runs in a row have failed.
+	Failures int64 `json:"failures"`
+	// Reason and Message are those of the last failure.
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+	// Repository is the URL of the git repository the automation
+	// updates, if it's known.
+	Repository string `json:"repository,omitempty"`
+	// Time is when the last failure happened.
+	Time time.Time `json:"time"`
+}
+
+// countFailure counts a failed run of the automation given, with the
+// reason and message given, and reports the failures if there have now
+// been enough in a row. The automation's status is patched by the
+// caller.
+func (r *ImageUpdateAutomationReconciler) countFailure(ctx context.Context, auto *imagev1.ImageUpdateAutomation, reason, msg string) {
+	auto.Status.ConsecutiveFailures++
+	spec := auto.Spec.FailureIssue
+	if spec == nil || auto.Status.FailureReport != nil || auto.Status.ConsecutiveFailures < failureThreshold(spec) {
+		return
+	}
+
+	log := logr.FromContext(ctx)
+	notice := FailureNotice{
+		Namespace: auto.GetNamespace(),
+		Name:      auto.GetName(),
+		Failures:  auto.Status.ConsecutiveFailures,
+		Reason:    reason,
+		Message:   msg,
+		Time:      time.Now(),
+	}
+	var origin sourcev1.GitRepository
+	if err := r.Get(ctx, types.NamespacedName{Namespace: auto.GetNamespace(), Name: auto.Spec.SourceRef.Name}, &origin); err == nil {
+		notice.Repository = origin.Spec.URL
+	}
+
+	reportCtx, cancel := context.WithTimeout(ctx, failureReportTimeout)
+	defer cancel()
+	issueURL, err := r.reportFailures(reportCtx, spec, notice)
+	if err != nil {
+		log.Error(err, "unable to report failures", "failures", notice.Failures)
+		r.event(ctx, *auto, events.EventSeverityError, fmt.Sprintf("unable to report %d failures in a row: %s", notice.Failures, err), nil)
+		return
+	}
+	auto.Status.FailureReport = &imagev1.FailureReport{
+		Time:     metav1.NewTime(notice.Time),
+		Failures: notice.Failures,
+		IssueURL: issueURL,
+	}
+	log.Info("reported failures", "failures", notice.Failures, "issue", issueURL)
+}
+
+// failureThreshold gives the number of runs in a row that must fail
+// before the failures are reported.
+func failureThreshold(spec *imagev1.FailureIssueSpec) int64 {
+	if spec.Failures > 0 {
+		return spec.Failures
+	}
+	return defaultFailureThreshold
+}
+
+// resetFailures clears the count of failed runs of the automation
+// given, and the report of them, after a run that succeeded.
+func resetFailures(auto *imagev1.ImageUpdateAutomation) {
+	auto.Status.ConsecutiveFailures = 0
+	auto.Status.FailureReport = nil
+}
+
+// reportFailures reports the failures given as the spec says, and
+// gives the web address of the issue opened, if one was.
+func (r *ImageUpdateAutomationReconciler) reportFailures(ctx context.Context, spec *imagev1.FailureIssueSpec, notice FailureNotice) (string, error) {
+	host, repoPath := repoHostPath(notice.Repository)
+	provider := spec.Provider
+	if provider == "" {
+		switch knownProvider(host) {
+		case "github":
+			provider = imagev1.FailureIssueGitHub
+		case "gitlab":
+			provider = imagev1.FailureIssueGitLab
+		default:
+			return "", fmt.Errorf("no failure issue provider given, and issues can't be opened for the repository %q", notice.Repository)
+		}
+	}
+
+	header := http.Header{}
+	if spec.SecretRef != nil {
+		var err error
+		if header, err = r.tokenHeader(ctx, types.NamespacedName{Namespace: notice.Namespace, Name: spec.SecretRef.Name}); err != nil {
+			return "", err
+		}
+	} else if provider != imagev1.FailureIssueWebhook {
+		return "", fmt.Errorf("a secret with a token must be given to open issues with %s", provider)
+	}
+	client := &http.Client{Timeout: failureReportTimeout}
+
+	if provider == imagev1.FailureIssueWebhook {
+		if spec.Address == "" {
+			return "", fmt.Errorf("the address of the webhook must be given")
+		}
+		return "", postJSON(ctx, client, spec.Address, header, notice)
+	}
+	if repoPath == "" {
+		return "", fmt.Errorf("unable to work out the repository from the URL %q", notice.Repository)
+	}
+	address, body, err := issueRequest(provider, spec.Address, repoPath, spec.Labels, notice)
+	if err != nil {
+		return "", err
+	}
+	var issue struct {
+		HTMLURL string `json:"html_url"`
+		WebURL  string `json:"web_url"`
+	}
+	if err := exchangeJSON(ctx, client, address, header, body, &issue); err != nil {
+		return "", err
+	}
+	if issue.HTMLURL != "" {
+		return issue.HTMLURL, nil
+	}
+	return issue.WebURL, nil
+}
+
+// issueRequest gives the URL to POST to, to open an issue about the
+// failures given on the repository with the path given, and the body
+// to POST.
+func issueRequest(provider imagev1.FailureIssueProvider, address, repoPath string, labels []string, notice FailureNotice) (string, interface{}, error) {
+	title := fmt.Sprintf("Image update automation %s/%s is failing", notice.Namespace, notice.Name)
+	description := issueDescription(notice)
+	switch provider {
+	case imagev1.FailureIssueGitHub:
+		if address == "" {
+			address = "https://api.github.com"
+		}
+		body := map[string]interface{}{
+			"title": title,
+			"body":  description,
+		}
+		if len(labels) > 0 {
+			body["labels"] = labels
+		}
+		return fmt.Sprintf("%s/repos/%s/issues", strings.TrimRight(address, "/"), repoPath), body, nil
+	case imagev1.FailureIssueGitLab:
+		if address == "" {
+			address = "https://gitlab.com/api/v4"
+		}
+		body := map[string]interface{}{
+			"title":       title,
+			"description": description,
+		}
+		if len(labels) > 0 {
+			body["labels"] = strings.Join(labels, ",")
+		}
+		return fmt.Sprintf("%s/projects/%s/issues", strings.TrimRight(address, "/"), url.PathEscape(repoPath)), body, nil
+	}
+	return "", nil, fmt.Errorf("unsupported failure issue provider %q", provider)
+}
+
+// issueDescription gives the description of the issue opened about
+// the failures given.
+func issueDescription(notice FailureNotice) string {
+	return fmt.Sprintf("The ImageUpdateAutomation `%s/%s` has failed %d runs in a row, most recently at %s, with the reason `%s`:\n\n```\n%s\n```\n\n"+
+		"Updates won't be made until the automation succeeds again. This issue isn't updated or closed when it does.\n",
+		notice.Namespace, notice.Name, notice.Failures, notice.Time.UTC().Format(time.RFC3339), notice.Reason, notice.Message)
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestIssueRequest(t *testing.T) {
+	notice := FailureNotice{
+		Namespace: "apps",
+		Name:      "podinfo",
+		Failures:  5,
+		Reason:    imagev1.PushRejectedReason,
+		Message:   "push rejected",
+		Time:      time.Now(),
+	}
+	address, body, err := issueRequest(imagev1.FailureIssueGitHub, "", "org/repo", []string{"automation"}, notice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := body.(map[string]interface{})
+	if address != "https://api.github.com/repos/org/repo/issues" || fields["title"] != "Image update automation apps/podinfo is failing" {
+		t.Errorf("unexpected issue request to %s: %v", address, fields)
+	}
+	if description := fields["body"].(string); !strings.Contains(description, "failed 5 runs in a row") || !strings.Contains(description, "push rejected") {
+		t.Errorf("unexpected issue description %q", description)
+	}
+
+	address, body, err = issueRequest(imagev1.FailureIssueGitLab, "https://gitlab.example.com/api/v4", "group/sub/repo", []string{"a", "b"}, notice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != "https://gitlab.example.com/api/v4/projects/group%2Fsub%2Frepo/issues" || body.(map[string]interface{})["labels"] != "a,b" {
+		t.Errorf("unexpected issue request to %s: %v", address, body)
+	}
+}
+
+func TestCountFailure(t *testing.T) {
+	var opened int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/org/repo/issues" || r.Header.Get("Authorization") != "Bearer s3cr3t" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		opened++
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"html_url": "https://github.example.com/org/repo/issues/1"})
+	}))
+	defer server.Close()
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := sourcev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "issue-token"},
+		Data:       map[string][]byte{"token": []byte("s3cr3t")},
+	}
+	repository := &sourcev1.GitRepository{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "repo"},
+		Spec:       sourcev1.GitRepositorySpec{URL: "https://github.example.com/org/repo.git"},
+	}
+	r := &ImageUpdateAutomationReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret, repository).Build(),
+	}
+
+	ctx := logr.NewContext(context.TODO(), logr.Discard())
+	var auto imagev1.ImageUpdateAutomation
+	auto.Namespace = "apps"
+	auto.Name = "podinfo"
+	auto.Spec.SourceRef.Name = "repo"
+	auto.Spec.FailureIssue = &imagev1.FailureIssueSpec{
+		Failures:  2,
+		Provider:  imagev1.FailureIssueGitHub,
+		Address:   server.URL,
+		SecretRef: &meta.LocalObjectReference{Name: "issue-token"},
+	}
+
+	r.countFailure(ctx, &auto, imagev1.PushFailedReason, "push failed")
+	if auto.Status.ConsecutiveFailures != 1 || auto.Status.FailureReport != nil || opened != 0 {
+		t.Errorf("expected a failure to be counted but not reported, got %d failures, report %v", auto.Status.ConsecutiveFailures, auto.Status.FailureReport)
+	}
+	r.countFailure(ctx, &auto, imagev1.PushFailedReason, "push failed")
+	report := auto.Status.FailureReport
+	if opened != 1 || report == nil || report.Failures != 2 || report.IssueURL != "https://github.example.com/org/repo/issues/1" {
+		t.Errorf("expected an issue to be opened once the threshold was reached, got report %v", report)
+	}
+	r.countFailure(ctx, &auto, imagev1.PushFailedReason, "push failed")
+	if opened != 1 || auto.Status.ConsecutiveFailures != 3 {
+		t.Errorf("expected the failures to be reported only once, got %d issues opened", opened)
+	}
+
+	resetFailures(&auto)
+	if auto.Status.ConsecutiveFailures != 0 || auto.Status.FailureReport != nil {
+		t.Error("expected a successful run to clear the failures")
+	}
+}
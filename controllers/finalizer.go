@@ -0,0 +1,214 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	libgit2 "github.com/libgit2/git2go/v31"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/fluxcd/pkg/runtime/events"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// An automation only has a finalizer when there is something to
+// clean up in the git repository once it's deleted, so that deleting
+// any other automation isn't held up by the controller.
+
+// needsFinalizer says whether the automation given has anything to
+// clean up when it's deleted.
+func needsFinalizer(auto *imagev1.ImageUpdateAutomation) bool {
+	gitSpec := auto.Spec.GitSpec
+	return gitSpec != nil && gitSpec.Push != nil && gitSpec.Push.DeleteBranchOnRemoval
+}
+
+// reconcileFinalizer adds the finalizer to the automation given, or
+// removes it, according to whether it's needed.
+func (r *ImageUpdateAutomationReconciler) reconcileFinalizer(ctx context.Context, auto *imagev1.ImageUpdateAutomation) error {
+	want := needsFinalizer(auto)
+	if want == controllerutil.ContainsFinalizer(auto, imagev1.ImageUpdateAutomationFinalizer) {
+		return nil
+	}
+	patch := client.MergeFromWithOptions(auto.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	if want {
+		controllerutil.AddFinalizer(auto, imagev1.ImageUpdateAutomationFinalizer)
+	} else {
+		controllerutil.RemoveFinalizer(auto, imagev1.ImageUpdateAutomationFinalizer)
+	}
+	return r.Patch(ctx, auto, patch)
+}
+
+// finalize cleans up after the automation given, which is being
+// deleted, then removes the finalizer so the deletion can go ahead.
+// Cleaning up is done as the automation's service account, if it has
+// one, as is the rest of a run; an automation that would be refused a
+// run, for referring to other namespaces, is not cleaned up after. If
+// cleaning up fails, it's tried again; the finalizer can be removed
+// by hand to give up.
+func (r *ImageUpdateAutomationReconciler) finalize(ctx context.Context, auto *imagev1.ImageUpdateAutomation) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(auto, imagev1.ImageUpdateAutomationFinalizer) {
+		return ctrl.Result{}, nil
+	}
+	var refused error
+	if r.noCrossNamespaceRefs {
+		refused = crossNamespaceRef(auto)
+	}
+	if refused != nil {
+		r.event(ctx, *auto, events.EventSeverityError, fmt.Sprintf("not deleting push branch: %s", refused), nil)
+	} else if needsFinalizer(auto) {
+		tenant, err := r.impersonate(auto)
+		if err != nil {
+			r.event(ctx, *auto, events.EventSeverityError, fmt.Sprintf("unable to delete push branch: %s", err), nil)
+			return ctrl.Result{Requeue: true}, err
+		}
+		wait, err := tenant.deletePushBranch(ctx, auto)
+		if err != nil {
+			r.event(ctx, *auto, events.EventSeverityError, fmt.Sprintf("unable to delete push branch: %s", err), nil)
+			return ctrl.Result{Requeue: true}, err
+		}
+		if wait > 0 {
+			return ctrl.Result{RequeueAfter: wait}, nil
+		}
+	}
+	patch := client.MergeFromWithOptions(auto.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	controllerutil.RemoveFinalizer(auto, imagev1.ImageUpdateAutomationFinalizer)
+	return ctrl.Result{}, client.IgnoreNotFound(r.Patch(ctx, auto, patch))
+}
+
+// deletePushBranch deletes the push branch of the automation given
+// from its git repository, if it's safe to. If another controller is
+// pushing to the branch, it returns how long to wait before trying
+// again.
+func (r *ImageUpdateAutomationReconciler) deletePushBranch(ctx context.Context, auto *imagev1.ImageUpdateAutomation) (time.Duration, error) {
+	log := logr.FromContext(ctx)
+
+	var origin sourcev1.GitRepository
+	originName := types.NamespacedName{Namespace: auto.GetNamespace(), Name: auto.Spec.SourceRef.Name}
+	if err := r.Get(ctx, originName, &origin); err != nil {
+		if apierrors.IsNotFound(err) {
+			// e.g., it was deleted along with the automation
+			log.Info("referenced git repository does not exist; not deleting the push branch", "gitrepository", originName)
+			return 0, nil
+		}
+		return 0, err
+	}
+	branch := branchToDelete(auto.Spec.GitSpec, &origin)
+	if branch == "" {
+		log.Info("push branch is not separate from the checkout ref; not deleting it")
+		return 0, nil
+	}
+
+	// the repository and branch are held until the deletion is done,
+	// even if it's given up on
+	ctx = withGitOperations(ctx)
+	releaseRepo, err := r.repoLocks.acquire(ctx, originName.String())
+	if err != nil {
+		return 0, err
+	}
+	defer whenGitOperationsDone(ctx, releaseRepo)
+	releasePush, wait, err := r.pushLeases.acquire(ctx, origin.Spec.URL, branch)
+	if err != nil || wait > 0 {
+		return wait, err
+	}
+	defer whenGitOperationsDone(ctx, releasePush)
+
+	access, err := r.getRepoAccess(ctx, auto, &origin)
+	if err != nil {
+		return 0, err
+	}
+	ctx, tmp, removeWorkspace, err := r.workspaces.create(ctx, fmt.Sprintf("%s-%s", originName.Namespace, originName.Name))
+	if err != nil {
+		return 0, err
+	}
+	defer removeWorkspace()
+
+	deleteCtx, cancel := gitOperationContext(ctx, &origin)
+	defer cancel()
+	var deleted bool
+	err = runGitOperation(deleteCtx, func() error {
+		var err error
+		deleted, err = deleteRemoteBranch(deleteCtx, tmp, branch, access)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if deleted {
+		r.event(ctx, *auto, events.EventSeverityInfo, fmt.Sprintf("deleted push branch %s", branch), nil)
+	}
+	return 0, nil
+}
+
+// branchToDelete gives the push branch of the git spec given, if it's
+// separate from the checkout ref and so can be deleted; otherwise, it
+// gives "". The branch of the checkout ref must be known, since with
+// no ref, or a tag or commit, the push branch may be the one it came
+// from.
+func branchToDelete(gitSpec *imagev1.GitSpec, origin *sourcev1.GitRepository) string {
+	if gitSpec == nil || gitSpec.Push == nil || gitSpec.Push.Branch == "" {
+		return ""
+	}
+	ref := origin.Spec.Reference
+	if gitSpec.Checkout != nil {
+		ref = &gitSpec.Checkout.Reference
+	}
+	if ref == nil || ref.Branch == "" || pinnedRevision(ref) != "" || ref.Branch == gitSpec.Push.Branch {
+		return ""
+	}
+	return gitSpec.Push.Branch
+}
+
+// deleteRemoteBranch deletes the branch given from the remote, using
+// an empty repository at path to push from. It reports whether the
+// branch was there to delete.
+func deleteRemoteBranch(ctx context.Context, path, branch string, access repoAccess) (bool, error) {
+	repo, err := libgit2.InitRepository(path, true)
+	if err != nil {
+		return false, err
+	}
+	defer repo.Free()
+	origin, err := repo.Remotes.Create(originRemote, access.url)
+	if err != nil {
+		return false, err
+	}
+	defer origin.Free()
+
+	callbacks := access.remoteCallbacks(ctx)
+	if err := origin.ConnectFetch(&callbacks, nil, nil); err != nil {
+		return false, err
+	}
+	ref := "refs/heads/" + branch
+	heads, err := origin.Ls(ref)
+	origin.Disconnect()
+	if err != nil {
+		return false, err
+	}
+	if len(heads) == 0 {
+		return false, nil
+	}
+	return true, pushRefs(ctx, path, []string{":" + ref}, access)
+}
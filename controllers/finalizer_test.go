@@ -0,0 +1,197 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestBranchToDelete(t *testing.T) {
+	origin := &sourcev1.GitRepository{
+		Spec: sourcev1.GitRepositorySpec{Reference: &sourcev1.GitRepositoryRef{Branch: "main"}},
+	}
+	tests := []struct {
+		name     string
+		gitSpec  imagev1.GitSpec
+		origin   *sourcev1.GitRepository
+		expected string
+	}{
+		{
+			name:     "push branch from the GitRepository's branch",
+			gitSpec:  imagev1.GitSpec{Push: &imagev1.PushSpec{Branch: "auto"}},
+			origin:   origin,
+			expected: "auto",
+		},
+		{
+			name: "push branch from the checkout branch",
+			gitSpec: imagev1.GitSpec{
+				Checkout: &imagev1.GitCheckoutSpec{Reference: sourcev1.GitRepositoryRef{Branch: "staging"}},
+				Push:     &imagev1.PushSpec{Branch: "main"},
+			},
+			origin:   origin,
+			expected: "main",
+		},
+		{
+			name:    "push branch is the checkout branch",
+			gitSpec: imagev1.GitSpec{Push: &imagev1.PushSpec{Branch: "main"}},
+			origin:  origin,
+		},
+		{
+			name:    "no push branch",
+			gitSpec: imagev1.GitSpec{Push: &imagev1.PushSpec{Refspec: "HEAD:refs/for/main"}},
+			origin:  origin,
+		},
+		{
+			name:    "no checkout ref",
+			gitSpec: imagev1.GitSpec{Push: &imagev1.PushSpec{Branch: "auto"}},
+			origin:  &sourcev1.GitRepository{},
+		},
+		{
+			name: "checkout of a tag",
+			gitSpec: imagev1.GitSpec{
+				Checkout: &imagev1.GitCheckoutSpec{Reference: sourcev1.GitRepositoryRef{Branch: "main", Tag: "v1.0.0"}},
+				Push:     &imagev1.PushSpec{Branch: "auto"},
+			},
+			origin: origin,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if branch := branchToDelete(&tt.gitSpec, tt.origin); branch != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, branch)
+			}
+		})
+	}
+}
+
+// forbiddenClient refuses to read anything, as a client for a service
+// account with no permissions would.
+type forbiddenClient struct {
+	client.Client
+}
+
+func (forbiddenClient) Get(_ context.Context, key client.ObjectKey, _ client.Object) error {
+	return apierrors.NewForbidden(schema.GroupResource{}, key.Name, nil)
+}
+
+func TestReconcileFinalizer(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := imagev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := sourcev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	ctx := logr.NewContext(context.TODO(), logr.Discard())
+
+	auto := &imagev1.ImageUpdateAutomation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "auto"},
+		Spec: imagev1.ImageUpdateAutomationSpec{
+			SourceRef: imagev1.SourceReference{Kind: sourcev1.GitRepositoryKind, Name: "missing"},
+			GitSpec: &imagev1.GitSpec{
+				Push: &imagev1.PushSpec{Branch: "auto", DeleteBranchOnRemoval: true},
+			},
+		},
+	}
+	r := &ImageUpdateAutomationReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(auto).Build(),
+		Scheme: scheme,
+	}
+	hasFinalizer := func() bool {
+		var got imagev1.ImageUpdateAutomation
+		if err := r.Get(ctx, client.ObjectKeyFromObject(auto), &got); err != nil {
+			t.Fatal(err)
+		}
+		return controllerutil.ContainsFinalizer(&got, imagev1.ImageUpdateAutomationFinalizer)
+	}
+
+	if err := r.reconcileFinalizer(ctx, auto); err != nil {
+		t.Fatal(err)
+	}
+	if !hasFinalizer() {
+		t.Fatal("expected the finalizer to be added when the push branch is to be deleted")
+	}
+
+	auto.Spec.GitSpec.Push.DeleteBranchOnRemoval = false
+	if err := r.reconcileFinalizer(ctx, auto); err != nil {
+		t.Fatal(err)
+	}
+	if hasFinalizer() {
+		t.Fatal("expected the finalizer to be removed when there's nothing to clean up")
+	}
+
+	auto.Spec.GitSpec.Push.DeleteBranchOnRemoval = true
+	if err := r.reconcileFinalizer(ctx, auto); err != nil {
+		t.Fatal(err)
+	}
+	now := metav1.Now()
+	auto.DeletionTimestamp = &now
+
+	// the GitRepository is read as the automation's service account,
+	// which isn't allowed to, so the automation is held on to
+	auto.Spec.ServiceAccountName = "automation"
+	r.restConfig = &rest.Config{Host: "https://kubernetes.example.com"}
+	r.tenantClients = newTenantClients()
+	r.tenantClients.clients[serviceAccountUsername("apps", "automation")] = forbiddenClient{r.Client}
+	if _, err := r.finalize(ctx, auto); !apierrors.IsForbidden(err) {
+		t.Errorf("expected the git repository to be read as the service account, got %v", err)
+	}
+	if !hasFinalizer() {
+		t.Fatal("expected the finalizer to be kept when cleaning up fails")
+	}
+
+	// an automation refused for referring to another namespace isn't
+	// cleaned up after, and is let go
+	r.noCrossNamespaceRefs = true
+	auto.Spec.DependsOn = []imagev1.DependencyReference{{Namespace: "other", Name: "staging"}}
+	if _, err := r.finalize(ctx, auto); err != nil {
+		t.Fatal(err)
+	}
+	if hasFinalizer() {
+		t.Fatal("expected the finalizer to be removed without cleaning up")
+	}
+
+	// the GitRepository is gone, so there's nothing that can be
+	// cleaned up, and the automation is let go
+	r.noCrossNamespaceRefs = false
+	auto.Spec.DependsOn = nil
+	auto.Spec.ServiceAccountName = ""
+	if err := r.reconcileFinalizer(ctx, auto); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.finalize(ctx, auto); err != nil {
+		t.Fatal(err)
+	}
+	if hasFinalizer() {
+		t.Error("expected the finalizer to be removed once finalized")
+	}
+}
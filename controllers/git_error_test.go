@@ -17,8 +17,24 @@ limitations under the License.
 package controllers
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"reflect"
 	"testing"
+
+	"github.com/go-logr/logr"
+	libgit2 "github.com/libgit2/git2go/v31"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
 )
 
 func TestLibgit2ErrorTidy(t *testing.T) {
@@ -74,3 +90,84 @@ func TestLibgit2ErrorUnchanged(t *testing.T) {
 		t.Errorf("expected %q, got %q", expectedReformat, reformattedMessage)
 	}
 }
+
+func TestIsAuthError(t *testing.T) {
+	for msg, expected := range map[string]bool{
+		"Failed to authenticate SSH session: Unable to send userauth-publickey request":          true,
+		"ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey]": true,
+		"unexpected http status code: 401":                                                       true,
+		"remote: This deploy key does not have write access to this project.":                    false,
+		"gave up waiting for git operation: context deadline exceeded":                           false,
+	} {
+		if isAuth := isAuthError(errors.New(msg)); isAuth != expected {
+			t.Errorf("expected %q to be an auth error: %v", msg, expected)
+		}
+	}
+	wrapped := fmt.Errorf("pushing: %w", &libgit2.GitError{Message: "no", Code: libgit2.ErrorCodeAuth})
+	if !isAuthError(wrapped) {
+		t.Error("expected a libgit2 error with the auth code to be an auth error")
+	}
+}
+
+func TestWithRotatedAuth(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "auth"},
+		Data:       map[string][]byte{"username": []byte("flux"), "password": []byte("old")},
+	}
+	repository := &sourcev1.GitRepository{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "repo"},
+		Spec: sourcev1.GitRepositorySpec{
+			URL:       "https://example.com/org/repo",
+			SecretRef: &meta.LocalObjectReference{Name: "auth"},
+		},
+	}
+	auto := &imagev1.ImageUpdateAutomation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "podinfo"},
+	}
+	r := &ImageUpdateAutomationReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret).Build(),
+	}
+	ctx := logr.NewContext(context.TODO(), logr.Discard())
+	access, err := r.getRepoAccess(ctx, auto, repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the secret is rotated while the first attempt is under way
+	var passwords []string
+	access, err = r.withRotatedAuth(ctx, auto, repository, access, func(access repoAccess) error {
+		passwords = append(passwords, access.auth.Password)
+		if access.auth.Password == "old" {
+			secret.Data["password"] = []byte("new")
+			if err := r.Update(ctx, secret); err != nil {
+				t.Fatal(err)
+			}
+			return errors.New("unexpected http status code: 401")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(passwords, []string{"old", "new"}) {
+		t.Errorf("expected an attempt with each password, got %v", passwords)
+	}
+	if access.auth.Password != "new" {
+		t.Errorf("expected the new credentials to be returned, got %q", access.auth.Password)
+	}
+
+	// when the credentials are as they were, there's no point trying
+	// again
+	attempts := 0
+	_, err = r.withRotatedAuth(ctx, auto, repository, access, func(repoAccess) error {
+		attempts++
+		return errors.New("unexpected http status code: 401")
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("expected one failed attempt, got %d (err %v)", attempts, err)
+	}
+}
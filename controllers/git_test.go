@@ -2,8 +2,10 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
@@ -13,8 +15,12 @@ import (
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/storage/memory"
 	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/fluxcd/pkg/gittestserver"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
 )
 
 func populateRepoFromFixture(repo *gogit.Repository, fixture string) error {
@@ -104,12 +110,43 @@ func TestIgnoreBrokenSymlink(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = commitChangedManifests(logr.Discard(), repo, tmp, nil, nil, "unused")
+	_, err = commitChangedManifests(logr.Discard(), repo, tmp, nil, nil, nil, "unused")
 	if err != errNoChanges {
 		t.Fatalf("expected no changes but got: %v", err)
 	}
 }
 
+func TestChangedFiles(t *testing.T) {
+	tmp, err := os.MkdirTemp("", "flux-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	repo, err := gogit.PlainInit(tmp, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = populateRepoFromFixture(repo, "testdata/pathconfig"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{"yes/deploy.yaml", "no/deploy.yaml"} {
+		if err = os.WriteFile(filepath.Join(tmp, file), []byte("changed: true\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := changedFiles(logr.Discard(), repo, tmp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"no/deploy.yaml", "yes/deploy.yaml"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected changed files %v, got %v", expected, files)
+	}
+}
+
 // this is a hook script that will reject a ref update for a branch
 // that's not `main`
 const rejectBranch = `
@@ -155,7 +192,7 @@ func TestPushRejected(t *testing.T) {
 	})
 
 	// This is here to guard against push in general being broken
-	err = push(context.TODO(), tmp, "main", repoAccess{
+	err = push(context.TODO(), tmp, pushRefspecs("main", "", false), repoAccess{
 		url:  repoURL,
 		auth: nil,
 	})
@@ -164,17 +201,242 @@ func TestPushRejected(t *testing.T) {
 	}
 
 	// This is not under test, but needed for the next bit
-	if err = switchBranch(repo, branch); err != nil {
+	if err = switchBranch(repo, tmp, branch, nil); err != nil {
 		t.Fatal(err)
 	}
 
 	// This is supposed to fail, because the hook rejects the branch
 	// pushed to.
-	err = push(context.TODO(), tmp, branch, repoAccess{
+	err = push(context.TODO(), tmp, pushRefspecs(branch, "", false), repoAccess{
 		url:  repoURL,
 		auth: nil,
 	})
 	if err == nil {
 		t.Error("push to a forbidden branch is expected to fail, but succeeded")
 	}
+	var rejected *refsRejectedError
+	if !errors.As(err, &rejected) || rejected.rejected["refs/heads/"+branch] == "" {
+		t.Errorf("expected the push to be reported as rejected for the branch, got %v", err)
+	}
+	if rejected != nil && rejected.protected() {
+		t.Error("expected a rejection by a hook not to be taken as branch protection")
+	}
+}
+
+func TestPushRefspecs(t *testing.T) {
+	for _, c := range []struct {
+		branch, refspec string
+		force           bool
+		expected        []string
+		target          string
+	}{
+		{"auto", "", false, []string{"refs/heads/auto:refs/heads/auto"}, "auto"},
+		{"auto", "", true, []string{"+refs/heads/auto:refs/heads/auto"}, "auto"},
+		{"", "HEAD:refs/for/main", false, []string{"HEAD:refs/for/main"}, "refspec HEAD:refs/for/main"},
+		{"auto", "refs/heads/auto:refs/heads/deploy/auto", false, []string{
+			"refs/heads/auto:refs/heads/auto",
+			"refs/heads/auto:refs/heads/deploy/auto",
+		}, "auto and refspec refs/heads/auto:refs/heads/deploy/auto"},
+	} {
+		refspecs := pushRefspecs(c.branch, c.refspec, c.force)
+		if !reflect.DeepEqual(refspecs, c.expected) {
+			t.Errorf("expected refspecs %v for branch %q and refspec %q, got %v", c.expected, c.branch, c.refspec, refspecs)
+		}
+		if target := pushTargets(c.branch, c.refspec); target != c.target {
+			t.Errorf("expected push target %q, got %q", c.target, target)
+		}
+	}
+}
+
+func TestCheckPushBranch(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		ref   *sourcev1.GitRepositoryRef
+		push  *imagev1.PushSpec
+		valid bool
+	}{
+		{"branch, no push spec", &sourcev1.GitRepositoryRef{Branch: "main"}, nil, true},
+		{"no ref, no push spec", nil, nil, false},
+		{"tag, no push spec", &sourcev1.GitRepositoryRef{Tag: "v1.0.0"}, nil, false},
+		{"commit on branch, no push spec", &sourcev1.GitRepositoryRef{Branch: "main", Commit: "abc123"}, nil, false},
+		{"tag, push branch", &sourcev1.GitRepositoryRef{Tag: "v1.0.0"}, &imagev1.PushSpec{Branch: "auto"}, true},
+		{"semver, push refspec", &sourcev1.GitRepositoryRef{SemVer: ">=1.0.0"}, &imagev1.PushSpec{Refspec: "HEAD:refs/for/main"}, true},
+		{"commit on branch, push to other branch", &sourcev1.GitRepositoryRef{Branch: "main", Commit: "abc123"}, &imagev1.PushSpec{Branch: "auto"}, true},
+		{"commit on branch, push to same branch", &sourcev1.GitRepositoryRef{Branch: "main", Commit: "abc123"}, &imagev1.PushSpec{Branch: "main"}, false},
+	} {
+		if err := checkPushBranch(c.ref, c.push); (err == nil) != c.valid {
+			t.Errorf("%s: expected valid to be %v, got error %v", c.name, c.valid, err)
+		}
+	}
+}
+
+func TestBranchDiverged(t *testing.T) {
+	repo, err := gogit.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = populateRepoFromFixture(repo, "testdata/appconfig"); err != nil {
+		t.Fatal(err)
+	}
+	working, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(msg string) {
+		if _, err := working.Commit(msg, &gogit.CommitOptions{
+			Author: &object.Signature{Name: "Testbot", Email: "test@example.com", When: time.Now()},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkout := func(branch string, create bool) {
+		if err := working.Checkout(&gogit.CheckoutOptions{
+			Branch: plumbing.NewBranchReferenceName(branch),
+			Create: create,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	diverged := func() bool {
+		d, err := branchDiverged(repo, "auto")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	// a branch with commits on top of the base
+	checkout("auto", true)
+	commit("Update on the push branch")
+	checkout("master", false)
+	if diverged() {
+		t.Error("expected a branch ahead of the base not to have diverged")
+	}
+
+	// the base has moved on
+	commit("Change to the base")
+	if !diverged() {
+		t.Error("expected the branch to have diverged once the base has a commit it doesn't")
+	}
+
+	if err := resetBranch(repo, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	branch, err := repo.Reference(plumbing.NewBranchReferenceName("auto"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if branch.Hash() != head.Hash() {
+		t.Errorf("expected the branch to be reset to %s, got %s", head.Hash(), branch.Hash())
+	}
+	if diverged() {
+		t.Error("expected the branch not to have diverged once reset")
+	}
+}
+
+func TestRunGitOperation(t *testing.T) {
+	failed := errors.New("failed")
+	if err := runGitOperation(context.TODO(), func() error { return failed }); err != failed {
+		t.Errorf("expected the error from the operation, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+	block := make(chan struct{})
+	defer close(block)
+	start := time.Now()
+	err := runGitOperation(ctx, func() error {
+		<-block
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be reported, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to give up on the operation at the deadline, waited %v", elapsed)
+	}
+}
+
+func TestPushRefStatuses(t *testing.T) {
+	earlier := metav1.Date(2021, 10, 1, 10, 0, 0, 0, time.UTC)
+	now := time.Date(2021, 10, 2, 10, 0, 0, 0, time.UTC)
+	previous := []imagev1.PushRefStatus{
+		{Ref: "refs/heads/main", LastPushCommit: "abc", LastPushTime: &earlier},
+		{Ref: "refs/heads/deploy", LastPushCommit: "abc", LastPushTime: &earlier},
+		{Ref: "refs/heads/old", LastPushCommit: "abc", LastPushTime: &earlier},
+	}
+	refspecs := pushRefspecs("main", "+refs/heads/main:refs/heads/deploy", false)
+
+	for _, c := range []struct {
+		name     string
+		err      error
+		expected []imagev1.PushRefStatus
+	}{
+		{"success", nil, []imagev1.PushRefStatus{
+			{Ref: "refs/heads/main", LastPushCommit: "def", LastPushTime: &metav1.Time{Time: now}},
+			{Ref: "refs/heads/deploy", LastPushCommit: "def", LastPushTime: &metav1.Time{Time: now}},
+		}},
+		{"one rejected", &refsRejectedError{rejected: map[string]string{"refs/heads/deploy": "protected branch"}}, []imagev1.PushRefStatus{
+			{Ref: "refs/heads/main", LastPushCommit: "def", LastPushTime: &metav1.Time{Time: now}},
+			{Ref: "refs/heads/deploy", LastPushCommit: "abc", LastPushTime: &earlier, LastPushError: "protected branch"},
+		}},
+		{"failed", errors.New("connection refused"), []imagev1.PushRefStatus{
+			{Ref: "refs/heads/main", LastPushCommit: "abc", LastPushTime: &earlier, LastPushError: "connection refused"},
+			{Ref: "refs/heads/deploy", LastPushCommit: "abc", LastPushTime: &earlier, LastPushError: "connection refused"},
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			statuses := pushRefStatuses(previous, refspecs, "def", now, c.err)
+			if !reflect.DeepEqual(statuses, c.expected) {
+				t.Errorf("expected statuses %v, got %v", c.expected, statuses)
+			}
+		})
+	}
+}
+
+func TestRefsRejectedProtected(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		err       *refsRejectedError
+		protected bool
+	}{
+		{"GitHub", &refsRejectedError{rejected: map[string]string{"refs/heads/main": "protected branch hook declined"}}, true},
+		{"GitLab", &refsRejectedError{
+			rejected: map[string]string{"refs/heads/main": "pre-receive hook declined"},
+			messages: "GitLab: You are not allowed to push code to protected branches on this project.",
+		}, true},
+		{"other hook", &refsRejectedError{
+			rejected: map[string]string{"refs/heads/main": "hook declined"},
+			messages: "*** Rejecting push to non-main branch refs/heads/main",
+		}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if protected := c.err.protected(); protected != c.protected {
+				t.Errorf("expected protected to be %v", c.protected)
+			}
+		})
+	}
+}
+
+func TestBranchProtectedSince(t *testing.T) {
+	auto := &imagev1.ImageUpdateAutomation{ObjectMeta: metav1.ObjectMeta{Generation: 2}}
+	if branchProtectedSince(auto) {
+		t.Error("expected an automation that isn't stalled not to count as protected")
+	}
+	imagev1.SetImageUpdateAutomationStalled(auto, imagev1.InvalidSpecReason, "invalid")
+	if branchProtectedSince(auto) {
+		t.Error("expected an automation stalled for another reason not to count as protected")
+	}
+	imagev1.SetImageUpdateAutomationStalled(auto, imagev1.BranchProtectedReason, "protected")
+	if !branchProtectedSince(auto) {
+		t.Error("expected an automation stalled by a protected branch to count as protected")
+	}
+	auto.Generation = 3
+	if branchProtectedSince(auto) {
+		t.Error("expected an automation changed since being stalled not to count as protected")
+	}
 }
@@ -0,0 +1,89 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// An automation with health gates doesn't commit more updates until
+// the objects that apply its commits are healthy. This is checked
+// only once there are updates to commit, so that an automation with
+// nothing to do isn't held up.
+
+// healthGateAPIVersions gives the API version to use for each kind of
+// health gate, when a reference doesn't give one.
+var healthGateAPIVersions = map[string]string{
+	"Kustomization": "kustomize.toolkit.fluxcd.io/v1beta1",
+	"HelmRelease":   "helm.toolkit.fluxcd.io/v2beta1",
+}
+
+// checkHealthGates returns an error naming the first of the health
+// gates given that is missing, not ready, or yet to apply the last
+// commit pushed by the automation; or nil if they are all healthy.
+func (r *ImageUpdateAutomationReconciler) checkHealthGates(ctx context.Context, auto *imagev1.ImageUpdateAutomation, gates []imagev1.HealthGateReference) error {
+	for _, gate := range gates {
+		apiVersion := gate.APIVersion
+		if apiVersion == "" {
+			apiVersion = healthGateAPIVersions[gate.Kind]
+		}
+		name := types.NamespacedName{
+			Namespace: gate.Namespace,
+			Name:      gate.Name,
+		}
+		if name.Namespace == "" {
+			name.Namespace = auto.GetNamespace()
+		}
+
+		var obj unstructured.Unstructured
+		obj.SetAPIVersion(apiVersion)
+		obj.SetKind(gate.Kind)
+		if err := r.Get(ctx, name, &obj); err != nil {
+			return fmt.Errorf("unable to get %s '%s': %w", gate.Kind, name, err)
+		}
+		if !dependencyReady(&obj) {
+			return fmt.Errorf("%s '%s' is not ready", gate.Kind, name)
+		}
+		if !appliedCommit(&obj, auto.Status.LastPushCommit) {
+			return fmt.Errorf("%s '%s' has not applied commit %s", gate.Kind, name, auto.Status.LastPushCommit)
+		}
+	}
+	return nil
+}
+
+// appliedCommit reports whether the object given has applied the
+// commit given, going by the revision in its status. The revision of
+// a Kustomization is given as "<branch>/<commit>"; if the object has
+// no revision, or it doesn't name a commit (e.g., that of a
+// HelmRelease is a chart version), it's taken to have applied it.
+func appliedCommit(obj *unstructured.Unstructured, commit string) bool {
+	if commit == "" || obj.GetKind() != "Kustomization" {
+		return true
+	}
+	revision, ok, err := unstructured.NestedString(obj.Object, "status", "lastAppliedRevision")
+	if err != nil || !ok || revision == "" {
+		return true
+	}
+	return revision == commit || strings.HasSuffix(revision, "/"+commit)
+}
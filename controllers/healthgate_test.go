@@ -0,0 +1,52 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestAppliedCommit(t *testing.T) {
+	const commit = "3a9b3a5cd5d0c2d4e5f6a7b8c9d0e1f2a3b4c5d6"
+	for _, c := range []struct {
+		name     string
+		kind     string
+		revision string
+		commit   string
+		applied  bool
+	}{
+		{"applied", "Kustomization", "auto/" + commit, commit, true},
+		{"applied, without a branch", "Kustomization", commit, commit, true},
+		{"not yet applied", "Kustomization", "auto/0123456789abcdef0123456789abcdef01234567", commit, false},
+		{"no revision", "Kustomization", "", commit, true},
+		{"nothing pushed", "Kustomization", "auto/0123456789abcdef0123456789abcdef01234567", "", true},
+		{"chart version", "HelmRelease", "6.0.1", commit, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			obj := unstructured.Unstructured{Object: map[string]interface{}{}}
+			obj.SetKind(c.kind)
+			if c.revision != "" {
+				obj.Object["status"] = map[string]interface{}{"lastAppliedRevision": c.revision}
+			}
+			if applied := appliedCommit(&obj, c.commit); applied != c.applied {
+				t.Errorf("expected applied to be %v, got %v", c.applied, applied)
+			}
+		})
+	}
+}
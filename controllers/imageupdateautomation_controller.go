@@ -19,11 +19,16 @@ package controllers
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"text/template"
 	"time"
@@ -31,6 +36,7 @@ import (
 	"github.com/Masterminds/sprig/v3"
 
 	gogit "github.com/go-git/go-git/v5"
+	gogitconfig "github.com/go-git/go-git/v5/config"
 	libgit2 "github.com/libgit2/git2go/v31"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
@@ -39,16 +45,20 @@ import (
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
 	kuberecorder "k8s.io/client-go/tools/record"
 	"k8s.io/client-go/tools/reference"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
@@ -64,6 +74,7 @@ import (
 	"github.com/fluxcd/source-controller/pkg/git"
 	gitlibgit2 "github.com/fluxcd/source-controller/pkg/git/libgit2"
 	gitstrat "github.com/fluxcd/source-controller/pkg/git/strategy"
+	"github.com/fluxcd/source-controller/pkg/sourceignore"
 
 	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
 	"github.com/fluxcd/image-automation-controller/pkg/update"
@@ -77,11 +88,134 @@ const repoRefKey = ".spec.gitRepository"
 
 const signingSecretKey = "git.asc"
 
+// maxStatusFiles is the greatest number of files listed in the status;
+// NB the MaxItems annotation on .status.lastPushFiles and
+// .status.skippedFiles.
+const maxStatusFiles = 100
+
+// maxSummaryItems is the greatest number of files, and of image
+// updates, listed in the summary given with a push event.
+const maxSummaryItems = 10
+
 // TemplateData is the type of the value given to the commit message
 // template.
 type TemplateData struct {
 	AutomationObject types.NamespacedName
 	Updated          update.Result
+	Changed          Changes
+	// Policies gives the image policies that led to updates, in
+	// order of namespace then name.
+	Policies []PolicyMetadata
+}
+
+// PolicyMetadata gives the identity and metadata of an image policy,
+// so that commit messages can include, e.g., team ownership recorded
+// in its labels.
+type PolicyMetadata struct {
+	Name        string
+	Namespace   string
+	Labels      map[string]string
+	Annotations map[string]string
+	// LatestImage is the image ref chosen by the policy.
+	LatestImage string
+	// ImageRepository gives what the image reflector knows about the
+	// image repository the policy selects from.
+	ImageRepository ImageRepositoryMetadata
+}
+
+// ImageRepositoryMetadata gives the details of an image repository,
+// as recorded by the image reflector in its status. The fields other
+// than the name and namespace are left empty if the image repository
+// could not be found.
+type ImageRepositoryMetadata struct {
+	Name      string
+	Namespace string
+	// CanonicalImageName is the fully-qualified name of the image;
+	// e.g., "index.docker.io/library/helloworld".
+	CanonicalImageName string
+	// LastScanTime is the time at which the image repository was last
+	// scanned for tags.
+	LastScanTime *metav1.Time
+	// TagCount is the number of tags found in the last scan.
+	TagCount int
+}
+
+// Policy gives the metadata for the image policy that led to the
+// image ref given being used in an update; e.g., in a template,
+// `{{ range .Updated.Images }}{{ ($.Policy .).Labels.team }}{{ end }}`.
+func (t TemplateData) Policy(ref update.ImageRef) PolicyMetadata {
+	name := ref.Policy()
+	for _, p := range t.Policies {
+		if p.Name == name.Name && p.Namespace == name.Namespace {
+			return p
+		}
+	}
+	return PolicyMetadata{Name: name.Name, Namespace: name.Namespace}
+}
+
+// getImageRepositoryMetadata fills in the details of the image
+// repository named in `repoMeta` from its status. These are only used in
+// commit messages, so if the image repository can't be fetched, the
+// details are left empty rather than failing the automation run.
+func (r *ImageUpdateAutomationReconciler) getImageRepositoryMetadata(ctx context.Context, repoMeta *ImageRepositoryMetadata) {
+	var repo imagev1_reflect.ImageRepository
+	name := types.NamespacedName{Namespace: repoMeta.Namespace, Name: repoMeta.Name}
+	if err := r.Get(ctx, name, &repo); err != nil {
+		logr.FromContext(ctx).V(logger.DebugLevel).Info("unable to get image repository for commit message", "imagerepository", name, "error", err.Error())
+		return
+	}
+	repoMeta.CanonicalImageName = repo.Status.CanonicalImageName
+	if scan := repo.Status.LastScanResult; scan != nil {
+		repoMeta.TagCount = scan.TagCount
+		if !scan.ScanTime.IsZero() {
+			scanTime := scan.ScanTime
+			repoMeta.LastScanTime = &scanTime
+		}
+	}
+}
+
+// policiesUsed gives the metadata of the policies, of those given,
+// that led to updates in the result.
+func policiesUsed(result update.Result, policies []imagev1_reflect.ImagePolicy) []PolicyMetadata {
+	used := make(map[types.NamespacedName]bool)
+	for _, ref := range result.Images() {
+		used[ref.Policy()] = true
+	}
+	var metas []PolicyMetadata
+	for _, policy := range policies {
+		if used[types.NamespacedName{Name: policy.Name, Namespace: policy.Namespace}] {
+			repoRef := policy.Spec.ImageRepositoryRef
+			if repoRef.Namespace == "" {
+				repoRef.Namespace = policy.Namespace
+			}
+			metas = append(metas, PolicyMetadata{
+				Name:        policy.Name,
+				Namespace:   policy.Namespace,
+				Labels:      policy.Labels,
+				Annotations: policy.Annotations,
+				LatestImage: policy.Status.LatestImage,
+				ImageRepository: ImageRepositoryMetadata{
+					Name:      repoRef.Name,
+					Namespace: repoRef.Namespace,
+				},
+			})
+		}
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		if metas[i].Namespace != metas[j].Namespace {
+			return metas[i].Namespace < metas[j].Namespace
+		}
+		return metas[i].Name < metas[j].Name
+	})
+	return metas
+}
+
+// Changes describes the changes made to the working directory by an
+// automation run.
+type Changes struct {
+	// Files lists the files changed, relative to the root of the
+	// repository and in lexical order.
+	Files []string
 }
 
 // ImageUpdateAutomationReconciler reconciles a ImageUpdateAutomation object
@@ -91,17 +225,140 @@ type ImageUpdateAutomationReconciler struct {
 	EventRecorder         kuberecorder.EventRecorder
 	ExternalEventRecorder *events.Recorder
 	MetricsRecorder       *metrics.Recorder
+	AutomationMetrics     *AutomationMetrics
+	// AuditSink, if set, is sent a record of every push made.
+	AuditSink AuditSink
+	// ReportSink, if set, is sent a report of every automation run.
+	ReportSink ReportSink
+
+	requeueDependency time.Duration
+	runSlots          *runSlots
+	coalescer         *coalescer
+	repoLocks         *repoLocks
+	pushLeases        *pushLeases
+	pushLimiter       *pushLimiter
+	cloneCache        *cloneCache
+	scanLimits        []update.Option
+	scanCache         *scanCache
+	policyStore       *policyStore
+	workspaces        *workspaces
+	pushBackoff       pushBackoff
+	// restConfig is used to make clients impersonating the service
+	// accounts given by automations; see impersonation.go.
+	restConfig           *rest.Config
+	tenantClients        *tenantClients
+	noCrossNamespaceRefs bool
+	// gcpWorkloadIdentityProvider is what service account tokens are
+	// exchanged with for gcp identities; see cloudidentity.go.
+	gcpWorkloadIdentityProvider string
+	// shards, if not nil, says which shards this controller leads;
+	// shardEvents queues runs of the automations in a shard once it
+	// does. See shardelection.go.
+	shards      *shardElection
+	shardEvents chan event.GenericEvent
 }
 
 type ImageUpdateAutomationReconcilerOptions struct {
-	MaxConcurrentReconciles int
+	MaxConcurrentReconciles   int
+	DependencyRequeueInterval time.Duration
+	// RemoteProbeInterval is how often the git repository of each
+	// automation is checked for being reachable with its credentials;
+	// zero means never.
+	RemoteProbeInterval time.Duration
+	// CloneCacheDir, if set, is where a copy of each git repository
+	// is kept between runs, so that runs fetch only what's new rather
+	// than cloning. CloneCacheMaxSize bounds the size of the cache in
+	// bytes; zero means no bound.
+	CloneCacheDir     string
+	CloneCacheMaxSize int64
+	// MaxPushesPerHour limits how many pushes are made to each git
+	// repository in any hour; zero means no limit.
+	MaxPushesPerHour int
+	// CoalesceWindow, if more than zero, turns on running automations
+	// that use the same GitRepository and .spec.git together, and is
+	// how long each run waits for others to queue up behind it.
+	CoalesceWindow time.Duration
+	// PolicyDebounce is how long to wait, after an image policy
+	// changes, before running the automations it affects; changes
+	// to other policies in the meantime are seen by the same runs.
+	PolicyDebounce time.Duration
+	// MaxFileSize and MaxDocuments bound the memory used in scanning
+	// a repository for updates: files larger than MaxFileSize bytes
+	// are skipped, as are files beyond the first MaxDocuments YAML
+	// documents. Zero means no limit.
+	MaxFileSize  int64
+	MaxDocuments int
+	// MetadataOnlyPolicyWatch has image policies watched and cached
+	// for their metadata only; the parts of a policy that are needed
+	// are fetched when it changes. This uses less memory when there
+	// are many policies.
+	MetadataOnlyPolicyWatch bool
+	// PrefetchLead, if more than zero, is how long before each
+	// automation is due to run to bring the cached copy of its git
+	// repository up to date. It needs CloneCacheDir to be set.
+	PrefetchLead time.Duration
+	// WorkspaceSweepInterval is how often to remove the directories
+	// of runs that are no longer going (e.g., because the controller
+	// was killed during them), besides when starting; zero means
+	// only when starting.
+	WorkspaceSweepInterval time.Duration
+	// WorkspaceDir is the directory in which runs clone git
+	// repositories (e.g., a volume of its own); the default temporary
+	// directory if empty. WorkspaceMaxSize is the most bytes the
+	// working directory of a run may use, with the repository checked
+	// out; a run using more fails. Zero means no limit.
+	WorkspaceDir     string
+	WorkspaceMaxSize int64
+	// PushFailureBackoff is how long to wait before trying again
+	// after a push fails; the wait doubles with each failure in a
+	// row, up to MaxPushFailureBackoff. Zero means the default for
+	// either.
+	PushFailureBackoff    time.Duration
+	MaxPushFailureBackoff time.Duration
+	// PushLeaseNamespace, if not empty, is the namespace in which to
+	// hold a Lease for each branch pushed to, so that runs in other
+	// controllers pushing to the same branch take turns with those in
+	// this one.
+	PushLeaseNamespace string
+	// WebhookAddr, if not empty, is the address on which to serve
+	// signed requests to run automations straight away; see
+	// receiver.go.
+	WebhookAddr string
+	// NoCrossNamespaceRefs, if true, refuses to run automations that
+	// refer to objects in other namespaces; e.g., a dependency or a
+	// health gate.
+	NoCrossNamespaceRefs bool
+	// GCPWorkloadIdentityProvider is the name of the workload identity
+	// provider with which to exchange tokens for the service accounts
+	// of automations that use a gcp identity.
+	GCPWorkloadIdentityProvider string
+	// ShardElection, if not nil, has a leader elected for each shard
+	// of automations, in place of a single leader for them all; this
+	// controller then runs only the automations in the shards it
+	// leads. See shardelection.go.
+	ShardElection *ShardElectionOptions
 }
 
 // +kubebuilder:rbac:groups=image.toolkit.fluxcd.io,resources=imageupdateautomations,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=image.toolkit.fluxcd.io,resources=imageupdateautomations/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=image.toolkit.fluxcd.io,resources=imageupdateautomations/finalizers,verbs=get;create;update;patch;delete
+// +kubebuilder:rbac:groups=image.toolkit.fluxcd.io,resources=imageupdatechangerequests,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=image.toolkit.fluxcd.io,resources=imageupdatechangerequests/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=image.toolkit.fluxcd.io,resources=imageupdaterunrequests,verbs=get;list;watch
+// +kubebuilder:rbac:groups=image.toolkit.fluxcd.io,resources=imageupdaterunrequests/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=gitrepositories,verbs=get;list;watch
+// +kubebuilder:rbac:groups=kustomize.toolkit.fluxcd.io,resources=kustomizations,verbs=get;patch
+// +kubebuilder:rbac:groups=apps,resources=deployments;statefulsets;daemonsets,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups=helm.toolkit.fluxcd.io,resources=helmreleases,verbs=get
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+// +kubebuilder:rbac:groups=image.toolkit.fluxcd.io,resources=imagerepositories,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=impersonate
+// +kubebuilder:rbac:groups="",resources=serviceaccounts/token,verbs=create
 
 func (r *ImageUpdateAutomationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ctx, span := startRunSpan(ctx, req.NamespacedName)
+	defer span.End()
+
 	log := logr.FromContext(ctx)
 	debuglog := log.V(logger.DebugLevel)
 	tracelog := log.V(logger.TraceLevel)
@@ -110,17 +367,113 @@ func (r *ImageUpdateAutomationReconciler) Reconcile(ctx context.Context, req ctr
 
 	var auto imagev1.ImageUpdateAutomation
 	if err := r.Get(ctx, req.NamespacedName, &auto); err != nil {
+		if apierrors.IsNotFound(err) {
+			r.coalescer.forget(req.NamespacedName)
+			r.scanCache.forget(req.NamespacedName)
+		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	// an automation in a shard led by another controller is left to
+	// that controller; see shardelection.go
+	if !r.shards.leads(shardKey(&auto)) {
+		debuglog.Info("skipping automation in a shard not led by this controller", "shard", shardKey(&auto))
+		return ctrl.Result{}, nil
+	}
+
+	// an automation being deleted only has to be cleaned up after;
+	// see finalizer.go
+	if !auto.GetDeletionTimestamp().IsZero() {
+		return r.finalize(ctx, &auto)
+	}
+	if err := r.reconcileFinalizer(ctx, &auto); err != nil {
+		return ctrl.Result{}, err
+	}
+
 	// record suspension metrics
 	defer r.recordSuspension(ctx, auto)
 
-	if auto.Spec.Suspend {
+	// A run asked for with an ImageUpdateRunRequest is made with the
+	// request's overrides, and its outcome is recorded in the request;
+	// see runrequest.go.
+	runRequest, err := r.pendingRunRequest(ctx, &auto)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if runRequest != nil {
+		if err := applyRunOverrides(&auto, runRequest); err != nil {
+			log.Info("refusing run request", "request", runRequest.GetName(), "reason", err.Error())
+			r.finishRunRequest(ctx, runRequest, runFailed(imagev1.RunRequestRefusedReason, err.Error(), time.Now()))
+			// there may be another request to act on
+			return ctrl.Result{Requeue: true}, nil
+		}
+	}
+	var runOutcome *imagev1.ImageUpdateRunRequestStatus
+	if runRequest != nil {
+		defer func() { r.finishRunRequest(ctx, runRequest, runOutcome) }()
+	}
+
+	// A suspended automation doesn't run, unless it's to preview the
+	// updates it would make; then it runs as far as making them, but
+	// doesn't commit or push. A revert can be asked for whether or not
+	// the automation is suspended, as can a dry run, with a run
+	// request.
+	previewing := auto.Spec.Suspend && auto.Spec.PreviewWhileSuspended && runRequest == nil
+	revertToken, revertRequested := revertRequest(&auto)
+	approvalToken, approvalRequested, err := r.approvalRequest(ctx, &auto)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if auto.Spec.Suspend && !previewing && !revertRequested && runRequest == nil {
 		log.Info("ImageUpdateAutomation is suspended, skipping automation run")
+		// what was pending may not be by the time it's looked at again
+		if auto.Status.PendingUpdates != nil {
+			auto.Status.PendingUpdates = nil
+			return ctrl.Result{}, r.patchStatus(ctx, req, auto.Status)
+		}
 		return ctrl.Result{}, nil
 	}
 
+	// runs against the same git repository take turns; one that finds
+	// the repository busy comes back later, rather than holding up a
+	// worker. An automation targeting the cluster has no repository.
+	// A git operation given up on may still push, so the repository,
+	// and the branch pushed to, are held until it's done.
+	ctx = withGitOperations(ctx)
+	if auto.Spec.Cluster == nil {
+		repository := types.NamespacedName{Namespace: auto.GetNamespace(), Name: auto.Spec.SourceRef.Name}
+		releaseRepo, ok := r.repoLocks.tryAcquire(repository.String())
+		if !ok {
+			debuglog.Info("another run is using the git repository; requeueing", "gitrepository", repository, "after", repoBusyRequeue.String())
+			r.coalescer.putOffRun(req.NamespacedName, now)
+			return ctrl.Result{RequeueAfter: repoBusyRequeue}, nil
+		}
+		defer whenGitOperationsDone(ctx, releaseRepo)
+	}
+
+	// If automations are coalesced, this automation may have been run
+	// along with another while it was put off; otherwise, give the runs of
+	// other automations a chance to be put off behind this one, so
+	// they can be run along with it. A run asked for with a request is
+	// always made, since the request wants its outcome.
+	if run, ok := r.coalescer.servedSince(req.NamespacedName, r.coalescer.due(req.NamespacedName, now)); ok && runRequest == nil {
+		return r.finishServedRun(ctx, req, &auto, run)
+	}
+	if err := r.coalescer.wait(ctx); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// when there are more automations to run than there are slots,
+	// the most urgent get to go first.
+	if err := r.runSlots.acquire(ctx, auto.Spec.PriorityClass); err != nil {
+		return ctrl.Result{}, err
+	}
+	defer r.runSlots.release()
+
+	// Send the report of the run when exiting, from whatever status
+	// it leaves the automation with.
+	defer func() { r.sendReport(ctx, auto, runReport(&auto, now)) }()
+
 	templateValues.AutomationObject = req.NamespacedName
 
 	// Record readiness metric when exiting; if there's any points at
@@ -137,8 +490,11 @@ func (r *ImageUpdateAutomationReconciler) Reconcile(ctx context.Context, req ctr
 	}
 
 	// whatever else happens, we've now "seen" the reconcile
-	// annotation if it's there
+	// annotation if it's there; a run requested this way is never
+	// skipped.
+	var reconcileRequested bool
 	if token, ok := meta.ReconcileAnnotationValue(auto.GetAnnotations()); ok {
+		reconcileRequested = token != auto.Status.GetLastHandledReconcileRequest()
 		auto.Status.SetLastHandledReconcileRequest(token)
 
 		if err := r.patchStatus(ctx, req, auto.Status); err != nil {
@@ -148,7 +504,9 @@ func (r *ImageUpdateAutomationReconciler) Reconcile(ctx context.Context, req ctr
 
 	// failWithError is a helper for bailing on the reconciliation.
 	failWithError := func(err error) (ctrl.Result, error) {
-		r.event(ctx, auto, events.EventSeverityError, err.Error())
+		runOutcome = runFailed(meta.ReconciliationFailedReason, err.Error(), time.Now())
+		r.event(ctx, auto, events.EventSeverityError, err.Error(), nil)
+		r.countFailure(ctx, &auto, meta.ReconciliationFailedReason, err.Error())
 		imagev1.SetImageUpdateAutomationReadiness(&auto, metav1.ConditionFalse, meta.ReconciliationFailedReason, err.Error())
 		if err := r.patchStatus(ctx, req, auto.Status); err != nil {
 			log.Error(err, "failed to reconcile")
@@ -156,15 +514,130 @@ func (r *ImageUpdateAutomationReconciler) Reconcile(ctx context.Context, req ctr
 		return ctrl.Result{Requeue: true}, err
 	}
 
+	// stallWithError is for bailing when the automation is
+	// misconfigured in a way that another attempt won't fix; it's
+	// not requeued, since it will be reconciled when the spec (or
+	// the GitRepository) changes.
+	stallWithError := func(reason string, err error) (ctrl.Result, error) {
+		runOutcome = runFailed(reason, err.Error(), time.Now())
+		r.event(ctx, auto, events.EventSeverityError, err.Error(), nil)
+		r.countFailure(ctx, &auto, reason, err.Error())
+		imagev1.SetImageUpdateAutomationReadiness(&auto, metav1.ConditionFalse, reason, err.Error())
+		imagev1.SetImageUpdateAutomationStalled(&auto, reason, err.Error())
+		return ctrl.Result{}, r.patchStatus(ctx, req, auto.Status)
+	}
+
+	// progress records the stage the run has reached in a Reconciling
+	// condition, so that a slow run can be told apart from a stuck
+	// one. The condition is only in the status patched here; patching
+	// the status at the end of the run removes it.
+	progress := func(msg string) {
+		progressing := auto.DeepCopy()
+		imagev1.SetImageUpdateAutomationReconciling(progressing, msg)
+		if err := r.patchStatus(ctx, req, progressing.Status); err != nil {
+			log.Error(err, "unable to record progress", "stage", msg)
+		}
+	}
+
+	// in a cluster shared by tenants, an automation may be kept from
+	// referring to other namespaces, and from reading or changing
+	// anything its service account can't; from here on, what the
+	// automation refers to is read and written through the reconciler
+	// for its service account. See impersonation.go.
+	if r.noCrossNamespaceRefs {
+		if err := crossNamespaceRef(&auto); err != nil {
+			return stallWithError(imagev1.AccessDeniedReason, err)
+		}
+	}
+	tenant, err := r.impersonate(&auto)
+	if err != nil {
+		return failWithError(err)
+	}
+	r = tenant
+
+	// the automation doesn't run until everything it depends on is
+	// ready; there's no watch on the dependencies, so check back
+	// after an interval.
+	if len(auto.Spec.DependsOn) > 0 {
+		if err := r.checkDependencies(ctx, &auto); err != nil {
+			msg := fmt.Sprintf("dependencies not ready: %s", err)
+			imagev1.SetImageUpdateAutomationReadiness(&auto, metav1.ConditionFalse, meta.DependencyNotReadyReason, msg)
+			if err := r.patchStatus(ctx, req, auto.Status); err != nil {
+				return ctrl.Result{Requeue: true}, err
+			}
+			log.Info(msg, "retry-after", r.requeueDependency)
+			return ctrl.Result{RequeueAfter: r.requeueDependency}, nil
+		}
+		debuglog.Info("all dependencies are ready")
+	}
+
+	// an automation targeting the cluster applies its updates there,
+	// and doesn't go anywhere near git; see cluster.go
+	if auto.Spec.Cluster != nil {
+		dryRun := auto.Spec.DryRun || previewing
+		updates, err := r.applyToCluster(ctx, &auto, func(policy string) bool { return runsPolicy(runRequest, policy) }, dryRun)
+		auto.Status.ReferencedPolicies = updates.policies
+		if err != nil {
+			return failWithError(err)
+		}
+		statusMessage := clusterStatusMessage(updates, dryRun)
+		if len(updates.objects) > 0 {
+			log.Info(statusMessage, "images", updates.images)
+			if !dryRun {
+				auto.Status.LastClusterUpdate = &imagev1.ClusterUpdateResult{
+					Time:    metav1.Time{Time: now},
+					Objects: updates.objects,
+					Images:  updates.images,
+				}
+			}
+			if dryRun || auto.Spec.EventVerbosity != imagev1.EventVerbosityErrors {
+				r.event(ctx, auto, events.EventSeverityInfo, statusMessage, nil)
+			}
+		}
+		auto.Status.LastAutomationRunTime = &metav1.Time{Time: now}
+		resetFailures(&auto)
+		imagev1.SetImageUpdateAutomationReadiness(&auto, metav1.ConditionTrue, meta.ReconciliationSucceededReason, statusMessage)
+		if err := r.patchStatus(ctx, req, auto.Status); err != nil {
+			return ctrl.Result{Requeue: true}, err
+		}
+		runOutcome = runSucceeded("", false, updates.images, nil, statusMessage, time.Now())
+		return ctrl.Result{RequeueAfter: intervalOrDefault(&auto)}, nil
+	}
+
 	// get the git repository object so it can be checked out
 
 	// only GitRepository objects are supported for now
+	if auto.Spec.SourceRef.Name == "" {
+		return stallWithError(imagev1.InvalidSpecReason, fmt.Errorf("one of .spec.sourceRef or .spec.cluster must be given"))
+	}
 	if kind := auto.Spec.SourceRef.Kind; kind != sourcev1.GitRepositoryKind {
-		return failWithError(fmt.Errorf("source kind %q not supported", kind))
+		return stallWithError(imagev1.InvalidSpecReason, fmt.Errorf("source kind %q not supported", kind))
 	}
 	gitSpec := auto.Spec.GitSpec
 	if gitSpec == nil {
-		return failWithError(fmt.Errorf("source kind %s neccessitates field .spec.git", sourcev1.GitRepositoryKind))
+		return stallWithError(imagev1.InvalidSpecReason, fmt.Errorf("source kind %s neccessitates field .spec.git", sourcev1.GitRepositoryKind))
+	}
+
+	messageTemplate, err := r.getMessageTemplate(ctx, &auto)
+	if err != nil {
+		return failWithError(err)
+	}
+	commitAuthor, err := r.getCommitAuthor(ctx, &auto)
+	if err != nil {
+		return failWithError(err)
+	}
+
+	// check the commit message template before doing anything
+	// expensive; there's no point trying again until the template is
+	// changed. That will be a change to the spec, unless the template
+	// is in a ConfigMap, which isn't watched, so is checked again at
+	// the next interval.
+	if err := validateCommitTemplates(gitSpec.Commit.SubjectTemplate, messageTemplate, templateValues); err != nil {
+		result, patchErr := stallWithError(imagev1.InvalidCommitTemplateReason, err)
+		if gitSpec.Commit.MessageTemplateFrom != nil {
+			result.RequeueAfter = intervalOrDefault(&auto)
+		}
+		return result, patchErr
 	}
 
 	var origin sourcev1.GitRepository
@@ -174,7 +647,10 @@ func (r *ImageUpdateAutomationReconciler) Reconcile(ctx context.Context, req ctr
 	}
 	debuglog.Info("fetching git repository", "gitrepository", originName)
 
-	if err := r.Get(ctx, originName, &origin); err != nil {
+	sourceCtx, endSourceSpan := startSpan(ctx, getSourceSpan)
+	err = r.Get(sourceCtx, originName, &origin)
+	endSourceSpan(err)
+	if err != nil {
 		if client.IgnoreNotFound(err) == nil {
 			imagev1.SetImageUpdateAutomationReadiness(&auto, metav1.ConditionFalse, imagev1.GitNotAvailableReason, "referenced git repository is missing")
 			log.Error(err, "referenced git repository does not exist")
@@ -196,97 +672,547 @@ func (r *ImageUpdateAutomationReconciler) Reconcile(ctx context.Context, req ctr
 		tracelog.Info("using git repository ref from GitRepository spec", "ref", ref)
 	} // else remain as `nil`, which is an acceptable value for cloneInto, later.
 
-	var pushBranch string
+	// When there's a push branch, commits are made on that branch
+	// and pushed to it; a push refspec can be given as well as, or
+	// instead of, a branch.
+	var pushBranch, pushRefspec string
 	if gitSpec.Push != nil {
 		pushBranch = gitSpec.Push.Branch
-		tracelog.Info("using push branch from .spec.push.branch", "branch", pushBranch)
-	} else {
-		// Here's where it gets constrained. If there's no push branch
-		// given, then the checkout ref must include a branch, and
-		// that can be used.
-		if ref == nil || ref.Branch == "" {
-			return failWithError(fmt.Errorf("Push branch not given explicitly, and cannot be inferred from .spec.git.checkout.ref or GitRepository .spec.ref"))
+		pushRefspec = gitSpec.Push.Refspec
+		if pushBranch == "" && pushRefspec == "" {
+			return stallWithError(imagev1.InvalidSpecReason, fmt.Errorf("at least one of .spec.git.push.branch and .spec.git.push.refspec must be given"))
+		}
+		if pushRefspec != "" {
+			if err := gogitconfig.RefSpec(pushRefspec).Validate(); err != nil {
+				return stallWithError(imagev1.InvalidSpecReason, fmt.Errorf("invalid push refspec %q: %w", pushRefspec, err))
+			}
 		}
+	}
+	// Here's where it gets constrained. If there's no push branch
+	// given, then the checkout ref must be a branch, and that can be
+	// used.
+	if err := checkPushBranch(ref, gitSpec.Push); err != nil {
+		return stallWithError(imagev1.InvalidPushBranchReason, err)
+	}
+	if gitSpec.Push != nil {
+		tracelog.Info("using push branch and refspec from .spec.git.push", "branch", pushBranch, "refspec", pushRefspec)
+	} else {
 		pushBranch = ref.Branch
 		tracelog.Info("using push branch from $ref.branch", "branch", pushBranch)
 	}
+	// Commits pushed to the push branch can be promoted from there to
+	// a canary branch; see canary.go.
+	var canary *imagev1.CanarySpec
+	if gitSpec.Push != nil {
+		canary = gitSpec.Push.Canary
+	}
+	if canary != nil && (pushBranch == "" || canary.Branch == pushBranch) {
+		return stallWithError(imagev1.InvalidSpecReason, fmt.Errorf(".spec.git.push.canary needs a push branch other than the canary branch"))
+	}
+	if canary == nil {
+		auto.Status.Canary = nil
+	}
+
+	// A revert asked for with the annotation is made in place of a
+	// run; see revert.go.
+	if revertRequested {
+		return r.revertLastPush(ctx, req, &auto, revertToken, &origin, ref, pushBranch, pushRefspec)
+	}
+	// So are promotions to the canary branch, of the commits that
+	// have been on the push branch for the soak time.
+	if due := canaryDue(canary, auto.Status.Canary, time.Now()); len(due) > 0 && !auto.Spec.Suspend {
+		return r.promoteCanary(ctx, req, &auto, &origin, pushBranch, due)
+	}
 
-	tmp, err := os.MkdirTemp("", fmt.Sprintf("%s-%s", originName.Namespace, originName.Name))
+	// Having been stalled by a push to a protected branch, the
+	// automation doesn't run again until it's changed or a run is
+	// requested; see the handling of rejected pushes, below.
+	if branchProtectedSince(&auto) && !reconcileRequested && runRequest == nil {
+		log.Info("the push branch was protected when last pushed to; not running until the automation is changed, or a reconciliation is requested")
+		return ctrl.Result{}, nil
+	}
+
+	// the spec has passed muster, so the automation is no longer
+	// stalled (if it was); this is recorded with the rest of the
+	// status at the end of the run.
+	apimeta.RemoveStatusCondition(&auto.Status.Conditions, meta.StalledCondition)
+
+	// If the repository has had as many pushes as it's allowed for
+	// now, there's no point running until it can have another; the
+	// updates will all be made then. A dry run or preview doesn't
+	// push, so isn't held back.
+	if wait := r.pushLimiter.wait(origin.Spec.URL, time.Now()); wait > 0 && !auto.Spec.DryRun && !previewing {
+		wait = wait.Round(time.Second)
+		log.Info("push rate limit reached for git repository; waiting", "url", origin.Spec.URL, "wait", wait.String())
+		imagev1.SetImageUpdateAutomationPushed(&auto, metav1.ConditionFalse, imagev1.PushRateLimitedReason,
+			fmt.Sprintf("push rate limit reached for %s; the next run is in %s", origin.Spec.URL, wait))
+		if err := r.patchStatus(ctx, req, auto.Status); err != nil {
+			return ctrl.Result{Requeue: true}, err
+		}
+		return ctrl.Result{RequeueAfter: wait}, nil
+	}
+
+	// Runs pushing to the same branch take turns, even if they use
+	// different GitRepository objects, or are in other controllers. A
+	// dry run or preview doesn't need a turn.
+	if !auto.Spec.DryRun && !previewing {
+		pushTarget := pushBranch
+		if pushTarget == "" {
+			pushTarget = pushRefspec
+		}
+		releasePush, wait, err := r.pushLeases.acquire(ctx, origin.Spec.URL, pushTarget)
+		if err != nil {
+			return failWithError(err)
+		}
+		if wait > 0 {
+			wait = wait.Round(time.Second)
+			log.Info("another controller is pushing to the branch; waiting", "url", origin.Spec.URL, "branch", pushTarget, "wait", wait.String())
+			return ctrl.Result{RequeueAfter: wait}, nil
+		}
+		defer whenGitOperationsDone(ctx, releasePush)
+	}
+
+	ctx, tmp, removeWorkspace, err := r.workspaces.create(ctx, fmt.Sprintf("%s-%s", originName.Namespace, originName.Name))
 	if err != nil {
 		return failWithError(err)
 	}
-	defer os.RemoveAll(tmp)
+	defer removeWorkspace()
 
-	// FIXME use context with deadline for at least the following ops
+	// If there's a timeout for the run, the git operations and the
+	// update all have to finish within it.
+	runCtx := ctx
+	if auto.Spec.Timeout != nil {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, auto.Spec.Timeout.Duration)
+		defer cancel()
+	}
 
 	debuglog.Info("attempting to clone git repository", "gitrepository", originName, "ref", ref, "working", tmp)
 
-	access, err := r.getRepoAccess(ctx, &origin)
+	access, err := r.getRepoAccess(ctx, &auto, &origin)
 	if err != nil {
 		return failWithError(err)
 	}
 
 	// Use the git operations timeout for the repo.
-	cloneCtx, cancel := context.WithTimeout(ctx, origin.Spec.Timeout.Duration)
+	cloneCtx, cancel := gitOperationContext(runCtx, &origin)
 	defer cancel()
+	// The updates to make are those of this automation, and of any
+	// automations run along with it. The overrides of a run request
+	// are only for this automation, so it's run alone.
+	var coalesced []imagev1.ImageUpdateAutomation
+	if runRequest == nil {
+		if coalesced, err = r.coalescedAutomations(ctx, &auto); err != nil {
+			return failWithError(err)
+		}
+	}
+	strategies := []*imagev1.UpdateStrategy{auto.Spec.Update}
+	for i := range coalesced {
+		strategies = append(strategies, coalesced[i].Spec.Update)
+	}
+
+	// If nothing the run depends on has changed since the last
+	// successful run, it would make no changes, so it's skipped. The
+	// state of the repository is known without cloning only when the
+	// automation checks out and pushes to the branch the
+	// GitRepository follows, from the revision of its artifact. A
+	// promotion also depends on how long images have been in each
+	// stage, so it's never skipped.
+	staged := auto.Spec.Update != nil && len(auto.Spec.Update.Stages) > 0
+	var digest string
+	if len(coalesced) == 0 && !staged && gitSpec.Checkout == nil && pushRefspec == "" &&
+		ref != nil && ref.Branch == pushBranch && origin.Status.Artifact != nil {
+		// the files are as they were in the last run, so the
+		// policies their markers refer to are those recorded then
+		current, err := r.getPolicies(ctx, auto.GetNamespace(), auto.Status.ReferencedPolicies)
+		if err != nil {
+			return failWithError(err)
+		}
+		digest = runDigest(auto.GetGeneration(), origin.Status.Artifact.Revision, current)
+		if !reconcileRequested && runRequest == nil && !approvalRequested && digest == auto.Status.LastRunDigest &&
+			apimeta.IsStatusConditionTrue(auto.Status.Conditions, meta.ReadyCondition) {
+			debuglog.Info("nothing has changed since the last run; skipping", "revision", origin.Status.Artifact.Revision)
+			return ctrl.Result{RequeueAfter: intervalOrDefault(&auto)}, nil
+		}
+	}
+
+	// When updates are confined to some directories, only those
+	// are checked out.
+	var sparse []string
+	if auto.Spec.Update != nil && auto.Spec.Update.Strategy == imagev1.UpdateStrategySetters {
+		for _, strategy := range strategies {
+			paths := sparsePaths(strategy)
+			if paths == nil {
+				sparse = nil
+				break
+			}
+			sparse = append(sparse, paths...)
+		}
+		// the file recording updates is committed along with them
+		if manifest := gitSpec.Commit.UpdateManifest; sparse != nil && manifest != nil {
+			if dir := updateManifestDir(manifest.Path); dir != "" {
+				sparse = append(sparse, dir)
+			} else {
+				sparse = nil
+			}
+		}
+	}
+
+	// this run sees the repository and the policies as they are from
+	// now on, which is what counts for automations run along with it
+	runStart := time.Now()
+
+	progress(fmt.Sprintf("cloning %s", origin.Spec.URL))
+	cloneCtx, endCloneSpan := startSpan(cloneCtx, cloneSpan)
 	var repo *gogit.Repository
-	if repo, err = cloneInto(cloneCtx, access, ref, tmp); err != nil {
+	cloneStart := time.Now()
+	if r.cloneCache != nil {
+		repo, err = r.cloneCache.cloneInto(cloneCtx, originName, access, ref, tmp, sparse)
+	} else {
+		repo, err = cloneInto(cloneCtx, access, ref, tmp, sparse)
+	}
+	r.AutomationMetrics.RecordDuration(req.NamespacedName, cloneOperation, gitImplementation, cloneStart)
+	endCloneSpan(err)
+	if err != nil {
+		return failWithError(err)
+	}
+	if err := r.workspaces.checkSize(tmp); err != nil {
 		return failWithError(err)
 	}
 
 	// When there's a push spec, the pushed-to branch is where commits
-	// shall be made
+	// shall be made. If the branch is recreated from the checkout ref,
+	// it has to be force-pushed.
+	var resetPushBranch bool
 
-	if gitSpec.Push != nil {
+	if gitSpec.Push != nil && pushBranch != "" {
 		// Use the git operations timeout for the repo.
-		fetchCtx, cancel := context.WithTimeout(ctx, origin.Spec.Timeout.Duration)
+		fetchCtx, cancel := gitOperationContext(runCtx, &origin)
 		defer cancel()
-		if err := fetch(fetchCtx, tmp, pushBranch, access); err != nil && err != errRemoteBranchMissing {
-			return failWithError(err)
+		progress(fmt.Sprintf("fetching branch %s", pushBranch))
+		fetchCtx, endFetchSpan := startSpan(fetchCtx, fetchSpan)
+		fetchStart := time.Now()
+		access, err = r.withRotatedAuth(ctx, &auto, &origin, access, func(access repoAccess) error {
+			return fetch(fetchCtx, tmp, pushBranch, access, func(p libgit2.TransferProgress) {
+				r.AutomationMetrics.RecordTransferProgress(req.NamespacedName, fetchOperation, p)
+			})
+		})
+		r.AutomationMetrics.RecordDuration(req.NamespacedName, fetchOperation, gitImplementation, fetchStart)
+		if err == errRemoteBranchMissing {
+			endFetchSpan(nil)
+		} else {
+			endFetchSpan(err)
 		}
-		if err = switchBranch(repo, pushBranch); err != nil {
+		if err != nil && err != errRemoteBranchMissing {
 			return failWithError(err)
 		}
-	}
-
-	manifestsPath := tmp
-	if auto.Spec.Update.Path != "" {
-		tracelog.Info("adjusting update path according to .spec.update.path", "base", tmp, "spec-path", auto.Spec.Update.Path)
-		if p, err := securejoin.SecureJoin(tmp, auto.Spec.Update.Path); err != nil {
+		// A push branch that isn't at the origin is made from the
+		// revision checked out, rather than any local branch of the
+		// same name; e.g., checking out a commit with go-git leaves
+		// the branch it was found on as a local branch.
+		if err == errRemoteBranchMissing {
+			if err := resetBranch(repo, pushBranch); err != nil {
+				return failWithError(err)
+			}
+		}
+		if err == nil && gitSpec.Push.ResetToBase {
+			diverged, err := branchDiverged(repo, pushBranch)
+			if err != nil {
+				return failWithError(err)
+			}
+			if diverged {
+				log.Info("push branch has diverged from the checkout ref; recreating it from there", "branch", pushBranch)
+				if err := resetBranch(repo, pushBranch); err != nil {
+					return failWithError(err)
+				}
+				resetPushBranch = true
+			}
+		}
+		if err = switchBranch(repo, tmp, pushBranch, sparse); err != nil {
 			return failWithError(err)
-		} else {
-			manifestsPath = p
 		}
 	}
 
+	// the image policies are needed after updating, to record which
+	// have been applied
+	var policies imagev1_reflect.ImagePolicyList
+	// the images in each stage of a promotion, as of this run
+	var stageStatuses []imagev1.StageStatus
+
 	switch {
 	case auto.Spec.Update != nil && auto.Spec.Update.Strategy == imagev1.UpdateStrategySetters:
-		// For setters we first want to compile a list of _all_ the
-		// policies in the same namespace (maybe in the future this
-		// could be filtered by the automation object).
-		var policies imagev1_reflect.ImagePolicyList
-		if err := r.List(ctx, &policies, &client.ListOptions{Namespace: req.NamespacedName.Namespace}); err != nil {
+		updatePaths := make([][]imagev1.UpdatePath, len(strategies))
+		for i, strategy := range strategies {
+			if updatePaths[i], err = pathsToUpdate(strategy); err != nil {
+				return failWithError(err)
+			}
+		}
+
+		// Submodules aren't checked out in cloning; those containing
+		// the paths to update are, if asked for.
+		var submodules []string
+		var submodulePathsToInit []string
+		for i, strategy := range strategies {
+			if strategy.InitSubmodules {
+				for _, updatePath := range updatePaths[i] {
+					submodulePathsToInit = append(submodulePathsToInit, repoPath(updatePath.Path))
+				}
+			}
+		}
+		if len(submodulePathsToInit) > 0 {
+			all, err := submodulePaths(repo)
+			if err != nil {
+				return failWithError(err)
+			}
+			submodules = submodulesContaining(all, submodulePathsToInit)
+		}
+		if len(submodules) > 0 {
+			progress("checking out submodules")
+			debuglog.Info("checking out submodules", "submodules", submodules)
+			submoduleCtx, cancel := gitOperationContext(runCtx, &origin)
+			defer cancel()
+			if err := initSubmodules(submoduleCtx, access, tmp, submodules); err != nil {
+				return failWithError(err)
+			}
+			if err := r.workspaces.checkSize(tmp); err != nil {
+				return failWithError(err)
+			}
+		}
+
+		// Rather than list every policy in the namespace, the
+		// policies the markers referred to in the last run are
+		// fetched, and those any other markers refer to are looked
+		// up as they are found. Markers can only refer to policies
+		// in the automation's namespace. Detecting image fields
+		// without markers needs every policy in the namespace,
+		// though. A run request can narrow the policies down
+		// further.
+		policyNames := auto.Status.ReferencedPolicies
+		if detectingImages(strategies) {
+			if policyNames, err = r.listPolicyNames(ctx, req.NamespacedName.Namespace); err != nil {
+				return failWithError(err)
+			}
+		}
+		if policies.Items, err = r.getPolicies(ctx, req.NamespacedName.Namespace, policyNames); err != nil {
 			return failWithError(err)
 		}
+		policies.Items = runPolicies(runRequest, policies.Items)
+		lookupPolicy := func(name types.NamespacedName) (*imagev1_reflect.ImagePolicy, error) {
+			if name.Namespace != req.NamespacedName.Namespace || !runsPolicy(runRequest, name.Name) {
+				return nil, nil
+			}
+			policy, err := r.getPolicy(ctx, name)
+			if policy != nil {
+				policies.Items = append(policies.Items, *policy)
+			}
+			return policy, err
+		}
 
-		debuglog.Info("updating with setters according to image policies", "count", len(policies.Items), "manifests-path", manifestsPath)
 		if tracelog.Enabled() {
 			for _, item := range policies.Items {
 				tracelog.Info("found policy", "namespace", item.Namespace, "name", item.Name, "latest-image", item.Status.LatestImage)
 			}
 		}
 
-		if result, err := updateAccordingToSetters(ctx, tracelog, manifestsPath, policies.Items); err != nil {
+		head, err := repo.Head()
+		if err != nil {
 			return failWithError(err)
-		} else {
-			templateValues.Updated = result
+		}
+		headCommit, err := repo.CommitObject(head.Hash())
+		if err != nil {
+			return failWithError(err)
+		}
+		headTree, err := headCommit.Tree()
+		if err != nil {
+			return failWithError(err)
+		}
+		ignoreFiles, err := sourceIgnoreFiles(headTree)
+		if err != nil {
+			return failWithError(err)
+		}
+
+		// If the repository has been scanned before, only the files
+		// that had markers then, and the files changed since, need
+		// to be scanned now.
+		scope, err := scanScope(strategies, origin.Spec.Ignore, ignoreFiles)
+		if err != nil {
+			return failWithError(err)
+		}
+		var scanOnly []update.Option
+		if entry, ok := r.scanCache.get(req.NamespacedName, scope); ok {
+			if candidates, ok := scanCandidates(repo, entry, head.Hash()); ok {
+				debuglog.Info("scanning only the files that had markers or have changed", "since", entry.revision.String(), "count", len(candidates))
+				scanOnly = []update.Option{update.WithOnlyFiles(tmp, candidates)}
+			} else {
+				debuglog.Info("scanning the whole repository", "since", entry.revision.String())
+			}
+		}
+		var screened []string
+		var skippedFiles []imagev1.SkippedFile
+
+		// A promotion puts in each stage after the first only the
+		// images ready to leave the stage before it; see promotion.go.
+		var promoted []map[types.NamespacedName]string
+		if staged {
+			promoted = r.promotedImages(ctx, &auto, now)
+		}
+
+		templateValues.Updated = update.Result{
+			Files:           make(map[string]update.FileResult),
+			MatchedPolicies: make(map[types.NamespacedName]struct{}),
+			MarkedPolicies:  make(map[types.NamespacedName]struct{}),
+		}
+		progress("updating manifests")
+		updateCtx, endUpdateSpan := startSpan(runCtx, updateSpan)
+		updateStart := time.Now()
+		for i, strategy := range strategies {
+			// Files ignored by the GitRepository, or by .sourceignore
+			// files, are out of scope for updates, as are those ignored by the automation itself.
+			ignorePatterns := sourceIgnorePatterns(ignoreFiles)
+			for _, ignore := range []*string{origin.Spec.Ignore, strategy.Ignore} {
+				if ignore != nil {
+					ignorePatterns = append(ignorePatterns, sourceignore.ReadPatterns(strings.NewReader(*ignore), nil)...)
+				}
+			}
+
+			for j, updatePath := range updatePaths[i] {
+				manifestsPath := tmp
+				if updatePath.Path != "" {
+					tracelog.Info("adjusting update path according to .spec.update", "base", tmp, "spec-path", updatePath.Path)
+					if p, err := securejoin.SecureJoin(tmp, updatePath.Path); err != nil {
+						endUpdateSpan(err)
+						return failWithError(err)
+					} else {
+						manifestsPath = p
+					}
+				}
+
+				debuglog.Info("updating with setters according to image policies", "count", len(policies.Items), "manifests-path", manifestsPath)
+				opts := append([]update.Option{
+					update.WithInclude(updatePath.Include...), update.WithExclude(updatePath.Exclude...),
+					update.WithIgnore(tmp, ignorePatterns),
+					update.WithSymlinks(tmp, update.SymlinkPolicy(strategy.Symlinks)),
+					update.WithImageFormat(update.ImageFormat(strategy.ImageFormat)),
+					update.WithRegistryRewrites(registryRewrites(strategy.RegistryRewrites)...),
+					update.WithAllowedPathsRoot(tmp),
+					update.WithDetectImages(strategy.DetectImages),
+				}, r.scanLimits...)
+				opts = append(opts, scanOnly...)
+				stagePolicies, stageLookup := policies.Items, lookupPolicy
+				if staged {
+					stagePolicies = withImages(policies.Items, promoted[j])
+					stageLookup = func(name types.NamespacedName) (*imagev1_reflect.ImagePolicy, error) {
+						policy, err := lookupPolicy(name)
+						if policy != nil {
+							policy = &withImages([]imagev1_reflect.ImagePolicy{*policy}, promoted[j])[0]
+						}
+						return policy, err
+					}
+				}
+				opts = append(opts, update.WithPolicyLookup(stageLookup))
+				result, err := updateAccordingToSetters(updateCtx, tracelog, manifestsPath, stagePolicies, opts...)
+				if err != nil {
+					endUpdateSpan(err)
+					if runCtx.Err() != nil {
+						err = fmt.Errorf("automation run did not complete within .spec.timeout: %w", runCtx.Err())
+					}
+					return failWithError(err)
+				}
+				if staged {
+					stage := strategy.Stages[j]
+					stageStatuses = append(stageStatuses, stageStatus(stage.Name, findStage(auto.Status.Stages, stage.Name),
+						result.MarkedPolicies, withImages(policies.Items, promoted[j]), now))
+				}
+
+				// When there's more than one path, the file names in
+				// the result are made relative to the root of the
+				// repository, so they can be told apart. The files are
+				// gone through in order of name, so that any skipped
+				// are listed in the same order each time.
+				files := make([]string, 0, len(result.Files))
+				for file := range result.Files {
+					files = append(files, file)
+				}
+				sort.Strings(files)
+				for _, file := range files {
+					fileResult := result.Files[file]
+					// changes within a submodule aren't committed
+					inRepo := filepath.ToSlash(filepath.Join(updatePath.Path, file))
+					if len(submodules) > 0 && withinPaths(inRepo, submodules) {
+						result.Skipped = append(result.Skipped, update.SkippedFile{
+							Path:    file,
+							Reason:  skipInSubmodule,
+							Message: "changes within a submodule are not committed",
+							Marked:  true,
+						})
+						continue
+					}
+					if len(strategy.Paths) > 0 || len(strategy.Stages) > 0 || len(strategies) > 1 {
+						file = filepath.ToSlash(filepath.Join(updatePath.Path, file))
+					}
+					templateValues.Updated.Files[file] = fileResult
+				}
+				templateValues.Updated.Matched += result.Matched
+				for policy := range result.MatchedPolicies {
+					templateValues.Updated.MatchedPolicies[policy] = struct{}{}
+				}
+				for policy := range result.MarkedPolicies {
+					templateValues.Updated.MarkedPolicies[policy] = struct{}{}
+				}
+				for _, file := range result.ScreenedFiles {
+					screened = append(screened, filepath.ToSlash(filepath.Join(updatePath.Path, file)))
+				}
+				for _, skipped := range result.Skipped {
+					skippedFiles = append(skippedFiles, imagev1.SkippedFile{
+						Path:    filepath.ToSlash(filepath.Join(updatePath.Path, skipped.Path)),
+						Reason:  string(skipped.Reason),
+						Message: skipped.Message,
+					})
+					if len(strategy.Paths) > 0 || len(strategy.Stages) > 0 || len(strategies) > 1 {
+						skipped.Path = filepath.ToSlash(filepath.Join(updatePath.Path, skipped.Path))
+					}
+					templateValues.Updated.Skipped = append(templateValues.Updated.Skipped, skipped)
+				}
+			}
+		}
+		if len(skippedFiles) > maxStatusFiles {
+			skippedFiles = skippedFiles[:maxStatusFiles]
+		}
+		if skipped := templateValues.Updated.Skipped; len(skipped) > 0 {
+			log.Info("files were skipped in scanning for updates", "skipped", skipped)
+			// the same files are skipped run after run until someone
+			// does something about them, so there's only an event
+			// when that changes
+			if skippedFilesChanged(auto.Status.SkippedFiles, skippedFiles) {
+				// Files with markers need seeing to; those without
+				// may have had nothing to update, and are only noted.
+				marked, unmarked := splitSkippedFiles(skipped)
+				if len(marked) > 0 {
+					r.event(ctx, auto, events.EventSeverityError, skippedFilesMessage(marked, true), nil)
+				}
+				if len(unmarked) > 0 {
+					r.event(ctx, auto, events.EventSeverityInfo, skippedFilesMessage(unmarked, false), nil)
+				}
+			}
+		}
+		r.AutomationMetrics.RecordDuration(req.NamespacedName, updateOperation, "", updateStart)
+		endUpdateSpan(nil)
+		r.scanCache.put(req.NamespacedName, scanEntry{scope: scope, revision: head.Hash(), files: screened})
+		auto.Status.SkippedFiles = skippedFiles
+		auto.Status.ReferencedPolicies = referencedPolicies(templateValues.Updated, req.NamespacedName.Namespace)
+		auto.Status.ObservedPolicies = observedPolicies(policiesMarked(templateValues.Updated, policies.Items))
+		templateValues.Policies = policiesUsed(templateValues.Updated, policies.Items)
+		for i := range templateValues.Policies {
+			r.getImageRepositoryMetadata(ctx, &templateValues.Policies[i].ImageRepository)
 		}
 	default:
 		log.Info("no update strategy given in the spec")
 		// no sense rescheduling until this resource changes
-		r.event(ctx, auto, events.EventSeverityInfo, "no known update strategy in spec, failing trivially")
-		imagev1.SetImageUpdateAutomationReadiness(&auto, metav1.ConditionFalse, imagev1.NoStrategyReason, "no known update strategy is given for object")
-		return ctrl.Result{}, r.patchStatus(ctx, req, auto.Status)
+		return stallWithError(imagev1.NoStrategyReason, errors.New("no known update strategy is given for object"))
+	}
+
+	if err := runCtx.Err(); err != nil {
+		return failWithError(fmt.Errorf("automation run did not complete within .spec.timeout: %w", err))
 	}
 
 	debuglog.Info("ran updates to working dir", "working", tmp)
@@ -300,52 +1226,300 @@ func (r *ImageUpdateAutomationReconciler) Reconcile(ctx context.Context, req ctr
 		}
 	}
 
+	// the files changed are those that will be committed, as
+	// reported by git
+	if templateValues.Changed.Files, err = changedFiles(tracelog, repo, tmp, sparse); err != nil {
+		return failWithError(err)
+	}
+
+	// A preview goes no further than this; what it would commit is
+	// recorded, and it's run again after the interval, or when
+	// something changes.
+	if previewing {
+		pending, err := pendingUpdates(repo, now, imageUpdates(templateValues.Updated), templateValues.Changed.Files)
+		if err != nil {
+			return failWithError(err)
+		}
+		log.Info("previewed updates of suspended automation", "revision", pending.Revision, "files", len(templateValues.Changed.Files))
+		auto.Status.PendingUpdates = pending
+		auto.Status.LastRunDigest = digest
+		imagev1.SetImageUpdateAutomationReadiness(&auto, metav1.ConditionTrue, meta.SuspendedReason, previewMessage(templateValues.Changed.Files))
+		if err := r.patchStatus(ctx, req, auto.Status); err != nil {
+			return ctrl.Result{Requeue: true}, err
+		}
+		return ctrl.Result{RequeueAfter: intervalOrDefault(&auto)}, nil
+	}
+
+	// An automation requiring approval goes no further than this
+	// until the updates have been approved; see approval.go. A dry
+	// run doesn't push, so doesn't need approval.
+	var approved bool
+	if auto.Spec.RequireApproval && !auto.Spec.DryRun && len(templateValues.Changed.Files) > 0 {
+		pending, err := pendingUpdates(repo, now, imageUpdates(templateValues.Updated), templateValues.Changed.Files)
+		if err != nil {
+			return failWithError(err)
+		}
+		diff, err := pendingDiff(repo, tmp, templateValues.Changed.Files)
+		if err != nil {
+			return failWithError(err)
+		}
+		pending.Diff, pending.ApprovalToken = shortDiff(diff), diffToken(diff)
+		if !approvalRequested || approvalToken != pending.ApprovalToken {
+			return r.awaitApproval(ctx, req, &auto, pending, digest)
+		}
+		log.Info("updates approved", "token", approvalToken)
+		approved = true
+	}
+	auto.Status.PendingUpdates = nil
+
+	// Updates aren't piled on top of the last commit pushed until the
+	// objects applying it are healthy; see healthgate.go. A dry run
+	// doesn't push, so isn't held back.
+	if len(auto.Spec.HealthGates) > 0 && len(templateValues.Changed.Files) > 0 && !auto.Spec.DryRun {
+		if err := r.checkHealthGates(ctx, &auto, auto.Spec.HealthGates); err != nil {
+			msg := fmt.Sprintf("holding back updates: %s", err)
+			imagev1.SetImageUpdateAutomationPushed(&auto, metav1.ConditionFalse, imagev1.HealthGateNotReadyReason, msg)
+			imagev1.SetImageUpdateAutomationReadiness(&auto, metav1.ConditionFalse, imagev1.HealthGateNotReadyReason, msg)
+			if err := r.patchStatus(ctx, req, auto.Status); err != nil {
+				return ctrl.Result{Requeue: true}, err
+			}
+			log.Info(msg, "retry-after", r.requeueDependency)
+			return ctrl.Result{RequeueAfter: r.requeueDependency}, nil
+		}
+		debuglog.Info("all health gates are healthy")
+	}
+
 	// construct the commit message from template and values
-	message, err := templateMsg(gitSpec.Commit.MessageTemplate, &templateValues)
+	message, err := commitMessage(gitSpec.Commit.SubjectTemplate, messageTemplate, gitSpec.Commit.SubjectMaxLength, &templateValues)
 	if err != nil {
 		return failWithError(err)
 	}
+	if gitSpec.Commit.UpdatesTrailer {
+		if message, err = appendUpdatesTrailer(message, templateValues.Updated); err != nil {
+			return failWithError(err)
+		}
+	}
+
+	// the updates about to be committed are recorded in the
+	// repository as well, if asked for; see updatemanifest.go
+	if manifest := gitSpec.Commit.UpdateManifest; manifest != nil && len(templateValues.Changed.Files) > 0 {
+		var parent string
+		if head, err := repo.Head(); err == nil {
+			parent = head.Hash().String()
+		}
+		entry := updateManifestEntry(req.NamespacedName, parent, now, templateValues.Updated, resultRoot(strategies))
+		if err := writeUpdateManifest(tmp, updateManifestPath(manifest.Path), manifest.MaxEntries, entry); err != nil {
+			return failWithError(err)
+		}
+	}
 
 	// The status message depends on what happens next. Since there's
 	// more than one way to succeed, there's some if..else below, and
 	// early returns only on failure.
 	author := &object.Signature{
-		Name:  gitSpec.Commit.Author.Name,
-		Email: gitSpec.Commit.Author.Email,
+		Name:  commitAuthor.Name,
+		Email: commitAuthor.Email,
 		When:  time.Now(),
 	}
 
-	if rev, err := commitChangedManifests(tracelog, repo, tmp, signingEntity, author, message); err != nil {
+	// a dry run result is only kept until the next commit, or run
+	// with nothing to commit
+	auto.Status.LastDryRun = nil
+	_, endCommitSpan := startSpan(ctx, commitSpan)
+	rev, err := commitChangedManifests(tracelog, repo, tmp, sparse, signingEntity, author, message)
+	if err == errNoChanges {
+		endCommitSpan(nil)
+	} else {
+		endCommitSpan(err)
+	}
+	if err != nil {
 		if err == errNoChanges {
 			debuglog.Info("no changes made in working directory; no commit")
 			statusMessage = "no updates made"
 			if lastCommit, lastTime := auto.Status.LastPushCommit, auto.Status.LastPushTime; lastCommit != "" {
 				statusMessage = fmt.Sprintf("%s; last commit %s at %s", statusMessage, lastCommit[:7], lastTime.Format(time.RFC3339))
 			}
+			reason := noChangeReason(policies.Items, templateValues.Updated)
+			auto.Status.ConsecutiveNoChangeRuns++
+			auto.Status.LastNoChangeReason = reason
+			auto.Status.ConsecutivePushFailures = 0
+			r.AutomationMetrics.RecordNoChange(req.NamespacedName, reason, auto.Status.ConsecutiveNoChangeRuns)
+			imagev1.SetImageUpdateAutomationPushed(&auto, metav1.ConditionFalse, imagev1.NoChangesReason,
+				fmt.Sprintf("no updates made (%s), so there was nothing to push", reason))
 		} else {
 			return failWithError(err)
 		}
+	} else if auto.Spec.DryRun {
+		pushTo := pushTargets(pushBranch, pushRefspec)
+		updates := imageUpdates(templateValues.Updated)
+		log.Info("dry run; not pushing commit", "revision", rev, "branch", pushBranch, "refspec", pushRefspec)
+		r.event(ctx, auto, events.EventSeverityInfo, fmt.Sprintf("Dry run: would have pushed change %s to %s\n%s\n%s",
+			rev, pushTo, strings.TrimRight(message, "\n"), pushSummary(templateValues.Changed.Files, updates)),
+			addChangeSummary(pushMetadata(rev, pushBranch, pushRefspec, templateValues.Updated, updates), updates, ""))
+		auto.Status.LastDryRun = dryRunResult(rev, message, pushBranch, pushRefspec, now, updates, templateValues.Changed.Files)
+		statusMessage = "dry run: would have pushed " + rev + " to " + pushTo
+		imagev1.SetImageUpdateAutomationPushed(&auto, metav1.ConditionFalse, imagev1.DryRunReason, statusMessage)
 	} else {
+		progress(fmt.Sprintf("pushing %s to %s", rev, pushTargets(pushBranch, pushRefspec)))
 		// Use the git operations timeout for the repo.
-		pushCtx, cancel := context.WithTimeout(ctx, origin.Spec.Timeout.Duration)
+		pushCtx, cancel := gitOperationContext(runCtx, &origin)
 		defer cancel()
-		if err := push(pushCtx, tmp, pushBranch, access); err != nil {
-			return failWithError(err)
+		pushCtx, endPushSpan := startSpan(pushCtx, pushSpan)
+		refspecs := pushRefspecs(pushBranch, pushRefspec, resetPushBranch)
+		pushStart := time.Now()
+		access, err = r.withRotatedAuth(ctx, &auto, &origin, access, func(access repoAccess) error {
+			return push(pushCtx, tmp, refspecs, access)
+		})
+		r.AutomationMetrics.RecordDuration(req.NamespacedName, pushOperation, gitImplementation, pushStart)
+		endPushSpan(err)
+		auto.Status.PushRefs = pushRefStatuses(auto.Status.PushRefs, refspecs, rev, now, err)
+		// A rejected push will be rejected again until someone
+		// changes the branch protection or permissions, so rather
+		// than retrying with backoff, it's reported distinctly and
+		// tried again at the next interval.
+		var rejected *refsRejectedError
+		if err != nil {
+			auto.Status.ConsecutivePushFailures++
 		}
-
-		r.event(ctx, auto, events.EventSeverityInfo, fmt.Sprintf("Committed and pushed change %s to %s\n%s", rev, pushBranch, message))
-		log.Info("pushed commit to origin", "revision", rev, "branch", pushBranch)
-		auto.Status.LastPushCommit = rev
-		auto.Status.LastPushTime = &metav1.Time{Time: now}
-		statusMessage = "committed and pushed " + rev + " to " + pushBranch
-	}
-
-	// Getting to here is a successful run.
-	auto.Status.LastAutomationRunTime = &metav1.Time{Time: now}
-	imagev1.SetImageUpdateAutomationReadiness(&auto, metav1.ConditionTrue, meta.ReconciliationSucceededReason, statusMessage)
-	if err := r.patchStatus(ctx, req, auto.Status); err != nil {
-		return ctrl.Result{Requeue: true}, err
-	}
+		if errors.As(err, &rejected) {
+			msg := fmt.Sprintf("push of %s to %s at %s was rejected: %s", rev, pushTargets(pushBranch, pushRefspec), origin.Spec.URL, err)
+			log.Info("push rejected", "revision", rev, "branch", pushBranch, "refspec", pushRefspec, "remote", origin.Spec.URL, "reason", err.Error())
+			metadata := pushMetadata(rev, pushBranch, pushRefspec, update.Result{}, nil)
+			metadata[remoteMetadataKey] = origin.Spec.URL
+			r.eventWithReason(ctx, auto, events.EventSeverityError, imagev1.PushRejectedReason, msg, metadata)
+			imagev1.SetImageUpdateAutomationPushed(&auto, metav1.ConditionFalse, imagev1.PushRejectedReason, msg)
+			runOutcome = runFailed(imagev1.PushRejectedReason, msg, time.Now())
+			r.countFailure(ctx, &auto, imagev1.PushRejectedReason, msg)
+			// A protected branch stays protected until someone
+			// changes it, which can't be seen from here; so rather
+			// than clone and update at every interval only to be
+			// rejected again, the automation is stalled.
+			if rejected.protected() {
+				msg = fmt.Sprintf("%s; the branch is protected, so the automation will not run again until it is changed, or a reconciliation is requested", msg)
+				imagev1.SetImageUpdateAutomationReadiness(&auto, metav1.ConditionFalse, imagev1.BranchProtectedReason, msg)
+				imagev1.SetImageUpdateAutomationStalled(&auto, imagev1.BranchProtectedReason, msg)
+				return ctrl.Result{}, r.patchStatus(ctx, req, auto.Status)
+			}
+			imagev1.SetImageUpdateAutomationReadiness(&auto, metav1.ConditionFalse, imagev1.PushRejectedReason, msg)
+			if err := r.patchStatus(ctx, req, auto.Status); err != nil {
+				return ctrl.Result{Requeue: true}, err
+			}
+			return ctrl.Result{RequeueAfter: intervalOrDefault(&auto)}, nil
+		}
+		// Any other failure is tried again with backoff. So as not
+		// to flood whoever is listening with an event for every
+		// attempt, there's one for the first failure, and one more
+		// if the failures go on for long enough that the backoff
+		// reaches its cap.
+		if err != nil {
+			failures := auto.Status.ConsecutivePushFailures
+			wait := r.pushBackoff.after(failures)
+			msg := fmt.Sprintf("push of %s to %s failed: %s", rev, pushTargets(pushBranch, pushRefspec), err)
+			if failures > 1 {
+				msg = fmt.Sprintf("%s (%d failures in a row)", msg, failures)
+			}
+			log.Error(err, "push failed", "revision", rev, "failures", failures, "retryAfter", wait)
+			switch {
+			case failures == 1:
+				r.eventWithReason(ctx, auto, events.EventSeverityError, imagev1.PushFailedReason,
+					fmt.Sprintf("%s; trying again in %s", msg, wait), nil)
+			case r.pushBackoff.escalates(failures):
+				r.eventWithReason(ctx, auto, events.EventSeverityError, imagev1.PushFailedReason,
+					fmt.Sprintf("%s; trying again every %s until a push succeeds", msg, wait), nil)
+			}
+			imagev1.SetImageUpdateAutomationPushed(&auto, metav1.ConditionFalse, imagev1.PushFailedReason, msg)
+			imagev1.SetImageUpdateAutomationReadiness(&auto, metav1.ConditionFalse, imagev1.PushFailedReason, msg)
+			runOutcome = runFailed(imagev1.PushFailedReason, msg, time.Now())
+			r.countFailure(ctx, &auto, imagev1.PushFailedReason, msg)
+			if err := r.patchStatus(ctx, req, auto.Status); err != nil {
+				return ctrl.Result{Requeue: true}, err
+			}
+			return ctrl.Result{RequeueAfter: wait}, nil
+		}
+
+		pushedTo := pushTargets(pushBranch, pushRefspec)
+		updates := imageUpdates(templateValues.Updated)
+		link, err := commitLink(auto.Spec.CommitLinkTemplate, origin.Spec.URL, rev, pushBranch)
+		if err != nil {
+			log.Error(err, "leaving out link to commit", "revision", rev)
+		}
+		if auto.Spec.EventVerbosity != imagev1.EventVerbosityErrors {
+			r.event(ctx, auto, events.EventSeverityInfo, fmt.Sprintf("Committed and pushed change %s to %s\n%s\n%s",
+				rev, pushedTo, strings.TrimRight(message, "\n"), pushSummary(templateValues.Changed.Files, updates)),
+				addChangeSummary(pushMetadata(rev, pushBranch, pushRefspec, templateValues.Updated, updates), updates, link))
+		}
+		if auto.Spec.EventVerbosity == imagev1.EventVerbosityFile {
+			for _, msg := range fileEventMessages(rev, templateValues.Updated) {
+				r.event(ctx, auto, events.EventSeverityInfo, msg, pushMetadata(rev, pushBranch, pushRefspec, update.Result{}, nil))
+			}
+		}
+		log.Info("pushed commit to origin", "revision", rev, "branch", pushBranch, "refspec", pushRefspec)
+		r.pushLimiter.record(origin.Spec.URL, time.Now())
+		auto.Status.LastPushCommit = rev
+		auto.Status.LastPushTime = &metav1.Time{Time: now}
+		if canary != nil {
+			auto.Status.Canary = canaryPushed(auto.Status.Canary, rev, now)
+		}
+		auto.Status.LastPushImages = updates
+		r.AutomationMetrics.RecordPush(req.NamespacedName, auto.Status.LastPushImages)
+		auto.Status.LastPushFiles = templateValues.Changed.Files
+		auto.Status.ConsecutiveNoChangeRuns = 0
+		auto.Status.LastNoChangeReason = ""
+		if failures := auto.Status.ConsecutivePushFailures; failures > 0 && auto.Spec.EventVerbosity != imagev1.EventVerbosityErrors {
+			r.event(ctx, auto, events.EventSeverityInfo, fmt.Sprintf("push of %s to %s succeeded after %d failures", rev, pushedTo, failures), nil)
+		}
+		auto.Status.ConsecutivePushFailures = 0
+		auto.Status.AppliedPolicies = appliedPolicies(auto.Status.AppliedPolicies, templateValues.Updated, policies.Items, now)
+		if len(auto.Status.LastPushFiles) > maxStatusFiles {
+			auto.Status.LastPushFiles = auto.Status.LastPushFiles[:maxStatusFiles]
+		}
+		statusMessage = "committed and pushed " + rev + " to " + pushedTo
+		if approved {
+			auto.Status.LastHandledApproval = approvalToken
+			if auto.Spec.ApprovalMethod == imagev1.ApprovalChangeRequest {
+				if err := r.changePushed(ctx, &auto, approvalToken, rev, now); err != nil {
+					log.Error(err, "unable to record push in change request", "token", approvalToken)
+				}
+			}
+		}
+		imagev1.SetImageUpdateAutomationPushed(&auto, metav1.ConditionTrue, imagev1.PushSucceededReason, statusMessage)
+
+		r.auditPush(ctx, auto, PushRecord{
+			Namespace: auto.GetNamespace(),
+			Name:      auto.GetName(),
+			Revision:  rev,
+			Branch:    pushBranch,
+			Refspec:   pushRefspec,
+			Images:    updates,
+			Author:    fmt.Sprintf("%s <%s>", author.Name, author.Email),
+			Time:      now,
+		})
+		r.setCommitStatus(ctx, auto, origin.Spec.URL, rev, len(updates), link)
+	}
+
+	// Getting to here is a successful run, for this automation and
+	// any automations run along with it.
+	if len(coalesced) > 0 {
+		names := make([]types.NamespacedName, len(coalesced))
+		for i := range coalesced {
+			names[i] = types.NamespacedName{Namespace: coalesced[i].GetNamespace(), Name: coalesced[i].GetName()}
+		}
+		log.Info("ran updates of other automations along with this one", "automations", names)
+		r.coalescer.markServed(names, servedRun{by: req.NamespacedName, start: runStart, message: statusMessage})
+	}
+	auto.Status.LastAutomationRunTime = &metav1.Time{Time: now}
+	auto.Status.LastRunDigest = digest
+	// a dry run leaves the stages as they are
+	if !auto.Spec.DryRun {
+		auto.Status.Stages = stageStatuses
+	}
+	resetFailures(&auto)
+	imagev1.SetImageUpdateAutomationReadiness(&auto, metav1.ConditionTrue, meta.ReconciliationSucceededReason, statusMessage)
+	if err := r.patchStatus(ctx, req, auto.Status); err != nil {
+		return ctrl.Result{Requeue: true}, err
+	}
+	runOutcome = runSucceeded(rev, rev != "" && !auto.Spec.DryRun, imageUpdates(templateValues.Updated),
+		templateValues.Changed.Files, statusMessage, time.Now())
 
 	// We're either in this method because something changed, or this
 	// object got requeued. Either way, once successful, we don't need
@@ -353,11 +1527,51 @@ func (r *ImageUpdateAutomationReconciler) Reconcile(ctx context.Context, req ctr
 	// changes again.
 
 	interval := intervalOrDefault(&auto)
+	// an image that will have soaked before then is promoted as soon
+	// as it has
+	if wait := nextPromotion(auto.Spec.Update.Stages, auto.Status.Stages, now); wait > 0 && wait < interval {
+		interval = wait
+	}
+	// likewise, a commit on the push branch is promoted to the canary
+	// branch as soon as it has been there for the soak time
+	if wait := nextCanaryPromotion(canary, auto.Status.Canary, time.Now()); wait > 0 && wait < interval {
+		interval = wait
+	}
 	return ctrl.Result{RequeueAfter: interval}, nil
 }
 
 func (r *ImageUpdateAutomationReconciler) SetupWithManager(mgr ctrl.Manager, opts ImageUpdateAutomationReconcilerOptions) error {
 	ctx := context.Background()
+	r.requeueDependency = opts.DependencyRequeueInterval
+	r.runSlots = newRunSlots(opts.MaxConcurrentReconciles)
+	r.repoLocks = newRepoLocks()
+	pushLeases, err := newPushLeases(mgr.GetClient(), mgr.GetAPIReader(), opts.PushLeaseNamespace)
+	if err != nil {
+		return err
+	}
+	r.pushLeases = pushLeases
+	r.coalescer = newCoalescer(opts.CoalesceWindow)
+	r.pushLimiter = newPushLimiter(opts.MaxPushesPerHour, time.Hour)
+	r.pushBackoff = newPushBackoff(opts.PushFailureBackoff, opts.MaxPushFailureBackoff)
+	r.scanLimits = []update.Option{update.WithMaxFileSize(opts.MaxFileSize), update.WithMaxDocuments(opts.MaxDocuments)}
+	r.scanCache = newScanCache()
+	r.restConfig = mgr.GetConfig()
+	r.tenantClients = newTenantClients()
+	r.noCrossNamespaceRefs = opts.NoCrossNamespaceRefs
+	r.gcpWorkloadIdentityProvider = opts.GCPWorkloadIdentityProvider
+	var policyWatchOpts []builder.WatchesOption
+	if opts.MetadataOnlyPolicyWatch {
+		r.policyStore = newPolicyStore(mgr.GetAPIReader())
+		policyWatchOpts = append(policyWatchOpts, builder.OnlyMetadata)
+	}
+	if opts.CloneCacheDir != "" {
+		cache, err := newCloneCache(opts.CloneCacheDir, opts.CloneCacheMaxSize)
+		if err != nil {
+			return err
+		}
+		r.cloneCache = cache
+	}
+
 	// Index the git repository object that each I-U-A refers to
 	if err := mgr.GetFieldIndexer().IndexField(ctx, &imagev1.ImageUpdateAutomation{}, repoRefKey, func(obj client.Object) []string {
 		updater := obj.(*imagev1.ImageUpdateAutomation)
@@ -367,20 +1581,85 @@ func (r *ImageUpdateAutomationReconciler) SetupWithManager(mgr ctrl.Manager, opt
 		return err
 	}
 
-	return ctrl.NewControllerManagedBy(mgr).
+	// Index the automation each run request refers to
+	if err := mgr.GetFieldIndexer().IndexField(ctx, &imagev1.ImageUpdateRunRequest{}, runRequestAutomationKey, func(obj client.Object) []string {
+		return []string{obj.(*imagev1.ImageUpdateRunRequest).Spec.AutomationRef.Name}
+	}); err != nil {
+		return err
+	}
+
+	// Index the image policies each I-U-A referred to in its last run
+	if err := mgr.GetFieldIndexer().IndexField(ctx, &imagev1.ImageUpdateAutomation{}, policyRefKey, indexReferencedPolicies); err != nil {
+		return err
+	}
+
+	workspaceDir := opts.WorkspaceDir
+	if workspaceDir == "" {
+		workspaceDir = os.TempDir()
+	}
+	workspaces, err := newWorkspaces(filepath.Join(workspaceDir, workspacesDir), opts.WorkspaceMaxSize)
+	if err != nil {
+		return err
+	}
+	r.workspaces = workspaces
+	if err := mgr.Add(&workspaceSweeper{workspaces: workspaces, interval: opts.WorkspaceSweepInterval}); err != nil {
+		return err
+	}
+
+	if opts.PrefetchLead > 0 {
+		if r.cloneCache == nil {
+			return fmt.Errorf("prefetching git repositories needs a clone cache directory")
+		}
+		if err := mgr.Add(newPrefetcher(r, opts.PrefetchLead)); err != nil {
+			return err
+		}
+	}
+
+	if opts.RemoteProbeInterval > 0 {
+		if err := mgr.Add(newRemoteProbe(r, opts.RemoteProbeInterval)); err != nil {
+			return err
+		}
+	}
+
+	if opts.WebhookAddr != "" {
+		if err := mgr.Add(newWebhookReceiver(r, opts.WebhookAddr)); err != nil {
+			return err
+		}
+	}
+
+	if opts.ShardElection != nil {
+		shards, err := newShardElection(mgr.GetConfig(), *opts.ShardElection, r.enqueueShard)
+		if err != nil {
+			return err
+		}
+		r.shards = shards
+		r.shardEvents = make(chan event.GenericEvent)
+		if err := mgr.Add(shards); err != nil {
+			return err
+		}
+	}
+
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&imagev1.ImageUpdateAutomation{}, builder.WithPredicates(
-			predicate.Or(predicate.GenerationChangedPredicate{}, predicates.ReconcileRequestedPredicate{}))).
+			predicate.Or(predicate.GenerationChangedPredicate{}, predicates.ReconcileRequestedPredicate{}, revertRequestedPredicate{}, approvalPredicate{}))).
 		Watches(&source.Kind{Type: &sourcev1.GitRepository{}}, handler.EnqueueRequestsFromMapFunc(r.automationsForGitRepo)).
-		Watches(&source.Kind{Type: &imagev1_reflect.ImagePolicy{}}, handler.EnqueueRequestsFromMapFunc(r.automationsForImagePolicy)).
-		WithOptions(controller.Options{
-			MaxConcurrentReconciles: opts.MaxConcurrentReconciles,
-		}).
-		Complete(r)
+		Watches(&source.Kind{Type: &imagev1.ImageUpdateRunRequest{}}, handler.EnqueueRequestsFromMapFunc(r.automationForRunRequest)).
+		Owns(&imagev1.ImageUpdateChangeRequest{}).
+		Watches(&source.Kind{Type: &imagev1_reflect.ImagePolicy{}}, newPolicyEventHandler(r, opts.PolicyDebounce), policyWatchOpts...)
+	if r.shardEvents != nil {
+		b = b.Watches(&source.Channel{Source: r.shardEvents}, &handler.EnqueueRequestForObject{})
+	}
+	return b.WithOptions(controller.Options{
+		MaxConcurrentReconciles: opts.MaxConcurrentReconciles * workersPerRunSlot,
+	}).Complete(r)
 }
 
 func (r *ImageUpdateAutomationReconciler) patchStatus(ctx context.Context,
 	req ctrl.Request,
-	newStatus imagev1.ImageUpdateAutomationStatus) error {
+	newStatus imagev1.ImageUpdateAutomationStatus) (err error) {
+
+	ctx, endSpan := startSpan(ctx, statusPatchSpan)
+	defer func() { endSpan(err) }()
 
 	var auto imagev1.ImageUpdateAutomation
 	if err := r.Get(ctx, req.NamespacedName, &auto); err != nil {
@@ -393,6 +1672,24 @@ func (r *ImageUpdateAutomationReconciler) patchStatus(ctx context.Context,
 	return r.Status().Patch(ctx, &auto, patch)
 }
 
+// finishServedRun records, in the status of the automation given,
+// that it was run along with another automation, and requeues it for
+// its next interval.
+func (r *ImageUpdateAutomationReconciler) finishServedRun(ctx context.Context, req ctrl.Request, auto *imagev1.ImageUpdateAutomation, run servedRun) (ctrl.Result, error) {
+	logr.FromContext(ctx).Info("automation was run along with another", "automation", run.by)
+	if token, ok := meta.ReconcileAnnotationValue(auto.GetAnnotations()); ok {
+		auto.Status.SetLastHandledReconcileRequest(token)
+	}
+	auto.Status.LastAutomationRunTime = &metav1.Time{Time: run.start}
+	resetFailures(auto)
+	imagev1.SetImageUpdateAutomationReadiness(auto, metav1.ConditionTrue, meta.ReconciliationSucceededReason,
+		fmt.Sprintf("run along with %s: %s", run.by.Name, run.message))
+	if err := r.patchStatus(ctx, req, auto.Status); err != nil {
+		return ctrl.Result{Requeue: true}, err
+	}
+	return ctrl.Result{RequeueAfter: intervalOrDefault(auto)}, nil
+}
+
 // intervalOrDefault gives the interval specified, or if missing, the default
 func intervalOrDefault(auto *imagev1.ImageUpdateAutomation) time.Duration {
 	if auto.Spec.Interval.Duration < time.Second {
@@ -429,22 +1726,65 @@ func (r *ImageUpdateAutomationReconciler) automationsForGitRepo(obj client.Objec
 	return reqs
 }
 
-// automationsForImagePolicy fetches all the automation objects that
-// might depend on a image policy object. Since the link is via
-// markers in the git repo, _any_ automation object in the same
-// namespace could be affected.
-func (r *ImageUpdateAutomationReconciler) automationsForImagePolicy(obj client.Object) []reconcile.Request {
-	ctx := context.Background()
-	var autoList imagev1.ImageUpdateAutomationList
-	if err := r.List(ctx, &autoList, client.InNamespace(obj.GetNamespace())); err != nil {
-		return nil
+// --- dependencies
+
+// dependencyAPIVersions gives the API version to use for each kind of
+// dependency, when a reference doesn't give one.
+var dependencyAPIVersions = map[string]string{
+	imagev1.ImageUpdateAutomationKind: imagev1.GroupVersion.String(),
+	"Kustomization":                   "kustomize.toolkit.fluxcd.io/v1beta1",
+}
+
+// checkDependencies returns an error naming the first dependency of
+// the automation that is missing or not ready, or nil if they are all
+// ready.
+func (r *ImageUpdateAutomationReconciler) checkDependencies(ctx context.Context, auto *imagev1.ImageUpdateAutomation) error {
+	for _, dep := range auto.Spec.DependsOn {
+		kind := dep.Kind
+		if kind == "" {
+			kind = imagev1.ImageUpdateAutomationKind
+		}
+		apiVersion := dep.APIVersion
+		if apiVersion == "" {
+			apiVersion = dependencyAPIVersions[kind]
+		}
+		name := types.NamespacedName{
+			Namespace: dep.Namespace,
+			Name:      dep.Name,
+		}
+		if name.Namespace == "" {
+			name.Namespace = auto.GetNamespace()
+		}
+
+		var obj unstructured.Unstructured
+		obj.SetAPIVersion(apiVersion)
+		obj.SetKind(kind)
+		if err := r.Get(ctx, name, &obj); err != nil {
+			return fmt.Errorf("unable to get %s '%s': %w", kind, name, err)
+		}
+		if !dependencyReady(&obj) {
+			return fmt.Errorf("%s '%s' is not ready", kind, name)
+		}
 	}
-	reqs := make([]reconcile.Request, len(autoList.Items), len(autoList.Items))
-	for i := range autoList.Items {
-		reqs[i].NamespacedName.Name = autoList.Items[i].GetName()
-		reqs[i].NamespacedName.Namespace = autoList.Items[i].GetNamespace()
+	return nil
+}
+
+// dependencyReady reports whether the object given has been
+// reconciled at its latest generation, and is Ready as a result.
+func dependencyReady(obj *unstructured.Unstructured) bool {
+	statusMap, ok, err := unstructured.NestedMap(obj.Object, "status")
+	if err != nil || !ok {
+		return false
 	}
-	return reqs
+	var status struct {
+		ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+		Conditions         []metav1.Condition `json:"conditions,omitempty"`
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(statusMap, &status); err != nil {
+		return false
+	}
+	return status.ObservedGeneration == obj.GetGeneration() &&
+		apimeta.IsStatusConditionTrue(status.Conditions, meta.ReadyCondition)
 }
 
 // --- git ops
@@ -453,12 +1793,17 @@ func (r *ImageUpdateAutomationReconciler) automationsForImagePolicy(obj client.O
 // it will do a non-shallow clone, and for anything else, it doesn't
 // matter what is used.
 
+const gitImplementation = sourcev1.LibGit2Implementation
+
 type repoAccess struct {
 	auth *git.AuthOptions
 	url  string
 }
 
-func (r *ImageUpdateAutomationReconciler) getRepoAccess(ctx context.Context, repository *sourcev1.GitRepository) (repoAccess, error) {
+// getRepoAccess gives the URL of the repository given and the auth
+// options for it, read from the repository's secret, or got using the
+// cloud identity the automation given gives, if it gives one.
+func (r *ImageUpdateAutomationReconciler) getRepoAccess(ctx context.Context, auto *imagev1.ImageUpdateAutomation, repository *sourcev1.GitRepository) (repoAccess, error) {
 	var access repoAccess
 	access.url = repository.Spec.URL
 
@@ -481,39 +1826,258 @@ func (r *ImageUpdateAutomationReconciler) getRepoAccess(ctx context.Context, rep
 			return access, err
 		}
 	}
+
+	if gitSpec := auto.Spec.GitSpec; gitSpec != nil && gitSpec.Identity != nil {
+		auth, err := r.cloudIdentityAuth(ctx, auto, access.url)
+		if err != nil {
+			return access, fmt.Errorf("cloud identity error: %w", err)
+		}
+		// anything else from the secret, like a CA certificate, is
+		// still used
+		if access.auth != nil {
+			auth.CAFile = access.auth.CAFile
+		}
+		access.auth = auth
+	}
 	return access, nil
 }
 
+// withRotatedAuth runs the git operation given with the access given.
+// If it fails with what looks to be the remote refusing the
+// credentials, they are read again from the secret, since it may have
+// been rotated since the run started, or got afresh with the
+// automation's cloud identity; if they have changed, the
+// operation is run once more with them. The access last used is
+// returned, for any operations after.
+func (r *ImageUpdateAutomationReconciler) withRotatedAuth(ctx context.Context, auto *imagev1.ImageUpdateAutomation, repository *sourcev1.GitRepository, access repoAccess, op func(repoAccess) error) (repoAccess, error) {
+	err := op(access)
+	if err == nil || !isAuthError(err) {
+		return access, err
+	}
+	fresh, accessErr := r.getRepoAccess(ctx, auto, repository)
+	if accessErr != nil || reflect.DeepEqual(fresh.auth, access.auth) {
+		return access, err
+	}
+	logr.FromContext(ctx).Info("git operation failed to authenticate, and the credentials have changed; trying again", "error", err.Error())
+	return fresh, op(fresh)
+}
+
+// isAuthError says whether the error given, from a git operation,
+// looks to be the remote refusing the credentials used. libgit2 only
+// sometimes gives an error code for this, so the message is looked at
+// too.
+func isAuthError(err error) bool {
+	var gitErr *libgit2.GitError
+	if errors.As(err, &gitErr) && gitErr.Code == libgit2.ErrorCodeAuth {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"authentication", "failed to authenticate", "unable to authenticate", "unauthorized", "status code: 401", "status code: 403"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
 func (r repoAccess) remoteCallbacks(ctx context.Context) libgit2.RemoteCallbacks {
-	return gitlibgit2.RemoteCallbacks(ctx, r.auth)
+	callbacks := gitlibgit2.RemoteCallbacks(ctx, r.auth)
+	if managedSSH && r.auth != nil && len(r.auth.Identity) > 0 && isSSHURL(r.url) {
+		callbacks.CredentialsCallback = sshMemoryCredentials(r.auth)
+	}
+	return callbacks
+}
+
+// gitOperationContext gives a context for a single git operation,
+// with the deadline given by the GitRepository's timeout, if it has
+// one.
+func gitOperationContext(ctx context.Context, repository *sourcev1.GitRepository) (context.Context, context.CancelFunc) {
+	if repository.Spec.Timeout == nil {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, repository.Spec.Timeout.Duration)
+}
+
+// runGitOperation runs the git operation given, and returns when it's
+// done or the context given is done, whichever is first. libgit2 only
+// looks at the context when it calls back (e.g., to report progress),
+// so an operation on a remote that has stopped responding would
+// otherwise hold up the run for good. An operation given up on is
+// left to finish or fail by itself; it must not use anything the
+// caller may remove or reuse once this returns, other than what's
+// held until the git operations of the context given are done (see
+// withGitOperations).
+func runGitOperation(ctx context.Context, op func() error) error {
+	ops := gitOperationsFrom(ctx)
+	if ops != nil {
+		ops.start()
+	}
+	done := make(chan error, 1)
+	go func() {
+		err := op()
+		if ops != nil {
+			ops.finish()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("gave up waiting for git operation: %w", ctx.Err())
+	}
 }
 
 // cloneInto clones the upstream repository at the `ref` given (which
-// can be `nil`). It returns a `*gogit.Repository` since that is used
+// can be `nil`). If `sparse` lists directories, only those may be
+// checked out. It returns a `*gogit.Repository` since that is used
 // for committing changes.
-func cloneInto(ctx context.Context, access repoAccess, ref *sourcev1.GitRepositoryRef, path string) (*gogit.Repository, error) {
+func cloneInto(ctx context.Context, access repoAccess, ref *sourcev1.GitRepositoryRef, path string, sparse []string) (*gogit.Repository, error) {
+	url, done := transportURL(access)
+	err := runGitOperation(ctx, func() error {
+		defer done()
+		return checkout(ctx, url, access.auth, ref, path, sparse)
+	})
+	if url != access.url {
+		if err != nil {
+			return nil, errors.New(strings.ReplaceAll(err.Error(), url, access.url))
+		}
+		if err := setOriginURL(path, access.url); err != nil {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return gogit.PlainOpen(path)
+}
+
+// checkout clones the repository at url into path, and checks out
+// the `ref` given (which can be `nil`). When the ref is a branch (or
+// not given) and `sparse` lists directories, only those directories
+// are checked out; tags and semver ranges are always checked out in
+// full.
+func checkout(ctx context.Context, url string, auth *git.AuthOptions, ref *sourcev1.GitRepositoryRef, path string, sparse []string) error {
+	if len(sparse) > 0 && pinnedRevision(ref) == "" {
+		branch := git.DefaultBranch
+		if ref != nil && ref.Branch != "" {
+			branch = ref.Branch
+		}
+		return sparseClone(ctx, url, auth, branch, path, sparse)
+	}
+
 	opts := git.CheckoutOptions{}
 	if ref != nil {
 		opts.Tag = ref.Tag
 		opts.SemVer = ref.SemVer
-		opts.Tag = ref.Tag
 		opts.Branch = ref.Branch
+		opts.Commit = ref.Commit
 	}
-	checkoutStrat, err := gitstrat.CheckoutStrategyForImplementation(ctx, sourcev1.LibGit2Implementation, opts)
-	if err == nil {
-		_, err = checkoutStrat.Checkout(ctx, path, access.url, access.auth)
+	checkoutStrat, err := gitstrat.CheckoutStrategyForImplementation(ctx, gitImplementation, opts)
+	if err != nil {
+		return err
+	}
+	_, err = checkoutStrat.Checkout(ctx, path, url, auth)
+	return err
+}
+
+// pinnedRevision describes the revision the checkout ref gives, if
+// it's a tag, semver range, or commit, for use in messages. It gives
+// an empty string if the ref is nil or only names a branch; i.e.,
+// when the head of a branch is checked out. The order of precedence
+// is that used when checking out.
+func pinnedRevision(ref *sourcev1.GitRepositoryRef) string {
+	switch {
+	case ref == nil:
+		return ""
+	case ref.Commit != "":
+		return "commit " + ref.Commit
+	case ref.SemVer != "":
+		return fmt.Sprintf("semver range %q", ref.SemVer)
+	case ref.Tag != "":
+		return fmt.Sprintf("tag %q", ref.Tag)
+	default:
+		return ""
 	}
+}
+
+// checkPushBranch gives an error if there's no branch to push to for
+// the checkout ref and push spec given, or the push branch can't be
+// used with the checkout ref. When the checkout ref gives a tag or
+// commit, the HEAD is detached; commits can be pushed with a refspec,
+// or to a push branch made from the revision, but not to the branch
+// given in the ref (the commit will usually not be at the head of it).
+func checkPushBranch(ref *sourcev1.GitRepositoryRef, push *imagev1.PushSpec) error {
+	pinned := pinnedRevision(ref)
+	if push == nil {
+		if pinned != "" {
+			return fmt.Errorf("the checkout ref gives %s, so a push branch or refspec must be given in .spec.git.push", pinned)
+		}
+		if ref == nil || ref.Branch == "" {
+			return errors.New("Push branch not given explicitly, and cannot be inferred from .spec.git.checkout.ref or GitRepository .spec.ref")
+		}
+		return nil
+	}
+	if pinned != "" && push.Branch != "" && push.Branch == ref.Branch {
+		return fmt.Errorf("push branch %q is the branch of the checkout ref, which gives %s; commits made on the %s cannot be pushed to the branch", push.Branch, pinned, pinned)
+	}
+	return nil
+}
+
+// branchDiverged says whether the local branch given is missing any
+// of the commits in HEAD; that is, whether HEAD is not an ancestor of
+// the branch. The repository may be a shallow clone, so commits that
+// aren't present are passed over; those between HEAD and the branch
+// will have been fetched with the branch.
+func branchDiverged(repo *gogit.Repository, branch string) (bool, error) {
+	head, err := repo.Head()
 	if err != nil {
-		return nil, err
+		return false, err
+	}
+	tip, err := repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if err != nil {
+		return false, err
 	}
 
-	return gogit.PlainOpen(path)
+	seen := map[plumbing.Hash]bool{}
+	queue := []plumbing.Hash{tip.Hash()}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if hash == head.Hash() {
+			return false, nil
+		}
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		commit, err := repo.CommitObject(hash)
+		if err == plumbing.ErrObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		queue = append(queue, commit.ParentHashes...)
+	}
+	return true, nil
+}
+
+// resetBranch points the local branch given at HEAD, discarding any
+// commits that were only on the branch.
+func resetBranch(repo *gogit.Repository, branch string) error {
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	return repo.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName(branch), head.Hash()))
 }
 
 // switchBranch switches the repo from the current branch to the
 // branch given. If the branch does not exist, it is created using the
-// head as the starting point.
-func switchBranch(repo *gogit.Repository, pushBranch string) error {
+// head as the starting point. If `sparse` lists directories, only
+// those are checked out, as when cloning.
+func switchBranch(repo *gogit.Repository, path string, pushBranch string, sparse []string) error {
 	localBranch := plumbing.NewBranchReferenceName(pushBranch)
 
 	// is the branch already present?
@@ -535,34 +2099,62 @@ func switchBranch(repo *gogit.Repository, pushBranch string) error {
 		return err
 	}
 
-	return tree.Checkout(&gogit.CheckoutOptions{
+	// A sparse checkout is kept sparse by moving HEAD without
+	// touching the working directory, then checking out the
+	// directories.
+	if err := tree.Checkout(&gogit.CheckoutOptions{
 		Branch: localBranch,
 		Create: create,
-	})
+		Keep:   len(sparse) > 0,
+	}); err != nil {
+		return err
+	}
+	if len(sparse) > 0 {
+		return sparseCheckout(path, sparse)
+	}
+	return nil
 }
 
 var errNoChanges error = errors.New("no changes made to working directory")
 
-func commitChangedManifests(tracelog logr.Logger, repo *gogit.Repository, absRepoPath string, ent *openpgp.Entity, author *object.Signature, message string) (string, error) {
+// changedFiles lists the files in the working directory that have
+// changes to be committed, in lexical order. If `within` lists
+// directories, only files in those are considered, since the working
+// directory is a sparse checkout of them.
+func changedFiles(tracelog logr.Logger, repo *gogit.Repository, absRepoPath string, within []string) ([]string, error) {
 	working, err := repo.Worktree()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	status, err := working.Status()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	// A change to the commit a submodule points at is never committed;
+	// see submodule.go.
+	submodules, err := submodulePaths(repo)
+	if err != nil {
+		return nil, err
 	}
 
 	// go-git has [a bug](https://github.com/go-git/go-git/issues/253)
 	// whereby it thinks broken symlinks to absolute paths are
 	// modified. There's no circumstance in which we want to commit a
 	// change to a broken symlink: so, detect and skip those.
-	var changed bool
+	var files []string
 	for file, _ := range status {
+		if !withinPaths(file, within) {
+			continue
+		}
+		if len(submodules) > 0 && withinPaths(file, submodules) {
+			tracelog.Info("change to submodule found; ignoring", "path", file)
+			continue
+		}
 		abspath := filepath.Join(absRepoPath, file)
 		info, err := os.Lstat(abspath)
 		if err != nil {
-			return "", fmt.Errorf("checking if %s is a symlink: %w", file, err)
+			return nil, fmt.Errorf("checking if %s is a symlink: %w", file, err)
 		}
 		if info.Mode()&os.ModeSymlink > 0 {
 			// symlinks are OK; broken symlinks are probably a result
@@ -573,15 +2165,30 @@ func commitChangedManifests(tracelog logr.Logger, repo *gogit.Repository, absRep
 				continue
 			}
 		}
-		tracelog.Info("adding file", "file", file)
-		working.Add(file)
-		changed = true
+		files = append(files, file)
 	}
+	sort.Strings(files)
+	return files, nil
+}
 
-	if !changed {
+func commitChangedManifests(tracelog logr.Logger, repo *gogit.Repository, absRepoPath string, within []string, ent *openpgp.Entity, author *object.Signature, message string) (string, error) {
+	files, err := changedFiles(tracelog, repo, absRepoPath, within)
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
 		return "", errNoChanges
 	}
 
+	working, err := repo.Worktree()
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		tracelog.Info("adding file", "file", file)
+		working.Add(file)
+	}
+
 	var rev plumbing.Hash
 	if rev, err = working.Commit(message, &gogit.CommitOptions{
 		Author:  author,
@@ -631,7 +2238,14 @@ var errRemoteBranchMissing = errors.New("remote branch missing")
 // returns errRemoteBranchMissing (this is to work in sympathy with
 // `switchBranch`, which will create the branch if it doesn't
 // exist). For any other problem it will return the error.
-func fetch(ctx context.Context, path string, branch string, access repoAccess) error {
+func fetch(ctx context.Context, path string, branch string, access repoAccess, progress func(libgit2.TransferProgress)) error {
+	return runGitOperation(ctx, func() error {
+		return fetchBranch(ctx, path, branch, access, progress)
+	})
+}
+
+// fetchBranch does the fetch for `fetch`.
+func fetchBranch(ctx context.Context, path string, branch string, access repoAccess, progress func(libgit2.TransferProgress)) error {
 	refspec := fmt.Sprintf("refs/heads/%s:refs/heads/%s", branch, branch)
 	repo, err := libgit2.OpenRepository(path)
 	if err != nil {
@@ -643,10 +2257,21 @@ func fetch(ctx context.Context, path string, branch string, access repoAccess) e
 		return err
 	}
 	defer origin.Free()
+	callbacks := access.remoteCallbacks(ctx)
+	if progress != nil {
+		next := callbacks.TransferProgressCallback
+		callbacks.TransferProgressCallback = func(p libgit2.TransferProgress) libgit2.ErrorCode {
+			progress(p)
+			if next == nil {
+				return libgit2.ErrorCodeOK
+			}
+			return next(p)
+		}
+	}
 	err = origin.Fetch(
 		[]string{refspec},
 		&libgit2.FetchOptions{
-			RemoteCallbacks: access.remoteCallbacks(ctx),
+			RemoteCallbacks: callbacks,
 		}, "",
 	)
 	if err != nil && libgit2.IsErrorCode(err, libgit2.ErrorCodeNotFound) {
@@ -655,11 +2280,99 @@ func fetch(ctx context.Context, path string, branch string, access repoAccess) e
 	return err
 }
 
-// push pushes the branch given to the origin using the git library
-// indicated by `impl`. It's passed both the path to the repo and a
-// gogit.Repository value, since the latter may as well be used if the
-// implementation is GoGit.
-func push(ctx context.Context, path, branch string, access repoAccess) error {
+// pushRefspecs gives the refspecs to push, given a branch and a
+// refspec, either of which may be empty. If force is true, the branch
+// is pushed even if the remote branch can't be fast-forwarded to it.
+func pushRefspecs(branch, refspec string, force bool) []string {
+	var refspecs []string
+	if branch != "" {
+		branchRefspec := fmt.Sprintf("refs/heads/%s:refs/heads/%s", branch, branch)
+		if force {
+			branchRefspec = "+" + branchRefspec
+		}
+		refspecs = append(refspecs, branchRefspec)
+	}
+	if refspec != "" {
+		refspecs = append(refspecs, refspec)
+	}
+	return refspecs
+}
+
+// branchProtectedSince says whether the automation given was stalled
+// by a push to a protected branch, and hasn't been changed since.
+func branchProtectedSince(auto *imagev1.ImageUpdateAutomation) bool {
+	stalled := apimeta.FindStatusCondition(auto.Status.Conditions, meta.StalledCondition)
+	return stalled != nil && stalled.Status == metav1.ConditionTrue &&
+		stalled.Reason == imagev1.BranchProtectedReason && stalled.ObservedGeneration == auto.GetGeneration()
+}
+
+// pushTargets describes where commits are pushed, for use in events
+// and status messages.
+func pushTargets(branch, refspec string) string {
+	switch {
+	case refspec == "":
+		return branch
+	case branch == "":
+		return "refspec " + refspec
+	default:
+		return branch + " and refspec " + refspec
+	}
+}
+
+// dryRunResult records a commit made by a dry run, for the status.
+func dryRunResult(rev, message, branch, refspec string, when time.Time, updates []imagev1.ImageUpdate, files []string) *imagev1.DryRunResult {
+	if len(files) > maxStatusFiles {
+		files = files[:maxStatusFiles]
+	}
+	return &imagev1.DryRunResult{
+		Commit:  rev,
+		Message: message,
+		Branch:  branch,
+		Refspec: refspec,
+		Time:    metav1.Time{Time: when},
+		Images:  updates,
+		Files:   files,
+	}
+}
+
+// pendingUpdates records the updates made in the working copy of the
+// repository given, by a preview run, for the status.
+func pendingUpdates(repo *gogit.Repository, when time.Time, updates []imagev1.ImageUpdate, files []string) (*imagev1.PendingUpdates, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > maxStatusFiles {
+		files = files[:maxStatusFiles]
+	}
+	return &imagev1.PendingUpdates{
+		Revision: head.Hash().String(),
+		Time:     metav1.Time{Time: when},
+		Images:   updates,
+		Files:    files,
+	}, nil
+}
+
+// previewMessage gives the message for the readiness of a suspended
+// automation, after a preview that would change the files given.
+func previewMessage(files []string) string {
+	if len(files) == 0 {
+		return "suspended; no updates pending"
+	}
+	return fmt.Sprintf("suspended; updates to %d file(s) pending", len(files))
+}
+
+// push pushes to the origin using the refspecs given, which are
+// expected to be fully formed (e.g., as returned by
+// `pushRefspecs`).
+func push(ctx context.Context, path string, refspecs []string, access repoAccess) error {
+	return runGitOperation(ctx, func() error {
+		return pushRefs(ctx, path, refspecs, access)
+	})
+}
+
+// pushRefs does the push for `push`.
+func pushRefs(ctx context.Context, path string, refspecs []string, access repoAccess) error {
 	repo, err := libgit2.OpenRepository(path)
 	if err != nil {
 		return err
@@ -675,20 +2388,113 @@ func push(ctx context.Context, path, branch string, access repoAccess) error {
 
 	// calling repo.Push will succeed even if a reference update is
 	// rejected; to detect this case, this callback is supplied.
-	var callbackErr error
+	rejected := make(map[string]string)
 	callbacks.PushUpdateReferenceCallback = func(refname, status string) libgit2.ErrorCode {
 		if status != "" {
-			callbackErr = fmt.Errorf("ref %s rejected: %s", refname, status)
+			rejected[refname] = status
 		}
 		return libgit2.ErrorCodeOK
 	}
-	err = origin.Push([]string{fmt.Sprintf("refs/heads/%s:refs/heads/%s", branch, branch)}, &libgit2.PushOptions{
+	// the reason given for a rejection is often only that a hook
+	// declined it, with the detail in the messages from the remote
+	var messages strings.Builder
+	next := callbacks.SidebandProgressCallback
+	callbacks.SidebandProgressCallback = func(str string) libgit2.ErrorCode {
+		messages.WriteString(str)
+		if next == nil {
+			return libgit2.ErrorCodeOK
+		}
+		return next(str)
+	}
+	err = origin.Push(refspecs, &libgit2.PushOptions{
 		RemoteCallbacks: callbacks,
 	})
 	if err != nil {
 		return libgit2PushError(err)
 	}
-	return callbackErr
+	if len(rejected) > 0 {
+		return &refsRejectedError{rejected: rejected, messages: messages.String()}
+	}
+	return nil
+}
+
+// refsRejectedError is returned from push when the remote refused to
+// update some of the refs pushed to. Any other refs were updated.
+type refsRejectedError struct {
+	// rejected maps the name of each ref rejected to the reason given
+	rejected map[string]string
+	// messages has what the remote said while pushing
+	messages string
+}
+
+// protected says whether the refs were rejected because they are
+// protected branches, going by the reasons and messages given by the
+// remote; e.g., GitHub gives "protected branch hook declined", and
+// GitLab says "You are not allowed to push code to protected
+// branches".
+func (e *refsRejectedError) protected() bool {
+	for _, reason := range e.rejected {
+		if strings.Contains(strings.ToLower(reason), "protected") {
+			return true
+		}
+	}
+	return strings.Contains(strings.ToLower(e.messages), "protected branch")
+}
+
+func (e *refsRejectedError) Error() string {
+	refs := make([]string, 0, len(e.rejected))
+	for ref := range e.rejected {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	msgs := make([]string, len(refs))
+	for i, ref := range refs {
+		msgs[i] = fmt.Sprintf("ref %s rejected: %s", ref, e.rejected[ref])
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// refspecDestination gives the remote ref updated by pushing with a
+// refspec of the form "[+]<src>:<dst>" (or "[+]<ref>" for the same
+// ref on each side).
+func refspecDestination(refspec string) string {
+	refspec = strings.TrimPrefix(refspec, "+")
+	if i := strings.Index(refspec, ":"); i >= 0 {
+		return refspec[i+1:]
+	}
+	return refspec
+}
+
+// pushRefStatuses gives the status of each ref pushed to, given the
+// refspecs used and the outcome of the push. Refs no longer pushed to
+// are dropped; for those that failed, the last commit successfully
+// pushed is kept.
+func pushRefStatuses(previous []imagev1.PushRefStatus, refspecs []string, rev string, now time.Time, pushErr error) []imagev1.PushRefStatus {
+	prev := make(map[string]imagev1.PushRefStatus)
+	for _, p := range previous {
+		prev[p.Ref] = p
+	}
+	var rejected *refsRejectedError
+	errors.As(pushErr, &rejected)
+
+	statuses := make([]imagev1.PushRefStatus, 0, len(refspecs))
+	for _, refspec := range refspecs {
+		ref := refspecDestination(refspec)
+		status := prev[ref]
+		status.Ref = ref
+		switch {
+		case rejected != nil && rejected.rejected[ref] != "":
+			status.LastPushError = rejected.rejected[ref]
+		case pushErr != nil && rejected == nil:
+			status.LastPushError = pushErr.Error()
+		default:
+			status.LastPushCommit = rev
+			status.LastPushTime = &metav1.Time{Time: now}
+			status.LastPushError = ""
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
 }
 
 func libgit2PushError(err error) error {
@@ -725,9 +2531,19 @@ func libgit2PushError(err error) error {
 
 // --- events, metrics
 
-func (r *ImageUpdateAutomationReconciler) event(ctx context.Context, auto imagev1.ImageUpdateAutomation, severity, msg string) {
+// event records an event for the automation, and sends it to the
+// external event recorder if there is one. The metadata, if given, is
+// attached to both as key/value pairs that can be used to filter and
+// route events.
+func (r *ImageUpdateAutomationReconciler) event(ctx context.Context, auto imagev1.ImageUpdateAutomation, severity, msg string, metadata map[string]string) {
+	r.eventWithReason(ctx, auto, severity, severity, msg, metadata)
+}
+
+// eventWithReason is like event, but gives the event a reason other
+// than its severity, for events that alerts might want to single out.
+func (r *ImageUpdateAutomationReconciler) eventWithReason(ctx context.Context, auto imagev1.ImageUpdateAutomation, severity, reason, msg string, metadata map[string]string) {
 	if r.EventRecorder != nil {
-		r.EventRecorder.Event(&auto, "Normal", severity, msg)
+		r.EventRecorder.AnnotatedEventf(&auto, metadata, "Normal", reason, "%s", msg)
 	}
 	if r.ExternalEventRecorder != nil {
 		objRef, err := reference.GetReference(r.Scheme, &auto)
@@ -736,13 +2552,43 @@ func (r *ImageUpdateAutomationReconciler) event(ctx context.Context, auto imagev
 			return
 		}
 
-		if err := r.ExternalEventRecorder.Eventf(*objRef, nil, severity, severity, msg); err != nil {
+		if err := r.ExternalEventRecorder.Eventf(*objRef, metadata, severity, reason, msg); err != nil {
 			logr.FromContext(ctx).Error(err, "unable to send event")
 			return
 		}
 	}
 }
 
+// auditPush sends the record of a push to the audit sink, if there is
+// one. The push has already happened by this point, so failing to
+// record it is reported, but doesn't fail the run.
+func (r *ImageUpdateAutomationReconciler) auditPush(ctx context.Context, auto imagev1.ImageUpdateAutomation, record PushRecord) {
+	if r.AuditSink == nil {
+		return
+	}
+	if record.Controller == "" {
+		record.Controller, _ = os.Hostname()
+	}
+	if err := r.AuditSink.RecordPush(ctx, record); err != nil {
+		logr.FromContext(ctx).Error(err, "unable to record push in audit trail", "revision", record.Revision)
+		r.event(ctx, auto, events.EventSeverityError, fmt.Sprintf("unable to record push of %s in audit trail: %s", record.Revision, err), nil)
+	}
+}
+
+// sendReport sends the report of an automation run to the report
+// sink, if there is one.
+func (r *ImageUpdateAutomationReconciler) sendReport(ctx context.Context, auto imagev1.ImageUpdateAutomation, report RunReport) {
+	if r.ReportSink == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, reportTimeout)
+	defer cancel()
+	if err := r.ReportSink.SendReport(ctx, report); err != nil {
+		logr.FromContext(ctx).Error(err, "unable to send run report")
+		r.event(ctx, auto, events.EventSeverityError, fmt.Sprintf("unable to send run report: %s", err), nil)
+	}
+}
+
 func (r *ImageUpdateAutomationReconciler) recordReadinessMetric(ctx context.Context, auto *imagev1.ImageUpdateAutomation) {
 	if r.MetricsRecorder == nil {
 		return
@@ -765,10 +2611,106 @@ func (r *ImageUpdateAutomationReconciler) recordReadinessMetric(ctx context.Cont
 
 // --- updates
 
+// pathsToUpdate gives the paths, with their include and exclude
+// patterns, to be updated according to the update strategy given. A
+// single path given in `.path` is treated as a path with no patterns,
+// as is the path of each stage given in `.stages`; if no path is
+// given at all, the result is the root of the repository.
+func pathsToUpdate(strategy *imagev1.UpdateStrategy) ([]imagev1.UpdatePath, error) {
+	if len(strategy.Stages) > 0 {
+		if strategy.Path != "" || len(strategy.Paths) > 0 {
+			return nil, fmt.Errorf(".spec.update.stages cannot be given together with .spec.update.path or .spec.update.paths")
+		}
+		if err := checkStages(strategy.Stages); err != nil {
+			return nil, err
+		}
+		paths := make([]imagev1.UpdatePath, len(strategy.Stages))
+		for i, stage := range strategy.Stages {
+			paths[i] = imagev1.UpdatePath{Path: stage.Path}
+		}
+		return paths, nil
+	}
+	if len(strategy.Paths) == 0 {
+		return []imagev1.UpdatePath{{Path: strategy.Path}}, nil
+	}
+	if strategy.Path != "" {
+		return nil, fmt.Errorf("only one of .spec.update.path and .spec.update.paths may be given")
+	}
+	return strategy.Paths, nil
+}
+
+// getPolicies gives the image policies named, in a namespace, leaving
+// out any that don't exist.
+func (r *ImageUpdateAutomationReconciler) getPolicies(ctx context.Context, namespace string, names []string) ([]imagev1_reflect.ImagePolicy, error) {
+	var policies []imagev1_reflect.ImagePolicy
+	for _, name := range names {
+		policy, err := r.getPolicy(ctx, types.NamespacedName{Namespace: namespace, Name: name})
+		if err != nil {
+			return nil, err
+		}
+		if policy != nil {
+			policies = append(policies, *policy)
+		}
+	}
+	return policies, nil
+}
+
+// listPolicyNames gives the names of all the image policies in the
+// namespace given.
+func (r *ImageUpdateAutomationReconciler) listPolicyNames(ctx context.Context, namespace string) ([]string, error) {
+	var list metav1.PartialObjectMetadataList
+	list.SetGroupVersionKind(imagev1_reflect.GroupVersion.WithKind(imagev1_reflect.ImagePolicyKind + "List"))
+	if err := r.List(ctx, &list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(list.Items))
+	for i := range list.Items {
+		names[i] = list.Items[i].GetName()
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// detectingImages reports whether any of the strategies given
+// detects image fields without markers.
+func detectingImages(strategies []*imagev1.UpdateStrategy) bool {
+	for _, strategy := range strategies {
+		if strategy != nil && strategy.DetectImages {
+			return true
+		}
+	}
+	return false
+}
+
+// getPolicy gives the image policy named, or nil if there's no such
+// policy.
+func (r *ImageUpdateAutomationReconciler) getPolicy(ctx context.Context, name types.NamespacedName) (*imagev1_reflect.ImagePolicy, error) {
+	var policy imagev1_reflect.ImagePolicy
+	var err error
+	if r.policyStore != nil {
+		meta := metav1.PartialObjectMetadata{}
+		meta.SetGroupVersionKind(imagev1_reflect.GroupVersion.WithKind(imagev1_reflect.ImagePolicyKind))
+		if err = r.Get(ctx, name, &meta); err == nil {
+			policy, err = r.policyStore.get(ctx, &meta)
+		}
+	} else {
+		err = r.Get(ctx, name, &policy)
+	}
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &policy, nil
+}
+
 // updateAccordingToSetters updates files under the root by treating
-// the given image policies as kyaml setters.
-func updateAccordingToSetters(ctx context.Context, tracelog logr.Logger, path string, policies []imagev1_reflect.ImagePolicy) (update.Result, error) {
-	return update.UpdateWithSetters(tracelog, path, path, policies)
+// the given image policies as kyaml setters. It stops once the context
+// given is done.
+func updateAccordingToSetters(ctx context.Context, tracelog logr.Logger, path string, policies []imagev1_reflect.ImagePolicy, opts ...update.Option) (update.Result, error) {
+	opts = append([]update.Option{update.WithContext(ctx)}, opts...)
+	return update.UpdateWithSetters(tracelog, path, path, policies, opts...)
 }
 
 func (r *ImageUpdateAutomationReconciler) recordSuspension(ctx context.Context, auto imagev1.ImageUpdateAutomation) {
@@ -790,23 +2732,535 @@ func (r *ImageUpdateAutomationReconciler) recordSuspension(ctx context.Context,
 	}
 }
 
-// templateMsg renders a msg template, returning the message or an error.
-func templateMsg(messageTemplate string, templateValues *TemplateData) (string, error) {
-	if messageTemplate == "" {
-		messageTemplate = defaultMessageTemplate
+// defaultMessageTemplateKey is the key in a ConfigMap under which a
+// commit message template is expected, if a key is not given.
+const defaultMessageTemplateKey = "messageTemplate"
+
+// getMessageTemplate gives the commit message template for the
+// automation, which is either given in the spec or held in a
+// ConfigMap referenced by the spec.
+func (r *ImageUpdateAutomationReconciler) getMessageTemplate(ctx context.Context, auto *imagev1.ImageUpdateAutomation) (string, error) {
+	commit := auto.Spec.GitSpec.Commit
+	from := commit.MessageTemplateFrom
+	if from == nil {
+		return commit.MessageTemplate, nil
+	}
+	if commit.MessageTemplate != "" {
+		return "", fmt.Errorf("only one of .spec.git.commit.messageTemplate and .spec.git.commit.messageTemplateFrom may be given")
+	}
+
+	name := types.NamespacedName{
+		Namespace: from.ConfigMapRef.Namespace,
+		Name:      from.ConfigMapRef.Name,
 	}
+	if name.Namespace == "" {
+		name.Namespace = auto.GetNamespace()
+	}
+	key := from.Key
+	if key == "" {
+		key = defaultMessageTemplateKey
+	}
+
+	var configMap corev1.ConfigMap
+	if err := r.Get(ctx, name, &configMap); err != nil {
+		return "", fmt.Errorf("could not get commit message template ConfigMap '%s': %w", name, err)
+	}
+	messageTemplate, ok := configMap.Data[key]
+	if !ok {
+		return "", fmt.Errorf("commit message template ConfigMap '%s' does not contain a '%s' key", name, key)
+	}
+	return messageTemplate, nil
+}
 
+// The keys in a Secret or ConfigMap under which the author of commits
+// is expected.
+const (
+	commitAuthorNameKey  = "name"
+	commitAuthorEmailKey = "email"
+)
+
+// getCommitAuthor gives the author of commits for the automation,
+// which is either given in the spec or held in a Secret or ConfigMap
+// referenced by the spec.
+func (r *ImageUpdateAutomationReconciler) getCommitAuthor(ctx context.Context, auto *imagev1.ImageUpdateAutomation) (imagev1.CommitUser, error) {
+	commit := auto.Spec.GitSpec.Commit
+	from := commit.AuthorFrom
+	if from == nil {
+		if commit.Author.Email == "" {
+			return imagev1.CommitUser{}, fmt.Errorf("one of .spec.git.commit.author and .spec.git.commit.authorFrom must be given")
+		}
+		return commit.Author, nil
+	}
+	if commit.Author != (imagev1.CommitUser{}) {
+		return imagev1.CommitUser{}, fmt.Errorf("only one of .spec.git.commit.author and .spec.git.commit.authorFrom may be given")
+	}
+
+	var kind string
+	var name types.NamespacedName
+	var data map[string]string
+	switch {
+	case from.SecretRef != nil && from.ConfigMapRef != nil:
+		return imagev1.CommitUser{}, fmt.Errorf("only one of .spec.git.commit.authorFrom.secretRef and .spec.git.commit.authorFrom.configMapRef may be given")
+	case from.SecretRef != nil:
+		kind = "Secret"
+		name = types.NamespacedName{Namespace: auto.GetNamespace(), Name: from.SecretRef.Name}
+		var secret corev1.Secret
+		if err := r.Get(ctx, name, &secret); err != nil {
+			return imagev1.CommitUser{}, fmt.Errorf("could not get commit author Secret '%s': %w", name, err)
+		}
+		data = make(map[string]string, len(secret.Data))
+		for key, value := range secret.Data {
+			data[key] = string(value)
+		}
+	case from.ConfigMapRef != nil:
+		kind = "ConfigMap"
+		name = types.NamespacedName{Namespace: from.ConfigMapRef.Namespace, Name: from.ConfigMapRef.Name}
+		if name.Namespace == "" {
+			name.Namespace = auto.GetNamespace()
+		}
+		var configMap corev1.ConfigMap
+		if err := r.Get(ctx, name, &configMap); err != nil {
+			return imagev1.CommitUser{}, fmt.Errorf("could not get commit author ConfigMap '%s': %w", name, err)
+		}
+		data = configMap.Data
+	default:
+		return imagev1.CommitUser{}, fmt.Errorf("one of .spec.git.commit.authorFrom.secretRef and .spec.git.commit.authorFrom.configMapRef must be given")
+	}
+
+	author := imagev1.CommitUser{
+		Name:  strings.TrimSpace(data[commitAuthorNameKey]),
+		Email: strings.TrimSpace(data[commitAuthorEmailKey]),
+	}
+	if author.Email == "" {
+		return imagev1.CommitUser{}, fmt.Errorf("commit author %s '%s' does not contain an '%s' key", kind, name, commitAuthorEmailKey)
+	}
+	return author, nil
+}
+
+// parseTemplate parses a template given in the spec, returning the
+// template or an error (which will include the line number of any
+// syntax error). The name is used in error messages.
+func parseTemplate(name, text string) (*template.Template, error) {
 	// Includes only functions that are guaranteed to always evaluate to the same result for given input.
 	// This removes the possibility of accidentally relying on where or when the template runs.
 	// https://github.com/Masterminds/sprig/blob/3ac42c7bc5e4be6aa534e036fb19dde4a996da2e/functions.go#L70
-	t, err := template.New("commit message").Funcs(sprig.HermeticTxtFuncMap()).Parse(messageTemplate)
+	t, err := template.New(name).Funcs(sprig.HermeticTxtFuncMap()).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create %s template from spec: %w", name, err)
+	}
+	return t, nil
+}
+
+// validateTemplate checks that a template can be parsed, and can be
+// run with the data available before any updates are made. This is so
+// mistakes in the template can be reported without first going to the
+// trouble of cloning the repository.
+func validateTemplate(name, text string, templateValues TemplateData) error {
+	t, err := parseTemplate(name, text)
+	if err != nil {
+		return err
+	}
+	if err := t.Execute(io.Discard, templateValues); err != nil {
+		return fmt.Errorf("failed to run %s template from spec: %w", name, err)
+	}
+	return nil
+}
+
+// validateCommitTemplates checks the subject template, if given, and
+// the message template (or its default).
+func validateCommitTemplates(subjectTemplate, messageTemplate string, templateValues TemplateData) error {
+	if subjectTemplate != "" {
+		if err := validateTemplate("commit subject", subjectTemplate, templateValues); err != nil {
+			return err
+		}
+	}
+	if messageTemplate == "" {
+		messageTemplate = defaultMessageTemplate
+	}
+	return validateTemplate("commit message", messageTemplate, templateValues)
+}
+
+// renderTemplate runs a template given in the spec, returning the
+// result or an error.
+func renderTemplate(name, text string, templateValues *TemplateData) (string, error) {
+	t, err := parseTemplate(name, text)
 	if err != nil {
-		return "", fmt.Errorf("unable to create commit message template from spec: %w", err)
+		return "", err
 	}
 
 	b := &strings.Builder{}
 	if err := t.Execute(b, *templateValues); err != nil {
-		return "", fmt.Errorf("failed to run template from spec: %w", err)
+		return "", fmt.Errorf("failed to run %s template from spec: %w", name, err)
 	}
 	return b.String(), nil
 }
+
+// templateMsg renders a msg template, returning the message or an error.
+func templateMsg(messageTemplate string, templateValues *TemplateData) (string, error) {
+	if messageTemplate == "" {
+		messageTemplate = defaultMessageTemplate
+	}
+	return renderTemplate("commit message", messageTemplate, templateValues)
+}
+
+// commitMessage puts together the commit message. If there is a
+// subject template, its result (run together onto one line) is the
+// subject, and the result of the message template is the body, which
+// may be empty. Otherwise, the message is the result of the message
+// template or its default. In either case, the subject is shortened
+// to maxSubjectLength characters if that is greater than zero.
+func commitMessage(subjectTemplate, messageTemplate string, maxSubjectLength int, templateValues *TemplateData) (string, error) {
+	if subjectTemplate == "" {
+		msg, err := templateMsg(messageTemplate, templateValues)
+		if err != nil {
+			return "", err
+		}
+		if i := strings.IndexByte(msg, '\n'); i >= 0 {
+			return truncateSubject(msg[:i], maxSubjectLength) + msg[i:], nil
+		}
+		return truncateSubject(msg, maxSubjectLength), nil
+	}
+
+	subject, err := renderTemplate("commit subject", subjectTemplate, templateValues)
+	if err != nil {
+		return "", err
+	}
+	subject = truncateSubject(strings.Join(strings.Fields(subject), " "), maxSubjectLength)
+	var body string
+	if messageTemplate != "" {
+		if body, err = renderTemplate("commit message", messageTemplate, templateValues); err != nil {
+			return "", err
+		}
+	}
+	if strings.TrimSpace(body) == "" {
+		return subject, nil
+	}
+	return subject + "\n\n" + body, nil
+}
+
+// truncateSubject shortens the subject given to at most max
+// characters, ending it with "..." to show it's been shortened. If max
+// is zero or less, the subject is returned as it is.
+func truncateSubject(subject string, max int) string {
+	chars := []rune(subject)
+	if max <= 0 || len(chars) <= max {
+		return subject
+	}
+	const ellipsis = "..."
+	if max <= len(ellipsis) {
+		return string(chars[:max])
+	}
+	return strings.TrimRight(string(chars[:max-len(ellipsis)]), " ") + ellipsis
+}
+
+// updatesTrailerKey is the key for the commit message trailer listing
+// the updates made.
+const updatesTrailerKey = "Flux-Image-Updates"
+
+// trailerUpdate is the form of each entry in the updates trailer.
+type trailerUpdate struct {
+	Policy string `json:"policy"`
+	Old    string `json:"old"`
+	New    string `json:"new"`
+}
+
+// appendUpdatesTrailer adds a trailer to the commit message giving,
+// in JSON, the old and new field values for each image policy used in
+// the update.
+func appendUpdatesTrailer(message string, result update.Result) (string, error) {
+	var updates []trailerUpdate
+	for _, u := range imageUpdates(result) {
+		updates = append(updates, trailerUpdate{
+			Policy: types.NamespacedName{Namespace: u.Policy.Namespace, Name: u.Policy.Name}.String(),
+			Old:    u.OldValue,
+			New:    u.NewValue,
+		})
+	}
+	if len(updates) == 0 {
+		return message, nil
+	}
+	value, err := json.Marshal(updates)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s\n\n%s: %s\n", strings.TrimRight(message, "\n"), updatesTrailerKey, value), nil
+}
+
+// imageUpdates gives the changes in the result, as the image policy
+// responsible with the old and new field values. The same change made
+// in more than one place is listed once.
+func imageUpdates(result update.Result) []imagev1.ImageUpdate {
+	var updates []imagev1.ImageUpdate
+	seen := make(map[imagev1.ImageUpdate]bool)
+	for _, change := range result.Changes() {
+		policy := change.Image.Policy()
+		u := imagev1.ImageUpdate{
+			Policy: meta.NamespacedObjectReference{
+				Namespace: policy.Namespace,
+				Name:      policy.Name,
+			},
+			OldValue: change.OldValue,
+			NewValue: change.NewValue,
+		}
+		if !seen[u] {
+			seen[u] = true
+			updates = append(updates, u)
+		}
+	}
+	return updates
+}
+
+// policiesMarked gives those of the policies given that markers
+// referred to in an update.
+func policiesMarked(result update.Result, policies []imagev1_reflect.ImagePolicy) []imagev1_reflect.ImagePolicy {
+	var marked []imagev1_reflect.ImagePolicy
+	for _, policy := range policies {
+		if _, ok := result.MarkedPolicies[types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}]; ok {
+			marked = append(marked, policy)
+		}
+	}
+	return marked
+}
+
+// observedPolicies gives the record of the image policies considered
+// in a run, ordered by name.
+func observedPolicies(policies []imagev1_reflect.ImagePolicy) []imagev1.ObservedPolicy {
+	var observed []imagev1.ObservedPolicy
+	for _, policy := range policies {
+		observed = append(observed, imagev1.ObservedPolicy{
+			Policy: meta.NamespacedObjectReference{
+				Namespace: policy.GetNamespace(),
+				Name:      policy.GetName(),
+			},
+			LatestImage: policy.Status.LatestImage,
+		})
+	}
+	sort.Slice(observed, func(i, j int) bool {
+		return observed[i].Policy.Name < observed[j].Policy.Name
+	})
+	return observed
+}
+
+// registryRewrites gives the rewrites given, for the update.
+func registryRewrites(rewrites []imagev1.RegistryRewrite) []update.RegistryRewrite {
+	result := make([]update.RegistryRewrite, len(rewrites))
+	for i, rewrite := range rewrites {
+		result[i] = update.RegistryRewrite{From: rewrite.From, To: rewrite.To}
+	}
+	return result
+}
+
+// runDigest gives a digest of what an automation run depends on,
+// short of the files in the repository: the generation of the
+// automation, the revision of the git repository, and the latest
+// image of each image policy the files refer to.
+func runDigest(generation int64, revision string, policies []imagev1_reflect.ImagePolicy) string {
+	images := make([]string, len(policies))
+	for i, policy := range policies {
+		images[i] = policy.Namespace + "/" + policy.Name + "=" + policy.Status.LatestImage
+	}
+	sort.Strings(images)
+	h := sha256.New()
+	fmt.Fprintf(h, "generation=%d\nrevision=%s\n", generation, revision)
+	for _, image := range images {
+		fmt.Fprintln(h, image)
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil))
+}
+
+// splitSkippedFiles divides the files skipped in scanning for updates
+// into those with markers and those without.
+func splitSkippedFiles(skipped []update.SkippedFile) (marked, unmarked []update.SkippedFile) {
+	for _, file := range skipped {
+		if file.Marked {
+			marked = append(marked, file)
+		} else {
+			unmarked = append(unmarked, file)
+		}
+	}
+	return marked, unmarked
+}
+
+// skippedFilesMessage describes the files skipped in scanning for
+// updates, for an event; `marked` says whether they have markers.
+func skippedFilesMessage(skipped []update.SkippedFile, marked bool) string {
+	var buf strings.Builder
+	if marked {
+		fmt.Fprintf(&buf, "%d file(s) with markers were skipped in scanning for updates:", len(skipped))
+	} else {
+		fmt.Fprintf(&buf, "%d file(s) without markers were skipped in scanning for updates:", len(skipped))
+	}
+	for _, file := range skipped {
+		fmt.Fprintf(&buf, "\n- %s (%s)", file.Path, file.Reason)
+		if file.Message != "" {
+			fmt.Fprintf(&buf, ": %s", file.Message)
+		}
+	}
+	return buf.String()
+}
+
+// skippedFilesChanged reports whether the files skipped in a run, as
+// recorded in the status, differ from those skipped in the run before.
+func skippedFilesChanged(previous, current []imagev1.SkippedFile) bool {
+	if len(previous) != len(current) {
+		return true
+	}
+	for i := range current {
+		if previous[i] != current[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// noChangeReason categorises a run that made no changes, given the
+// image policies considered and the result of updating.
+func noChangeReason(policies []imagev1_reflect.ImagePolicy, result update.Result) imagev1.NoChangeReason {
+	var latest bool
+	for _, policy := range policies {
+		if policy.Status.LatestImage != "" {
+			latest = true
+			break
+		}
+	}
+	switch {
+	case !latest:
+		return imagev1.NoChangeNoPolicies
+	case result.Matched == 0:
+		return imagev1.NoChangeNoMarkersMatched
+	default:
+		return imagev1.NoChangeImagesCurrent
+	}
+}
+
+// pushSummary describes what was changed by a push, for including in
+// the event sent about it. Only the first few files and image updates
+// are listed, so that the event stays a readable size however many
+// manifests were changed.
+func pushSummary(files []string, updates []imagev1.ImageUpdate) string {
+	var b strings.Builder
+	writeList := func(heading string, items []string) {
+		fmt.Fprintf(&b, "\n%s (%d):\n", heading, len(items))
+		for i, item := range items {
+			if i == maxSummaryItems {
+				fmt.Fprintf(&b, "- ... and %d more\n", len(items)-maxSummaryItems)
+				break
+			}
+			fmt.Fprintf(&b, "- %s\n", item)
+		}
+	}
+	writeList("Files changed", files)
+	if len(updates) > 0 {
+		images := make([]string, len(updates))
+		for i, u := range updates {
+			images[i] = fmt.Sprintf("%s/%s: %s -> %s", u.Policy.Namespace, u.Policy.Name, u.OldValue, u.NewValue)
+		}
+		writeList("Images updated", images)
+	}
+	return b.String()
+}
+
+// fileEventMessages gives a message for each file changed by an
+// update, listing the changes made to it, in order of file name.
+func fileEventMessages(rev string, result update.Result) []string {
+	files := make([]string, 0, len(result.Files))
+	for file := range result.Files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	msgs := make([]string, len(files))
+	for i, file := range files {
+		var b strings.Builder
+		fmt.Fprintf(&b, "Updated %s in change %s", file, rev)
+		for _, change := range result.Files[file].Changes {
+			fmt.Fprintf(&b, "\n- %s", change)
+		}
+		msgs[i] = b.String()
+	}
+	return msgs
+}
+
+// The keys of the metadata attached to push events, and events about
+// rejected pushes.
+const (
+	revisionMetadataKey = "revision"
+	branchMetadataKey   = "branch"
+	refspecMetadataKey  = "refspec"
+	imagesMetadataKey   = "images"
+	policiesMetadataKey = "policies"
+	remoteMetadataKey   = "remote"
+)
+
+// pushMetadata gives the metadata for the event sent about a push. The
+// images and policies are each given as a sorted, comma-separated list.
+func pushMetadata(rev, branch, refspec string, result update.Result, updates []imagev1.ImageUpdate) map[string]string {
+	metadata := map[string]string{
+		revisionMetadataKey: rev,
+	}
+	if branch != "" {
+		metadata[branchMetadataKey] = branch
+	}
+	if refspec != "" {
+		metadata[refspecMetadataKey] = refspec
+	}
+
+	var images []string
+	for _, ref := range result.Images() {
+		images = append(images, ref.String())
+	}
+	if len(images) > 0 {
+		sort.Strings(images)
+		metadata[imagesMetadataKey] = strings.Join(images, ",")
+	}
+
+	var policies []string
+	seen := make(map[string]bool)
+	for _, u := range updates {
+		policy := u.Policy.Namespace + "/" + u.Policy.Name
+		if !seen[policy] {
+			seen[policy] = true
+			policies = append(policies, policy)
+		}
+	}
+	if len(policies) > 0 {
+		sort.Strings(policies)
+		metadata[policiesMetadataKey] = strings.Join(policies, ",")
+	}
+	return metadata
+}
+
+// appliedPolicies updates the record of the image each policy last
+// caused to be pushed, given the result of a pushed update. Records for
+// policies that no longer exist are dropped.
+func appliedPolicies(previous []imagev1.AppliedPolicy, result update.Result, policies []imagev1_reflect.ImagePolicy, now time.Time) []imagev1.AppliedPolicy {
+	applied := make(map[types.NamespacedName]imagev1.AppliedPolicy)
+	for _, a := range previous {
+		applied[types.NamespacedName{Namespace: a.Policy.Namespace, Name: a.Policy.Name}] = a
+	}
+	for _, ref := range result.Images() {
+		policy := ref.Policy()
+		applied[policy] = imagev1.AppliedPolicy{
+			Policy: meta.NamespacedObjectReference{
+				Namespace: policy.Namespace,
+				Name:      policy.Name,
+			},
+			LastAppliedImage: ref.String(),
+			LastAppliedTime:  metav1.Time{Time: now},
+		}
+	}
+
+	var records []imagev1.AppliedPolicy
+	for _, policy := range policies {
+		if a, ok := applied[types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}]; ok {
+			records = append(records, a)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Policy.Namespace != records[j].Policy.Namespace {
+			return records[i].Policy.Namespace < records[j].Policy.Namespace
+		}
+		return records[i].Policy.Name < records[j].Policy.Name
+	})
+	return records
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// In a cluster shared by tenants, an automation can be made to act
+// as a service account in its own namespace, rather than as the
+// controller, so that it can only get at, and change, what the tenant
+// could anyway. The controller still reads and writes its own objects
+// (the automation, run requests and so on) itself; everything else,
+// including the objects patched by a cluster target, is read and
+// written as the service account. That includes image policies,
+// which are in the same API group as the controller's own objects, so
+// the controller's own are picked out by kind.
+
+// controllerKinds are the kinds that the controller reads and writes
+// itself, whether or not it is impersonating a service account.
+var controllerKinds = map[string]bool{
+	"ImageUpdateAutomation":        true,
+	"ImageUpdateAutomationList":    true,
+	"ImageUpdateRunRequest":        true,
+	"ImageUpdateRunRequestList":    true,
+	"ImageUpdateChangeRequest":     true,
+	"ImageUpdateChangeRequestList": true,
+}
+
+// impersonatingClient reads and writes objects other than the
+// controller's own with the tenant client, and does everything else,
+// including writing the status of its own objects, with the embedded
+// client.
+type impersonatingClient struct {
+	client.Client
+	tenant client.Client
+}
+
+func (c impersonatingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	return c.clientFor(obj).Get(ctx, key, obj)
+}
+
+func (c impersonatingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	return c.clientFor(list).List(ctx, list, opts...)
+}
+
+func (c impersonatingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	return c.clientFor(obj).Create(ctx, obj, opts...)
+}
+
+func (c impersonatingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return c.clientFor(obj).Update(ctx, obj, opts...)
+}
+
+func (c impersonatingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return c.clientFor(obj).Patch(ctx, obj, patch, opts...)
+}
+
+func (c impersonatingClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	return c.clientFor(obj).Delete(ctx, obj, opts...)
+}
+
+func (c impersonatingClient) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) error {
+	return c.clientFor(obj).DeleteAllOf(ctx, obj, opts...)
+}
+
+// clientFor gives the client to use for the object given.
+func (c impersonatingClient) clientFor(obj runtime.Object) client.Client {
+	gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+	if err == nil && gvk.Group == imagev1.GroupVersion.Group && controllerKinds[gvk.Kind] {
+		return c.Client
+	}
+	return c.tenant
+}
+
+// tenantClients keeps the client made for each service account, so
+// that one isn't made every time an automation runs.
+type tenantClients struct {
+	mu      sync.Mutex
+	clients map[string]client.Client
+}
+
+func newTenantClients() *tenantClients {
+	return &tenantClients{clients: make(map[string]client.Client)}
+}
+
+// get gives the client for the username given, making it with the
+// func given if there isn't one yet.
+func (c *tenantClients) get(username string, newClient func() (client.Client, error)) (client.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cl, ok := c.clients[username]; ok {
+		return cl, nil
+	}
+	cl, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+	c.clients[username] = cl
+	return cl, nil
+}
+
+// serviceAccountUsername gives the username with which to impersonate
+// the service account given.
+func serviceAccountUsername(namespace, name string) string {
+	return fmt.Sprintf("system:serviceaccount:%s:%s", namespace, name)
+}
+
+// impersonate gives a reconciler that reads and writes the objects
+// the automation given refers to as its service account, or the
+// reconciler itself if the automation doesn't give one.
+func (r *ImageUpdateAutomationReconciler) impersonate(auto *imagev1.ImageUpdateAutomation) (*ImageUpdateAutomationReconciler, error) {
+	if auto.Spec.ServiceAccountName == "" {
+		return r, nil
+	}
+	if r.restConfig == nil {
+		return nil, fmt.Errorf("unable to impersonate service account '%s': no client configuration", auto.Spec.ServiceAccountName)
+	}
+	username := serviceAccountUsername(auto.GetNamespace(), auto.Spec.ServiceAccountName)
+	tenantClient, err := r.tenantClients.get(username, func() (client.Client, error) {
+		config := rest.CopyConfig(r.restConfig)
+		config.Impersonate = rest.ImpersonationConfig{UserName: username}
+		return client.New(config, client.Options{Scheme: r.Client.Scheme(), Mapper: r.Client.RESTMapper()})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to impersonate service account '%s': %w", auto.Spec.ServiceAccountName, err)
+	}
+	tenant := *r
+	tenant.Client = impersonatingClient{Client: r.Client, tenant: tenantClient}
+	// the policy store reads with the controller's own client
+	tenant.policyStore = nil
+	return &tenant, nil
+}
+
+// crossNamespaceRef returns an error naming the first reference in
+// the automation given to an object in another namespace, or nil if
+// there is none.
+func crossNamespaceRef(auto *imagev1.ImageUpdateAutomation) error {
+	namespace := auto.GetNamespace()
+	for _, dep := range auto.Spec.DependsOn {
+		if dep.Namespace != "" && dep.Namespace != namespace {
+			return fmt.Errorf("cannot depend on '%s/%s' in another namespace", dep.Namespace, dep.Name)
+		}
+	}
+	for _, gate := range auto.Spec.HealthGates {
+		if gate.Namespace != "" && gate.Namespace != namespace {
+			return fmt.Errorf("cannot use health gate '%s/%s' in another namespace", gate.Namespace, gate.Name)
+		}
+	}
+	if git := auto.Spec.GitSpec; git != nil && git.Commit.MessageTemplateFrom != nil {
+		ref := git.Commit.MessageTemplateFrom.ConfigMapRef
+		if ref.Namespace != "" && ref.Namespace != namespace {
+			return fmt.Errorf("cannot use commit message template ConfigMap '%s/%s' in another namespace", ref.Namespace, ref.Name)
+		}
+	}
+	if git := auto.Spec.GitSpec; git != nil && git.Commit.AuthorFrom != nil && git.Commit.AuthorFrom.ConfigMapRef != nil {
+		ref := git.Commit.AuthorFrom.ConfigMapRef
+		if ref.Namespace != "" && ref.Namespace != namespace {
+			return fmt.Errorf("cannot use commit author ConfigMap '%s/%s' in another namespace", ref.Namespace, ref.Name)
+		}
+	}
+	return nil
+}
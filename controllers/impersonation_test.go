@@ -0,0 +1,198 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	imagev1_reflect "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+	"github.com/fluxcd/pkg/apis/meta"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// mappingClient gives a RESTMapper, which the fake client doesn't,
+// so that a client can be made from it without discovery.
+type mappingClient struct {
+	client.Client
+}
+
+func (mappingClient) RESTMapper() apimeta.RESTMapper {
+	return apimeta.NewDefaultRESTMapper(nil)
+}
+
+// readOnlyClient refuses to write anything, as a client for a service
+// account that may only read would.
+type readOnlyClient struct {
+	client.Client
+}
+
+func (readOnlyClient) Patch(_ context.Context, obj client.Object, _ client.Patch, _ ...client.PatchOption) error {
+	return apierrors.NewForbidden(schema.GroupResource{}, obj.GetName(), nil)
+}
+
+func TestCrossNamespaceRef(t *testing.T) {
+	var auto imagev1.ImageUpdateAutomation
+	auto.Namespace = "tenant"
+	auto.Spec.DependsOn = []imagev1.DependencyReference{{Name: "staging", Namespace: "tenant"}, {Name: "local"}}
+	auto.Spec.GitSpec = &imagev1.GitSpec{}
+	if err := crossNamespaceRef(&auto); err != nil {
+		t.Errorf("expected references within the namespace to be allowed, got %v", err)
+	}
+
+	auto.Spec.HealthGates = []imagev1.HealthGateReference{{Kind: "Kustomization", Name: "apps", Namespace: "flux-system"}}
+	if err := crossNamespaceRef(&auto); err == nil {
+		t.Error("expected an error for a health gate in another namespace")
+	}
+	auto.Spec.HealthGates = nil
+	auto.Spec.GitSpec.Commit.MessageTemplateFrom = &imagev1.MessageTemplateReference{}
+	auto.Spec.GitSpec.Commit.MessageTemplateFrom.ConfigMapRef.Namespace = "flux-system"
+	if err := crossNamespaceRef(&auto); err == nil {
+		t.Error("expected an error for a commit message template in another namespace")
+	}
+	auto.Spec.GitSpec.Commit.MessageTemplateFrom = nil
+	auto.Spec.GitSpec.Commit.AuthorFrom = &imagev1.CommitAuthorReference{
+		ConfigMapRef: &meta.NamespacedObjectReference{Namespace: "flux-system", Name: "bot"},
+	}
+	if err := crossNamespaceRef(&auto); err == nil {
+		t.Error("expected an error for a commit author in another namespace")
+	}
+}
+
+func TestImpersonate(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := imagev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := sourcev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := imagev1_reflect.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := appsv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	auto := &imagev1.ImageUpdateAutomation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: "podinfo"},
+	}
+	controllerRepo := &sourcev1.GitRepository{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: "repo"},
+		Spec:       sourcev1.GitRepositorySpec{URL: "https://controller.example.com/repo"},
+	}
+	tenantRepo := controllerRepo.DeepCopy()
+	tenantRepo.Spec.URL = "https://tenant.example.com/repo"
+	// a policy the service account can't see, in another namespace
+	otherPolicy := &imagev1_reflect.ImagePolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "secret-app"},
+	}
+	// a workload the service account can read but not change
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: "app"},
+	}
+
+	r := &ImageUpdateAutomationReconciler{
+		Client:        mappingClient{fake.NewClientBuilder().WithScheme(scheme).WithObjects(auto, controllerRepo, otherPolicy, deployment).Build()},
+		policyStore:   newPolicyStore(nil),
+		tenantClients: newTenantClients(),
+	}
+	if same, err := r.impersonate(auto); err != nil || same != r {
+		t.Errorf("expected the reconciler itself without a service account, got %v, %v", same, err)
+	}
+	auto.Spec.ServiceAccountName = "automation"
+	if _, err := r.impersonate(auto); err == nil {
+		t.Error("expected an error with no client configuration")
+	}
+
+	r.restConfig = &rest.Config{Host: "https://kubernetes.example.com"}
+	tenant, err := r.impersonate(auto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tenant == r || tenant.policyStore != nil {
+		t.Error("expected a copy of the reconciler, without the policy store")
+	}
+	again, err := r.impersonate(auto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Client.(impersonatingClient).tenant != tenant.Client.(impersonatingClient).tenant {
+		t.Error("expected the client for the service account to be reused")
+	}
+
+	// swap in a fake for the client impersonating the service account
+	impersonating, ok := tenant.Client.(impersonatingClient)
+	if !ok {
+		t.Fatalf("expected an impersonating client, got %T", tenant.Client)
+	}
+	impersonating.tenant = readOnlyClient{fake.NewClientBuilder().WithScheme(scheme).WithObjects(tenantRepo, deployment).Build()}
+	tenant.Client = impersonating
+
+	var repo sourcev1.GitRepository
+	if err := tenant.Get(context.TODO(), types.NamespacedName{Namespace: "tenant", Name: "repo"}, &repo); err != nil {
+		t.Fatal(err)
+	}
+	if repo.Spec.URL != tenantRepo.Spec.URL {
+		t.Errorf("expected the git repository to be read as the service account, got %s", repo.Spec.URL)
+	}
+	var policy imagev1_reflect.ImagePolicy
+	if err := tenant.Get(context.TODO(), types.NamespacedName{Namespace: "other", Name: "secret-app"}, &policy); err == nil {
+		t.Error("expected the image policy to be read as the service account")
+	}
+	var policies imagev1_reflect.ImagePolicyList
+	if err := tenant.List(context.TODO(), &policies); err != nil || len(policies.Items) != 0 {
+		t.Errorf("expected image policies to be listed as the service account, got %v, %v", policies.Items, err)
+	}
+	var found imagev1.ImageUpdateAutomation
+	if err := tenant.Get(context.TODO(), types.NamespacedName{Namespace: "tenant", Name: "podinfo"}, &found); err != nil {
+		t.Errorf("expected the automation to be read by the controller, got %v", err)
+	}
+	var autos imagev1.ImageUpdateAutomationList
+	if err := tenant.List(context.TODO(), &autos); err != nil || len(autos.Items) != 1 {
+		t.Errorf("expected automations to be listed by the controller, got %v, %v", autos.Items, err)
+	}
+
+	var app appsv1.Deployment
+	if err := tenant.Get(context.TODO(), types.NamespacedName{Namespace: "tenant", Name: "app"}, &app); err != nil {
+		t.Fatal(err)
+	}
+	patch := client.MergeFrom(app.DeepCopy())
+	app.Spec.Template.Spec.Containers = []corev1.Container{{Name: "app", Image: "app:v2"}}
+	if err := tenant.Patch(context.TODO(), &app, patch); !apierrors.IsForbidden(err) {
+		t.Errorf("expected the deployment to be patched as the service account, and refused, got %v", err)
+	}
+	autoPatch := client.MergeFrom(found.DeepCopy())
+	found.Spec.Suspend = true
+	if err := tenant.Patch(context.TODO(), &found, autoPatch); err != nil {
+		t.Errorf("expected the automation to be patched by the controller, got %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	libgit2 "github.com/libgit2/git2go/v31"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// AutomationMetrics records metrics particular to image update
+// automation, in addition to those recorded for all GitOps Toolkit
+// resources by the metrics.Recorder.
+type AutomationMetrics struct {
+	updatesCounter    *prometheus.CounterVec
+	pushesCounter     *prometheus.CounterVec
+	durationHistogram *prometheus.HistogramVec
+	remoteGauge       *prometheus.GaugeVec
+	noChangeCounter   *prometheus.CounterVec
+	noChangeGauge     *prometheus.GaugeVec
+	transferGauge     *prometheus.GaugeVec
+}
+
+// The operations for which durations are recorded.
+const (
+	cloneOperation  = "clone"
+	fetchOperation  = "fetch"
+	updateOperation = "update"
+	pushOperation   = "push"
+)
+
+// NewAutomationMetrics creates the metrics; these must be registered,
+// using the collectors from `Collectors()`, before they are exported.
+func NewAutomationMetrics() *AutomationMetrics {
+	return &AutomationMetrics{
+		updatesCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "image_automation_updates_total",
+				Help: "The number of image updates pushed by an image update automation, by image policy.",
+			},
+			[]string{"automation", "namespace", "policy"},
+		),
+		pushesCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "image_automation_pushes_total",
+				Help: "The number of commits pushed by an image update automation.",
+			},
+			[]string{"automation", "namespace"},
+		),
+		durationHistogram: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "image_automation_operation_duration_seconds",
+				Help:    "The duration in seconds of each operation (clone, fetch, update, push) in an image update automation run.",
+				Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+			},
+			[]string{"automation", "namespace", "operation", "implementation"},
+		),
+		remoteGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "image_automation_git_remote_reachable",
+				Help: "Whether the git repository of an image update automation could be connected to for pushing, when last checked (1 for yes, 0 for no).",
+			},
+			[]string{"automation", "namespace"},
+		),
+		noChangeCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "image_automation_no_change_runs_total",
+				Help: "The number of image update automation runs that made no changes, by the reason none were made.",
+			},
+			[]string{"automation", "namespace", "reason"},
+		),
+		noChangeGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "image_automation_consecutive_no_change_runs",
+				Help: "The number of image update automation runs in a row, since the last push, that made no changes.",
+			},
+			[]string{"automation", "namespace"},
+		),
+		transferGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "image_automation_git_transfer_progress",
+				Help: "The progress of the latest git transfer in an image update automation run: the objects expected and received so far, and the bytes received so far.",
+			},
+			[]string{"automation", "namespace", "operation", "measure"},
+		),
+	}
+}
+
+// Collectors gives the collectors for all the metrics.
+func (m *AutomationMetrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.updatesCounter,
+		m.pushesCounter,
+		m.durationHistogram,
+		m.remoteGauge,
+		m.noChangeCounter,
+		m.noChangeGauge,
+		m.transferGauge,
+	}
+}
+
+// RecordPush records that the automation given pushed a commit
+// making the updates given.
+func (m *AutomationMetrics) RecordPush(automation types.NamespacedName, updates []imagev1.ImageUpdate) {
+	if m == nil {
+		return
+	}
+	m.pushesCounter.WithLabelValues(automation.Name, automation.Namespace).Inc()
+	m.noChangeGauge.WithLabelValues(automation.Name, automation.Namespace).Set(0)
+	for _, u := range updates {
+		m.updatesCounter.WithLabelValues(automation.Name, automation.Namespace, u.Policy.Name).Inc()
+	}
+}
+
+// RecordNoChange records that a run of the automation given made no
+// changes, for the reason given, and how many runs in a row have now
+// made none.
+func (m *AutomationMetrics) RecordNoChange(automation types.NamespacedName, reason imagev1.NoChangeReason, consecutive int64) {
+	if m == nil {
+		return
+	}
+	m.noChangeCounter.WithLabelValues(automation.Name, automation.Namespace, string(reason)).Inc()
+	m.noChangeGauge.WithLabelValues(automation.Name, automation.Namespace).Set(float64(consecutive))
+}
+
+// RecordTransferProgress records the progress of a git transfer made
+// by the automation given. It's called as the transfer proceeds, so
+// that a slow transfer can be told apart from one that has stalled.
+func (m *AutomationMetrics) RecordTransferProgress(automation types.NamespacedName, operation string, progress libgit2.TransferProgress) {
+	if m == nil {
+		return
+	}
+	for measure, value := range map[string]uint{
+		"total_objects":    progress.TotalObjects,
+		"received_objects": progress.ReceivedObjects,
+		"received_bytes":   progress.ReceivedBytes,
+	} {
+		m.transferGauge.WithLabelValues(automation.Name, automation.Namespace, operation, measure).Set(float64(value))
+	}
+}
+
+// RecordDuration records how long an operation in an automation run
+// took, given the time it started. The implementation is that of the
+// git library used, if the operation is a git operation, and empty
+// otherwise.
+func (m *AutomationMetrics) RecordDuration(automation types.NamespacedName, operation, implementation string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.durationHistogram.WithLabelValues(automation.Name, automation.Namespace, operation, implementation).Observe(time.Since(start).Seconds())
+}
+
+// RecordRemoteCheck records whether the git repository of the
+// automation given could be reached with its credentials.
+func (m *AutomationMetrics) RecordRemoteCheck(automation types.NamespacedName, reachable bool) {
+	if m == nil {
+		return
+	}
+	var value float64
+	if reachable {
+		value = 1
+	}
+	m.remoteGauge.WithLabelValues(automation.Name, automation.Namespace).Set(value)
+}
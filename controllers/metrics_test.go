@@ -0,0 +1,117 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	libgit2 "github.com/libgit2/git2go/v31"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestRecordPush(t *testing.T) {
+	m := NewAutomationMetrics()
+	auto := types.NamespacedName{Namespace: "apps", Name: "auto"}
+	app := meta.NamespacedObjectReference{Namespace: "apps", Name: "app"}
+	other := meta.NamespacedObjectReference{Namespace: "apps", Name: "other"}
+
+	m.RecordPush(auto, []imagev1.ImageUpdate{
+		{Policy: app, OldValue: "app:v1.0.0", NewValue: "app:v1.0.1"},
+		{Policy: other, OldValue: "other:v1.0.0", NewValue: "other:v1.0.1"},
+	})
+	m.RecordPush(auto, []imagev1.ImageUpdate{
+		{Policy: app, OldValue: "app:v1.0.1", NewValue: "app:v1.0.2"},
+	})
+
+	if n := testutil.ToFloat64(m.pushesCounter.WithLabelValues("auto", "apps")); n != 2 {
+		t.Errorf("expected 2 pushes, got %v", n)
+	}
+	if n := testutil.ToFloat64(m.updatesCounter.WithLabelValues("auto", "apps", "app")); n != 2 {
+		t.Errorf("expected 2 updates for policy app, got %v", n)
+	}
+	if n := testutil.ToFloat64(m.updatesCounter.WithLabelValues("auto", "apps", "other")); n != 1 {
+		t.Errorf("expected 1 update for policy other, got %v", n)
+	}
+
+	// a nil recorder is allowed, and does nothing
+	var none *AutomationMetrics
+	none.RecordPush(auto, nil)
+}
+
+func TestRecordDuration(t *testing.T) {
+	m := NewAutomationMetrics()
+	auto := types.NamespacedName{Namespace: "apps", Name: "auto"}
+
+	m.RecordDuration(auto, cloneOperation, gitImplementation, time.Now().Add(-time.Second))
+	m.RecordDuration(auto, updateOperation, "", time.Now())
+
+	if n := testutil.CollectAndCount(m.durationHistogram); n != 2 {
+		t.Errorf("expected a histogram for each of 2 operations, got %d", n)
+	}
+
+	var none *AutomationMetrics
+	none.RecordDuration(auto, pushOperation, gitImplementation, time.Now())
+}
+
+func TestRecordNoChange(t *testing.T) {
+	m := NewAutomationMetrics()
+	auto := types.NamespacedName{Namespace: "apps", Name: "auto"}
+
+	m.RecordNoChange(auto, imagev1.NoChangeImagesCurrent, 1)
+	m.RecordNoChange(auto, imagev1.NoChangeImagesCurrent, 2)
+	if n := testutil.ToFloat64(m.noChangeCounter.WithLabelValues("auto", "apps", "ImagesCurrent")); n != 2 {
+		t.Errorf("expected 2 runs with images current, got %v", n)
+	}
+	if n := testutil.ToFloat64(m.noChangeGauge.WithLabelValues("auto", "apps")); n != 2 {
+		t.Errorf("expected 2 consecutive runs with no change, got %v", n)
+	}
+
+	m.RecordPush(auto, nil)
+	if n := testutil.ToFloat64(m.noChangeGauge.WithLabelValues("auto", "apps")); n != 0 {
+		t.Errorf("expected consecutive runs with no change to be reset by a push, got %v", n)
+	}
+
+	var none *AutomationMetrics
+	none.RecordNoChange(auto, imagev1.NoChangeNoPolicies, 1)
+}
+
+func TestRecordTransferProgress(t *testing.T) {
+	m := NewAutomationMetrics()
+	auto := types.NamespacedName{Namespace: "apps", Name: "auto"}
+
+	m.RecordTransferProgress(auto, fetchOperation, libgit2.TransferProgress{TotalObjects: 100, ReceivedObjects: 10, ReceivedBytes: 2048})
+	m.RecordTransferProgress(auto, fetchOperation, libgit2.TransferProgress{TotalObjects: 100, ReceivedObjects: 40, ReceivedBytes: 8192})
+
+	for measure, expected := range map[string]float64{
+		"total_objects":    100,
+		"received_objects": 40,
+		"received_bytes":   8192,
+	} {
+		if n := testutil.ToFloat64(m.transferGauge.WithLabelValues("auto", "apps", fetchOperation, measure)); n != expected {
+			t.Errorf("expected %s to be %v, got %v", measure, expected, n)
+		}
+	}
+
+	var none *AutomationMetrics
+	none.RecordTransferProgress(auto, fetchOperation, libgit2.TransferProgress{})
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// Events about commits carry, as well as the metadata for routing them
+// (see pushMetadata), metadata that notification providers can show
+// as it is: a one-line summary of the updates, a line for each image
+// updated, and a link to the commit. The notification-controller
+// shows each as a field of the message it sends to, e.g., Slack.
+const (
+	summaryMetadataKey    = "summary"
+	changesMetadataKey    = "changes"
+	commitLinkMetadataKey = "commitURL"
+)
+
+// addChangeSummary adds to the metadata given the summary of the
+// updates given, and the link to the commit, if there is one.
+func addChangeSummary(metadata map[string]string, updates []imagev1.ImageUpdate, link string) map[string]string {
+	if summary := updatesSummary(updates); summary != "" {
+		metadata[summaryMetadataKey] = summary
+	}
+	if changes := updatesChanges(updates); changes != "" {
+		metadata[changesMetadataKey] = changes
+	}
+	if link != "" {
+		metadata[commitLinkMetadataKey] = link
+	}
+	return metadata
+}
+
+// updatesSummary gives a line saying what the updates given were;
+// e.g., "podinfo 5.0.0 → 5.0.1" for a single update, or "3 images
+// updated: api, podinfo, web". Policies are named without their
+// namespace, to keep the line short.
+func updatesSummary(updates []imagev1.ImageUpdate) string {
+	switch len(updates) {
+	case 0:
+		return ""
+	case 1:
+		u := updates[0]
+		return fmt.Sprintf("%s %s → %s", u.Policy.Name, shortValue(u.OldValue), shortValue(u.NewValue))
+	}
+	var names []string
+	seen := make(map[string]bool)
+	for _, u := range updates {
+		if !seen[u.Policy.Name] {
+			seen[u.Policy.Name] = true
+			names = append(names, u.Policy.Name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) > maxSummaryItems {
+		names = append(names[:maxSummaryItems], fmt.Sprintf("and %d more", len(names)-maxSummaryItems))
+	}
+	return fmt.Sprintf("%d images updated: %s", len(updates), strings.Join(names, ", "))
+}
+
+// updatesChanges gives a line for each of the updates given, with the
+// policy responsible and the old and new values in full. Only the
+// first few updates are given.
+func updatesChanges(updates []imagev1.ImageUpdate) string {
+	var lines []string
+	for i, u := range updates {
+		if i == maxSummaryItems {
+			lines = append(lines, fmt.Sprintf("... and %d more", len(updates)-maxSummaryItems))
+			break
+		}
+		old := u.OldValue
+		if old == "" {
+			old = "(unset)"
+		}
+		lines = append(lines, fmt.Sprintf("%s/%s: %s → %s", u.Policy.Namespace, u.Policy.Name, old, u.NewValue))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// shortValue gives the tag of the image given, if it has one, or the
+// value as it is otherwise; e.g., "5.0.1" for
+// "ghcr.io/stefanprodan/podinfo:5.0.1". A field may hold only the tag
+// to begin with.
+func shortValue(value string) string {
+	if value == "" {
+		return "(unset)"
+	}
+	if i := strings.LastIndex(value, ":"); i >= 0 && !strings.Contains(value[i:], "/") {
+		return value[i+1:]
+	}
+	return value
+}
+
+// commitLink gives the web address of the commit given, using the
+// template given, or else the address worked out from the URL of the
+// git repository. It gives an empty string if there is no template
+// and the address can't be worked out.
+func commitLink(tmpl, repoURL, rev, branch string) (string, error) {
+	if tmpl == "" {
+		return knownCommitLink(repoURL, rev), nil
+	}
+	t, err := template.New("commit link").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse commit link template: %w", err)
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, struct{ Revision, Branch string }{rev, branch}); err != nil {
+		return "", fmt.Errorf("unable to make commit link: %w", err)
+	}
+	return b.String(), nil
+}
+
+// knownCommitLink gives the web address of the commit given in the git
+// repository at the URL given, for the hosts whose addresses are
+// known, or an empty string.
+func knownCommitLink(repoURL, rev string) string {
+	host, path := repoHostPath(repoURL)
+	if path == "" {
+		return ""
+	}
+	switch host {
+	case "github.com":
+		return fmt.Sprintf("https://github.com/%s/commit/%s", path, rev)
+	case "gitlab.com":
+		return fmt.Sprintf("https://gitlab.com/%s/-/commit/%s", path, rev)
+	case "bitbucket.org":
+		return fmt.Sprintf("https://bitbucket.org/%s/commits/%s", path, rev)
+	}
+	return ""
+}
+
+// knownProvider gives the name of the git provider for the host
+// given, if it's one of the public services, or an empty string.
+func knownProvider(host string) string {
+	switch host {
+	case "github.com":
+		return "github"
+	case "gitlab.com":
+		return "gitlab"
+	case "bitbucket.org":
+		return "bitbucket"
+	}
+	return ""
+}
+
+// repoHostPath gives the host and path of the git repository URL
+// given, which may be in the scp-like form `git@github.com:org/repo`.
+// The path is given without slashes at either end, or a `.git`
+// suffix; e.g., `org/repo`.
+func repoHostPath(repoURL string) (string, string) {
+	var host, path string
+	if !strings.Contains(repoURL, "://") {
+		parts := strings.SplitN(repoURL, ":", 2)
+		if len(parts) != 2 {
+			return "", ""
+		}
+		host, path = parts[0], parts[1]
+		if i := strings.LastIndex(host, "@"); i >= 0 {
+			host = host[i+1:]
+		}
+	} else {
+		u, err := url.Parse(repoURL)
+		if err != nil {
+			return "", ""
+		}
+		host, path = u.Hostname(), u.Path
+	}
+	return host, strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+}
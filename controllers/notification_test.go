@@ -0,0 +1,109 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestAddChangeSummary(t *testing.T) {
+	podinfo := imagev1.ImageUpdate{
+		Policy:   meta.NamespacedObjectReference{Namespace: "apps", Name: "podinfo"},
+		OldValue: "ghcr.io/stefanprodan/podinfo:5.0.0",
+		NewValue: "ghcr.io/stefanprodan/podinfo:5.0.1",
+	}
+	expected := map[string]string{
+		"revision":  "abc123",
+		"summary":   "podinfo 5.0.0 → 5.0.1",
+		"changes":   "apps/podinfo: ghcr.io/stefanprodan/podinfo:5.0.0 → ghcr.io/stefanprodan/podinfo:5.0.1",
+		"commitURL": "https://github.com/org/repo/commit/abc123",
+	}
+	metadata := addChangeSummary(map[string]string{"revision": "abc123"}, []imagev1.ImageUpdate{podinfo},
+		"https://github.com/org/repo/commit/abc123")
+	if !reflect.DeepEqual(metadata, expected) {
+		t.Errorf("expected metadata %v, got %v", expected, metadata)
+	}
+
+	web := imagev1.ImageUpdate{
+		Policy:   meta.NamespacedObjectReference{Namespace: "apps", Name: "web"},
+		NewValue: "v2",
+	}
+	podinfoTag := imagev1.ImageUpdate{Policy: podinfo.Policy, OldValue: "5.0.0", NewValue: "5.0.1"}
+	expected = map[string]string{
+		"summary": "3 images updated: podinfo, web",
+		"changes": "apps/web: (unset) → v2\napps/podinfo: ghcr.io/stefanprodan/podinfo:5.0.0 → ghcr.io/stefanprodan/podinfo:5.0.1\napps/podinfo: 5.0.0 → 5.0.1",
+	}
+	metadata = addChangeSummary(map[string]string{}, []imagev1.ImageUpdate{web, podinfo, podinfoTag}, "")
+	if !reflect.DeepEqual(metadata, expected) {
+		t.Errorf("expected metadata %v, got %v", expected, metadata)
+	}
+
+	if metadata := addChangeSummary(map[string]string{}, nil, ""); len(metadata) != 0 {
+		t.Errorf("expected no metadata without updates, got %v", metadata)
+	}
+}
+
+func TestShortValue(t *testing.T) {
+	for value, expected := range map[string]string{
+		"ghcr.io/stefanprodan/podinfo:5.0.1": "5.0.1",
+		"localhost:5000/podinfo":             "localhost:5000/podinfo",
+		"localhost:5000/podinfo:v1":          "v1",
+		"5.0.1":                              "5.0.1",
+		"":                                   "(unset)",
+	} {
+		if got := shortValue(value); got != expected {
+			t.Errorf("expected %q for %q, got %q", expected, value, got)
+		}
+	}
+}
+
+func TestCommitLink(t *testing.T) {
+	for _, c := range []struct {
+		tmpl, url, expected string
+	}{
+		{url: "https://github.com/org/repo", expected: "https://github.com/org/repo/commit/abc123"},
+		{url: "ssh://git@github.com/org/repo.git", expected: "https://github.com/org/repo/commit/abc123"},
+		{url: "git@gitlab.com:group/sub/repo.git", expected: "https://gitlab.com/group/sub/repo/-/commit/abc123"},
+		{url: "https://user@bitbucket.org/team/repo.git", expected: "https://bitbucket.org/team/repo/commits/abc123"},
+		{url: "https://git.example.com/org/repo", expected: ""},
+		{url: "https://github.com/", expected: ""},
+		{
+			tmpl:     "https://git.example.com/org/repo/commit/{{ .Revision }}?branch={{ .Branch }}",
+			url:      "https://git.example.com/org/repo",
+			expected: "https://git.example.com/org/repo/commit/abc123?branch=main",
+		},
+	} {
+		link, err := commitLink(c.tmpl, c.url, "abc123", "main")
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", c.url, err)
+		}
+		if link != c.expected {
+			t.Errorf("expected link %q for %q, got %q", c.expected, c.url, link)
+		}
+	}
+
+	for _, bad := range []string{"{{ .Revision", "{{ .Missing }}"} {
+		if _, err := commitLink(bad, "https://github.com/org/repo", "abc123", "main"); err == nil {
+			t.Errorf("expected an error for template %q", bad)
+		}
+	}
+}
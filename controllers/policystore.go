@@ -0,0 +1,94 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	imagev1_reflect "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+)
+
+// When image policies are watched for their metadata only, the cache
+// holds just the metadata of each policy, and the rest of a policy
+// is fetched from the API server when an automation run or a policy
+// event needs it. Only the fields used are kept, and a policy is
+// fetched again only once its resource version has moved on.
+
+// policyStore keeps the parts of image policies that automation runs
+// use, as of a resource version of each.
+type policyStore struct {
+	// reader fetches policies; it's expected not to be backed by a
+	// cache, since that would hold the whole of every policy.
+	reader client.Reader
+
+	mu       sync.Mutex
+	policies map[types.NamespacedName]imagev1_reflect.ImagePolicy
+}
+
+func newPolicyStore(reader client.Reader) *policyStore {
+	return &policyStore{
+		reader:   reader,
+		policies: make(map[types.NamespacedName]imagev1_reflect.ImagePolicy),
+	}
+}
+
+// get gives the policy with the metadata given, fetching it if the
+// policy kept is older than the metadata.
+func (s *policyStore) get(ctx context.Context, meta client.Object) (imagev1_reflect.ImagePolicy, error) {
+	name := types.NamespacedName{Namespace: meta.GetNamespace(), Name: meta.GetName()}
+	s.mu.Lock()
+	policy, ok := s.policies[name]
+	s.mu.Unlock()
+	if ok && policy.ResourceVersion == meta.GetResourceVersion() {
+		return policy, nil
+	}
+
+	var fetched imagev1_reflect.ImagePolicy
+	if err := s.reader.Get(ctx, name, &fetched); err != nil {
+		return imagev1_reflect.ImagePolicy{}, err
+	}
+	policy = trimPolicy(fetched)
+	s.mu.Lock()
+	s.policies[name] = policy
+	s.mu.Unlock()
+	return policy, nil
+}
+
+// forget drops the policy given, once it's deleted.
+func (s *policyStore) forget(name types.NamespacedName) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.policies, name)
+}
+
+// trimPolicy gives a copy of the policy with only the fields that
+// automation runs use.
+func trimPolicy(policy imagev1_reflect.ImagePolicy) imagev1_reflect.ImagePolicy {
+	var trimmed imagev1_reflect.ImagePolicy
+	trimmed.Name = policy.Name
+	trimmed.Namespace = policy.Namespace
+	trimmed.ResourceVersion = policy.ResourceVersion
+	trimmed.Labels = policy.Labels
+	trimmed.Annotations = policy.Annotations
+	trimmed.Spec.ImageRepositoryRef = policy.Spec.ImageRepositoryRef
+	trimmed.Status.LatestImage = policy.Status.LatestImage
+	return trimmed
+}
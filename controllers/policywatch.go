@@ -0,0 +1,202 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	imagev1_reflect "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+	"github.com/fluxcd/image-automation-controller/pkg/update"
+)
+
+// policyRefKey indexes automations by the names of the image policies
+// their markers referred to in their last run. Automations that have
+// not recorded any are indexed under anyPolicy, since it's not known
+// which policies they refer to.
+const (
+	policyRefKey = ".status.referencedPolicies"
+	anyPolicy    = "*"
+)
+
+// indexReferencedPolicies gives the values under which an automation
+// is indexed with policyRefKey.
+func indexReferencedPolicies(obj client.Object) []string {
+	auto, ok := obj.(*imagev1.ImageUpdateAutomation)
+	if !ok || len(auto.Status.ReferencedPolicies) == 0 {
+		return []string{anyPolicy}
+	}
+	return auto.Status.ReferencedPolicies
+}
+
+// referencedPolicies gives the names of the policies in the namespace
+// given that markers referred to in an update, in order, for
+// recording in the status. Policies in other namespaces are left out,
+// since markers can't refer to them.
+func referencedPolicies(result update.Result, namespace string) []string {
+	var names []string
+	for policy := range result.MarkedPolicies {
+		if policy.Namespace == namespace {
+			names = append(names, policy.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// policyEventHandler queues the automations that an image policy
+// change could affect. A change to a policy that doesn't change its
+// latest image is ignored; otherwise the automations that referred to
+// the policy in their last run are queued. Since markers are recorded
+// whether or not the policy they refer to exists or has an image, this
+// includes the automations that refer to a policy that is new, or has
+// its first image.
+//
+// When there's a delay, automations are queued to run after it, so
+// that a burst of changes to policies (e.g., a new image used by many
+// policies) results in one run of each automation, rather than one
+// run per change.
+//
+// When policies are watched for their metadata only, the events
+// don't say what the latest image was or is. The handler fetches the
+// policy (through the reconciler's policy store) and compares its
+// latest image with the one it saw last; when it hasn't seen one
+// (e.g., since starting), it takes the policy to have had no image.
+type policyEventHandler struct {
+	reconciler *ImageUpdateAutomationReconciler
+	delay      time.Duration
+
+	mu           sync.Mutex
+	latestImages map[types.NamespacedName]string
+}
+
+func newPolicyEventHandler(r *ImageUpdateAutomationReconciler, delay time.Duration) *policyEventHandler {
+	return &policyEventHandler{
+		reconciler:   r,
+		delay:        delay,
+		latestImages: make(map[types.NamespacedName]string),
+	}
+}
+
+func (h *policyEventHandler) Create(e event.CreateEvent, q workqueue.RateLimitingInterface) {
+	h.enqueue(q, h.reconciler.automationsForPolicy(e.Object))
+}
+
+func (h *policyEventHandler) Update(e event.UpdateEvent, q workqueue.RateLimitingInterface) {
+	var oldImage, newImage string
+	switch newPolicy := e.ObjectNew.(type) {
+	case *imagev1_reflect.ImagePolicy:
+		oldPolicy, ok := e.ObjectOld.(*imagev1_reflect.ImagePolicy)
+		if !ok {
+			return
+		}
+		oldImage, newImage = oldPolicy.Status.LatestImage, newPolicy.Status.LatestImage
+	case *metav1.PartialObjectMetadata:
+		if e.ObjectOld.GetResourceVersion() == newPolicy.GetResourceVersion() {
+			return
+		}
+		var err error
+		if oldImage, newImage, err = h.seeLatestImage(newPolicy); err != nil {
+			// whether the latest image changed isn't known, so
+			// it's assumed it did
+			h.enqueue(q, h.reconciler.automationsForPolicy(newPolicy))
+			return
+		}
+	default:
+		return
+	}
+
+	if oldImage != newImage {
+		h.enqueue(q, h.reconciler.automationsForPolicy(e.ObjectNew))
+	}
+}
+
+func (h *policyEventHandler) Delete(e event.DeleteEvent, q workqueue.RateLimitingInterface) {
+	if h.reconciler.policyStore != nil {
+		name := types.NamespacedName{Namespace: e.Object.GetNamespace(), Name: e.Object.GetName()}
+		h.reconciler.policyStore.forget(name)
+		h.mu.Lock()
+		delete(h.latestImages, name)
+		h.mu.Unlock()
+	}
+	h.enqueue(q, h.reconciler.automationsForPolicy(e.Object))
+}
+
+func (h *policyEventHandler) Generic(e event.GenericEvent, q workqueue.RateLimitingInterface) {
+	h.enqueue(q, h.reconciler.automationsForPolicy(e.Object))
+}
+
+// seeLatestImage fetches the policy with the metadata given, and gives
+// the latest image seen before, if any, and the latest image now.
+func (h *policyEventHandler) seeLatestImage(meta client.Object) (string, string, error) {
+	policy, err := h.reconciler.policyStore.get(context.Background(), meta)
+	if err != nil {
+		return "", "", err
+	}
+	name := types.NamespacedName{Namespace: meta.GetNamespace(), Name: meta.GetName()}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	previous := h.latestImages[name]
+	h.latestImages[name] = policy.Status.LatestImage
+	return previous, policy.Status.LatestImage, nil
+}
+
+func (h *policyEventHandler) enqueue(q workqueue.RateLimitingInterface, reqs []reconcile.Request) {
+	for _, req := range reqs {
+		if h.delay > 0 {
+			// an automation already waiting keeps its place, so
+			// changes within the delay are all seen by one run
+			q.AddAfter(req, h.delay)
+		} else {
+			q.Add(req)
+		}
+	}
+}
+
+// automationsForPolicy gives requests for the automations that
+// referred to the policy given in their last run, and those that
+// haven't recorded which policies they refer to.
+func (r *ImageUpdateAutomationReconciler) automationsForPolicy(policy client.Object) []reconcile.Request {
+	seen := make(map[types.NamespacedName]bool)
+	var reqs []reconcile.Request
+	for _, key := range []string{policy.GetName(), anyPolicy} {
+		var autoList imagev1.ImageUpdateAutomationList
+		if err := r.List(context.Background(), &autoList, client.InNamespace(policy.GetNamespace()),
+			client.MatchingFields{policyRefKey: key}); err != nil {
+			return nil
+		}
+		for i := range autoList.Items {
+			name := types.NamespacedName{Namespace: autoList.Items[i].GetNamespace(), Name: autoList.Items[i].GetName()}
+			if !seen[name] {
+				seen[name] = true
+				reqs = append(reqs, reconcile.Request{NamespacedName: name})
+			}
+		}
+	}
+	return reqs
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	imagev1_reflect "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+	"github.com/fluxcd/image-automation-controller/pkg/update"
+)
+
+func TestReferencedPolicies(t *testing.T) {
+	result := update.Result{MarkedPolicies: map[types.NamespacedName]struct{}{
+		{Namespace: "apps", Name: "podinfo"}:  {},
+		{Namespace: "apps", Name: "backend"}:  {},
+		{Namespace: "other", Name: "backend"}: {},
+	}}
+	names := referencedPolicies(result, "apps")
+	if !reflect.DeepEqual(names, []string{"backend", "podinfo"}) {
+		t.Errorf("expected the names of the policies in the namespace in order, got %v", names)
+	}
+
+	auto := &imagev1.ImageUpdateAutomation{}
+	if keys := indexReferencedPolicies(auto); !reflect.DeepEqual(keys, []string{anyPolicy}) {
+		t.Errorf("expected an automation that hasn't recorded policies to be indexed under any policy, got %v", keys)
+	}
+	auto.Status.ReferencedPolicies = names
+	if keys := indexReferencedPolicies(auto); !reflect.DeepEqual(keys, names) {
+		t.Errorf("expected the automation to be indexed under its policies, got %v", keys)
+	}
+}
+
+func TestPolicyEventHandler(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := imagev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	r := &ImageUpdateAutomationReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			&imagev1.ImageUpdateAutomation{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "auto"}},
+			&imagev1.ImageUpdateAutomation{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "auto"}},
+		).Build(),
+		Scheme: scheme,
+	}
+	policy := func(image string) *imagev1_reflect.ImagePolicy {
+		return &imagev1_reflect.ImagePolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "podinfo"},
+			Status:     imagev1_reflect.ImagePolicyStatus{LatestImage: image},
+		}
+	}
+
+	q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer q.ShutDown()
+	h := newPolicyEventHandler(r, 0)
+
+	// a status update that doesn't change the image doesn't queue
+	// anything
+	h.Update(event.UpdateEvent{ObjectOld: policy("podinfo:v1"), ObjectNew: policy("podinfo:v1")}, q)
+	if q.Len() != 0 {
+		t.Errorf("expected nothing to be queued, got %d", q.Len())
+	}
+
+	// the first image queues the automations referring to the policy
+	// (here, one that hasn't recorded which policies it refers to)
+	h.Update(event.UpdateEvent{ObjectOld: policy(""), ObjectNew: policy("podinfo:v1")}, q)
+	if q.Len() != 1 {
+		t.Fatalf("expected one automation to be queued, got %d", q.Len())
+	}
+	item, _ := q.Get()
+	q.Done(item)
+	if req := item.(reconcile.Request); req.Namespace != "apps" || req.Name != "auto" {
+		t.Errorf("expected apps/auto to be queued, got %v", req)
+	}
+
+	// with a delay, automations are queued after it
+	h.delay = 50 * time.Millisecond
+	h.Create(event.CreateEvent{Object: policy("podinfo:v1")}, q)
+	if q.Len() != 0 {
+		t.Errorf("expected nothing to be queued before the delay, got %d", q.Len())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if q.Len() != 1 {
+		t.Errorf("expected the automation to be queued after the delay, got %d", q.Len())
+	}
+}
+
+func TestPolicyEventHandlerMetadataOnly(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := imagev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := imagev1_reflect.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	policy := &imagev1_reflect.ImagePolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "podinfo"},
+		Status:     imagev1_reflect.ImagePolicyStatus{LatestImage: "podinfo:v1"},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&imagev1.ImageUpdateAutomation{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "auto"}},
+		policy,
+	).Build()
+	r := &ImageUpdateAutomationReconciler{
+		Client:      c,
+		Scheme:      scheme,
+		policyStore: newPolicyStore(c),
+	}
+	metadata := func() *metav1.PartialObjectMetadata {
+		var current imagev1_reflect.ImagePolicy
+		if err := c.Get(context.TODO(), types.NamespacedName{Namespace: "apps", Name: "podinfo"}, &current); err != nil {
+			t.Fatal(err)
+		}
+		return &metav1.PartialObjectMetadata{ObjectMeta: current.ObjectMeta}
+	}
+	setImage := func(image string) {
+		policy.Status.LatestImage = image
+		if err := c.Update(context.TODO(), policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer q.ShutDown()
+	h := newPolicyEventHandler(r, 0)
+	expectQueued := func(n int) {
+		t.Helper()
+		if q.Len() != n {
+			t.Fatalf("expected %d automation(s) to be queued, got %d", n, q.Len())
+		}
+		for i := 0; i < n; i++ {
+			item, _ := q.Get()
+			q.Done(item)
+			q.Forget(item)
+		}
+	}
+
+	// an event with the same resource version is a resync
+	meta := metadata()
+	h.Update(event.UpdateEvent{ObjectOld: meta, ObjectNew: meta}, q)
+	expectQueued(0)
+
+	// the first image seen is taken to be new
+	old := metadata()
+	setImage("podinfo:v2")
+	h.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: metadata()}, q)
+	expectQueued(1)
+
+	// a change that leaves the image as it was doesn't queue anything
+	old = metadata()
+	policy.Labels = map[string]string{"changed": "true"}
+	setImage("podinfo:v2")
+	h.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: metadata()}, q)
+	expectQueued(0)
+
+	// the store keeps the parts of the policy used
+	kept, err := r.policyStore.get(context.TODO(), metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept.Status.LatestImage != "podinfo:v2" || kept.Labels["changed"] != "true" {
+		t.Errorf("expected the store to have the latest policy, got %v", kept)
+	}
+}
+
+func TestListPolicyNames(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := imagev1_reflect.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	r := &ImageUpdateAutomationReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			&imagev1_reflect.ImagePolicy{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "podinfo"}},
+			&imagev1_reflect.ImagePolicy{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "backend"}},
+			&imagev1_reflect.ImagePolicy{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "frontend"}},
+		).Build(),
+	}
+	names, err := r.listPolicyNames(context.TODO(), "apps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"backend", "podinfo"}) {
+		t.Errorf("expected the names of the policies in the namespace in order, got %v", names)
+	}
+
+	if detectingImages([]*imagev1.UpdateStrategy{{}, nil}) {
+		t.Error("expected no detection without a strategy asking for it")
+	}
+	if !detectingImages([]*imagev1.UpdateStrategy{{}, {DetectImages: true}}) {
+		t.Error("expected detection when any strategy asks for it")
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/fluxcd/pkg/runtime/logger"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// prefetcher refreshes the cached copy of the git repository of each
+// automation shortly before the automation is next due to run. The
+// run still fetches from the remote, to be sure of seeing the latest
+// commits, but by then there is little or nothing left to transfer,
+// so the run holds its place in the work queue for less time.
+type prefetcher struct {
+	reconciler *ImageUpdateAutomationReconciler
+	// lead is how long before a run is due to refresh the cached
+	// copy of its repository
+	lead time.Duration
+	// fetch refreshes the cached copy of a GitRepository; tests
+	// replace it.
+	fetch func(context.Context, types.NamespacedName, repoAccess) error
+	// prefetched records the time each automation's run was due
+	// when its repository was last refreshed, so that it's
+	// refreshed once per run.
+	prefetched map[types.NamespacedName]time.Time
+}
+
+func newPrefetcher(r *ImageUpdateAutomationReconciler, lead time.Duration) *prefetcher {
+	return &prefetcher{
+		reconciler: r,
+		lead:       lead,
+		fetch:      r.cloneCache.prefetch,
+		prefetched: make(map[types.NamespacedName]time.Time),
+	}
+}
+
+// Start runs the prefetcher until the context is done. It looks for
+// runs coming due twice in each lead time, so that each is seen
+// before it's due.
+func (p *prefetcher) Start(ctx context.Context) error {
+	ctx = logr.NewContext(ctx, ctrl.Log.WithName("prefetch"))
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		p.prefetch(ctx, time.Now())
+	}, p.lead/2)
+	return nil
+}
+
+// prefetch refreshes the cached copy of the repository of each
+// automation due to run within the lead time from now. A repository
+// used by several automations is refreshed only once.
+func (p *prefetcher) prefetch(ctx context.Context, now time.Time) {
+	log := logr.FromContext(ctx)
+	var autos imagev1.ImageUpdateAutomationList
+	if err := p.reconciler.List(ctx, &autos); err != nil {
+		log.Error(err, "unable to list image update automations")
+		return
+	}
+
+	seen := make(map[types.NamespacedName]bool)
+	fetched := make(map[types.NamespacedName]bool)
+	for i := range autos.Items {
+		auto := &autos.Items[i]
+		name := types.NamespacedName{Namespace: auto.GetNamespace(), Name: auto.GetName()}
+		seen[name] = true
+		if auto.Spec.Suspend || auto.Spec.SourceRef.Kind != sourcev1.GitRepositoryKind || auto.Status.LastAutomationRunTime == nil ||
+			!p.reconciler.shards.leads(shardKey(auto)) {
+			continue
+		}
+		due := nextRunDue(auto.Status.LastAutomationRunTime.Time, intervalOrDefault(auto), now)
+		if due.Sub(now) > p.lead || p.prefetched[name].Equal(due) {
+			continue
+		}
+		p.prefetched[name] = due
+
+		originName := types.NamespacedName{Namespace: auto.GetNamespace(), Name: auto.Spec.SourceRef.Name}
+		if fetched[originName] {
+			continue
+		}
+		fetched[originName] = true
+		if err := p.prefetchRepository(ctx, auto, originName); err != nil {
+			// the run will report the problem, if it persists
+			log.V(logger.DebugLevel).Info("unable to prefetch git repository", "gitrepository", originName, "error", err.Error())
+		}
+	}
+	for name := range p.prefetched {
+		if !seen[name] {
+			delete(p.prefetched, name)
+		}
+	}
+}
+
+// prefetchRepository refreshes the cached copy of the GitRepository
+// given, reading it as the automation given would.
+func (p *prefetcher) prefetchRepository(ctx context.Context, auto *imagev1.ImageUpdateAutomation, originName types.NamespacedName) error {
+	reconciler, err := p.reconciler.impersonate(auto)
+	if err != nil {
+		return err
+	}
+	var origin sourcev1.GitRepository
+	if err := reconciler.Get(ctx, originName, &origin); err != nil {
+		return err
+	}
+	access, err := reconciler.getRepoAccess(ctx, auto, &origin)
+	if err != nil {
+		return err
+	}
+	fetchCtx, cancel := gitOperationContext(ctx, &origin)
+	defer cancel()
+	return p.fetch(fetchCtx, originName, access)
+}
+
+// nextRunDue gives the time the next run of an automation that last
+// ran at `last` is due, as of now. A run skipped because nothing has
+// changed doesn't record its time, so the next run is due at the
+// first whole interval after the last recorded run that is still to
+// come.
+func nextRunDue(last time.Time, interval time.Duration, now time.Time) time.Time {
+	due := last.Add(interval)
+	if due.After(now) {
+		return due
+	}
+	elapsed := now.Sub(last)
+	return last.Add((elapsed/interval + 1) * interval)
+}
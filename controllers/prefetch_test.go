@@ -0,0 +1,113 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestNextRunDue(t *testing.T) {
+	last := time.Date(2021, 10, 1, 10, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		now, due time.Duration
+	}{
+		{now: 2 * time.Minute, due: 5 * time.Minute},
+		{now: 5 * time.Minute, due: 10 * time.Minute},
+		{now: 12 * time.Minute, due: 15 * time.Minute},
+	} {
+		if due := nextRunDue(last, 5*time.Minute, last.Add(c.now)); !due.Equal(last.Add(c.due)) {
+			t.Errorf("at %v after the last run, expected the next to be due at %v after, got %v", c.now, c.due, due.Sub(last))
+		}
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := imagev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := sourcev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	last := time.Date(2021, 10, 1, 10, 0, 0, 0, time.UTC)
+	automation := func(name, repo string) *imagev1.ImageUpdateAutomation {
+		return &imagev1.ImageUpdateAutomation{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: name},
+			Spec: imagev1.ImageUpdateAutomationSpec{
+				SourceRef: imagev1.SourceReference{Kind: sourcev1.GitRepositoryKind, Name: repo},
+				Interval:  metav1.Duration{Duration: 10 * time.Minute},
+			},
+			Status: imagev1.ImageUpdateAutomationStatus{
+				LastAutomationRunTime: &metav1.Time{Time: last},
+			},
+		}
+	}
+	r := &ImageUpdateAutomationReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			automation("auto", "repo"),
+			automation("other", "repo"),
+			&sourcev1.GitRepository{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "repo"},
+				Spec:       sourcev1.GitRepositorySpec{URL: "https://example.com/org/repo"},
+			},
+		).Build(),
+		Scheme: scheme,
+	}
+
+	var fetched []types.NamespacedName
+	p := newPrefetcher(r, time.Minute)
+	p.fetch = func(_ context.Context, repository types.NamespacedName, _ repoAccess) error {
+		fetched = append(fetched, repository)
+		return nil
+	}
+	ctx := logr.NewContext(context.TODO(), logr.Discard())
+
+	p.prefetch(ctx, last.Add(5*time.Minute))
+	if len(fetched) != 0 {
+		t.Errorf("expected nothing to be fetched well before a run is due, got %v", fetched)
+	}
+
+	p.prefetch(ctx, last.Add(9*time.Minute+30*time.Second))
+	if len(fetched) != 1 || fetched[0] != (types.NamespacedName{Namespace: "apps", Name: "repo"}) {
+		t.Errorf("expected the repository to be fetched once for both automations, got %v", fetched)
+	}
+
+	p.prefetch(ctx, last.Add(9*time.Minute+45*time.Second))
+	if len(fetched) != 1 {
+		t.Errorf("expected the repository not to be fetched again for the same run, got %v", fetched)
+	}
+
+	// a run skipped because nothing changed leaves the last run time
+	// as it was; the next run is due an interval later
+	p.prefetch(ctx, last.Add(19*time.Minute+30*time.Second))
+	if len(fetched) != 2 {
+		t.Errorf("expected the repository to be fetched for the next run, got %v", fetched)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// The work queue used by controller-runtime hands out requests in the
+// order they arrived, so priority is applied after dequeuing: there
+// are more workers than automations allowed to run at once, and the
+// workers wait their turn for a run slot, which is given to the most
+// urgent waiting automation.
+
+// workersPerRunSlot is how many workers are started for each
+// automation allowed to run at once; the extra workers are what let
+// urgent automations overtake others that were queued earlier.
+const workersPerRunSlot = 4
+
+// priorityRank gives the position of a priority class in the order in
+// which waiting automations are run. An unset class counts as Normal.
+func priorityRank(class imagev1.PriorityClassName) int {
+	switch class {
+	case imagev1.PriorityClassHigh:
+		return 0
+	case imagev1.PriorityClassLow:
+		return 2
+	default:
+		return 1
+	}
+}
+
+const numPriorityRanks = 3
+
+// runSlots limits how many automations run at once, and when all the
+// slots are taken, gives the next free slot to the waiter with the
+// most urgent priority class (and, within a class, the one that has
+// waited longest).
+type runSlots struct {
+	mu      sync.Mutex
+	free    int
+	waiting [numPriorityRanks][]chan struct{}
+}
+
+func newRunSlots(n int) *runSlots {
+	if n < 1 {
+		n = 1
+	}
+	return &runSlots{free: n}
+}
+
+// acquire waits for a run slot, or for the context to be done. If it
+// returns nil, the caller must call release when finished.
+func (s *runSlots) acquire(ctx context.Context, class imagev1.PriorityClassName) error {
+	if s == nil {
+		return nil
+	}
+	rank := priorityRank(class)
+
+	s.mu.Lock()
+	if s.free > 0 {
+		s.free--
+		s.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	s.waiting[rank] = append(s.waiting[rank], ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, ch := range s.waiting[rank] {
+			if ch == ready {
+				s.waiting[rank] = append(s.waiting[rank][:i], s.waiting[rank][i+1:]...)
+				return ctx.Err()
+			}
+		}
+		// the slot was handed over in the meantime, so pass it on
+		s.releaseLocked()
+		return ctx.Err()
+	}
+}
+
+// release gives up a run slot, handing it to the most urgent waiter
+// if there is one.
+func (s *runSlots) release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked()
+}
+
+func (s *runSlots) releaseLocked() {
+	for rank := range s.waiting {
+		if len(s.waiting[rank]) > 0 {
+			next := s.waiting[rank][0]
+			s.waiting[rank] = s.waiting[rank][1:]
+			close(next)
+			return
+		}
+	}
+	s.free++
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestRunSlotsPriority(t *testing.T) {
+	slots := newRunSlots(1)
+	ctx := context.Background()
+	if err := slots.acquire(ctx, imagev1.PriorityClassLow); err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan imagev1.PriorityClassName, 3)
+	wait := func(class imagev1.PriorityClassName) {
+		if err := slots.acquire(ctx, class); err != nil {
+			t.Error(err)
+			return
+		}
+		order <- class
+		slots.release()
+	}
+	// queue the waiters one at a time, so that their order of
+	// arrival is known
+	for _, class := range []imagev1.PriorityClassName{imagev1.PriorityClassLow, "", imagev1.PriorityClassHigh} {
+		go wait(class)
+		for !slotsWaiting(slots, class) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	slots.release()
+	for _, expected := range []imagev1.PriorityClassName{imagev1.PriorityClassHigh, "", imagev1.PriorityClassLow} {
+		if class := <-order; class != expected {
+			t.Errorf("expected %q to run next, got %q", expected, class)
+		}
+	}
+}
+
+func TestRunSlotsCancel(t *testing.T) {
+	slots := newRunSlots(1)
+	if err := slots.acquire(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := slots.acquire(ctx, imagev1.PriorityClassHigh); err == nil {
+		t.Fatal("expected acquire to fail when the context is done")
+	}
+	slots.release()
+	if err := slots.acquire(context.Background(), imagev1.PriorityClassLow); err != nil {
+		t.Fatalf("expected slot to be free after cancelled wait, got %v", err)
+	}
+}
+
+func slotsWaiting(s *runSlots, class imagev1.PriorityClassName) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiting[priorityRank(class)]) > 0
+}
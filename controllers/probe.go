@@ -0,0 +1,186 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-logr/logr"
+	libgit2 "github.com/libgit2/git2go/v31"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fluxcd/pkg/runtime/events"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// remoteProbe periodically checks that the git repository of each
+// automation can be connected to for pushing, with the credentials
+// that would be used to push. This brings broken credentials (e.g., a
+// deploy key that was revoked, or lacks write access) to light before
+// the next automation run fails because of them.
+//
+// Failures are reported against the automation, in an event and in a
+// metric, rather than through the controller's health endpoints; one
+// automation's broken key says nothing about the controller's health.
+type remoteProbe struct {
+	reconciler *ImageUpdateAutomationReconciler
+	interval   time.Duration
+	// check connects to a remote; tests replace it.
+	check func(context.Context, repoAccess) error
+	// failing holds the error last reported for each automation whose
+	// check failed, so that an event is sent only when that changes.
+	failing map[types.NamespacedName]string
+}
+
+func newRemoteProbe(r *ImageUpdateAutomationReconciler, interval time.Duration) *remoteProbe {
+	return &remoteProbe{
+		reconciler: r,
+		interval:   interval,
+		check:      checkRemote,
+		failing:    make(map[types.NamespacedName]string),
+	}
+}
+
+// Start runs the probe until the context is done. Since the probe
+// doesn't say otherwise, the manager only starts it once elected
+// leader.
+func (p *remoteProbe) Start(ctx context.Context) error {
+	ctx = logr.NewContext(ctx, ctrl.Log.WithName("remote-probe"))
+	wait.UntilWithContext(ctx, p.probe, p.interval)
+	return nil
+}
+
+// probe checks the git repository of each automation that isn't
+// suspended.
+func (p *remoteProbe) probe(ctx context.Context) {
+	log := logr.FromContext(ctx)
+	var autos imagev1.ImageUpdateAutomationList
+	if err := p.reconciler.List(ctx, &autos); err != nil {
+		log.Error(err, "unable to list image update automations")
+		return
+	}
+
+	seen := make(map[types.NamespacedName]bool)
+	for _, auto := range autos.Items {
+		if auto.Spec.Suspend || !p.reconciler.shards.leads(shardKey(&auto)) {
+			continue
+		}
+		name := types.NamespacedName{Namespace: auto.GetNamespace(), Name: auto.GetName()}
+		seen[name] = true
+		checked, err := p.checkAutomation(ctx, &auto)
+		if !checked {
+			continue
+		}
+		p.reconciler.AutomationMetrics.RecordRemoteCheck(name, err == nil)
+		p.report(ctx, auto, err)
+	}
+	for name := range p.failing {
+		if !seen[name] {
+			delete(p.failing, name)
+		}
+	}
+}
+
+// checkAutomation checks the git repository of the automation given.
+// It returns false if there was no repository to check; problems
+// finding the repository are left for the automation run to report.
+func (p *remoteProbe) checkAutomation(ctx context.Context, auto *imagev1.ImageUpdateAutomation) (bool, error) {
+	if auto.Spec.SourceRef.Kind != sourcev1.GitRepositoryKind {
+		return false, nil
+	}
+	// the repository is read as the automation would read it
+	reconciler, err := p.reconciler.impersonate(auto)
+	if err != nil {
+		return false, nil
+	}
+	var origin sourcev1.GitRepository
+	originName := types.NamespacedName{Namespace: auto.GetNamespace(), Name: auto.Spec.SourceRef.Name}
+	if err := reconciler.Get(ctx, originName, &origin); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			logr.FromContext(ctx).Error(err, "unable to get git repository", "gitrepository", originName)
+		}
+		return false, nil
+	}
+
+	access, err := reconciler.getRepoAccess(ctx, auto, &origin)
+	if err != nil {
+		return true, err
+	}
+	checkCtx, cancel := gitOperationContext(ctx, &origin)
+	defer cancel()
+	return true, p.check(checkCtx, access)
+}
+
+// report sends an event when the check of an automation's git
+// repository starts failing, fails differently, or recovers.
+func (p *remoteProbe) report(ctx context.Context, auto imagev1.ImageUpdateAutomation, err error) {
+	name := types.NamespacedName{Namespace: auto.GetNamespace(), Name: auto.GetName()}
+	previous, wasFailing := p.failing[name]
+	switch {
+	case err != nil && (!wasFailing || previous != err.Error()):
+		p.failing[name] = err.Error()
+		p.reconciler.event(ctx, auto, events.EventSeverityError,
+			fmt.Sprintf("unable to connect to git repository for pushing: %s", err), nil)
+	case err == nil && wasFailing:
+		delete(p.failing, name)
+		p.reconciler.event(ctx, auto, events.EventSeverityInfo, "git repository can be connected to for pushing again", nil)
+	}
+}
+
+// checkRemote connects to the remote as if to push, which checks that
+// it can be reached and that the credentials are accepted for
+// pushing, without sending anything.
+func checkRemote(ctx context.Context, access repoAccess) error {
+	return runGitOperation(ctx, func() error {
+		return connectPush(ctx, access)
+	})
+}
+
+// connectPush does the connecting for `checkRemote`.
+func connectPush(ctx context.Context, access repoAccess) error {
+	tmp, err := os.MkdirTemp("", "remote-probe")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	repo, err := libgit2.InitRepository(tmp, true)
+	if err != nil {
+		return err
+	}
+	defer repo.Free()
+	remote, err := repo.Remotes.CreateAnonymous(access.url)
+	if err != nil {
+		return err
+	}
+	defer remote.Free()
+
+	callbacks := access.remoteCallbacks(ctx)
+	if err := remote.ConnectPush(&callbacks, nil, nil); err != nil {
+		return libgit2PushError(err)
+	}
+	remote.Disconnect()
+	return nil
+}
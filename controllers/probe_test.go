@@ -0,0 +1,125 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestRemoteProbe(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := imagev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := sourcev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	automation := func(name, repo string, suspend bool) *imagev1.ImageUpdateAutomation {
+		return &imagev1.ImageUpdateAutomation{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: name},
+			Spec: imagev1.ImageUpdateAutomationSpec{
+				SourceRef: imagev1.SourceReference{Kind: sourcev1.GitRepositoryKind, Name: repo},
+				Suspend:   suspend,
+			},
+		}
+	}
+	repo := &sourcev1.GitRepository{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "repo"},
+		Spec:       sourcev1.GitRepositorySpec{URL: "ssh://git@example.com/org/repo"},
+	}
+	recorder := record.NewFakeRecorder(10)
+	metrics := NewAutomationMetrics()
+	r := &ImageUpdateAutomationReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			automation("auto", "repo", false),
+			automation("suspended", "repo", true),
+			automation("no-repo", "missing", false),
+			repo,
+		).Build(),
+		Scheme:            scheme,
+		EventRecorder:     recorder,
+		AutomationMetrics: metrics,
+	}
+
+	var checkErr error
+	var checked []string
+	probe := newRemoteProbe(r, 0)
+	probe.check = func(_ context.Context, access repoAccess) error {
+		checked = append(checked, access.url)
+		return checkErr
+	}
+	ctx := logr.NewContext(context.TODO(), logr.Discard())
+
+	expectEvent := func(substr string) {
+		t.Helper()
+		select {
+		case event := <-recorder.Events:
+			if !strings.Contains(event, substr) {
+				t.Errorf("expected an event containing %q, got %q", substr, event)
+			}
+		default:
+			t.Errorf("expected an event containing %q", substr)
+		}
+	}
+	expectNoEvent := func() {
+		t.Helper()
+		select {
+		case event := <-recorder.Events:
+			t.Errorf("expected no event, got %q", event)
+		default:
+		}
+	}
+
+	checkErr = errors.New("permission denied")
+	probe.probe(ctx)
+	if len(checked) != 1 || checked[0] != repo.Spec.URL {
+		t.Errorf("expected only the repository of the automation that isn't suspended to be checked, got %v", checked)
+	}
+	if n := testutil.ToFloat64(metrics.remoteGauge.WithLabelValues("auto", "apps")); n != 0 {
+		t.Errorf("expected the remote to be recorded as unreachable, got %v", n)
+	}
+	expectEvent("permission denied")
+
+	// the same failure again is not reported again
+	probe.probe(ctx)
+	expectNoEvent()
+
+	checkErr = nil
+	probe.probe(ctx)
+	if n := testutil.ToFloat64(metrics.remoteGauge.WithLabelValues("auto", "apps")); n != 1 {
+		t.Errorf("expected the remote to be recorded as reachable, got %v", n)
+	}
+	expectEvent("again")
+
+	probe.probe(ctx)
+	expectNoEvent()
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	imagev1_reflect "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+	"github.com/fluxcd/pkg/apis/meta"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// An automation with stages promotes images through them in order;
+// e.g., dev, then staging, then prod. The first stage is given the
+// latest image selected by each policy, as any other path would be.
+// Each stage after it is given the image recorded as being in the
+// stage before it, once the image has been there for that stage's
+// soak time, and that stage's health gates are healthy. The images in
+// each stage are recorded in the status after each run that pushes
+// its commit, or has nothing to commit.
+
+// checkStages returns an error if the stages given can't be told
+// apart.
+func checkStages(stages []imagev1.PromotionStage) error {
+	seen := make(map[string]bool, len(stages))
+	for _, stage := range stages {
+		if seen[stage.Name] {
+			return fmt.Errorf("more than one stage in .spec.update.stages is named %q", stage.Name)
+		}
+		seen[stage.Name] = true
+	}
+	return nil
+}
+
+// promotedImages gives, for each stage of the automation given, the
+// images that may be put in it, by policy. The entry for the first
+// stage is nil, meaning the latest images may be.
+func (r *ImageUpdateAutomationReconciler) promotedImages(ctx context.Context, auto *imagev1.ImageUpdateAutomation, now time.Time) []map[types.NamespacedName]string {
+	log := logr.FromContext(ctx)
+	stages := auto.Spec.Update.Stages
+	promoted := make([]map[types.NamespacedName]string, len(stages))
+	for i := 1; i < len(stages); i++ {
+		from := stages[i-1]
+		if err := r.checkHealthGates(ctx, auto, from.HealthGates); err != nil {
+			log.Info("holding back promotion", "from", from.Name, "to", stages[i].Name, "reason", err.Error())
+			promoted[i] = map[types.NamespacedName]string{}
+			continue
+		}
+		promoted[i] = soakedImages(from, findStage(auto.Status.Stages, from.Name), now)
+	}
+	return promoted
+}
+
+// soakedImages gives the images recorded in the stage given that have
+// been there for its soak time, by policy.
+func soakedImages(stage imagev1.PromotionStage, status *imagev1.StageStatus, now time.Time) map[types.NamespacedName]string {
+	images := make(map[types.NamespacedName]string)
+	if status == nil {
+		return images
+	}
+	for _, image := range status.Images {
+		if now.Sub(image.Since.Time) >= soakTime(stage) {
+			images[stagePolicyName(image.Policy)] = image.Image
+		}
+	}
+	return images
+}
+
+// nextPromotion gives how long it will be until an image, recorded in
+// a stage other than the last, has been there for the stage's soak
+// time and can be promoted; or zero if no image is waiting for that.
+func nextPromotion(stages []imagev1.PromotionStage, statuses []imagev1.StageStatus, now time.Time) time.Duration {
+	var next time.Duration
+	for i := 0; i+1 < len(stages); i++ {
+		status := findStage(statuses, stages[i].Name)
+		if status == nil {
+			continue
+		}
+		promoted := map[types.NamespacedName]string{}
+		if to := findStage(statuses, stages[i+1].Name); to != nil {
+			for _, image := range to.Images {
+				promoted[stagePolicyName(image.Policy)] = image.Image
+			}
+		}
+		for _, image := range status.Images {
+			if promoted[stagePolicyName(image.Policy)] == image.Image {
+				continue
+			}
+			wait := image.Since.Add(soakTime(stages[i])).Sub(now)
+			if wait > 0 && (next == 0 || wait < next) {
+				next = wait
+			}
+		}
+	}
+	return next
+}
+
+// withImages gives copies of the policies given, each with its latest
+// image replaced by the image given for it, or by none if there isn't
+// one, so that it's left out of updates. If images is nil, the
+// policies are given as they are.
+func withImages(policies []imagev1_reflect.ImagePolicy, images map[types.NamespacedName]string) []imagev1_reflect.ImagePolicy {
+	if images == nil {
+		return policies
+	}
+	out := make([]imagev1_reflect.ImagePolicy, len(policies))
+	for i, policy := range policies {
+		policy.Status.LatestImage = images[types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}]
+		out[i] = policy
+	}
+	return out
+}
+
+// stageStatus gives the status of a stage after a run: for each policy
+// marked in the stage's files, the image the run put there, or, if it
+// put none, the image recorded before. An image keeps the time it was
+// first recorded in the stage.
+func stageStatus(name string, previous *imagev1.StageStatus, marked map[types.NamespacedName]struct{}, policies []imagev1_reflect.ImagePolicy, now time.Time) imagev1.StageStatus {
+	before := map[types.NamespacedName]imagev1.StageImage{}
+	if previous != nil {
+		for _, image := range previous.Images {
+			before[stagePolicyName(image.Policy)] = image
+		}
+	}
+	latest := map[types.NamespacedName]string{}
+	for _, policy := range policies {
+		latest[types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}] = policy.Status.LatestImage
+	}
+
+	status := imagev1.StageStatus{Name: name}
+	for policy := range marked {
+		image, ok := before[policy]
+		if latest[policy] != "" && (!ok || image.Image != latest[policy]) {
+			image = imagev1.StageImage{
+				Policy: meta.NamespacedObjectReference{Namespace: policy.Namespace, Name: policy.Name},
+				Image:  latest[policy],
+				Since:  metav1.Time{Time: now},
+			}
+		} else if !ok {
+			continue
+		}
+		status.Images = append(status.Images, image)
+	}
+	sort.Slice(status.Images, func(i, j int) bool {
+		a, b := status.Images[i].Policy, status.Images[j].Policy
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	return status
+}
+
+// findStage gives the status of the stage named, or nil if there
+// isn't one.
+func findStage(statuses []imagev1.StageStatus, name string) *imagev1.StageStatus {
+	for i := range statuses {
+		if statuses[i].Name == name {
+			return &statuses[i]
+		}
+	}
+	return nil
+}
+
+func soakTime(stage imagev1.PromotionStage) time.Duration {
+	if stage.SoakTime == nil {
+		return 0
+	}
+	return stage.SoakTime.Duration
+}
+
+func stagePolicyName(ref meta.NamespacedObjectReference) types.NamespacedName {
+	return types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	imagev1_reflect "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+	"github.com/fluxcd/pkg/apis/meta"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestPathsToUpdateStages(t *testing.T) {
+	strategy := &imagev1.UpdateStrategy{
+		Stages: []imagev1.PromotionStage{{Name: "dev", Path: "./dev"}, {Name: "prod", Path: "./prod"}},
+	}
+	paths, err := pathsToUpdate(strategy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || paths[0].Path != "./dev" || paths[1].Path != "./prod" {
+		t.Errorf("expected the path of each stage, in order, got %v", paths)
+	}
+
+	strategy.Path = "./apps"
+	if _, err := pathsToUpdate(strategy); err == nil {
+		t.Error("expected an error when both stages and a path are given")
+	}
+	strategy.Path = ""
+	strategy.Stages[1].Name = "dev"
+	if _, err := pathsToUpdate(strategy); err == nil {
+		t.Error("expected an error when two stages have the same name")
+	}
+}
+
+func TestPromotion(t *testing.T) {
+	now := time.Now()
+	app := meta.NamespacedObjectReference{Namespace: "apps", Name: "app"}
+	web := meta.NamespacedObjectReference{Namespace: "apps", Name: "web"}
+	stages := []imagev1.PromotionStage{
+		{Name: "dev", Path: "./dev", SoakTime: &metav1.Duration{Duration: time.Hour}},
+		{Name: "prod", Path: "./prod"},
+	}
+	statuses := []imagev1.StageStatus{
+		{Name: "dev", Images: []imagev1.StageImage{
+			{Policy: app, Image: "app:v2", Since: metav1.Time{Time: now.Add(-2 * time.Hour)}},
+			{Policy: web, Image: "web:v2", Since: metav1.Time{Time: now.Add(-10 * time.Minute)}},
+		}},
+		{Name: "prod", Images: []imagev1.StageImage{
+			{Policy: app, Image: "app:v1", Since: metav1.Time{Time: now.Add(-48 * time.Hour)}},
+			{Policy: web, Image: "web:v1", Since: metav1.Time{Time: now.Add(-48 * time.Hour)}},
+		}},
+	}
+
+	// only the image that has soaked for long enough is promoted
+	images := soakedImages(stages[0], findStage(statuses, "dev"), now)
+	if len(images) != 1 || images[types.NamespacedName{Namespace: "apps", Name: "app"}] != "app:v2" {
+		t.Errorf("expected only app:v2 to be ready for promotion, got %v", images)
+	}
+	if wait := nextPromotion(stages, statuses, now); wait != 50*time.Minute {
+		t.Errorf("expected the next promotion to be in 50m, got %s", wait)
+	}
+
+	policy := func(name, latest string) imagev1_reflect.ImagePolicy {
+		var p imagev1_reflect.ImagePolicy
+		p.Namespace, p.Name = "apps", name
+		p.Status.LatestImage = latest
+		return p
+	}
+	policies := []imagev1_reflect.ImagePolicy{policy("app", "app:v3"), policy("web", "web:v3")}
+	if got := withImages(policies, nil); got[0].Status.LatestImage != "app:v3" {
+		t.Errorf("expected the latest images to be kept for the first stage, got %v", got)
+	}
+	promoted := withImages(policies, images)
+	if promoted[0].Status.LatestImage != "app:v2" || promoted[1].Status.LatestImage != "" {
+		t.Errorf("expected app:v2 and no image for web, got %q and %q", promoted[0].Status.LatestImage, promoted[1].Status.LatestImage)
+	}
+	if policies[0].Status.LatestImage != "app:v3" {
+		t.Error("expected the policies given to be left as they were")
+	}
+
+	marked := map[types.NamespacedName]struct{}{
+		{Namespace: "apps", Name: "web"}: {},
+		{Namespace: "apps", Name: "app"}: {},
+	}
+	prod := stageStatus("prod", findStage(statuses, "prod"), marked, promoted, now)
+	expected := []imagev1.StageImage{
+		{Policy: app, Image: "app:v2", Since: metav1.Time{Time: now}},
+		{Policy: web, Image: "web:v1", Since: metav1.Time{Time: now.Add(-48 * time.Hour)}},
+	}
+	if len(prod.Images) != len(expected) {
+		t.Fatalf("expected images %v, got %v", expected, prod.Images)
+	}
+	for i := range expected {
+		if prod.Images[i].Policy != expected[i].Policy || prod.Images[i].Image != expected[i].Image || !prod.Images[i].Since.Equal(&expected[i].Since) {
+			t.Errorf("expected %v, got %v", expected[i], prod.Images[i])
+		}
+	}
+}
@@ -0,0 +1,293 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+const (
+	// defaultPushLeaseDuration is how long a push lease lasts without
+	// being renewed; it's renewed three times in that period.
+	defaultPushLeaseDuration = time.Minute
+	// pushLeasePrefix starts the name of each Lease object used.
+	pushLeasePrefix = "image-automation-push-"
+)
+
+// The annotations put on a Lease object, so it can be told which
+// repository and branch it's for.
+var (
+	pushLeaseURLAnnotation    = imagev1.GroupVersion.Group + "/push-url"
+	pushLeaseBranchAnnotation = imagev1.GroupVersion.Group + "/push-branch"
+)
+
+// pushLeases makes runs that push to the same branch of the same git
+// repository take turns, whichever GitRepository object they use;
+// otherwise, both would clone the same commit, and the second to push
+// would be rejected as not a fast-forward.
+//
+// Within the controller, a run waits for the others to finish. If a
+// namespace is given, a coordination.k8s.io Lease in that namespace
+// is also held for the branch, so that runs in other controllers
+// (e.g., other shards) take turns too; a run that finds the Lease
+// held elsewhere is tried again once it would expire.
+type pushLeases struct {
+	locks *repoLocks
+
+	// client and reader are used for the Lease objects, if namespace
+	// is not empty. The reader should not be a cached one, since the
+	// Lease must be seen as it is when taken.
+	client    client.Client
+	reader    client.Reader
+	namespace string
+	identity  string
+	duration  time.Duration
+}
+
+// newPushLeases creates pushLeases which hold Lease objects in the
+// namespace given, if it's not empty.
+func newPushLeases(c client.Client, reader client.Reader, namespace string) (*pushLeases, error) {
+	identity, err := leaseIdentity()
+	if err != nil {
+		return nil, err
+	}
+	return &pushLeases{
+		locks:     newRepoLocks(),
+		client:    c,
+		reader:    reader,
+		namespace: namespace,
+		identity:  identity,
+		duration:  defaultPushLeaseDuration,
+	}, nil
+}
+
+// leaseIdentity makes up a name for this controller as a holder of
+// Leases, from its hostname (the pod name, in a cluster) and a random
+// suffix, so that a restarted controller doesn't think it holds the
+// Leases of the one before.
+func leaseIdentity() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return hostname + "_" + hex.EncodeToString(suffix), nil
+}
+
+// pushLeaseKey gives the key for pushing to the branch given of the
+// git repository at the URL given. URLs that differ only in a
+// trailing slash or ".git" are taken to be the same repository.
+func pushLeaseKey(url, branch string) string {
+	url = strings.TrimSuffix(strings.TrimSuffix(url, "/"), ".git")
+	return url + "#" + branch
+}
+
+// pushLeaseName gives the name of the Lease object for a key. A hash
+// is used, since a URL won't do as a name.
+func pushLeaseName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return pushLeasePrefix + hex.EncodeToString(sum[:])[:16]
+}
+
+// acquire takes the lease for pushing to the branch given of the git
+// repository at the URL given, waiting for other runs in this
+// controller to give it up. If the Lease object is held by another
+// controller, it returns how long to wait before trying again, and a
+// nil func. Otherwise, the caller must call the func returned when
+// finished.
+func (l *pushLeases) acquire(ctx context.Context, url, branch string) (func(), time.Duration, error) {
+	if l == nil {
+		return func() {}, 0, nil
+	}
+	key := pushLeaseKey(url, branch)
+	unlock, err := l.locks.acquire(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if l.namespace == "" {
+		return unlock, 0, nil
+	}
+
+	wait, err := l.take(ctx, key, url, branch)
+	if err != nil || wait > 0 {
+		unlock()
+		return nil, wait, err
+	}
+
+	renewCtx, stopRenewing := context.WithCancel(context.Background())
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		l.renew(renewCtx, logr.FromContext(ctx), key)
+	}()
+	return func() {
+		stopRenewing()
+		<-renewed
+		l.give(logr.FromContext(ctx), key)
+		unlock()
+	}, 0, nil
+}
+
+// take tries to take the Lease object for a key, creating it if
+// necessary. If it's held by another controller, it returns how long
+// until the Lease expires.
+func (l *pushLeases) take(ctx context.Context, key, url, branch string) (time.Duration, error) {
+	name := types.NamespacedName{Namespace: l.namespace, Name: pushLeaseName(key)}
+	for {
+		var lease coordinationv1.Lease
+		err := l.reader.Get(ctx, name, &lease)
+		if apierrors.IsNotFound(err) {
+			lease = coordinationv1.Lease{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: name.Namespace,
+					Name:      name.Name,
+					Annotations: map[string]string{
+						pushLeaseURLAnnotation:    url,
+						pushLeaseBranchAnnotation: branch,
+					},
+				},
+			}
+			l.hold(&lease, time.Now())
+			err = l.client.Create(ctx, &lease)
+			if apierrors.IsAlreadyExists(err) {
+				continue
+			}
+			if err != nil {
+				return 0, fmt.Errorf("creating push lease: %w", err)
+			}
+			return 0, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("getting push lease: %w", err)
+		}
+
+		now := time.Now()
+		if remaining := l.remaining(&lease, now); remaining > 0 {
+			return remaining, nil
+		}
+		l.hold(&lease, now)
+		err = l.client.Update(ctx, &lease)
+		if apierrors.IsConflict(err) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("taking push lease: %w", err)
+		}
+		return 0, nil
+	}
+}
+
+// remaining gives how long until the Lease given expires, if it's held
+// by another controller, or zero.
+func (l *pushLeases) remaining(lease *coordinationv1.Lease, now time.Time) time.Duration {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || *spec.HolderIdentity == l.identity {
+		return 0
+	}
+	if spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return 0
+	}
+	expires := spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+	if remaining := expires.Sub(now); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// hold fills in the spec of the Lease given as held by this
+// controller, from the time given.
+func (l *pushLeases) hold(lease *coordinationv1.Lease, now time.Time) {
+	identity := l.identity
+	seconds := int32(l.duration / time.Second)
+	at := metav1.NewMicroTime(now)
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != identity {
+		lease.Spec.AcquireTime = &at
+	}
+	lease.Spec.HolderIdentity = &identity
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.RenewTime = &at
+}
+
+// renew keeps the Lease object for a key held until the context is
+// done, or it's found to have been taken by another controller.
+func (l *pushLeases) renew(ctx context.Context, log logr.Logger, key string) {
+	name := types.NamespacedName{Namespace: l.namespace, Name: pushLeaseName(key)}
+	ticker := time.NewTicker(l.duration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var lease coordinationv1.Lease
+		if err := l.reader.Get(ctx, name, &lease); err != nil {
+			log.Error(err, "unable to renew push lease", "key", key)
+			continue
+		}
+		if h := lease.Spec.HolderIdentity; h == nil || *h != l.identity {
+			log.Info("push lease taken by another controller", "key", key)
+			return
+		}
+		l.hold(&lease, time.Now())
+		if err := l.client.Update(ctx, &lease); err != nil {
+			log.Error(err, "unable to renew push lease", "key", key)
+		}
+	}
+}
+
+// give gives up the Lease object for a key, if it's still held by this
+// controller, so another can take it without waiting for it to
+// expire.
+func (l *pushLeases) give(log logr.Logger, key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	name := types.NamespacedName{Namespace: l.namespace, Name: pushLeaseName(key)}
+	var lease coordinationv1.Lease
+	if err := l.reader.Get(ctx, name, &lease); err != nil {
+		log.Error(err, "unable to give up push lease", "key", key)
+		return
+	}
+	if h := lease.Spec.HolderIdentity; h == nil || *h != l.identity {
+		return
+	}
+	lease.Spec.HolderIdentity = nil
+	lease.Spec.AcquireTime = nil
+	lease.Spec.RenewTime = nil
+	if err := l.client.Update(ctx, &lease); err != nil {
+		log.Error(err, "unable to give up push lease", "key", key)
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestPushLeaseKey(t *testing.T) {
+	same := []string{
+		"https://example.com/org/repo",
+		"https://example.com/org/repo/",
+		"https://example.com/org/repo.git",
+	}
+	for _, url := range same {
+		if key := pushLeaseKey(url, "main"); key != pushLeaseKey(same[0], "main") {
+			t.Errorf("expected %q to have the same key as %q, got %q", url, same[0], key)
+		}
+	}
+	if pushLeaseKey(same[0], "main") == pushLeaseKey(same[0], "other") {
+		t.Error("expected different branches to have different keys")
+	}
+}
+
+func TestPushLeases(t *testing.T) {
+	ctx := context.Background()
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()
+	url := "https://example.com/org/repo"
+
+	this, err := newPushLeases(c, c, "flux-system")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newPushLeases(c, c, "flux-system")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if this.identity == other.identity {
+		t.Fatal("expected each controller to have its own identity")
+	}
+
+	release, wait, err := this.acquire(ctx, url, "main")
+	if err != nil || wait != 0 {
+		t.Fatalf("expected to take the lease, got wait %s, err %v", wait, err)
+	}
+
+	// another branch isn't held up, in this controller or another
+	releaseOther, wait, err := other.acquire(ctx, url, "other")
+	if err != nil || wait != 0 {
+		t.Fatalf("expected to take the lease for another branch, got wait %s, err %v", wait, err)
+	}
+	releaseOther()
+
+	// another controller is told to wait until the lease expires
+	_, wait, err = other.acquire(ctx, url+".git", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait <= 0 || wait > defaultPushLeaseDuration {
+		t.Errorf("expected to be told to wait for the lease, got %s", wait)
+	}
+	if len(other.locks.locks) != 0 {
+		t.Error("expected the lock within the controller to be given up when the lease is held elsewhere")
+	}
+
+	// once given up, the other controller can take it
+	release()
+	releaseOther, wait, err = other.acquire(ctx, url, "main")
+	if err != nil || wait != 0 {
+		t.Fatalf("expected to take the lease once given up, got wait %s, err %v", wait, err)
+	}
+
+	// a lease that has expired can be taken, even if it wasn't given up
+	name := types.NamespacedName{Namespace: "flux-system", Name: pushLeaseName(pushLeaseKey(url, "main"))}
+	var lease coordinationv1.Lease
+	if err := c.Get(ctx, name, &lease); err != nil {
+		t.Fatal(err)
+	}
+	if h := lease.Spec.HolderIdentity; h == nil || *h != other.identity {
+		t.Fatalf("expected the lease to be held by the other controller, got %v", h)
+	}
+	expired := metav1.NewMicroTime(time.Now().Add(-2 * defaultPushLeaseDuration))
+	lease.Spec.RenewTime = &expired
+	if err := c.Update(ctx, &lease); err != nil {
+		t.Fatal(err)
+	}
+	release, wait, err = this.acquire(ctx, url, "main")
+	if err != nil || wait != 0 {
+		t.Fatalf("expected to take the expired lease, got wait %s, err %v", wait, err)
+	}
+	release()
+
+	// the other controller no longer holds it, so leaves it alone
+	releaseOther()
+	if err := c.Get(ctx, name, &lease); err != nil {
+		t.Fatal(err)
+	}
+	if lease.Spec.HolderIdentity != nil {
+		t.Errorf("expected the lease to be given up, got holder %q", *lease.Spec.HolderIdentity)
+	}
+}
+
+func TestPushLeasesWithinController(t *testing.T) {
+	leases, err := newPushLeases(nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	release, _, err := leases.acquire(ctx, "https://example.com/org/repo", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan func())
+	go func() {
+		release, _, err := leases.acquire(ctx, "https://example.com/org/repo.git", "main")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("expected the second run to wait for the first")
+	case <-time.After(10 * time.Millisecond):
+	}
+	release()
+	(<-acquired)()
+}
+
+func TestPushLeaseHeldForGitOperations(t *testing.T) {
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()
+	url := "https://example.com/org/repo"
+	this, err := newPushLeases(c, c, "flux-system")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newPushLeases(c, c, "flux-system")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := withGitOperations(context.Background())
+	release, wait, err := this.acquire(ctx, url, "main")
+	if err != nil || wait != 0 {
+		t.Fatalf("expected to take the lease, got wait %s, err %v", wait, err)
+	}
+
+	// a push that's given up on, but is still going
+	opCtx, cancel := context.WithCancel(ctx)
+	unblock := make(chan struct{})
+	cancel()
+	if err := runGitOperation(opCtx, func() error {
+		<-unblock
+		return nil
+	}); err == nil {
+		t.Fatal("expected the operation to be given up on")
+	}
+	whenGitOperationsDone(ctx, release)
+
+	if _, wait, err := other.acquire(context.Background(), url, "main"); err != nil || wait == 0 {
+		t.Errorf("expected the lease to be held by the push still going, got wait %s, err %v", wait, err)
+	}
+	timeoutCtx, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelTimeout()
+	if _, _, err := this.acquire(timeoutCtx, url, "main"); err == nil {
+		t.Error("expected another run in this controller to wait for the push still going")
+	}
+
+	close(unblock)
+	acquireCtx, cancelAcquire := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelAcquire()
+	releaseAgain, wait, err := this.acquire(acquireCtx, url, "main")
+	if err != nil || wait != 0 {
+		t.Fatalf("expected the lease to be given up once the push is done, got wait %s, err %v", wait, err)
+	}
+	releaseAgain()
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+)
+
+// pushLimiter limits how many pushes are made to each git repository
+// (identified by its URL) in a sliding window of time. An automation
+// that would go over the limit doesn't run until the window allows
+// another push; since each run applies every policy, the updates
+// that arrive in the meantime are all made in that one push.
+type pushLimiter struct {
+	max    int
+	window time.Duration
+
+	mu sync.Mutex
+	// pushes holds the times of the pushes to each repository within
+	// the window, oldest first.
+	pushes map[string][]time.Time
+}
+
+// newPushLimiter creates a limiter allowing max pushes to each
+// repository in the window given. If max is zero or less, there's no
+// limit, and the limiter returned is nil (which is ready to use).
+func newPushLimiter(max int, window time.Duration) *pushLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &pushLimiter{max: max, window: window, pushes: make(map[string][]time.Time)}
+}
+
+// wait gives how long from now it will be until a push to the
+// repository is allowed; zero means a push is allowed now.
+func (l *pushLimiter) wait(repo string, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pushes := l.prune(repo, now)
+	if len(pushes) < l.max {
+		return 0
+	}
+	// the oldest push has to leave the window first
+	return pushes[0].Add(l.window).Sub(now)
+}
+
+// record counts a push made to the repository.
+func (l *pushLimiter) record(repo string, now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pushes[repo] = append(l.prune(repo, now), now)
+}
+
+// prune drops the pushes to the repository that are no longer within
+// the window, and returns those that are. It must be called with the
+// lock held.
+func (l *pushLimiter) prune(repo string, now time.Time) []time.Time {
+	pushes := l.pushes[repo]
+	i := 0
+	for i < len(pushes) && !pushes[i].Add(l.window).After(now) {
+		i++
+	}
+	pushes = pushes[i:]
+	if len(pushes) == 0 {
+		delete(l.pushes, repo)
+	} else {
+		l.pushes[repo] = pushes
+	}
+	return pushes
+}
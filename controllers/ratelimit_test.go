@@ -0,0 +1,50 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPushLimiter(t *testing.T) {
+	limiter := newPushLimiter(2, time.Hour)
+	repo, other := "ssh://git@example.com/org/repo", "ssh://git@example.com/org/other"
+	start := time.Date(2021, 10, 1, 10, 0, 0, 0, time.UTC)
+
+	limiter.record(repo, start)
+	if wait := limiter.wait(repo, start.Add(time.Minute)); wait != 0 {
+		t.Errorf("expected a second push to be allowed, got a wait of %v", wait)
+	}
+	limiter.record(repo, start.Add(10*time.Minute))
+
+	if wait := limiter.wait(repo, start.Add(20*time.Minute)); wait != 40*time.Minute {
+		t.Errorf("expected to wait until the first push leaves the window, got %v", wait)
+	}
+	if wait := limiter.wait(other, start.Add(20*time.Minute)); wait != 0 {
+		t.Errorf("expected pushes to another repository to be allowed, got a wait of %v", wait)
+	}
+	if wait := limiter.wait(repo, start.Add(time.Hour)); wait != 0 {
+		t.Errorf("expected a push to be allowed once the first leaves the window, got a wait of %v", wait)
+	}
+
+	var unlimited *pushLimiter = newPushLimiter(0, time.Hour)
+	unlimited.record(repo, start)
+	if wait := unlimited.wait(repo, start); wait != 0 {
+		t.Errorf("expected no limit, got a wait of %v", wait)
+	}
+}
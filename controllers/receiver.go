@@ -0,0 +1,226 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+const (
+	// webhookPathPrefix is followed, in the path of a request to run
+	// an automation, by the automation's namespace and name.
+	webhookPathPrefix = "/hook/"
+	// webhookTokenKey is the key, in the Secret an automation refers
+	// to, of the key used to sign requests to run it.
+	webhookTokenKey = "token"
+	// maxWebhookBody bounds the size of a request body read.
+	maxWebhookBody = 1 << 20
+)
+
+// webhookReceiver serves requests to run a named automation straight
+// away, e.g., from a container registry or CI pipeline when an image
+// is pushed. A request is
+//
+//	POST /hook/<namespace>/<name>
+//
+// signed with an HMAC of its body, keyed with the token in the Secret
+// the automation's .spec.webhookSecretRef refers to. The signature is
+// given in `X-Signature: sha256=<hex>` (or sha512), or in GitHub's
+// `X-Hub-Signature-256`. The run is requested with the reconcile
+// annotation, as `flux reconcile` does.
+type webhookReceiver struct {
+	reconciler *ImageUpdateAutomationReconciler
+	addr       string
+	log        logr.Logger
+}
+
+func newWebhookReceiver(r *ImageUpdateAutomationReconciler, addr string) *webhookReceiver {
+	return &webhookReceiver{
+		reconciler: r,
+		addr:       addr,
+		log:        ctrl.Log.WithName("webhook-receiver"),
+	}
+}
+
+// Start serves requests until the context is done.
+func (w *webhookReceiver) Start(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              w.addr,
+		Handler:           w,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		w.log.Info("serving webhook receiver", "addr", w.addr)
+		errc <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// NeedLeaderElection says that the receiver is served by every
+// replica, since any of them can ask for a run.
+func (w *webhookReceiver) NeedLeaderElection() bool {
+	return false
+}
+
+func (w *webhookReceiver) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if req.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, ok := webhookAutomationName(req.URL.Path)
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+	log := w.log.WithValues("automation", name)
+
+	var auto imagev1.ImageUpdateAutomation
+	if err := w.reconciler.Get(ctx, name, &auto); err != nil {
+		if apierrors.IsNotFound(err) {
+			http.NotFound(rw, req)
+			return
+		}
+		log.Error(err, "unable to get automation")
+		http.Error(rw, "unable to get automation", http.StatusInternalServerError)
+		return
+	}
+	// an automation that doesn't say how to check requests can't be
+	// run by them; it's not told apart from one that doesn't exist
+	if auto.Spec.WebhookSecretRef == nil {
+		http.NotFound(rw, req)
+		return
+	}
+
+	var secret corev1.Secret
+	secretName := types.NamespacedName{Namespace: auto.GetNamespace(), Name: auto.Spec.WebhookSecretRef.Name}
+	if err := w.reconciler.Get(ctx, secretName, &secret); err != nil {
+		log.Error(err, "unable to get webhook secret", "secret", secretName)
+		http.Error(rw, "unable to get webhook secret", http.StatusInternalServerError)
+		return
+	}
+	token, ok := secret.Data[webhookTokenKey]
+	if !ok || len(token) == 0 {
+		log.Error(errors.New("no token in webhook secret"), "unable to check request", "secret", secretName, "key", webhookTokenKey)
+		http.Error(rw, "unable to check request", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(rw, req.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(rw, "unable to read request body", http.StatusBadRequest)
+		return
+	}
+	if err := verifySignature(req.Header, body, token); err != nil {
+		log.Info("refused request to run automation", "reason", err.Error())
+		http.Error(rw, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	patch := client.MergeFrom(auto.DeepCopy())
+	annotations := auto.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[meta.ReconcileRequestAnnotation] = time.Now().Format(time.RFC3339Nano)
+	auto.SetAnnotations(annotations)
+	if err := w.reconciler.Patch(ctx, &auto, patch); err != nil {
+		log.Error(err, "unable to request run of automation")
+		http.Error(rw, "unable to request run", http.StatusInternalServerError)
+		return
+	}
+	log.Info("run of automation requested by webhook")
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// webhookAutomationName gives the name of the automation a request to
+// the path given is to run.
+func webhookAutomationName(path string) (types.NamespacedName, bool) {
+	if !strings.HasPrefix(path, webhookPathPrefix) {
+		return types.NamespacedName{}, false
+	}
+	parts := strings.Split(strings.TrimPrefix(path, webhookPathPrefix), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return types.NamespacedName{}, false
+	}
+	return types.NamespacedName{Namespace: parts[0], Name: parts[1]}, true
+}
+
+// verifySignature returns an error unless the headers given carry an
+// HMAC of the body, keyed with the token given.
+func verifySignature(header http.Header, body, token []byte) error {
+	signature := header.Get("X-Signature")
+	if signature == "" {
+		signature = header.Get("X-Hub-Signature-256")
+	}
+	if signature == "" {
+		return errors.New("request is not signed")
+	}
+	parts := strings.SplitN(signature, "=", 2)
+	if len(parts) != 2 {
+		return errors.New("signature is not in the form <algorithm>=<hex>")
+	}
+	algo, sum := parts[0], parts[1]
+	var newHash func() hash.Hash
+	switch algo {
+	case "sha256":
+		newHash = sha256.New
+	case "sha512":
+		newHash = sha512.New
+	default:
+		return errors.New("unsupported signature algorithm " + algo)
+	}
+	expected, err := hex.DecodeString(sum)
+	if err != nil {
+		return errors.New("signature is not hex encoded")
+	}
+	mac := hmac.New(newHash, token)
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
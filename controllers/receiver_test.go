@@ -0,0 +1,137 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func sign(body, token string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	body := []byte(`{"tag":"v1.2.3"}`)
+	header := http.Header{}
+	if err := verifySignature(header, body, []byte("s3cr3t")); err == nil {
+		t.Error("expected a request that isn't signed to be refused")
+	}
+	header.Set("X-Hub-Signature-256", sign(string(body), "s3cr3t"))
+	if err := verifySignature(header, body, []byte("s3cr3t")); err != nil {
+		t.Errorf("expected a GitHub signature to be accepted, got %v", err)
+	}
+	if err := verifySignature(header, body, []byte("other")); err == nil {
+		t.Error("expected a signature with another key to be refused")
+	}
+	header.Set("X-Signature", "md5=abcd")
+	if err := verifySignature(header, body, []byte("s3cr3t")); err == nil {
+		t.Error("expected an unsupported algorithm to be refused")
+	}
+}
+
+func TestWebhookReceiver(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := imagev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	auto := &imagev1.ImageUpdateAutomation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "auto"},
+		Spec: imagev1.ImageUpdateAutomationSpec{
+			WebhookSecretRef: &meta.LocalObjectReference{Name: "hook"},
+		},
+	}
+	unsigned := &imagev1.ImageUpdateAutomation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "unsigned"},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "hook"},
+		Data:       map[string][]byte{"token": []byte("s3cr3t")},
+	}
+	r := &ImageUpdateAutomationReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(auto, unsigned, secret).Build(),
+		Scheme: scheme,
+	}
+	receiver := newWebhookReceiver(r, "")
+
+	body := `{"tag":"v1.2.3"}`
+	serve := func(method, path, signature string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if signature != "" {
+			req.Header.Set("X-Signature", signature)
+		}
+		rec := httptest.NewRecorder()
+		receiver.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	requested := func(name string) bool {
+		var got imagev1.ImageUpdateAutomation
+		if err := r.Get(context.TODO(), types.NamespacedName{Namespace: "apps", Name: name}, &got); err != nil {
+			t.Fatal(err)
+		}
+		_, ok := got.GetAnnotations()[meta.ReconcileRequestAnnotation]
+		return ok
+	}
+
+	for _, c := range []struct {
+		method, path, signature string
+		code                    int
+	}{
+		{http.MethodGet, "/hook/apps/auto", sign(body, "s3cr3t"), http.StatusMethodNotAllowed},
+		{http.MethodPost, "/hook/apps", sign(body, "s3cr3t"), http.StatusNotFound},
+		{http.MethodPost, "/hook/apps/missing", sign(body, "s3cr3t"), http.StatusNotFound},
+		{http.MethodPost, "/hook/apps/unsigned", sign(body, "s3cr3t"), http.StatusNotFound},
+		{http.MethodPost, "/hook/apps/auto", "", http.StatusUnauthorized},
+		{http.MethodPost, "/hook/apps/auto", sign(body, "wrong"), http.StatusUnauthorized},
+	} {
+		if code := serve(c.method, c.path, c.signature); code != c.code {
+			t.Errorf("%s %s: expected %d, got %d", c.method, c.path, c.code, code)
+		}
+	}
+	if requested("auto") || requested("unsigned") {
+		t.Fatal("expected no run to be requested by requests refused")
+	}
+
+	if code := serve(http.MethodPost, "/hook/apps/auto", sign(body, "s3cr3t")); code != http.StatusAccepted {
+		t.Errorf("expected a signed request to be accepted, got %d", code)
+	}
+	if !requested("auto") {
+		t.Error("expected a run of the automation to be requested")
+	}
+}
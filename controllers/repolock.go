@@ -0,0 +1,124 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// repoLocks makes runs of automations that use the same GitRepository
+// take turns; the key for a GitRepository is its namespaced name. Two
+// runs against the same repository at once would each clone the same
+// commit, and the second to push would be rejected (or worse, with a
+// refspec that forces, would overwrite the first); in turn, the
+// second run starts from the first run's commit.
+//
+// A run that finds its repository busy is requeued rather than
+// waiting for it, so that it doesn't hold up a worker, or a run slot,
+// that could be running an automation using another repository.
+type repoLocks struct {
+	mu    sync.Mutex
+	locks map[string]*repoLock
+}
+
+type repoLock struct {
+	// held has room for one token, which is there while the lock is
+	// held; a channel rather than a mutex, so waiting can be
+	// abandoned.
+	held chan struct{}
+	// users counts the runs holding or waiting for the lock, so it
+	// can be forgotten when there are none.
+	users int
+}
+
+func newRepoLocks() *repoLocks {
+	return &repoLocks{locks: make(map[string]*repoLock)}
+}
+
+// acquire waits for the lock with the key given, or for the context
+// to be done. If it returns nil, the caller must call the function
+// returned when finished.
+func (l *repoLocks) acquire(ctx context.Context, repository string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	lock, ok := l.locks[repository]
+	if !ok {
+		lock = &repoLock{held: make(chan struct{}, 1)}
+		l.locks[repository] = lock
+	}
+	lock.users++
+	l.mu.Unlock()
+
+	select {
+	case lock.held <- struct{}{}:
+		return func() {
+			<-lock.held
+			l.forget(repository, lock)
+		}, nil
+	case <-ctx.Done():
+		l.forget(repository, lock)
+		return nil, ctx.Err()
+	}
+}
+
+// repoBusyRequeue is how long a run that finds its repository busy
+// waits before trying again.
+const repoBusyRequeue = 5 * time.Second
+
+// tryAcquire takes the lock with the key given if it's free, and
+// reports whether it did. If it did, the caller must call the function
+// returned when finished.
+func (l *repoLocks) tryAcquire(repository string) (func(), bool) {
+	if l == nil {
+		return func() {}, true
+	}
+
+	l.mu.Lock()
+	lock, ok := l.locks[repository]
+	if !ok {
+		lock = &repoLock{held: make(chan struct{}, 1)}
+		l.locks[repository] = lock
+	}
+	lock.users++
+	l.mu.Unlock()
+
+	select {
+	case lock.held <- struct{}{}:
+		return func() {
+			<-lock.held
+			l.forget(repository, lock)
+		}, true
+	default:
+		l.forget(repository, lock)
+		return nil, false
+	}
+}
+
+// forget drops a run from the users of a lock, and the lock itself if
+// there are no more.
+func (l *repoLocks) forget(repository string, lock *repoLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lock.users--; lock.users == 0 {
+		delete(l.locks, repository)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestRepoLocks(t *testing.T) {
+	locks := newRepoLocks()
+	ctx := context.Background()
+	repo := types.NamespacedName{Namespace: "apps", Name: "repo"}.String()
+	other := types.NamespacedName{Namespace: "apps", Name: "other"}.String()
+
+	release, err := locks.acquire(ctx, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another repository isn't held up
+	releaseOther, err := locks.acquire(ctx, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseOther()
+
+	// the same repository waits, and can give up waiting
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := locks.acquire(timeoutCtx, repo); err == nil {
+		t.Fatal("expected acquire to fail when the context is done")
+	}
+
+	acquired := make(chan func())
+	go func() {
+		release, err := locks.acquire(ctx, repo)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("expected the second run to wait for the first")
+	case <-time.After(10 * time.Millisecond):
+	}
+	release()
+	(<-acquired)()
+
+	if len(locks.locks) != 0 {
+		t.Errorf("expected no locks to be left once released, got %v", locks.locks)
+	}
+}
+
+func TestRepoLocksTryAcquire(t *testing.T) {
+	locks := newRepoLocks()
+	repo := types.NamespacedName{Namespace: "apps", Name: "repo"}.String()
+
+	release, ok := locks.tryAcquire(repo)
+	if !ok {
+		t.Fatal("expected a free repository to be taken")
+	}
+	if _, ok := locks.tryAcquire(repo); ok {
+		t.Fatal("expected a busy repository not to be taken")
+	}
+	if releaseOther, ok := locks.tryAcquire(types.NamespacedName{Namespace: "apps", Name: "other"}.String()); !ok {
+		t.Error("expected another repository not to be held up")
+	} else {
+		releaseOther()
+	}
+	release()
+	release, ok = locks.tryAcquire(repo)
+	if !ok {
+		t.Fatal("expected the repository to be taken once released")
+	}
+	release()
+
+	if len(locks.locks) != 0 {
+		t.Errorf("expected no locks to be left once released, got %v", locks.locks)
+	}
+}
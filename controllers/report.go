@@ -0,0 +1,168 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// reportTimeout bounds how long sending a run report may take, so that
+// a slow sink doesn't hold up the automation it's reporting on.
+const reportTimeout = 30 * time.Second
+
+// RunReport is the report of a single automation run, whatever its
+// outcome.
+type RunReport struct {
+	// Namespace and Name identify the automation that ran.
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Ready is whether the run succeeded; Outcome is the reason given
+	// in the Ready condition, and Message its message.
+	Ready   bool   `json:"ready"`
+	Outcome string `json:"outcome"`
+	Message string `json:"message,omitempty"`
+	// Revision is the SHA of the commit pushed by the run, if any;
+	// Images and Files are the updates in that commit, and the files
+	// it changed.
+	Revision string                `json:"revision,omitempty"`
+	Images   []imagev1.ImageUpdate `json:"images,omitempty"`
+	Files    []string              `json:"files,omitempty"`
+	// StartTime is when the run started, and DurationSeconds how long
+	// it took.
+	StartTime       time.Time `json:"startTime"`
+	DurationSeconds float64   `json:"durationSeconds"`
+}
+
+// ReportSink is where the report of each automation run is sent.
+type ReportSink interface {
+	SendReport(ctx context.Context, report RunReport) error
+}
+
+// NewReportSink creates the sink for the address given, which is
+// either an http:// or https:// URL, to which reports are POSTed as
+// JSON, or an s3://<endpoint>/<bucket>[/<prefix>] URL, under which
+// each report is written as an object. Credentials for S3 are taken
+// from the environment, or from the instance metadata service.
+func NewReportSink(address string) (ReportSink, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid report sink address %q: %w", address, err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &webhookReportSink{url: address, client: &http.Client{Timeout: reportTimeout}}, nil
+	case "s3":
+		return newBucketReportSink(u)
+	default:
+		return nil, fmt.Errorf("unsupported report sink scheme %q", u.Scheme)
+	}
+}
+
+// webhookReportSink POSTs reports to a URL.
+type webhookReportSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookReportSink) SendReport(ctx context.Context, report RunReport) error {
+	return postJSON(ctx, s.client, s.url, nil, report)
+}
+
+// bucketReportSink writes each report as an object in an S3 bucket.
+type bucketReportSink struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newBucketReportSink(u *url.URL) (*bucketReportSink, error) {
+	bucket, prefix := strings.TrimPrefix(u.Path, "/"), ""
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		bucket, prefix = bucket[:i], strings.Trim(bucket[i+1:], "/")
+	}
+	if u.Host == "" || bucket == "" {
+		return nil, fmt.Errorf("report sink address %q must be of the form s3://<endpoint>/<bucket>[/<prefix>]", u.String())
+	}
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+		}),
+		Secure: u.Query().Get("insecure") != "true",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &bucketReportSink{client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+func (s *bucketReportSink) SendReport(ctx context.Context, report RunReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(ctx, s.bucket, reportObjectName(s.prefix, report), bytes.NewReader(body), int64(len(body)),
+		minio.PutObjectOptions{ContentType: "application/json"})
+	return err
+}
+
+// reportObjectName gives the name of the object a report is written
+// to. Reports for an automation sort in the order of the runs.
+func reportObjectName(prefix string, report RunReport) string {
+	return path.Join(prefix, report.Namespace, report.Name, report.StartTime.UTC().Format("20060102T150405.000Z")+".json")
+}
+
+// runReport makes the report of the automation run that started at
+// the time given, from the status the run left the automation with.
+func runReport(auto *imagev1.ImageUpdateAutomation, start time.Time) RunReport {
+	report := RunReport{
+		Namespace:       auto.GetNamespace(),
+		Name:            auto.GetName(),
+		StartTime:       start,
+		DurationSeconds: time.Since(start).Seconds(),
+	}
+	if ready := apimeta.FindStatusCondition(auto.Status.Conditions, meta.ReadyCondition); ready != nil {
+		report.Ready = ready.Status == metav1.ConditionTrue
+		report.Outcome = ready.Reason
+		report.Message = ready.Message
+	}
+	// the push fields in the status are only this run's if it set
+	// the push time to when it started
+	if pushed := auto.Status.LastPushTime; pushed != nil && pushed.Time.Equal(start) {
+		report.Revision = auto.Status.LastPushCommit
+		report.Images = auto.Status.LastPushImages
+		report.Files = auto.Status.LastPushFiles
+	}
+	return report
+}
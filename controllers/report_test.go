@@ -0,0 +1,105 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestRunReport(t *testing.T) {
+	start := time.Date(2021, 10, 1, 10, 0, 0, 0, time.UTC)
+	auto := &imagev1.ImageUpdateAutomation{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "auto"},
+	}
+	auto.Status.LastPushCommit = "abc123"
+	auto.Status.LastPushTime = &metav1.Time{Time: start.Add(-time.Hour)}
+	auto.Status.LastPushFiles = []string{"deploy.yaml"}
+	imagev1.SetImageUpdateAutomationReadiness(auto, metav1.ConditionFalse, meta.ReconciliationFailedReason, "unable to clone")
+
+	// a push from an earlier run isn't reported as this run's
+	report := runReport(auto, start)
+	if report.Ready || report.Outcome != meta.ReconciliationFailedReason || report.Message != "unable to clone" {
+		t.Errorf("expected a failed run to be reported, got %+v", report)
+	}
+	if report.Revision != "" || report.Files != nil {
+		t.Errorf("expected no push in the report, got %+v", report)
+	}
+
+	auto.Status.LastPushCommit = "def456"
+	auto.Status.LastPushTime = &metav1.Time{Time: start}
+	imagev1.SetImageUpdateAutomationReadiness(auto, metav1.ConditionTrue, meta.ReconciliationSucceededReason, "committed and pushed def456 to main")
+	report = runReport(auto, start)
+	if !report.Ready || report.Revision != "def456" || len(report.Files) != 1 {
+		t.Errorf("expected the push to be reported, got %+v", report)
+	}
+}
+
+func TestReportObjectName(t *testing.T) {
+	report := RunReport{Namespace: "apps", Name: "auto", StartTime: time.Date(2021, 10, 1, 10, 0, 0, 0, time.UTC)}
+	if name := reportObjectName("runs", report); name != "runs/apps/auto/20211001T100000.000Z.json" {
+		t.Errorf("unexpected object name %q", name)
+	}
+	if name := reportObjectName("", report); name != "apps/auto/20211001T100000.000Z.json" {
+		t.Errorf("unexpected object name %q without a prefix", name)
+	}
+}
+
+func TestWebhookReportSink(t *testing.T) {
+	received := make(chan RunReport, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report RunReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- report
+	}))
+	defer server.Close()
+
+	sink, err := NewReportSink(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := RunReport{Namespace: "apps", Name: "auto", Ready: true, Outcome: meta.ReconciliationSucceededReason, Revision: "abc123"}
+	if err := sink.SendReport(context.TODO(), report); err != nil {
+		t.Fatal(err)
+	}
+	if found := <-received; found.Revision != report.Revision || found.Outcome != report.Outcome {
+		t.Errorf("expected report %+v, got %+v", report, found)
+	}
+}
+
+func TestNewReportSink(t *testing.T) {
+	if _, err := NewReportSink("s3://s3.example.com/reports/automation"); err != nil {
+		t.Errorf("unexpected error for an S3 address: %v", err)
+	}
+	for _, address := range []string{"s3://s3.example.com", "oci://registry.example.com/reports", "/var/log/reports"} {
+		if _, err := NewReportSink(address); err == nil {
+			t.Errorf("expected an error for %q", address)
+		}
+	}
+}
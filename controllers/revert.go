@@ -0,0 +1,361 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/runtime/events"
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+	"github.com/fluxcd/image-automation-controller/pkg/update"
+)
+
+// An automation can be asked to revert the last commit it pushed, by
+// setting the revert annotation (imagev1.RevertRequestAnnotation) to a
+// new value. The revert is made in place of a run, and pushed to the
+// push branch; the request is then recorded as handled, whether or not
+// the revert could be made, unless it failed in a way that trying
+// again could fix.
+
+// revertRequest gives the value of the revert annotation of the
+// automation given, if it asks for a revert that hasn't been handled.
+func revertRequest(auto *imagev1.ImageUpdateAutomation) (string, bool) {
+	token, ok := auto.GetAnnotations()[imagev1.RevertRequestAnnotation]
+	return token, ok && token != auto.Status.LastHandledRevertAt
+}
+
+// revertRequestedPredicate passes on updates that change the revert
+// annotation, so that a revert is made as soon as it's asked for.
+type revertRequestedPredicate struct {
+	predicate.Funcs
+}
+
+func (revertRequestedPredicate) Update(e event.UpdateEvent) bool {
+	if e.ObjectOld == nil || e.ObjectNew == nil {
+		return false
+	}
+	token, ok := e.ObjectNew.GetAnnotations()[imagev1.RevertRequestAnnotation]
+	return ok && token != e.ObjectOld.GetAnnotations()[imagev1.RevertRequestAnnotation]
+}
+
+// cannotRevertError is returned when a revert can't be made, and
+// trying again won't change that.
+type cannotRevertError struct {
+	reason string
+}
+
+func (e *cannotRevertError) Error() string {
+	return e.reason
+}
+
+// revertLastPush reverts the last commit pushed by the automation
+// given, and pushes the revert to the push branch.
+func (r *ImageUpdateAutomationReconciler) revertLastPush(ctx context.Context, req ctrl.Request, auto *imagev1.ImageUpdateAutomation, token string,
+	origin *sourcev1.GitRepository, ref *sourcev1.GitRepositoryRef, pushBranch, pushRefspec string) (ctrl.Result, error) {
+	log := logr.FromContext(ctx)
+	now := time.Now()
+
+	// giveUp records the request as handled, though no revert was
+	// made, since asking again won't help.
+	giveUp := func(reason string) (ctrl.Result, error) {
+		log.Info("unable to revert the last push", "reason", reason)
+		r.eventWithReason(ctx, *auto, events.EventSeverityError, imagev1.RevertFailedReason,
+			fmt.Sprintf("unable to revert the last commit pushed: %s", reason), nil)
+		auto.Status.LastHandledRevertAt = token
+		if err := r.patchStatus(ctx, req, auto.Status); err != nil {
+			return ctrl.Result{Requeue: true}, err
+		}
+		return ctrl.Result{RequeueAfter: intervalOrDefault(auto)}, nil
+	}
+	// fail leaves the request to be tried again, with backoff.
+	fail := func(err error) (ctrl.Result, error) {
+		if cannot, ok := err.(*cannotRevertError); ok {
+			return giveUp(cannot.reason)
+		}
+		r.eventWithReason(ctx, *auto, events.EventSeverityError, imagev1.RevertFailedReason,
+			fmt.Sprintf("unable to revert the last commit pushed: %s", err), nil)
+		imagev1.SetImageUpdateAutomationReadiness(auto, metav1.ConditionFalse, meta.ReconciliationFailedReason, err.Error())
+		if err := r.patchStatus(ctx, req, auto.Status); err != nil {
+			log.Error(err, "failed to reconcile")
+		}
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	target := auto.Status.LastPushCommit
+	switch {
+	case target == "":
+		return giveUp("the automation has not pushed a commit")
+	case auto.Status.LastRevert != nil && auto.Status.LastRevert.Reverted == target:
+		return giveUp(fmt.Sprintf("commit %s has already been reverted, by %s", target, auto.Status.LastRevert.Commit))
+	case pushBranch == "":
+		return giveUp("there is no push branch to push the revert to")
+	}
+
+	// the branch is held until the push is done, even if it's given up on
+	ctx = withGitOperations(ctx)
+	releasePush, wait, err := r.pushLeases.acquire(ctx, origin.Spec.URL, pushBranch)
+	if err != nil {
+		return fail(err)
+	}
+	if wait > 0 {
+		return ctrl.Result{RequeueAfter: wait.Round(time.Second)}, nil
+	}
+	defer whenGitOperationsDone(ctx, releasePush)
+
+	gitSpec := auto.Spec.GitSpec
+	var signingEntity *openpgp.Entity
+	if gitSpec.Commit.SigningKey != nil {
+		if signingEntity, err = r.getSigningEntity(ctx, *auto); err != nil {
+			return fail(err)
+		}
+	}
+
+	access, err := r.getRepoAccess(ctx, auto, origin)
+	if err != nil {
+		return fail(err)
+	}
+	ctx, tmp, removeWorkspace, err := r.workspaces.create(ctx, fmt.Sprintf("%s-%s", origin.GetNamespace(), origin.GetName()))
+	if err != nil {
+		return fail(err)
+	}
+	defer removeWorkspace()
+
+	cloneCtx, cancel := gitOperationContext(ctx, origin)
+	defer cancel()
+	repo, err := cloneInto(cloneCtx, access, ref, tmp, nil)
+	if err != nil {
+		return fail(err)
+	}
+	if err := r.workspaces.checkSize(tmp); err != nil {
+		return fail(err)
+	}
+	if gitSpec.Push != nil {
+		fetchCtx, cancel := gitOperationContext(ctx, origin)
+		defer cancel()
+		access, err = r.withRotatedAuth(ctx, auto, origin, access, func(access repoAccess) error {
+			return fetch(fetchCtx, tmp, pushBranch, access, nil)
+		})
+		if err == errRemoteBranchMissing {
+			return giveUp(fmt.Sprintf("the push branch %s does not exist", pushBranch))
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if err := switchBranch(repo, tmp, pushBranch, nil); err != nil {
+			return fail(err)
+		}
+	}
+
+	commitAuthor, err := r.getCommitAuthor(ctx, auto)
+	if err != nil {
+		return fail(err)
+	}
+	author := &object.Signature{
+		Name:  commitAuthor.Name,
+		Email: commitAuthor.Email,
+		When:  now,
+	}
+	rev, err := revertCommit(repo, tmp, target, signingEntity, author)
+	if err != nil {
+		return fail(err)
+	}
+
+	pushCtx, cancel := gitOperationContext(ctx, origin)
+	defer cancel()
+	refspecs := pushRefspecs(pushBranch, pushRefspec, false)
+	_, err = r.withRotatedAuth(ctx, auto, origin, access, func(access repoAccess) error {
+		return push(pushCtx, tmp, refspecs, access)
+	})
+	auto.Status.PushRefs = pushRefStatuses(auto.Status.PushRefs, refspecs, rev, now, err)
+	if err != nil {
+		return fail(err)
+	}
+	r.pushLimiter.record(origin.Spec.URL, now)
+
+	pushedTo := pushTargets(pushBranch, pushRefspec)
+	log.Info("reverted last push", "reverted", target, "revision", rev, "branch", pushBranch, "refspec", pushRefspec)
+	r.eventWithReason(ctx, *auto, events.EventSeverityInfo, imagev1.RevertSucceededReason,
+		fmt.Sprintf("Reverted commit %s with %s, pushed to %s", target, rev, pushedTo),
+		pushMetadata(rev, pushBranch, pushRefspec, update.Result{}, nil))
+	auto.Status.LastRevert = &imagev1.RevertResult{
+		Commit:   rev,
+		Reverted: target,
+		Time:     metav1.Time{Time: now},
+	}
+	// a commit reverted before it's promoted is never promoted; see
+	// canary.go
+	if dropCanaryCommit(auto.Status.Canary, target) {
+		log.Info("reverted commit will not be promoted to the canary branch", "reverted", target)
+	}
+	auto.Status.LastHandledRevertAt = token
+	if err := r.patchStatus(ctx, req, auto.Status); err != nil {
+		return ctrl.Result{Requeue: true}, err
+	}
+	return ctrl.Result{RequeueAfter: intervalOrDefault(auto)}, nil
+}
+
+// revertCommit commits, on top of HEAD, the reverse of the changes
+// made by the commit given, and returns the SHA1 of the new commit.
+// The commit must be in the history of HEAD, and the files it changed
+// must not have been changed since; otherwise, reverting it would
+// undo more than the commit did.
+func revertCommit(repo *gogit.Repository, path, hash string, ent *openpgp.Entity, author *object.Signature) (string, error) {
+	commit, err := repo.CommitObject(plumbing.NewHash(hash))
+	if err == plumbing.ErrObjectNotFound {
+		return "", &cannotRevertError{fmt.Sprintf("commit %s is not in the repository", hash)}
+	}
+	if err != nil {
+		return "", err
+	}
+	if commit.NumParents() != 1 {
+		return "", &cannotRevertError{fmt.Sprintf("commit %s has %d parents, so cannot be reverted", hash, commit.NumParents())}
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+	headCommit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return "", err
+	}
+	if ok, err := commit.IsAncestor(headCommit); err != nil {
+		return "", err
+	} else if !ok {
+		return "", &cannotRevertError{fmt.Sprintf("commit %s is not in the history of the push branch", hash)}
+	}
+
+	parent, err := commit.Parent(0)
+	if err != nil {
+		return "", err
+	}
+	parentTree, err := parent.Tree()
+	if err != nil {
+		return "", err
+	}
+	commitTree, err := commit.Tree()
+	if err != nil {
+		return "", err
+	}
+	headTree, err := headCommit.Tree()
+	if err != nil {
+		return "", err
+	}
+
+	working, err := repo.Worktree()
+	if err != nil {
+		return "", err
+	}
+	// the files changed must be as the commit left them
+	changed, err := applyChanges(working, path, headTree, commitTree, parentTree)
+	if err != nil {
+		return "", err
+	}
+	if changed != "" {
+		return "", &cannotRevertError{fmt.Sprintf("%s has been changed since commit %s", changed, hash)}
+	}
+
+	rev, err := working.Commit(revertMessage(hash, commit.Message), &gogit.CommitOptions{
+		Author:  author,
+		SignKey: ent,
+	})
+	if err != nil {
+		return "", err
+	}
+	return rev.String(), nil
+}
+
+// applyChanges makes in the working tree the changes from one tree to
+// another, and adds them to the index. Each file changed must be, in
+// the tree at HEAD, as it is in the tree changed from; if one isn't,
+// nothing is changed, and its name is returned.
+func applyChanges(working *gogit.Worktree, path string, head, from, to *object.Tree) (string, error) {
+	changes, err := object.DiffTree(from, to)
+	if err != nil {
+		return "", err
+	}
+	for _, change := range changes {
+		name := change.From.Name
+		if name == "" {
+			name = change.To.Name
+		}
+		current, err := head.FindEntry(name)
+		if err != nil && err != object.ErrEntryNotFound && err != object.ErrDirectoryNotFound {
+			return "", err
+		}
+		if (change.From.Name == "") != (current == nil) || (current != nil && current.Hash != change.From.TreeEntry.Hash) {
+			return name, nil
+		}
+	}
+
+	for _, change := range changes {
+		if change.To.Name == "" {
+			if _, err := working.Remove(change.From.Name); err != nil {
+				return "", err
+			}
+			continue
+		}
+		name := change.To.Name
+		file, err := to.TreeEntryFile(&change.To.TreeEntry)
+		if err != nil {
+			return "", err
+		}
+		contents, err := file.Contents()
+		if err != nil {
+			return "", err
+		}
+		mode, err := change.To.TreeEntry.Mode.ToOSFileMode()
+		if err != nil {
+			return "", err
+		}
+		abspath := filepath.Join(path, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(abspath), 0o755); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(abspath, []byte(contents), mode); err != nil {
+			return "", err
+		}
+		if _, err := working.Add(name); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// revertMessage gives the message for the revert of the commit given,
+// in the form git uses.
+func revertMessage(hash, message string) string {
+	subject := strings.SplitN(strings.TrimSpace(message), "\n", 2)[0]
+	return fmt.Sprintf("Revert \"%s\"\n\nThis reverts commit %s.\n", subject, hash)
+}
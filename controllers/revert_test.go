@@ -0,0 +1,136 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestRevertRequest(t *testing.T) {
+	auto := &imagev1.ImageUpdateAutomation{}
+	if _, ok := revertRequest(auto); ok {
+		t.Error("expected no revert to be asked for without the annotation")
+	}
+	auto.SetAnnotations(map[string]string{imagev1.RevertRequestAnnotation: "now"})
+	if token, ok := revertRequest(auto); !ok || token != "now" {
+		t.Errorf("expected a revert to be asked for with the token %q, got %q (%v)", "now", token, ok)
+	}
+	auto.Status.LastHandledRevertAt = "now"
+	if _, ok := revertRequest(auto); ok {
+		t.Error("expected no revert to be asked for once the token has been handled")
+	}
+}
+
+func TestRevertCommit(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := gogit.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	working, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	author := &object.Signature{Name: "Testbot", Email: "test@example.com", When: time.Now()}
+	write := func(name, contents string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := working.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(name string) string {
+		contents, err := os.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			return ""
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(contents)
+	}
+	commit := func(msg string) string {
+		rev, err := working.Commit(msg, &gogit.CommitOptions{Author: author})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rev.String()
+	}
+
+	write("apps/app.yaml", "image: app:v1\n")
+	write("apps/other.yaml", "image: other:v1\n")
+	commit("Initial commit")
+	write("apps/app.yaml", "image: app:v2\n")
+	write("apps/new.yaml", "image: new:v1\n")
+	target := commit("Update app to v2\n\nFiles:\n- apps/app.yaml\n")
+	write("apps/other.yaml", "image: other:v2\n")
+	commit("Update other to v2")
+
+	rev, err := revertCommit(repo, dir, target, nil, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := read("apps/app.yaml"); got != "image: app:v1\n" {
+		t.Errorf("expected the file changed by the commit to be restored, got %q", got)
+	}
+	if got := read("apps/new.yaml"); got != "" {
+		t.Errorf("expected the file added by the commit to be removed, got %q", got)
+	}
+	if got := read("apps/other.yaml"); got != "image: other:v2\n" {
+		t.Errorf("expected the later change to be kept, got %q", got)
+	}
+	reverted, err := repo.CommitObject(plumbing.NewHash(rev))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Revert \"Update app to v2\"\n\nThis reverts commit " + target + ".\n"
+	if reverted.Message != expected {
+		t.Errorf("expected message %q, got %q", expected, reverted.Message)
+	}
+	status, err := working.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.IsClean() {
+		t.Errorf("expected everything to be committed, got status %s", status)
+	}
+
+	// the file has been changed since, by the revert
+	var cannot *cannotRevertError
+	if _, err := revertCommit(repo, dir, target, nil, author); !errors.As(err, &cannot) {
+		t.Errorf("expected the revert of a commit whose files have changed since to be refused, got %v", err)
+	}
+	// the commit isn't there at all
+	if _, err := revertCommit(repo, dir, "0123456789abcdef0123456789abcdef01234567", nil, author); !errors.As(err, &cannot) {
+		t.Errorf("expected the revert of a missing commit to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	imagev1_reflect "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+	"github.com/fluxcd/pkg/apis/meta"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// A one-off run of an automation can be asked for by creating an
+// ImageUpdateRunRequest that refers to it. The automation is run for
+// the oldest request that hasn't finished, with the request's
+// overrides applied to the copy of the automation the run works from,
+// and the outcome of the run is recorded in the request. A run that
+// doesn't get as far as finishing (e.g., because a dependency isn't
+// ready) leaves the request for the next run to act on.
+
+const runRequestAutomationKey = ".spec.automationRef.name"
+
+// automationForRunRequest gives the automation a run request that
+// hasn't finished refers to, so that it's run.
+func (r *ImageUpdateAutomationReconciler) automationForRunRequest(obj client.Object) []reconcile.Request {
+	run, ok := obj.(*imagev1.ImageUpdateRunRequest)
+	if !ok || run.Finished() {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{
+		Namespace: run.GetNamespace(),
+		Name:      run.Spec.AutomationRef.Name,
+	}}}
+}
+
+// pendingRunRequest gives the oldest request to run the automation
+// given that hasn't finished, or nil if there isn't one.
+func (r *ImageUpdateAutomationReconciler) pendingRunRequest(ctx context.Context, auto *imagev1.ImageUpdateAutomation) (*imagev1.ImageUpdateRunRequest, error) {
+	var runs imagev1.ImageUpdateRunRequestList
+	if err := r.List(ctx, &runs, client.InNamespace(auto.GetNamespace()),
+		client.MatchingFields{runRequestAutomationKey: auto.GetName()}); err != nil {
+		return nil, err
+	}
+	return oldestPendingRun(runs.Items), nil
+}
+
+// oldestPendingRun gives the oldest of the requests given that hasn't
+// finished, or nil if they all have.
+func oldestPendingRun(runs []imagev1.ImageUpdateRunRequest) *imagev1.ImageUpdateRunRequest {
+	var oldest *imagev1.ImageUpdateRunRequest
+	for i := range runs {
+		run := &runs[i]
+		if run.Finished() || !run.GetDeletionTimestamp().IsZero() {
+			continue
+		}
+		if oldest == nil || run.CreationTimestamp.Before(&oldest.CreationTimestamp) ||
+			(run.CreationTimestamp.Equal(&oldest.CreationTimestamp) && run.GetName() < oldest.GetName()) {
+			oldest = run
+		}
+	}
+	return oldest
+}
+
+// applyRunOverrides makes the automation given, as the run works from
+// it, do what the request given asks for. It returns an error if the
+// request can't be acted on.
+func applyRunOverrides(auto *imagev1.ImageUpdateAutomation, run *imagev1.ImageUpdateRunRequest) error {
+	if auto.Spec.Suspend && !run.Spec.DryRun {
+		return fmt.Errorf("automation %s is suspended; only a dry run can be asked for", auto.GetName())
+	}
+	if run.Spec.DryRun {
+		auto.Spec.DryRun = true
+	}
+	return nil
+}
+
+// runsPolicy says whether a run for the request given updates the
+// fields marked for the image policy named. Without a request, all
+// policies are updated.
+func runsPolicy(run *imagev1.ImageUpdateRunRequest, name string) bool {
+	if run == nil || len(run.Spec.Policies) == 0 {
+		return true
+	}
+	for _, policy := range run.Spec.Policies {
+		if policy == name {
+			return true
+		}
+	}
+	return false
+}
+
+// runPolicies gives those of the policies given whose fields a run for
+// the request given updates.
+func runPolicies(run *imagev1.ImageUpdateRunRequest, policies []imagev1_reflect.ImagePolicy) []imagev1_reflect.ImagePolicy {
+	if run == nil || len(run.Spec.Policies) == 0 {
+		return policies
+	}
+	var out []imagev1_reflect.ImagePolicy
+	for _, policy := range policies {
+		if runsPolicy(run, policy.GetName()) {
+			out = append(out, policy)
+		}
+	}
+	return out
+}
+
+// runFailed gives the status of a request whose run failed, or was
+// refused.
+func runFailed(reason, message string, now time.Time) *imagev1.ImageUpdateRunRequestStatus {
+	status := &imagev1.ImageUpdateRunRequestStatus{CompletionTime: &metav1.Time{Time: now}}
+	apimeta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:    meta.ReadyCondition,
+		Status:  metav1.ConditionFalse,
+		Reason:  reason,
+		Message: message,
+	})
+	return status
+}
+
+// runSucceeded gives the status of a request whose run finished; rev
+// is empty if the run made no commit.
+func runSucceeded(rev string, pushed bool, updates []imagev1.ImageUpdate, files []string, message string, now time.Time) *imagev1.ImageUpdateRunRequestStatus {
+	if len(files) > maxStatusFiles {
+		files = files[:maxStatusFiles]
+	}
+	status := &imagev1.ImageUpdateRunRequestStatus{
+		CompletionTime: &metav1.Time{Time: now},
+		Commit:         rev,
+		Pushed:         pushed,
+		Images:         updates,
+		Files:          files,
+	}
+	apimeta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:    meta.ReadyCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  meta.ReconciliationSucceededReason,
+		Message: message,
+	})
+	return status
+}
+
+// finishRunRequest records the outcome of a run in the request it was
+// made for. If there's no outcome, the run didn't finish, and the
+// request is left as it is.
+func (r *ImageUpdateAutomationReconciler) finishRunRequest(ctx context.Context, run *imagev1.ImageUpdateRunRequest, outcome *imagev1.ImageUpdateRunRequestStatus) {
+	if outcome == nil {
+		return
+	}
+	log := logr.FromContext(ctx)
+	patch := client.MergeFrom(run.DeepCopy())
+	run.Status = *outcome
+	if err := r.Status().Patch(ctx, run, patch); err != nil {
+		log.Error(err, "unable to record outcome of run request", "request", run.GetName())
+		return
+	}
+	log.Info("finished run request", "request", run.GetName(), "commit", outcome.Commit, "pushed", outcome.Pushed)
+}
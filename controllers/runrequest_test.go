@@ -0,0 +1,125 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imagev1_reflect "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+	"github.com/fluxcd/pkg/apis/meta"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func runRequest(name string, created time.Time) imagev1.ImageUpdateRunRequest {
+	var run imagev1.ImageUpdateRunRequest
+	run.Name = name
+	run.CreationTimestamp = metav1.NewTime(created)
+	run.Spec.AutomationRef.Name = "auto"
+	return run
+}
+
+func TestOldestPendingRun(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	if run := oldestPendingRun(nil); run != nil {
+		t.Errorf("expected no request to run, got %s", run.Name)
+	}
+
+	finished := runRequest("finished", now.Add(-time.Hour))
+	finished.Status.CompletionTime = &metav1.Time{Time: now}
+	runs := []imagev1.ImageUpdateRunRequest{
+		runRequest("newer", now),
+		finished,
+		runRequest("older-b", now.Add(-time.Minute)),
+		runRequest("older-a", now.Add(-time.Minute)),
+	}
+	if run := oldestPendingRun(runs); run == nil || run.Name != "older-a" {
+		t.Errorf("expected the oldest request, by name, that hasn't finished, got %v", run)
+	}
+
+	deleting := runRequest("deleting", now.Add(-time.Hour))
+	deleting.DeletionTimestamp = &metav1.Time{Time: now}
+	if run := oldestPendingRun([]imagev1.ImageUpdateRunRequest{finished, deleting}); run != nil {
+		t.Errorf("expected no request to run, got %s", run.Name)
+	}
+}
+
+func TestApplyRunOverrides(t *testing.T) {
+	var auto imagev1.ImageUpdateAutomation
+	auto.Name = "auto"
+	run := runRequest("run", time.Now())
+	if err := applyRunOverrides(&auto, &run); err != nil || auto.Spec.DryRun {
+		t.Errorf("expected a plain run of the automation, got dry run %v, error %v", auto.Spec.DryRun, err)
+	}
+
+	auto.Spec.Suspend = true
+	if err := applyRunOverrides(&auto, &run); err == nil {
+		t.Error("expected a run of a suspended automation that isn't a dry run to be refused")
+	}
+	run.Spec.DryRun = true
+	if err := applyRunOverrides(&auto, &run); err != nil || !auto.Spec.DryRun {
+		t.Errorf("expected a dry run of the suspended automation, got dry run %v, error %v", auto.Spec.DryRun, err)
+	}
+}
+
+func TestRunPolicies(t *testing.T) {
+	policies := make([]imagev1_reflect.ImagePolicy, 3)
+	for i, name := range []string{"web", "api", "worker"} {
+		policies[i].Name = name
+	}
+	if got := runPolicies(nil, policies); len(got) != 3 || !runsPolicy(nil, "web") {
+		t.Errorf("expected all policies without a request, got %d", len(got))
+	}
+
+	run := runRequest("run", time.Now())
+	if got := runPolicies(&run, policies); len(got) != 3 {
+		t.Errorf("expected all policies for a request naming none, got %d", len(got))
+	}
+	run.Spec.Policies = []string{"api", "missing"}
+	got := runPolicies(&run, policies)
+	if len(got) != 1 || got[0].Name != "api" {
+		t.Errorf("expected only the policy named, got %v", got)
+	}
+	if runsPolicy(&run, "web") || !runsPolicy(&run, "api") {
+		t.Error("expected only the fields marked for the policy named to be updated")
+	}
+}
+
+func TestRunOutcome(t *testing.T) {
+	now := time.Now()
+	failed := runFailed(imagev1.PushRejectedReason, "rejected", now)
+	if failed.CompletionTime == nil || !apimeta.IsStatusConditionFalse(failed.Conditions, meta.ReadyCondition) {
+		t.Errorf("expected a finished request that isn't ready, got %+v", failed)
+	}
+
+	files := make([]string, maxStatusFiles+10)
+	for i := range files {
+		files[i] = fmt.Sprintf("deploy/%d.yaml", i)
+	}
+	succeeded := runSucceeded("abc1234", true, nil, files, "committed and pushed", now)
+	if len(succeeded.Files) != maxStatusFiles {
+		t.Errorf("expected the files listed to be limited to %d, got %d", maxStatusFiles, len(succeeded.Files))
+	}
+	if succeeded.Commit != "abc1234" || !succeeded.Pushed || !apimeta.IsStatusConditionTrue(succeeded.Conditions, meta.ReadyCondition) {
+		t.Errorf("unexpected outcome of a run that pushed %+v", succeeded)
+	}
+}
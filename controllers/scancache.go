@@ -0,0 +1,167 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"k8s.io/apimachinery/pkg/types"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// Scanning a repository for files with setter markers means reading
+// every YAML file in it. Between one run of an automation and the
+// next, only the files that had markers and the files changed in
+// between can have markers, so the next run need only read those.
+
+// maxIncrementalChanges is the number of files changed between two
+// revisions above which the whole repository is scanned again rather
+// than just the files changed; past that, working out which files
+// changed costs as much as it saves.
+const maxIncrementalChanges = 1000
+
+// scanCache records, for each automation, which files in its git
+// repository contained setter markers as of the revision last
+// scanned. The zero value is not usable; a nil *scanCache is, and
+// never has anything cached.
+type scanCache struct {
+	mu      sync.Mutex
+	entries map[types.NamespacedName]scanEntry
+}
+
+// scanEntry records the outcome of a scan.
+type scanEntry struct {
+	// scope identifies what was scanned; see scanScope
+	scope string
+	// revision is the commit scanned
+	revision plumbing.Hash
+	// files lists the files with markers (or that couldn't be looked
+	// at), relative to the root of the repository
+	files []string
+}
+
+func newScanCache() *scanCache {
+	return &scanCache{entries: make(map[types.NamespacedName]scanEntry)}
+}
+
+// get returns the entry for the automation given, if there is one
+// for the same scope.
+func (c *scanCache) get(name types.NamespacedName, scope string) (scanEntry, bool) {
+	if c == nil {
+		return scanEntry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[name]
+	if !ok || entry.scope != scope {
+		return scanEntry{}, false
+	}
+	return entry, true
+}
+
+// put records the outcome of a scan for the automation given.
+func (c *scanCache) put(name types.NamespacedName, entry scanEntry) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[name] = entry
+}
+
+// forget drops the entry for an automation, e.g., once it's deleted.
+func (c *scanCache) forget(name types.NamespacedName) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, name)
+}
+
+// scanScope identifies which files a scan considers: those selected by
+// the update strategies given, less those ignored by the
+// GitRepository and by the .sourceignore files given. A scan with a
+// different scope can't be used to narrow down the next.
+func scanScope(strategies []*imagev1.UpdateStrategy, sourceIgnore *string, ignoreFiles map[string]string) (string, error) {
+	bytes, err := json.Marshal(struct {
+		Strategies  []*imagev1.UpdateStrategy `json:"strategies"`
+		Ignore      *string                   `json:"ignore"`
+		IgnoreFiles map[string]string         `json:"ignoreFiles,omitempty"`
+	}{strategies, sourceIgnore, ignoreFiles})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(bytes)), nil
+}
+
+// scanCandidates gives the files to scan at the revision given, having
+// scanned the entry's revision before: the files that had markers
+// then, and the files changed since. It returns false if the whole
+// repository has to be scanned; e.g., because the revision scanned
+// before is no longer in the history, or too much has changed.
+func scanCandidates(repo *gogit.Repository, entry scanEntry, revision plumbing.Hash) ([]string, bool) {
+	if entry.revision == revision {
+		return entry.files, true
+	}
+	previous, err := repo.CommitObject(entry.revision)
+	if err != nil {
+		return nil, false
+	}
+	current, err := repo.CommitObject(revision)
+	if err != nil {
+		return nil, false
+	}
+	previousTree, err := previous.Tree()
+	if err != nil {
+		return nil, false
+	}
+	currentTree, err := current.Tree()
+	if err != nil {
+		return nil, false
+	}
+	changes, err := object.DiffTree(previousTree, currentTree)
+	if err != nil || len(changes) > maxIncrementalChanges {
+		return nil, false
+	}
+
+	files := make(map[string]struct{}, len(entry.files)+len(changes))
+	for _, file := range entry.files {
+		files[file] = struct{}{}
+	}
+	for _, change := range changes {
+		// a file deleted since has no name in To, and needn't be
+		// scanned
+		if change.To.Name != "" {
+			files[change.To.Name] = struct{}{}
+		}
+	}
+	candidates := make([]string, 0, len(files))
+	for file := range files {
+		candidates = append(candidates, file)
+	}
+	sort.Strings(candidates)
+	return candidates, true
+}
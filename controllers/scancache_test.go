@@ -0,0 +1,122 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"k8s.io/apimachinery/pkg/types"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestScanCandidates(t *testing.T) {
+	fs := memfs.New()
+	repo, err := gogit.Init(memory.NewStorage(), fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	working, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(files map[string]string, removed ...string) plumbing.Hash {
+		t.Helper()
+		for name, content := range files {
+			if err := util.WriteFile(fs, name, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := working.Add(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, name := range removed {
+			if _, err := working.Remove(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		hash, err := working.Commit("commit", &gogit.CommitOptions{
+			Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+
+	first := commit(map[string]string{
+		"apps/marked.yaml":   "marked",
+		"apps/unmarked.yaml": "unmarked",
+		"apps/gone.yaml":     "gone",
+	})
+	entry := scanEntry{revision: first, files: []string{"apps/gone.yaml", "apps/marked.yaml"}}
+
+	if files, ok := scanCandidates(repo, entry, first); !ok || !reflect.DeepEqual(files, entry.files) {
+		t.Errorf("expected the files with markers at the same revision, got %v (%v)", files, ok)
+	}
+
+	second := commit(map[string]string{"apps/new.yaml": "new"}, "apps/gone.yaml")
+	expected := []string{"apps/gone.yaml", "apps/marked.yaml", "apps/new.yaml"}
+	if files, ok := scanCandidates(repo, entry, second); !ok || !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected %v, got %v (%v)", expected, files, ok)
+	}
+
+	unknown := scanEntry{revision: plumbing.NewHash("0123456789012345678901234567890123456789")}
+	if _, ok := scanCandidates(repo, unknown, second); ok {
+		t.Error("expected a full scan when the revision scanned before is not in the repository")
+	}
+}
+
+func TestScanCache(t *testing.T) {
+	name := types.NamespacedName{Namespace: "apps", Name: "auto"}
+	path := "./apps"
+	scope, err := scanScope([]*imagev1.UpdateStrategy{{Strategy: imagev1.UpdateStrategySetters, Path: path}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherScope, err := scanScope([]*imagev1.UpdateStrategy{{Strategy: imagev1.UpdateStrategySetters, Path: path}}, &path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nilCache *scanCache
+	nilCache.put(name, scanEntry{scope: scope})
+	if _, ok := nilCache.get(name, scope); ok {
+		t.Error("expected nothing to be cached in a nil cache")
+	}
+
+	cache := newScanCache()
+	cache.put(name, scanEntry{scope: scope, files: []string{"apps/marked.yaml"}})
+	if _, ok := cache.get(name, scope); !ok {
+		t.Error("expected an entry for the same scope")
+	}
+	if _, ok := cache.get(name, otherScope); ok {
+		t.Error("expected no entry for a different scope")
+	}
+	cache.forget(name)
+	if _, ok := cache.get(name, scope); ok {
+		t.Error("expected no entry once forgotten")
+	}
+}
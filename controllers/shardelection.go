@@ -0,0 +1,241 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// Instead of one controller leading and running every automation, the
+// automations can be split into shards by the label
+// imagev1.ShardKeyLabel, and a leader elected for each shard, so that
+// several replicas of the controller run automations at once. Each
+// replica runs only the automations in the shards it leads. When the
+// leader of a shard goes away, its Lease expires, and a replica
+// standing by for the shard takes over.
+
+// shardLeasePrefix starts the name of the Lease object for each shard.
+const shardLeasePrefix = "image-automation-shard-"
+
+// shardKey gives the shard the object given is in.
+func shardKey(obj metav1.Object) string {
+	if key := obj.GetLabels()[imagev1.ShardKeyLabel]; key != "" {
+		return key
+	}
+	return imagev1.DefaultShardKey
+}
+
+// validShardKeys returns an error for the first of the shard keys
+// given that can't be used in the name of a Lease.
+func validShardKeys(keys []string) error {
+	for _, key := range keys {
+		if errs := validation.IsDNS1123Label(key); len(errs) > 0 {
+			return fmt.Errorf("invalid shard key %q: %s", key, errs[0])
+		}
+	}
+	return nil
+}
+
+// ShardElectionOptions says which shards a controller contends to
+// lead, and how.
+type ShardElectionOptions struct {
+	// Shards lists the shards to contend for straight away.
+	Shards []string
+	// StandbyShards lists the shards to take over only once they have
+	// been without a leader for a lease duration; e.g., those another
+	// replica lists in Shards.
+	StandbyShards []string
+	// Namespace is the namespace in which to hold a Lease for each
+	// shard.
+	Namespace     string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// shardElection contends to lead each shard, and keeps track of the
+// shards led.
+type shardElection struct {
+	opts     ShardElectionOptions
+	config   *rest.Config
+	identity string
+	// started is called with each shard when this controller starts
+	// leading it.
+	started func(ctx context.Context, shard string)
+
+	mu  sync.RWMutex
+	led map[string]bool
+}
+
+func newShardElection(config *rest.Config, opts ShardElectionOptions, started func(context.Context, string)) (*shardElection, error) {
+	if opts.Namespace == "" {
+		return nil, fmt.Errorf("electing a leader for each shard needs a namespace for the Leases")
+	}
+	if err := validShardKeys(append(append([]string{}, opts.Shards...), opts.StandbyShards...)); err != nil {
+		return nil, err
+	}
+	identity, err := leaseIdentity()
+	if err != nil {
+		return nil, err
+	}
+	return &shardElection{
+		opts:     opts,
+		config:   config,
+		identity: identity,
+		started:  started,
+		led:      make(map[string]bool),
+	}, nil
+}
+
+// leads reports whether this controller leads the shard given. Without
+// shard election, it leads every shard.
+func (s *shardElection) leads(shard string) bool {
+	if s == nil {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.led[shard]
+}
+
+func (s *shardElection) setLeading(shard string, leading bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if leading {
+		s.led[shard] = true
+	} else {
+		delete(s.led, shard)
+	}
+}
+
+// Start contends for each shard until the context is done.
+func (s *shardElection) Start(ctx context.Context) error {
+	ctx = logr.NewContext(ctx, ctrl.Log.WithName("shard-election"))
+	coordination, err := coordinationv1client.NewForConfig(s.config)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	for _, shard := range s.opts.Shards {
+		wg.Add(1)
+		go func(shard string) {
+			defer wg.Done()
+			s.contend(ctx, coordination, shard, false)
+		}(shard)
+	}
+	for _, shard := range s.opts.StandbyShards {
+		wg.Add(1)
+		go func(shard string) {
+			defer wg.Done()
+			s.contend(ctx, coordination, shard, true)
+		}(shard)
+	}
+	wg.Wait()
+	return nil
+}
+
+// NeedLeaderElection says that shard election runs in every replica,
+// since it takes the place of electing a single leader.
+func (s *shardElection) NeedLeaderElection() bool {
+	return false
+}
+
+// contend tries to lead the shard given until the context is done,
+// trying again whenever leadership is lost. A controller standing by
+// for the shard waits a lease duration before each try, so that the
+// controller which lists the shard in its Shards gets it first.
+func (s *shardElection) contend(ctx context.Context, coordination coordinationv1client.CoordinationV1Interface, shard string, standby bool) {
+	log := logr.FromContext(ctx).WithValues("shard", shard)
+	for ctx.Err() == nil {
+		if standby {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(s.opts.LeaseDuration):
+			}
+		}
+		elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock: &resourcelock.LeaseLock{
+				LeaseMeta: metav1.ObjectMeta{
+					Namespace: s.opts.Namespace,
+					Name:      shardLeasePrefix + shard,
+				},
+				Client:     coordination,
+				LockConfig: resourcelock.ResourceLockConfig{Identity: s.identity},
+			},
+			LeaseDuration:   s.opts.LeaseDuration,
+			RenewDeadline:   s.opts.RenewDeadline,
+			RetryPeriod:     s.opts.RetryPeriod,
+			ReleaseOnCancel: true,
+			Name:            shard,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					log.Info("started leading shard")
+					s.setLeading(shard, true)
+					if s.started != nil {
+						s.started(ctx, shard)
+					}
+				},
+				OnStoppedLeading: func() {
+					log.Info("stopped leading shard")
+					s.setLeading(shard, false)
+				},
+			},
+		})
+		if err != nil {
+			log.Error(err, "unable to contend for shard")
+			return
+		}
+		elector.Run(ctx)
+	}
+}
+
+// enqueueShard queues a run of each automation in the shard given,
+// once this controller starts leading it, since it will have skipped
+// them until then.
+func (r *ImageUpdateAutomationReconciler) enqueueShard(ctx context.Context, shard string) {
+	var autos imagev1.ImageUpdateAutomationList
+	if err := r.List(ctx, &autos); err != nil {
+		logr.FromContext(ctx).Error(err, "unable to list image update automations", "shard", shard)
+		return
+	}
+	for i := range autos.Items {
+		if shardKey(&autos.Items[i]) != shard {
+			continue
+		}
+		select {
+		case r.shardEvents <- event.GenericEvent{Object: &autos.Items[i]}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestShardKey(t *testing.T) {
+	var auto imagev1.ImageUpdateAutomation
+	if key := shardKey(&auto); key != imagev1.DefaultShardKey {
+		t.Errorf("expected an automation without the label to be in the default shard, got %q", key)
+	}
+	auto.SetLabels(map[string]string{imagev1.ShardKeyLabel: "shard1"})
+	if key := shardKey(&auto); key != "shard1" {
+		t.Errorf("expected the shard given by the label, got %q", key)
+	}
+}
+
+func TestNewShardElection(t *testing.T) {
+	config := &rest.Config{Host: "https://kubernetes.example.com"}
+	if _, err := newShardElection(config, ShardElectionOptions{Shards: []string{"shard1"}}, nil); err == nil {
+		t.Error("expected an error without a namespace")
+	}
+	if _, err := newShardElection(config, ShardElectionOptions{Shards: []string{"shard1"}, StandbyShards: []string{"Shard_2"}, Namespace: "flux-system"}, nil); err == nil {
+		t.Error("expected an error for a shard key that can't be used in a name")
+	}
+
+	s, err := newShardElection(config, ShardElectionOptions{Shards: []string{"shard1"}, Namespace: "flux-system"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.leads("shard1") {
+		t.Error("expected no shard to be led before being elected")
+	}
+	s.setLeading("shard1", true)
+	if !s.leads("shard1") || s.leads(imagev1.DefaultShardKey) {
+		t.Error("expected only the shard elected to be led")
+	}
+	s.setLeading("shard1", false)
+	if s.leads("shard1") {
+		t.Error("expected the shard not to be led once leadership is lost")
+	}
+
+	var none *shardElection
+	if !none.leads("shard1") {
+		t.Error("expected every shard to be led without shard election")
+	}
+}
+
+func TestContendForShard(t *testing.T) {
+	started := make(chan string, 1)
+	s, err := newShardElection(&rest.Config{}, ShardElectionOptions{
+		Shards:        []string{"shard1"},
+		Namespace:     "flux-system",
+		LeaseDuration: time.Second,
+		RenewDeadline: 500 * time.Millisecond,
+		RetryPeriod:   100 * time.Millisecond,
+	}, func(_ context.Context, shard string) { started <- shard })
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientset := kubefake.NewSimpleClientset()
+
+	ctx, cancel := context.WithCancel(logr.NewContext(context.Background(), logr.Discard()))
+	done := make(chan struct{})
+	go func() {
+		s.contend(ctx, clientset.CoordinationV1(), "shard1", false)
+		close(done)
+	}()
+	select {
+	case shard := <-started:
+		if shard != "shard1" || !s.leads("shard1") {
+			t.Errorf("expected to lead shard1, got %q", shard)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected to be elected leader of the shard")
+	}
+	lease, err := clientset.CoordinationV1().Leases("flux-system").Get(context.TODO(), shardLeasePrefix+"shard1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder := lease.Spec.HolderIdentity; holder == nil || *holder != s.identity {
+		t.Errorf("expected the Lease to be held by %s, got %v", s.identity, holder)
+	}
+
+	cancel()
+	<-done
+	if s.leads("shard1") {
+		t.Error("expected the shard not to be led once contending stops")
+	}
+}
+
+func TestEnqueueShard(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := imagev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	var objs []client.Object
+	for name, shard := range map[string]string{"unlabelled": "", "first": "shard1", "second": "shard1", "other": "shard2"} {
+		auto := &imagev1.ImageUpdateAutomation{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: name},
+		}
+		if shard != "" {
+			auto.SetLabels(map[string]string{imagev1.ShardKeyLabel: shard})
+		}
+		objs = append(objs, auto)
+	}
+	r := &ImageUpdateAutomationReconciler{
+		Client:      fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build(),
+		shardEvents: make(chan event.GenericEvent, len(objs)),
+	}
+
+	r.enqueueShard(context.TODO(), "shard1")
+	close(r.shardEvents)
+	queued := make(map[string]bool)
+	for e := range r.shardEvents {
+		queued[e.Object.GetName()] = true
+	}
+	if len(queued) != 2 || !queued["first"] || !queued["second"] {
+		t.Errorf("expected only the automations in the shard to be queued, got %v", queued)
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/fluxcd/source-controller/pkg/sourceignore"
+)
+
+// The source-controller leaves out of a GitRepository's artifact the
+// files matched by the .sourceignore files in the repository, and by
+// the GitRepository's .spec.ignore. Those files are left out of
+// updates too, so that the two controllers agree on what is in scope.
+// The default exclusions of the source-controller (e.g., CI
+// configuration) are not applied, since those files may well have
+// images to update.
+
+// sourceIgnoreFiles gives the contents of each .sourceignore file in
+// the tree given, by path. The files are read from the tree rather
+// than the working directory, since a sparse checkout may not include
+// them.
+func sourceIgnoreFiles(tree *object.Tree) (map[string]string, error) {
+	files := make(map[string]string)
+	err := tree.Files().ForEach(func(f *object.File) error {
+		if path.Base(f.Name) != sourceignore.IgnoreFile || !f.Mode.IsFile() {
+			return nil
+		}
+		contents, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		files[f.Name] = contents
+		return nil
+	})
+	return files, err
+}
+
+// sourceIgnorePatterns gives the patterns in the .sourceignore files
+// given, each relative to the directory it's in. As with the
+// source-controller, the patterns in a directory come after those in
+// the directories above it, so take precedence.
+func sourceIgnorePatterns(files map[string]string) []gitignore.Pattern {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if di, dj := strings.Count(paths[i], "/"), strings.Count(paths[j], "/"); di != dj {
+			return di < dj
+		}
+		return paths[i] < paths[j]
+	})
+	var patterns []gitignore.Pattern
+	for _, p := range paths {
+		var domain []string
+		if dir := path.Dir(p); dir != "." {
+			domain = strings.Split(dir, "/")
+		}
+		patterns = append(patterns, sourceignore.ReadPatterns(strings.NewReader(files[p]), domain)...)
+	}
+	return patterns
+}
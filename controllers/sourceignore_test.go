@@ -0,0 +1,93 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+func TestSourceIgnore(t *testing.T) {
+	repo, err := gogit.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	working, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{
+		".sourceignore":      "# leave out test fixtures\ntestdata/\n",
+		"apps/.sourceignore": "*.draft.yaml\n!keep.draft.yaml\n",
+		"apps/deploy.yaml":   "kind: Deployment\n",
+	} {
+		f, err := working.Filesystem.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if _, err := working.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash, err := working.Commit("initial", &gogit.CommitOptions{
+		Author: &object.Signature{Name: "Testbot", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := sourceIgnoreFiles(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected the two .sourceignore files, got %v", files)
+	}
+
+	matcher := gitignore.NewMatcher(sourceIgnorePatterns(files))
+	for file, ignored := range map[string]bool{
+		"testdata/deploy.yaml":      true,
+		"apps/testdata/deploy.yaml": true,
+		"apps/deploy.yaml":          false,
+		"apps/next.draft.yaml":      true,
+		"apps/keep.draft.yaml":      false,
+		"other/next.draft.yaml":     false,
+	} {
+		if matcher.Match(strings.Split(file, "/"), false) != ignored {
+			t.Errorf("expected %s to be ignored: %v", file, ignored)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	libgit2 "github.com/libgit2/git2go/v31"
+
+	"github.com/fluxcd/source-controller/pkg/git"
+	gitlibgit2 "github.com/fluxcd/source-controller/pkg/git/libgit2"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+// A sparse checkout writes only some directories of the repository
+// to the working directory. Since an automation doesn't look outside
+// the directories it updates, they are all that need checking out;
+// in a large repository, that can be a small part of it.
+//
+// The index still holds the whole tree at HEAD, so that commits made
+// from it leave everything outside the directories as it was. This
+// does mean that, according to git, the files outside the
+// directories have been deleted from the working directory; so, only
+// changes within the directories are considered for committing.
+
+// sparsePaths gives the directories, relative to the root of the
+// repository and using forward slashes, to which the update strategy
+// given confines updates. It returns nil if the whole repository
+// might be updated.
+func sparsePaths(strategy *imagev1.UpdateStrategy) []string {
+	updatePaths, err := pathsToUpdate(strategy)
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	for _, updatePath := range updatePaths {
+		p := repoPath(updatePath.Path)
+		if p == "" {
+			return nil
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// repoPath cleans the path given, relative to the root of the
+// repository, so it uses forward slashes and doesn't start with one;
+// the root itself is "".
+func repoPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/")
+}
+
+// withinPaths reports whether the file given, relative to the root of
+// the repository, is in one of the directories given. Every file is
+// within an empty list of directories.
+func withinPaths(file string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	file = filepath.ToSlash(file)
+	for _, p := range paths {
+		if file == p || strings.HasPrefix(file, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sparseClone clones the branch given from url into path, checking
+// out only the directories given.
+func sparseClone(ctx context.Context, url string, auth *git.AuthOptions, branch string, path string, paths []string) error {
+	repo, err := libgit2.Clone(url, path, &libgit2.CloneOptions{
+		FetchOptions: &libgit2.FetchOptions{
+			DownloadTags:    libgit2.DownloadTagsNone,
+			RemoteCallbacks: gitlibgit2.RemoteCallbacks(ctx, auth),
+		},
+		// the checkout is done below, limited to the paths
+		CheckoutOpts:   &libgit2.CheckoutOptions{Strategy: libgit2.CheckoutNone},
+		CheckoutBranch: branch,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to clone: %w", err)
+	}
+	repo.Free()
+	return sparseCheckout(path, paths)
+}
+
+// sparseCheckout resets the index of the repository at path to the
+// tree at HEAD, and checks out only the directories given.
+func sparseCheckout(path string, paths []string) error {
+	repo, err := libgit2.OpenRepository(path)
+	if err != nil {
+		return err
+	}
+	defer repo.Free()
+
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	defer head.Free()
+	commit, err := repo.LookupCommit(head.Target())
+	if err != nil {
+		return err
+	}
+	defer commit.Free()
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+
+	index, err := repo.Index()
+	if err != nil {
+		return err
+	}
+	defer index.Free()
+	if err := index.ReadTree(tree); err != nil {
+		return err
+	}
+	if err := index.Write(); err != nil {
+		return err
+	}
+	return repo.CheckoutIndex(index, &libgit2.CheckoutOptions{
+		Strategy: libgit2.CheckoutForce | libgit2.CheckoutRemoveUntracked,
+		Paths:    paths,
+	})
+}
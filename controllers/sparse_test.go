@@ -0,0 +1,94 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+)
+
+func TestSparsePaths(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy imagev1.UpdateStrategy
+		expected []string
+	}{
+		{
+			name:     "no path",
+			strategy: imagev1.UpdateStrategy{},
+		},
+		{
+			name:     "root path",
+			strategy: imagev1.UpdateStrategy{Path: "./"},
+		},
+		{
+			name:     "single path",
+			strategy: imagev1.UpdateStrategy{Path: "./clusters/prod/"},
+			expected: []string{"clusters/prod"},
+		},
+		{
+			name:     "path outside the repository is kept inside",
+			strategy: imagev1.UpdateStrategy{Path: "../../apps"},
+			expected: []string{"apps"},
+		},
+		{
+			name: "several paths",
+			strategy: imagev1.UpdateStrategy{Paths: []imagev1.UpdatePath{
+				{Path: "./apps"}, {Path: "infrastructure"},
+			}},
+			expected: []string{"apps", "infrastructure"},
+		},
+		{
+			name: "several paths including the root",
+			strategy: imagev1.UpdateStrategy{Paths: []imagev1.UpdatePath{
+				{Path: "./apps"}, {Path: "."},
+			}},
+		},
+		{
+			name:     "both path and paths",
+			strategy: imagev1.UpdateStrategy{Path: "./apps", Paths: []imagev1.UpdatePath{{Path: "./infrastructure"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if paths := sparsePaths(&tt.strategy); !reflect.DeepEqual(paths, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, paths)
+			}
+		})
+	}
+}
+
+func TestWithinPaths(t *testing.T) {
+	paths := []string{"apps", "clusters/prod"}
+	for file, expected := range map[string]bool{
+		"apps/podinfo.yaml":        true,
+		"apps":                     true,
+		"apps-old/podinfo.yaml":    false,
+		"clusters/prod/kustomize":  true,
+		"clusters/staging/app.yml": false,
+		"README.md":                false,
+	} {
+		if within := withinPaths(file, paths); within != expected {
+			t.Errorf("expected %q within %v to be %v", file, paths, expected)
+		}
+	}
+	if !withinPaths("README.md", nil) {
+		t.Error("expected every file to be within an empty list of paths")
+	}
+}
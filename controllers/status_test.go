@@ -0,0 +1,345 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	imagev1_reflect "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+	"github.com/fluxcd/pkg/apis/meta"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+	"github.com/fluxcd/image-automation-controller/pkg/update"
+)
+
+func TestImageUpdates(t *testing.T) {
+	ref := fakeImageRef{
+		name:   "app:v1.0.1",
+		policy: types.NamespacedName{Namespace: "apps", Name: "app"},
+	}
+	result := update.Result{
+		Files: map[string]update.FileResult{
+			"a.yaml": {Changes: []update.Change{
+				{Setter: "apps:app", OldValue: "app:v1.0.0", NewValue: "app:v1.0.1", Image: ref},
+				{Setter: "apps:app:tag", OldValue: "v1.0.0", NewValue: "v1.0.1", Image: ref},
+			}},
+			"b.yaml": {Changes: []update.Change{
+				{Setter: "apps:app", OldValue: "app:v1.0.0", NewValue: "app:v1.0.1", Image: ref},
+			}},
+		},
+	}
+	policy := meta.NamespacedObjectReference{Namespace: "apps", Name: "app"}
+	expected := []imagev1.ImageUpdate{
+		{Policy: policy, OldValue: "app:v1.0.0", NewValue: "app:v1.0.1"},
+		{Policy: policy, OldValue: "v1.0.0", NewValue: "v1.0.1"},
+	}
+	if updates := imageUpdates(result); !reflect.DeepEqual(updates, expected) {
+		t.Errorf("expected updates %v, got %v", expected, updates)
+	}
+}
+
+func TestAppliedPolicies(t *testing.T) {
+	earlier := metav1.Date(2021, 10, 1, 10, 0, 0, 0, time.UTC)
+	now := time.Date(2021, 10, 2, 10, 0, 0, 0, time.UTC)
+	previous := []imagev1.AppliedPolicy{
+		{
+			Policy:           meta.NamespacedObjectReference{Namespace: "apps", Name: "app"},
+			LastAppliedImage: "app:v1.0.0",
+			LastAppliedTime:  earlier,
+		},
+		{
+			Policy:           meta.NamespacedObjectReference{Namespace: "apps", Name: "other"},
+			LastAppliedImage: "other:v2.0.0",
+			LastAppliedTime:  earlier,
+		},
+		{
+			Policy:           meta.NamespacedObjectReference{Namespace: "apps", Name: "deleted"},
+			LastAppliedImage: "deleted:v3.0.0",
+			LastAppliedTime:  earlier,
+		},
+	}
+	result := update.Result{
+		Files: map[string]update.FileResult{
+			"deploy.yaml": {
+				Objects: map[update.ObjectIdentifier][]update.ImageRef{
+					{}: {fakeImageRef{
+						name:   "app:v1.0.1",
+						policy: types.NamespacedName{Namespace: "apps", Name: "app"},
+					}},
+				},
+			},
+		},
+	}
+	var policies []imagev1_reflect.ImagePolicy
+	for _, name := range []string{"other", "app", "unapplied"} {
+		policies = append(policies, imagev1_reflect.ImagePolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: name},
+		})
+	}
+
+	expected := []imagev1.AppliedPolicy{
+		{
+			Policy:           meta.NamespacedObjectReference{Namespace: "apps", Name: "app"},
+			LastAppliedImage: "app:v1.0.1",
+			LastAppliedTime:  metav1.Time{Time: now},
+		},
+		previous[1],
+	}
+	if applied := appliedPolicies(previous, result, policies, now); !reflect.DeepEqual(applied, expected) {
+		t.Errorf("expected applied policies %v, got %v", expected, applied)
+	}
+}
+
+func TestPushSummary(t *testing.T) {
+	updates := []imagev1.ImageUpdate{
+		{Policy: meta.NamespacedObjectReference{Namespace: "apps", Name: "app"}, OldValue: "app:v1.0.0", NewValue: "app:v1.0.1"},
+	}
+	expected := `
+Files changed (2):
+- a.yaml
+- b.yaml
+
+Images updated (1):
+- apps/app: app:v1.0.0 -> app:v1.0.1
+`
+	if summary := pushSummary([]string{"a.yaml", "b.yaml"}, updates); summary != expected {
+		t.Errorf("expected summary %q, got %q", expected, summary)
+	}
+
+	var files []string
+	for i := 0; i < maxSummaryItems+3; i++ {
+		files = append(files, fmt.Sprintf("%d.yaml", i))
+	}
+	summary := pushSummary(files, nil)
+	if !strings.HasSuffix(summary, "- 9.yaml\n- ... and 3 more\n") {
+		t.Errorf("expected the list of files to be cut short, got %q", summary)
+	}
+	if strings.Contains(summary, "Images updated") {
+		t.Errorf("expected no images to be listed when there are no updates, got %q", summary)
+	}
+}
+
+func TestPushMetadata(t *testing.T) {
+	app := fakeImageRef{
+		name:   "app:v1.0.1",
+		policy: types.NamespacedName{Namespace: "apps", Name: "app"},
+	}
+	db := fakeImageRef{
+		name:   "db:v2.0.0",
+		policy: types.NamespacedName{Namespace: "apps", Name: "db"},
+	}
+	result := update.Result{
+		Files: map[string]update.FileResult{
+			"deploy.yaml": {
+				Objects: map[update.ObjectIdentifier][]update.ImageRef{
+					{}: {db, app},
+				},
+			},
+		},
+	}
+	updates := []imagev1.ImageUpdate{
+		{Policy: meta.NamespacedObjectReference{Namespace: "apps", Name: "db"}, OldValue: "db:v1.0.0", NewValue: "db:v2.0.0"},
+		{Policy: meta.NamespacedObjectReference{Namespace: "apps", Name: "app"}, OldValue: "app:v1.0.0", NewValue: "app:v1.0.1"},
+		{Policy: meta.NamespacedObjectReference{Namespace: "apps", Name: "app"}, OldValue: "v1.0.0", NewValue: "v1.0.1"},
+	}
+	expected := map[string]string{
+		"revision": "abc123",
+		"branch":   "main",
+		"images":   "app:v1.0.1,db:v2.0.0",
+		"policies": "apps/app,apps/db",
+	}
+	if metadata := pushMetadata("abc123", "main", "", result, updates); !reflect.DeepEqual(metadata, expected) {
+		t.Errorf("expected metadata %v, got %v", expected, metadata)
+	}
+}
+
+func TestNoChangeReason(t *testing.T) {
+	withLatest := imagev1_reflect.ImagePolicy{Status: imagev1_reflect.ImagePolicyStatus{LatestImage: "app:v1.0.0"}}
+	withoutLatest := imagev1_reflect.ImagePolicy{}
+	for _, c := range []struct {
+		name     string
+		policies []imagev1_reflect.ImagePolicy
+		matched  int
+		expected imagev1.NoChangeReason
+	}{
+		{"no policies", nil, 0, imagev1.NoChangeNoPolicies},
+		{"no latest images", []imagev1_reflect.ImagePolicy{withoutLatest}, 0, imagev1.NoChangeNoPolicies},
+		{"no markers", []imagev1_reflect.ImagePolicy{withoutLatest, withLatest}, 0, imagev1.NoChangeNoMarkersMatched},
+		{"current", []imagev1_reflect.ImagePolicy{withLatest}, 2, imagev1.NoChangeImagesCurrent},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if reason := noChangeReason(c.policies, update.Result{Matched: c.matched}); reason != c.expected {
+				t.Errorf("expected reason %q, got %q", c.expected, reason)
+			}
+		})
+	}
+}
+
+func TestObservedPolicies(t *testing.T) {
+	policies := []imagev1_reflect.ImagePolicy{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "db"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "app"},
+			Status:     imagev1_reflect.ImagePolicyStatus{LatestImage: "app:v1.0.1"},
+		},
+	}
+	expected := []imagev1.ObservedPolicy{
+		{Policy: meta.NamespacedObjectReference{Namespace: "apps", Name: "app"}, LatestImage: "app:v1.0.1"},
+		{Policy: meta.NamespacedObjectReference{Namespace: "apps", Name: "db"}},
+	}
+	if observed := observedPolicies(policies); !reflect.DeepEqual(observed, expected) {
+		t.Errorf("expected observed policies %v, got %v", expected, observed)
+	}
+}
+
+func TestFileEventMessages(t *testing.T) {
+	result := update.Result{
+		Files: map[string]update.FileResult{
+			"b.yaml": {Changes: []update.Change{
+				{OldValue: "app:v1.0.0", NewValue: "app:v1.0.1"},
+			}},
+			"a.yaml": {Changes: []update.Change{
+				{OldValue: "v1.0.0", NewValue: "v1.0.1"},
+				{OldValue: "db:v2.0.0", NewValue: "db:v2.1.0"},
+			}},
+		},
+	}
+	expected := []string{
+		"Updated a.yaml in change abc123\n- v1.0.0 -> v1.0.1\n- db:v2.0.0 -> db:v2.1.0",
+		"Updated b.yaml in change abc123\n- app:v1.0.0 -> app:v1.0.1",
+	}
+	if msgs := fileEventMessages("abc123", result); !reflect.DeepEqual(msgs, expected) {
+		t.Errorf("expected messages %q, got %q", expected, msgs)
+	}
+}
+
+func TestRunDigest(t *testing.T) {
+	policy := func(name, image string) imagev1_reflect.ImagePolicy {
+		p := imagev1_reflect.ImagePolicy{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: name}}
+		p.Status.LatestImage = image
+		return p
+	}
+	policies := []imagev1_reflect.ImagePolicy{policy("app", "app:v1.0.0"), policy("db", "db:v2.0.0")}
+	digest := runDigest(1, "main/abc123", policies)
+
+	reordered := []imagev1_reflect.ImagePolicy{policies[1], policies[0]}
+	if d := runDigest(1, "main/abc123", reordered); d != digest {
+		t.Errorf("expected the digest not to depend on the order of policies")
+	}
+	for name, d := range map[string]string{
+		"generation": runDigest(2, "main/abc123", policies),
+		"revision":   runDigest(1, "main/def456", policies),
+		"image":      runDigest(1, "main/abc123", []imagev1_reflect.ImagePolicy{policy("app", "app:v1.0.1"), policies[1]}),
+		"policies":   runDigest(1, "main/abc123", policies[:1]),
+	} {
+		if d == digest {
+			t.Errorf("expected a change of %s to change the digest", name)
+		}
+	}
+}
+
+func TestSkippedFilesMessage(t *testing.T) {
+	message := skippedFilesMessage([]update.SkippedFile{
+		{Path: "big.yaml", Reason: update.SkipTooLarge, Marked: true},
+		{Path: "deploy/app.yaml", Reason: update.SkipDocumentLimit, Marked: true},
+		{Path: "bad.yaml", Reason: update.SkipParseError, Message: "yaml: line 2: did not find expected key", Marked: true},
+	}, true)
+	expected := "3 file(s) with markers were skipped in scanning for updates:\n- big.yaml (TooLarge)\n- deploy/app.yaml (DocumentLimit)\n- bad.yaml (ParseError): yaml: line 2: did not find expected key"
+	if message != expected {
+		t.Errorf("expected message %q, got %q", expected, message)
+	}
+	message = skippedFilesMessage([]update.SkippedFile{{Path: "vendor/blob.yaml", Reason: update.SkipBinary}}, false)
+	expected = "1 file(s) without markers were skipped in scanning for updates:\n- vendor/blob.yaml (Binary)"
+	if message != expected {
+		t.Errorf("expected message %q, got %q", expected, message)
+	}
+}
+
+func TestSplitSkippedFiles(t *testing.T) {
+	large := update.SkippedFile{Path: "big.yaml", Reason: update.SkipTooLarge, Marked: true}
+	link := update.SkippedFile{Path: "passwd.yaml", Reason: update.SkipSymlinkOutsideTree}
+	marked, unmarked := splitSkippedFiles([]update.SkippedFile{large, link})
+	if len(marked) != 1 || marked[0] != large {
+		t.Errorf("expected only the file with markers to be marked, got %v", marked)
+	}
+	if len(unmarked) != 1 || unmarked[0] != link {
+		t.Errorf("expected only the file without markers to be unmarked, got %v", unmarked)
+	}
+}
+
+func TestSkippedFilesChanged(t *testing.T) {
+	skipped := []imagev1.SkippedFile{
+		{Path: "big.yaml", Reason: string(update.SkipTooLarge)},
+		{Path: "bad.yaml", Reason: string(update.SkipParseError), Message: "yaml: line 2: did not find expected key"},
+	}
+	if skippedFilesChanged(skipped, append([]imagev1.SkippedFile(nil), skipped...)) {
+		t.Error("expected the same files skipped not to be a change")
+	}
+	if !skippedFilesChanged(nil, skipped) {
+		t.Error("expected files skipped for the first time to be a change")
+	}
+	if !skippedFilesChanged(skipped, skipped[:1]) {
+		t.Error("expected fewer files skipped to be a change")
+	}
+	fixed := append([]imagev1.SkippedFile(nil), skipped...)
+	fixed[1].Message = "yaml: line 3: mapping values are not allowed in this context"
+	if !skippedFilesChanged(skipped, fixed) {
+		t.Error("expected a different message to be a change")
+	}
+}
+
+func TestDryRunResult(t *testing.T) {
+	var files []string
+	for i := 0; i < maxStatusFiles+10; i++ {
+		files = append(files, fmt.Sprintf("deploy/app-%03d.yaml", i))
+	}
+	when := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	updates := []imagev1.ImageUpdate{
+		{Policy: meta.NamespacedObjectReference{Namespace: "apps", Name: "app"}, OldValue: "app:v1.0.0", NewValue: "app:v1.0.1"},
+	}
+	result := dryRunResult("abc123", "Update images\n", "image-updates", "", when, updates, files)
+	if result.Commit != "abc123" || result.Message != "Update images\n" || result.Branch != "image-updates" || result.Refspec != "" {
+		t.Errorf("unexpected commit details in %+v", result)
+	}
+	if !result.Time.Time.Equal(when) {
+		t.Errorf("expected time %s, got %s", when, result.Time)
+	}
+	if !reflect.DeepEqual(result.Images, updates) {
+		t.Errorf("expected images %v, got %v", updates, result.Images)
+	}
+	if len(result.Files) != maxStatusFiles || result.Files[0] != files[0] {
+		t.Errorf("expected the first %d files, got %v", maxStatusFiles, result.Files)
+	}
+}
+
+func TestPreviewMessage(t *testing.T) {
+	if message := previewMessage(nil); message != "suspended; no updates pending" {
+		t.Errorf("unexpected message with no files: %q", message)
+	}
+	if message := previewMessage([]string{"a.yaml", "b.yaml"}); message != "suspended; updates to 2 file(s) pending" {
+		t.Errorf("unexpected message with files: %q", message)
+	}
+}
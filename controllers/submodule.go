@@ -0,0 +1,104 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	libgit2 "github.com/libgit2/git2go/v31"
+
+	"github.com/fluxcd/image-automation-controller/pkg/update"
+)
+
+// A submodule is recorded in the repository as a pointer to a commit
+// in another repository (a "gitlink"). Submodules aren't checked out
+// when cloning; and even when they are, an automation never commits
+// changes to them, since that would mean pushing to the other
+// repository first. Nor does it commit a change to the commit a
+// submodule points at, which could otherwise be picked up from the
+// working directory.
+
+// skipInSubmodule is given for a file updated within a submodule,
+// since the change isn't committed.
+const skipInSubmodule update.SkipReason = "InSubmodule"
+
+// submodulePaths gives the paths of the submodules in the index of
+// the repository given, relative to its root and using forward
+// slashes.
+func submodulePaths(repo *gogit.Repository) ([]string, error) {
+	index, err := repo.Storer.Index()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range index.Entries {
+		if entry.Mode == filemode.Submodule {
+			paths = append(paths, entry.Name)
+		}
+	}
+	return paths, nil
+}
+
+// submodulesContaining gives those of the submodules given that
+// contain any of the paths given, or are within them. The paths are
+// relative to the root of the repository and use forward slashes, as
+// from sparsePaths; the root itself is "".
+func submodulesContaining(submodules []string, paths []string) []string {
+	var containing []string
+	for _, submodule := range submodules {
+		for _, p := range paths {
+			if p == "" || withinPaths(p, []string{submodule}) || withinPaths(submodule, []string{p}) {
+				containing = append(containing, submodule)
+				break
+			}
+		}
+	}
+	return containing
+}
+
+// initSubmodules checks out the submodules given, in the repository
+// at path, at the commits recorded for them. The credentials for the
+// repository are used in fetching them.
+func initSubmodules(ctx context.Context, access repoAccess, path string, submodules []string) error {
+	return runGitOperation(ctx, func() error {
+		repo, err := libgit2.OpenRepository(path)
+		if err != nil {
+			return err
+		}
+		defer repo.Free()
+		for _, name := range submodules {
+			submodule, err := repo.Submodules.Lookup(name)
+			if err != nil {
+				return fmt.Errorf("looking up submodule %s: %w", name, err)
+			}
+			err = submodule.Update(true, &libgit2.SubmoduleUpdateOptions{
+				CheckoutOpts: &libgit2.CheckoutOptions{Strategy: libgit2.CheckoutForce},
+				FetchOptions: &libgit2.FetchOptions{
+					RemoteCallbacks: access.remoteCallbacks(ctx),
+				},
+			})
+			submodule.Free()
+			if err != nil {
+				return fmt.Errorf("checking out submodule %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
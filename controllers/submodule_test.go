@@ -0,0 +1,114 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-logr/logr"
+)
+
+func TestSubmodulesContaining(t *testing.T) {
+	submodules := []string{"vendor/lib", "charts"}
+	tests := []struct {
+		name     string
+		paths    []string
+		expected []string
+	}{
+		{name: "root", paths: []string{""}, expected: submodules},
+		{name: "within a submodule", paths: []string{"vendor/lib/deploy"}, expected: []string{"vendor/lib"}},
+		{name: "a submodule itself", paths: []string{"charts"}, expected: []string{"charts"}},
+		{name: "containing a submodule", paths: []string{"vendor"}, expected: []string{"vendor/lib"}},
+		{name: "outside any submodule", paths: []string{"apps", "charts-old"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if containing := submodulesContaining(submodules, tt.paths); !reflect.DeepEqual(containing, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, containing)
+			}
+		})
+	}
+}
+
+func TestChangedFilesIgnoresSubmodules(t *testing.T) {
+	tmp, err := os.MkdirTemp("", "flux-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	repo, err := gogit.PlainInit(tmp, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = populateRepoFromFixture(repo, "testdata/pathconfig"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a submodule checked out at a commit other than the one
+	// recorded, as if it had been updated in the working directory
+	sub, err := gogit.PlainInit(filepath.Join(tmp, "sub"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(tmp, "sub", "deploy.yaml"), []byte("changed: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	subWorking, err := sub.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = subWorking.Add("deploy.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = subWorking.Commit("submodule commit", &gogit.CommitOptions{
+		Author: &object.Signature{Name: "Testbot", Email: "test@example.com", When: time.Now()},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	index, err := repo.Storer.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := index.Add("sub")
+	entry.Mode = filemode.Submodule
+	entry.Hash = plumbing.NewHash("0123456789abcdef0123456789abcdef01234567")
+	if err = repo.Storer.SetIndex(index); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(filepath.Join(tmp, "yes/deploy.yaml"), []byte("changed: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := changedFiles(logr.Discard(), repo, tmp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"yes/deploy.yaml"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected changed files %v, got %v", expected, files)
+	}
+}
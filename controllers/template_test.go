@@ -0,0 +1,362 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	imagev1_reflect "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+	"github.com/fluxcd/pkg/apis/meta"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+	"github.com/fluxcd/image-automation-controller/pkg/update"
+)
+
+// fakeImageRef is just enough of an update.ImageRef for templates
+// that look up policies.
+type fakeImageRef struct {
+	name   string
+	policy types.NamespacedName
+}
+
+func (r fakeImageRef) String() string               { return r.name }
+func (r fakeImageRef) Identifier() string           { return "" }
+func (r fakeImageRef) Repository() string           { return "" }
+func (r fakeImageRef) Registry() string             { return "" }
+func (r fakeImageRef) Name() string                 { return r.name }
+func (r fakeImageRef) Policy() types.NamespacedName { return r.policy }
+
+func TestTemplatePolicyMetadata(t *testing.T) {
+	ref := fakeImageRef{
+		name:   "app:v1.0.1",
+		policy: types.NamespacedName{Namespace: "apps", Name: "app"},
+	}
+	result := update.Result{
+		Files: map[string]update.FileResult{
+			"deploy.yaml": {
+				Objects: map[update.ObjectIdentifier][]update.ImageRef{
+					{}: {ref},
+				},
+			},
+		},
+	}
+	policies := []imagev1_reflect.ImagePolicy{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "apps",
+				Name:        "unused",
+				Labels:      map[string]string{"team": "other"},
+				Annotations: map[string]string{},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "apps",
+				Name:        "app",
+				Labels:      map[string]string{"team": "platform"},
+				Annotations: map[string]string{"ticket": "OPS-123"},
+			},
+		},
+	}
+
+	data := TemplateData{
+		Updated:  result,
+		Policies: policiesUsed(result, policies),
+	}
+	if len(data.Policies) != 1 || data.Policies[0].Name != "app" {
+		t.Fatalf("expected only the policy used in the update, got %v", data.Policies)
+	}
+
+	msg, err := templateMsg(`{{ range .Updated.Images }}{{ . }} ({{ ($.Policy .).Labels.team }}, {{ ($.Policy .).Annotations.ticket }}){{ end }}`, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "app:v1.0.1 (platform, OPS-123)"; msg != expected {
+		t.Errorf("expected message %q, got %q", expected, msg)
+	}
+}
+
+func TestValidateMessageTemplate(t *testing.T) {
+	for _, c := range []struct {
+		name, template string
+		valid          bool
+	}{
+		{"default", "", true},
+		{"fields and methods", "Update {{ .AutomationObject }}\n{{ range .Updated.Images }}{{ . }}{{ end }}{{ range .Changed.Files }}{{ . }}{{ end }}", true},
+		{"syntax error", "Update\n{{ range .Updated.Images }}", false},
+		{"unknown function", "{{ nope .AutomationObject }}", false},
+		{"unknown field", "{{ .Automation }}", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateCommitTemplates("", c.template, TemplateData{})
+			if c.valid && err != nil {
+				t.Errorf("expected template to be valid, got %v", err)
+			}
+			if !c.valid && err == nil {
+				t.Error("expected template to be invalid")
+			}
+		})
+	}
+}
+
+func TestGetMessageTemplate(t *testing.T) {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "flux-system",
+			Name:      "templates",
+		},
+		Data: map[string]string{
+			"messageTemplate": "Shared template",
+			"other":           "Other template",
+		},
+	}
+	r := &ImageUpdateAutomationReconciler{
+		Client: fake.NewClientBuilder().WithObjects(configMap).Build(),
+	}
+
+	for _, c := range []struct {
+		name     string
+		commit   imagev1.CommitSpec
+		expected string
+		fails    bool
+	}{
+		{"inline", imagev1.CommitSpec{MessageTemplate: "Inline template"}, "Inline template", false},
+		{"default key", imagev1.CommitSpec{MessageTemplateFrom: &imagev1.MessageTemplateReference{
+			ConfigMapRef: meta.NamespacedObjectReference{Namespace: "flux-system", Name: "templates"},
+		}}, "Shared template", false},
+		{"given key", imagev1.CommitSpec{MessageTemplateFrom: &imagev1.MessageTemplateReference{
+			ConfigMapRef: meta.NamespacedObjectReference{Namespace: "flux-system", Name: "templates"},
+			Key:          "other",
+		}}, "Other template", false},
+		{"missing key", imagev1.CommitSpec{MessageTemplateFrom: &imagev1.MessageTemplateReference{
+			ConfigMapRef: meta.NamespacedObjectReference{Namespace: "flux-system", Name: "templates"},
+			Key:          "missing",
+		}}, "", true},
+		{"same namespace by default", imagev1.CommitSpec{MessageTemplateFrom: &imagev1.MessageTemplateReference{
+			ConfigMapRef: meta.NamespacedObjectReference{Name: "templates"},
+		}}, "", true},
+		{"both given", imagev1.CommitSpec{MessageTemplate: "Inline template", MessageTemplateFrom: &imagev1.MessageTemplateReference{
+			ConfigMapRef: meta.NamespacedObjectReference{Namespace: "flux-system", Name: "templates"},
+		}}, "", true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			auto := &imagev1.ImageUpdateAutomation{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: "auto"},
+				Spec: imagev1.ImageUpdateAutomationSpec{
+					GitSpec: &imagev1.GitSpec{Commit: c.commit},
+				},
+			}
+			messageTemplate, err := r.getMessageTemplate(context.TODO(), auto)
+			if c.fails {
+				if err == nil {
+					t.Errorf("expected an error, got template %q", messageTemplate)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if messageTemplate != c.expected {
+				t.Errorf("expected template %q, got %q", c.expected, messageTemplate)
+			}
+		})
+	}
+}
+
+func TestGetCommitAuthor(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "tenant",
+			Name:      "bot",
+		},
+		Data: map[string][]byte{
+			"name":  []byte("Flux"),
+			"email": []byte("12345+flux@users.noreply.github.com\n"),
+		},
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "flux-system",
+			Name:      "bot",
+		},
+		Data: map[string]string{
+			"email": "flux@example.com",
+		},
+	}
+	r := &ImageUpdateAutomationReconciler{
+		Client: fake.NewClientBuilder().WithObjects(secret, configMap).Build(),
+	}
+
+	for _, c := range []struct {
+		name     string
+		commit   imagev1.CommitSpec
+		expected imagev1.CommitUser
+		fails    bool
+	}{
+		{"inline", imagev1.CommitSpec{Author: imagev1.CommitUser{Name: "Flux", Email: "flux@example.com"}},
+			imagev1.CommitUser{Name: "Flux", Email: "flux@example.com"}, false},
+		{"neither given", imagev1.CommitSpec{}, imagev1.CommitUser{}, true},
+		{"secret", imagev1.CommitSpec{AuthorFrom: &imagev1.CommitAuthorReference{
+			SecretRef: &meta.LocalObjectReference{Name: "bot"},
+		}}, imagev1.CommitUser{Name: "Flux", Email: "12345+flux@users.noreply.github.com"}, false},
+		{"config map", imagev1.CommitSpec{AuthorFrom: &imagev1.CommitAuthorReference{
+			ConfigMapRef: &meta.NamespacedObjectReference{Namespace: "flux-system", Name: "bot"},
+		}}, imagev1.CommitUser{Email: "flux@example.com"}, false},
+		{"missing secret", imagev1.CommitSpec{AuthorFrom: &imagev1.CommitAuthorReference{
+			SecretRef: &meta.LocalObjectReference{Name: "missing"},
+		}}, imagev1.CommitUser{}, true},
+		{"no reference", imagev1.CommitSpec{AuthorFrom: &imagev1.CommitAuthorReference{}}, imagev1.CommitUser{}, true},
+		{"both given", imagev1.CommitSpec{Author: imagev1.CommitUser{Email: "flux@example.com"}, AuthorFrom: &imagev1.CommitAuthorReference{
+			SecretRef: &meta.LocalObjectReference{Name: "bot"},
+		}}, imagev1.CommitUser{}, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			auto := &imagev1.ImageUpdateAutomation{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "tenant", Name: "auto"},
+				Spec: imagev1.ImageUpdateAutomationSpec{
+					GitSpec: &imagev1.GitSpec{Commit: c.commit},
+				},
+			}
+			author, err := r.getCommitAuthor(context.TODO(), auto)
+			if c.fails {
+				if err == nil {
+					t.Errorf("expected an error, got author %v", author)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if author != c.expected {
+				t.Errorf("expected author %v, got %v", c.expected, author)
+			}
+		})
+	}
+}
+
+func TestGetImageRepositoryMetadata(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := imagev1_reflect.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	scanTime := metav1.Date(2021, 10, 1, 10, 0, 0, 0, time.UTC)
+	repo := &imagev1_reflect.ImageRepository{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "app"},
+		Status: imagev1_reflect.ImageRepositoryStatus{
+			CanonicalImageName: "index.docker.io/org/app",
+			LastScanResult: &imagev1_reflect.ScanResult{
+				TagCount: 12,
+				ScanTime: scanTime,
+			},
+		},
+	}
+	r := &ImageUpdateAutomationReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(repo).Build(),
+	}
+
+	ctx := logr.NewContext(context.TODO(), logr.Discard())
+	found := ImageRepositoryMetadata{Namespace: "apps", Name: "app"}
+	r.getImageRepositoryMetadata(ctx, &found)
+	if found.CanonicalImageName != "index.docker.io/org/app" || found.TagCount != 12 ||
+		found.LastScanTime == nil || !found.LastScanTime.Equal(&scanTime) {
+		t.Errorf("unexpected image repository metadata %+v", found)
+	}
+
+	missing := ImageRepositoryMetadata{Namespace: "apps", Name: "missing"}
+	r.getImageRepositoryMetadata(ctx, &missing)
+	if missing != (ImageRepositoryMetadata{Namespace: "apps", Name: "missing"}) {
+		t.Errorf("expected only the name of a missing image repository, got %+v", missing)
+	}
+}
+
+func TestCommitMessage(t *testing.T) {
+	data := TemplateData{
+		AutomationObject: types.NamespacedName{Namespace: "apps", Name: "automation"},
+	}
+	for _, c := range []struct {
+		name             string
+		subject, message string
+		max              int
+		expected         string
+	}{
+		{"default", "", "", 0, defaultMessageTemplate},
+		{"message only", "", "Update {{ .AutomationObject.Name }}\n\nBody\n", 0, "Update automation\n\nBody\n"},
+		{"long message subject", "", "Update images for automation {{ .AutomationObject }}\n\nBody", 20, "Update images for...\n\nBody"},
+		{"subject and body", "Update {{ .AutomationObject.Name }}", "Body\n", 0, "Update automation\n\nBody\n"},
+		{"subject only", "Update\n{{ .AutomationObject.Name }}\n", "", 0, "Update automation"},
+		{"long subject", "Update images for automation {{ .AutomationObject }}", "Body", 72, "Update images for automation apps/automation\n\nBody"},
+		{"truncated subject", "Update images for automation {{ .AutomationObject }}", "Body", 31, "Update images for automation...\n\nBody"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			msg, err := commitMessage(c.subject, c.message, c.max, &data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg != c.expected {
+				t.Errorf("expected message %q, got %q", c.expected, msg)
+			}
+		})
+	}
+}
+
+func TestAppendUpdatesTrailer(t *testing.T) {
+	ref := fakeImageRef{
+		name:   "app:v1.0.1",
+		policy: types.NamespacedName{Namespace: "apps", Name: "app"},
+	}
+	change := update.Change{
+		Setter:   "apps:app",
+		OldValue: "app:v1.0.0",
+		NewValue: "app:v1.0.1",
+		Image:    ref,
+	}
+	result := update.Result{
+		Files: map[string]update.FileResult{
+			"a.yaml": {Changes: []update.Change{change}},
+			"b.yaml": {Changes: []update.Change{change}},
+		},
+	}
+
+	msg, err := appendUpdatesTrailer("Update images\n", result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `Update images
+
+Flux-Image-Updates: [{"policy":"apps/app","old":"app:v1.0.0","new":"app:v1.0.1"}]
+`
+	if msg != expected {
+		t.Errorf("expected message %q, got %q", expected, msg)
+	}
+
+	msg, err = appendUpdatesTrailer("No updates", update.Result{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg != "No updates" {
+		t.Errorf("expected message to be unchanged when there are no updates, got %q", msg)
+	}
+}
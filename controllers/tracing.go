@@ -0,0 +1,66 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// tracer makes the spans for each stage of an automation run. It uses
+// the global tracer provider, which drops the spans unless an exporter
+// has been set up by main.
+var tracer = otel.Tracer("github.com/fluxcd/image-automation-controller/controllers")
+
+// The stages of an automation run that are given their own span.
+const (
+	getSourceSpan   = "get source"
+	cloneSpan       = "clone"
+	fetchSpan       = "fetch"
+	updateSpan      = "update"
+	commitSpan      = "commit"
+	pushSpan        = "push"
+	statusPatchSpan = "status patch"
+)
+
+// startRunSpan starts the span for a whole automation run, which
+// the spans for its stages are children of.
+func startRunSpan(ctx context.Context, automation types.NamespacedName) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "reconcile", trace.WithAttributes(
+		attribute.String("automation", automation.Name),
+		attribute.String("namespace", automation.Namespace),
+	))
+}
+
+// startSpan starts a span for a stage of an automation run. The
+// function returned ends the span, marking it as failed if given an
+// error.
+func startSpan(ctx context.Context, name string) (context.Context, func(error)) {
+	ctx, span := tracer.Start(ctx, name)
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
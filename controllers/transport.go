@@ -0,0 +1,496 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	libgit2 "github.com/libgit2/git2go/v31"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/fluxcd/source-controller/pkg/git"
+)
+
+// managedSSHProtocols are the URL schemes for which libgit2 uses its
+// SSH transport.
+var managedSSHProtocols = []string{"ssh", "ssh+git", "git+ssh"}
+
+// managedTransports holds the transports registered, which must not
+// be freed while libgit2 may use them; i.e., for the life of the
+// process.
+var managedTransports []*libgit2.RegisteredSmartTransport
+
+// managedSSH says whether the managed SSH transport is in use.
+var managedSSH bool
+
+// UseManagedSSHTransport has libgit2 use an SSH transport written in
+// Go for the clones, fetches and pushes of automation runs, in place
+// of libssh2. libssh2, and the callbacks it makes into Go for
+// credentials and host key checks, have been a source of crashes and
+// stalls when many runs connect at once; the Go transport does the
+// whole connection in Go, so runs connect independently of each
+// other.
+//
+// The transport keeps each connection open for the idle timeout given
+// after it was last used, so that the git operations of a run (and of
+// later runs, if the timeout is long enough) that use the same remote
+// host and credentials share one connection, rather than each making
+// its own. Zero means connections aren't kept.
+//
+// HTTP(S) remotes keep using libgit2's own transport: the Go HTTP
+// transport in this version of git2go can't push, and doesn't take
+// the certificate authority given in a GitRepository's secret.
+//
+// This must be called before any git operations, and only once.
+func UseManagedSSHTransport(idleTimeout time.Duration) error {
+	sshConnections.idleTimeout = idleTimeout
+	for _, protocol := range managedSSHProtocols {
+		transport, err := libgit2.NewRegisteredSmartTransport(protocol, false, newSSHSubtransport)
+		if err != nil {
+			return fmt.Errorf("unable to register managed SSH transport for %q: %w", protocol, err)
+		}
+		managedTransports = append(managedTransports, transport)
+	}
+	managedSSH = true
+	return nil
+}
+
+// The transport authenticates with the private key of the
+// GitRepository's secret. For the operations done here, credentials
+// are given to libgit2 as the private key itself (see
+// repoAccess.remoteCallbacks). Clones done with source-controller's
+// checkout supply credentials the transport can't read the key from,
+// so those clone from a URL made up for the purpose, which the
+// transport looks up to find the remote and its credentials.
+
+// isSSHURL reports whether the URL given is one the managed SSH
+// transport would be used for.
+func isSSHURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	for _, protocol := range managedSSHProtocols {
+		if u.Scheme == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// transportTargets holds the remotes standing behind made-up URLs, by
+// the host of the URL.
+var transportTargets = struct {
+	mu      sync.Mutex
+	targets map[string]repoAccess
+}{targets: make(map[string]repoAccess)}
+
+// transportURL gives the URL to clone from with source-controller's
+// checkout, and a function to call once the clone is done. This is
+// the URL of the remote, unless the managed SSH transport is in use
+// for it.
+func transportURL(access repoAccess) (string, func()) {
+	if !managedSSH || access.auth == nil || !isSSHURL(access.url) {
+		return access.url, func() {}
+	}
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return access.url, func() {}
+	}
+	host := "image-automation-" + hex.EncodeToString(nonce[:])
+	transportTargets.mu.Lock()
+	transportTargets.targets[host] = access
+	transportTargets.mu.Unlock()
+	return "ssh://" + host + "/repository", func() {
+		transportTargets.mu.Lock()
+		delete(transportTargets.targets, host)
+		transportTargets.mu.Unlock()
+	}
+}
+
+// sshIdentity is what the transport authenticates with.
+type sshIdentity struct {
+	user       string
+	privateKey []byte
+	passphrase string
+}
+
+// poolKey gives the key under which a connection to the address given
+// with this identity is kept. It holds a digest of the private key, so
+// that a connection is only reused with the key it was made with.
+func (id sshIdentity) poolKey(addr string) string {
+	digest := sha256.New()
+	digest.Write(id.privateKey)
+	digest.Write([]byte{0})
+	digest.Write([]byte(id.passphrase))
+	return fmt.Sprintf("%s@%s/%x", id.user, addr, digest.Sum(nil))
+}
+
+func (id sshIdentity) clientConfig() (*ssh.ClientConfig, error) {
+	var signer ssh.Signer
+	var err error
+	if id.passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(id.privateKey, []byte(id.passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(id.privateKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.ClientConfig{
+		User: id.user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+	}, nil
+}
+
+// sshConnections holds the connections of the managed SSH transport.
+var sshConnections = newSSHPool()
+
+// sshPool keeps SSH connections open for reuse, by the address and
+// identity they were made with.
+type sshPool struct {
+	idleTimeout time.Duration
+
+	mu    sync.Mutex
+	conns map[string]*sshConn
+}
+
+// sshConn is a connection made by an sshPool.
+type sshConn struct {
+	key     string
+	client  *ssh.Client
+	hostKey ssh.PublicKey
+	// pooled says whether the connection is kept in the pool; one
+	// that isn't is closed once it's no longer used.
+	pooled bool
+	// users counts the git operations using the connection.
+	users int
+	// idle closes the connection, once it's been unused for the idle
+	// timeout.
+	idle *time.Timer
+}
+
+func newSSHPool() *sshPool {
+	return &sshPool{conns: make(map[string]*sshConn)}
+}
+
+// acquire gives the connection kept under the key given, or else one
+// made with dial, and whether it was reused. The connection must be
+// released when the caller is done with it.
+func (p *sshPool) acquire(key string, dial func() (*ssh.Client, ssh.PublicKey, error)) (*sshConn, bool, error) {
+	p.mu.Lock()
+	if conn, ok := p.conns[key]; ok {
+		conn.users++
+		if conn.idle != nil {
+			conn.idle.Stop()
+			conn.idle = nil
+		}
+		p.mu.Unlock()
+		return conn, true, nil
+	}
+	p.mu.Unlock()
+
+	// dialling can take a while, so it's done without holding the
+	// lock; if another connection is kept under the key meanwhile,
+	// this one is used just the once
+	client, hostKey, err := dial()
+	if err != nil {
+		return nil, false, err
+	}
+	conn := &sshConn{key: key, client: client, hostKey: hostKey, users: 1}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.conns[key]; !ok && p.idleTimeout > 0 {
+		conn.pooled = true
+		p.conns[key] = conn
+	}
+	return conn, false, nil
+}
+
+// release gives back a connection acquired from the pool. A connection
+// no longer used is closed after the idle timeout, unless it's used
+// again before then.
+func (p *sshPool) release(conn *sshConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn.users--
+	if conn.users > 0 {
+		return
+	}
+	if !conn.pooled {
+		conn.client.Close()
+		return
+	}
+	conn.idle = time.AfterFunc(p.idleTimeout, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if conn.users == 0 && p.conns[conn.key] == conn {
+			delete(p.conns, conn.key)
+			conn.client.Close()
+		}
+	})
+}
+
+// discard stops the connection given from being reused, e.g., because
+// it has been closed by the remote. It's closed once it's released by
+// those using it.
+func (p *sshPool) discard(conn *sshConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns[conn.key] == conn {
+		delete(p.conns, conn.key)
+	}
+	conn.pooled = false
+}
+
+// sshSubtransport carries the git protocol for libgit2 over a session
+// on a connection from sshConnections.
+type sshSubtransport struct {
+	transport *libgit2.Transport
+
+	conn       *sshConn
+	session    *ssh.Session
+	stdin      io.WriteCloser
+	stdout     io.Reader
+	lastAction libgit2.SmartServiceAction
+	stream     *sshStream
+}
+
+func newSSHSubtransport(_ *libgit2.Remote, transport *libgit2.Transport) (libgit2.SmartSubtransport, error) {
+	return &sshSubtransport{transport: transport}, nil
+}
+
+func (t *sshSubtransport) Action(rawURL string, action libgit2.SmartServiceAction) (libgit2.SmartSubtransportStream, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var command string
+	switch action {
+	case libgit2.SmartServiceActionUploadpackLs, libgit2.SmartServiceActionUploadpack:
+		if t.stream != nil {
+			if t.lastAction == libgit2.SmartServiceActionUploadpackLs {
+				return t.stream, nil
+			}
+			t.Close()
+		}
+		command = "git-upload-pack"
+	case libgit2.SmartServiceActionReceivepackLs, libgit2.SmartServiceActionReceivepack:
+		if t.stream != nil {
+			if t.lastAction == libgit2.SmartServiceActionReceivepackLs {
+				return t.stream, nil
+			}
+			t.Close()
+		}
+		command = "git-receive-pack"
+	default:
+		return nil, fmt.Errorf("unexpected action: %v", action)
+	}
+
+	u, id, err := t.target(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	if err := t.openSession(u.Hostname(), addr, id); err != nil {
+		return nil, err
+	}
+	if err := t.session.Start(fmt.Sprintf("%s %q", command, u.Path)); err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.lastAction = action
+	t.stream = &sshStream{owner: t}
+	return t.stream, nil
+}
+
+// target gives the remote URL and the identity to use for the URL
+// libgit2 gives, which may be a made-up one.
+func (t *sshSubtransport) target(rawURL string) (*url.URL, sshIdentity, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, sshIdentity{}, err
+	}
+
+	transportTargets.mu.Lock()
+	access, ok := transportTargets.targets[u.Host]
+	transportTargets.mu.Unlock()
+	if ok {
+		if u, err = url.Parse(access.url); err != nil {
+			return nil, sshIdentity{}, err
+		}
+		return u, sshIdentity{
+			user:       access.auth.Username,
+			privateKey: access.auth.Identity,
+			passphrase: access.auth.Password,
+		}, nil
+	}
+
+	cred, err := t.transport.SmartCredentials(u.User.Username(), libgit2.CredentialTypeSSHKey|libgit2.CredentialTypeSSHMemory)
+	if err != nil {
+		return nil, sshIdentity{}, err
+	}
+	defer cred.Free()
+	user, _, privateKey, passphrase, err := cred.GetSSHKey()
+	if err != nil {
+		return nil, sshIdentity{}, fmt.Errorf("the managed SSH transport needs a private key: %w", err)
+	}
+	id := sshIdentity{user: user, privateKey: []byte(privateKey), passphrase: passphrase}
+	if cred.Type() == libgit2.CredentialTypeSSHKey {
+		// the key is given as the path to a file
+		if id.privateKey, err = os.ReadFile(privateKey); err != nil {
+			return nil, sshIdentity{}, err
+		}
+	}
+	return u, id, nil
+}
+
+// openSession opens a session on a connection to the address given,
+// reusing a connection if there's one open. The host key of a
+// connection reused is checked again, since the check may be
+// different for this operation than for the one that made it.
+func (t *sshSubtransport) openSession(hostname, addr string, id sshIdentity) error {
+	dial := func() (*ssh.Client, ssh.PublicKey, error) {
+		config, err := id.clientConfig()
+		if err != nil {
+			return nil, nil, err
+		}
+		var hostKey ssh.PublicKey
+		config.HostKeyCallback = func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return t.checkHostKey(hostname, key)
+		}
+		client, err := ssh.Dial("tcp", addr, config)
+		return client, hostKey, err
+	}
+
+	key := id.poolKey(addr)
+	conn, reused, err := sshConnections.acquire(key, dial)
+	if err != nil {
+		return err
+	}
+	if reused {
+		if err := t.checkHostKey(hostname, conn.hostKey); err != nil {
+			sshConnections.release(conn)
+			return err
+		}
+	}
+	session, err := conn.client.NewSession()
+	if err != nil && reused {
+		// the connection has most likely been closed at the other
+		// end since it was last used; a new one is made
+		sshConnections.discard(conn)
+		sshConnections.release(conn)
+		if conn, _, err = sshConnections.acquire(key, dial); err != nil {
+			return err
+		}
+		session, err = conn.client.NewSession()
+	}
+	if err != nil {
+		sshConnections.release(conn)
+		return err
+	}
+	t.conn = conn
+	t.session = session
+	if t.stdin, err = session.StdinPipe(); err != nil {
+		t.Close()
+		return err
+	}
+	if t.stdout, err = session.StdoutPipe(); err != nil {
+		t.Close()
+		return err
+	}
+	return nil
+}
+
+// checkHostKey checks the host key given with the certificate check
+// of the operation.
+func (t *sshSubtransport) checkHostKey(hostname string, key ssh.PublicKey) error {
+	if key == nil {
+		return errors.New("no host key")
+	}
+	marshaled := key.Marshal()
+	cert := &libgit2.Certificate{
+		Kind: libgit2.CertificateHostkey,
+		Hostkey: libgit2.HostkeyCertificate{
+			Kind:         libgit2.HostkeySHA1 | libgit2.HostkeyMD5 | libgit2.HostkeySHA256 | libgit2.HostkeyRaw,
+			HashMD5:      md5.Sum(marshaled),
+			HashSHA1:     sha1.Sum(marshaled),
+			HashSHA256:   sha256.Sum256(marshaled),
+			Hostkey:      marshaled,
+			SSHPublicKey: key,
+		},
+	}
+	return t.transport.SmartCertificateCheck(cert, true, hostname)
+}
+
+// Close ends the session, and gives back the connection it was on.
+func (t *sshSubtransport) Close() error {
+	t.stream = nil
+	if t.session != nil {
+		if t.stdin != nil {
+			t.stdin.Close()
+		}
+		t.session.Wait()
+		t.session.Close()
+		t.session, t.stdin, t.stdout = nil, nil, nil
+	}
+	if t.conn != nil {
+		sshConnections.release(t.conn)
+		t.conn = nil
+	}
+	return nil
+}
+
+func (t *sshSubtransport) Free() {}
+
+type sshStream struct {
+	owner *sshSubtransport
+}
+
+func (s *sshStream) Read(buf []byte) (int, error) {
+	return s.owner.stdout.Read(buf)
+}
+
+func (s *sshStream) Write(buf []byte) (int, error) {
+	return s.owner.stdin.Write(buf)
+}
+
+func (s *sshStream) Free() {}
+
+// sshMemoryCredentials gives credentials for the managed SSH
+// transport, which can read the private key from them.
+func sshMemoryCredentials(auth *git.AuthOptions) libgit2.CredentialsCallback {
+	return func(_ string, _ string, _ libgit2.CredentialType) (*libgit2.Credential, error) {
+		return libgit2.NewCredentialSSHKeyFromMemory(auth.Username, "", string(auth.Identity), auth.Password)
+	}
+}
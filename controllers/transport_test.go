@@ -0,0 +1,142 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startSSHServer starts an SSH server that accepts any client, and
+// refuses any channel opened.
+func startSSHServer(t *testing.T) string {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for ch := range chans {
+					ch.Reject(ssh.Prohibited, "no channels")
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestSSHPool(t *testing.T) {
+	addr := startSSHServer(t)
+	dials := 0
+	dial := func() (*ssh.Client, ssh.PublicKey, error) {
+		dials++
+		var hostKey ssh.PublicKey
+		client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User: "git",
+			HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+				hostKey = key
+				return nil
+			},
+		})
+		return client, hostKey, err
+	}
+
+	p := newSSHPool()
+	p.idleTimeout = 50 * time.Millisecond
+
+	first, reused, err := p.acquire("key", dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused || first.hostKey == nil {
+		t.Errorf("expected a new connection, with its host key recorded")
+	}
+	p.release(first)
+
+	second, reused, err := p.acquire("key", dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reused || second != first || dials != 1 {
+		t.Errorf("expected the connection to be reused within the idle timeout (dials: %d)", dials)
+	}
+	other, reused, err := p.acquire("other", dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused || dials != 2 {
+		t.Errorf("expected a connection for a different key to be made (dials: %d)", dials)
+	}
+	p.release(other)
+
+	// a connection in use isn't closed when idle ones are
+	time.Sleep(150 * time.Millisecond)
+	if _, _, err := second.client.SendRequest("keepalive", true, nil); err != nil {
+		t.Errorf("expected the connection in use to be open: %v", err)
+	}
+	p.release(second)
+
+	time.Sleep(150 * time.Millisecond)
+	if _, _, err := second.client.SendRequest("keepalive", true, nil); err == nil {
+		t.Errorf("expected the connection to be closed after the idle timeout")
+	}
+	third, reused, err := p.acquire("key", dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused || dials != 3 {
+		t.Errorf("expected a new connection after the idle timeout (dials: %d)", dials)
+	}
+
+	// a connection discarded isn't reused, and is closed once
+	// released
+	p.discard(third)
+	p.release(third)
+	if _, _, err := third.client.SendRequest("keepalive", true, nil); err == nil {
+		t.Errorf("expected the discarded connection to be closed once released")
+	}
+	if _, reused, err := p.acquire("key", dial); err != nil || reused {
+		t.Errorf("expected a new connection in place of the one discarded (%v)", err)
+	}
+}
@@ -1000,6 +1000,10 @@ func expectCommittedAndPushed(conditions []metav1.Condition) {
 	rc := apimeta.FindStatusCondition(conditions, meta.ReadyCondition)
 	Expect(rc).ToNot(BeNil())
 	Expect(rc.Message).To(ContainSubstring("committed and pushed"))
+	pc := apimeta.FindStatusCondition(conditions, imagev1.PushedCondition)
+	Expect(pc).ToNot(BeNil())
+	Expect(pc.Status).To(Equal(metav1.ConditionTrue))
+	Expect(pc.Reason).To(Equal(imagev1.PushSucceededReason))
 }
 
 func replaceMarker(path string, policyKey types.NamespacedName) error {
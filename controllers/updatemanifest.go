@@ -0,0 +1,173 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+	"github.com/fluxcd/image-automation-controller/pkg/update"
+)
+
+// An automation with .spec.git.commit.updateManifest records the
+// updates in each commit it makes in a file in the repository, along
+// with the updates already there. The record is in the content of the
+// repository rather than in commit messages, so it survives commits
+// being squashed or rebased. A commit can't give its own hash, so each
+// entry gives the commit it was made on top of instead.
+
+// defaultUpdateManifestPath is where the updates are recorded, if the
+// automation doesn't say.
+const defaultUpdateManifestPath = ".flux/image-updates.yaml"
+
+// updateManifestHeader is written at the top of the file, for anyone
+// who comes across it without knowing where it came from.
+const updateManifestHeader = "# The updates committed by Flux image update automation. This file\n" +
+	"# is rewritten by the automation; changes made to it may be lost.\n"
+
+// UpdateManifest is the form of the file recording updates.
+type UpdateManifest struct {
+	// Updates lists an entry for each commit, oldest first.
+	Updates []UpdateManifestEntry `yaml:"updates"`
+}
+
+// UpdateManifestEntry records the updates made by a commit.
+type UpdateManifestEntry struct {
+	// Time is when the commit was made.
+	Time time.Time `yaml:"time"`
+	// Automation is the namespace and name of the automation that
+	// made the commit.
+	Automation string `yaml:"automation"`
+	// ParentCommit is the commit on top of which the commit was made.
+	ParentCommit string `yaml:"parentCommit,omitempty"`
+	// Changes lists each field value changed by the commit.
+	Changes []UpdateManifestChange `yaml:"changes"`
+}
+
+// UpdateManifestChange records a field value changed by an update.
+type UpdateManifestChange struct {
+	// File is the file changed, relative to the root of the
+	// repository.
+	File string `yaml:"file"`
+	// Policy is the namespace and name of the image policy that gave
+	// the new value.
+	Policy   string `yaml:"policy"`
+	OldValue string `yaml:"oldValue"`
+	NewValue string `yaml:"newValue"`
+}
+
+// updateManifestPath gives the path, relative to the root of the
+// repository, of the file recording updates.
+func updateManifestPath(p string) string {
+	if p == "" {
+		p = defaultUpdateManifestPath
+	}
+	return repoPath(p)
+}
+
+// updateManifestDir gives the directory, relative to the root of the
+// repository, of the file recording updates; the root itself is "".
+func updateManifestDir(p string) string {
+	return repoPath(path.Dir(updateManifestPath(p)))
+}
+
+// updateManifestEntry gives the entry recording the updates in the
+// result given. The file names in the result are relative to the
+// directory given, which is itself relative to the root of the
+// repository.
+func updateManifestEntry(automation types.NamespacedName, parent string, now time.Time, result update.Result, root string) UpdateManifestEntry {
+	entry := UpdateManifestEntry{
+		Time:         now.UTC().Truncate(time.Second),
+		Automation:   automation.String(),
+		ParentCommit: parent,
+	}
+	files := make([]string, 0, len(result.Files))
+	for file := range result.Files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		for _, change := range result.Files[file].Changes {
+			policy := change.Image.Policy()
+			entry.Changes = append(entry.Changes, UpdateManifestChange{
+				File:     path.Join(root, filepath.ToSlash(file)),
+				Policy:   policy.String(),
+				OldValue: change.OldValue,
+				NewValue: change.NewValue,
+			})
+		}
+	}
+	return entry
+}
+
+// writeUpdateManifest adds the entry given to the file recording
+// updates in the working directory given, creating the file if it's
+// not there, and dropping the oldest entries if there are more than
+// the maximum given (unless that's zero).
+func writeUpdateManifest(workDir, manifestPath string, maxEntries int, entry UpdateManifestEntry) error {
+	abspath := filepath.Join(workDir, filepath.FromSlash(manifestPath))
+	var manifest UpdateManifest
+	existing, err := os.ReadFile(abspath)
+	switch {
+	case err == nil:
+		if err := yaml.Unmarshal(existing, &manifest); err != nil {
+			return fmt.Errorf("unable to parse the update manifest %s: %w", manifestPath, err)
+		}
+	case os.IsNotExist(err):
+		if err := os.MkdirAll(filepath.Dir(abspath), 0755); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	manifest.Updates = append(manifest.Updates, entry)
+	if maxEntries > 0 && len(manifest.Updates) > maxEntries {
+		manifest.Updates = manifest.Updates[len(manifest.Updates)-maxEntries:]
+	}
+
+	var b bytes.Buffer
+	b.WriteString(updateManifestHeader)
+	enc := yaml.NewEncoder(&b)
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(abspath, b.Bytes(), 0644)
+}
+
+// resultRoot gives the directory, relative to the root of the
+// repository, that the file names in the result of a run with the
+// update strategies given are relative to. They are relative to the
+// root unless there's a single strategy with a single path.
+func resultRoot(strategies []*imagev1.UpdateStrategy) string {
+	if len(strategies) == 1 && len(strategies[0].Paths) == 0 && len(strategies[0].Stages) == 0 {
+		return repoPath(strategies[0].Path)
+	}
+	return ""
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	imagev1 "github.com/fluxcd/image-automation-controller/api/v1beta1"
+	"github.com/fluxcd/image-automation-controller/pkg/update"
+)
+
+func TestUpdateManifestPath(t *testing.T) {
+	for given, expected := range map[string][2]string{
+		"":                 {".flux/image-updates.yaml", ".flux"},
+		"./updates.yaml":   {"updates.yaml", ""},
+		"/audit/log.yaml":  {"audit/log.yaml", "audit"},
+		"a/b/updates.yaml": {"a/b/updates.yaml", "a/b"},
+	} {
+		if p, dir := updateManifestPath(given), updateManifestDir(given); p != expected[0] || dir != expected[1] {
+			t.Errorf("expected %q to give path %q in %q, got %q in %q", given, expected[0], expected[1], p, dir)
+		}
+	}
+}
+
+func TestResultRoot(t *testing.T) {
+	single := &imagev1.UpdateStrategy{Path: "./clusters/prod/"}
+	if root := resultRoot([]*imagev1.UpdateStrategy{single}); root != "clusters/prod" {
+		t.Errorf("expected files to be relative to the path, got %q", root)
+	}
+	multiple := &imagev1.UpdateStrategy{Paths: []imagev1.UpdatePath{{Path: "./apps"}}}
+	if root := resultRoot([]*imagev1.UpdateStrategy{multiple}); root != "" {
+		t.Errorf("expected files to be relative to the root with paths, got %q", root)
+	}
+	if root := resultRoot([]*imagev1.UpdateStrategy{single, single}); root != "" {
+		t.Errorf("expected files to be relative to the root with more than one strategy, got %q", root)
+	}
+}
+
+func TestWriteUpdateManifest(t *testing.T) {
+	ref := fakeImageRef{
+		name:   "app:v1.0.1",
+		policy: types.NamespacedName{Namespace: "apps", Name: "app"},
+	}
+	result := update.Result{
+		Files: map[string]update.FileResult{
+			"deploy.yaml": {Changes: []update.Change{
+				{Setter: "apps:app", OldValue: "app:v1.0.0", NewValue: "app:v1.0.1", Image: ref},
+			}},
+		},
+	}
+	automation := types.NamespacedName{Namespace: "apps", Name: "podinfo"}
+	now := time.Date(2021, 7, 1, 12, 0, 0, 500, time.UTC)
+
+	tmp := t.TempDir()
+	manifestPath := updateManifestPath("")
+	for i, parent := range []string{"abc123", "def456", "fed789"} {
+		entry := updateManifestEntry(automation, parent, now.Add(time.Duration(i)*time.Hour), result, "clusters/prod")
+		if err := writeUpdateManifest(tmp, manifestPath, 2, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	written, err := os.ReadFile(filepath.Join(tmp, ".flux", "image-updates.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(written), updateManifestHeader) {
+		t.Errorf("expected the file to start with the header, got:\n%s", written)
+	}
+	var manifest UpdateManifest
+	if err := yaml.Unmarshal(written, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Updates) != 2 || manifest.Updates[0].ParentCommit != "def456" || manifest.Updates[1].ParentCommit != "fed789" {
+		t.Fatalf("expected the two newest entries to be kept, got %+v", manifest.Updates)
+	}
+	entry := manifest.Updates[1]
+	if !entry.Time.Equal(time.Date(2021, 7, 1, 14, 0, 0, 0, time.UTC)) || entry.Automation != "apps/podinfo" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	expected := UpdateManifestChange{File: "clusters/prod/deploy.yaml", Policy: "apps/app", OldValue: "app:v1.0.0", NewValue: "app:v1.0.1"}
+	if len(entry.Changes) != 1 || entry.Changes[0] != expected {
+		t.Errorf("expected changes [%+v], got %+v", expected, entry.Changes)
+	}
+
+	if err := os.WriteFile(filepath.Join(tmp, manifestPath), []byte("updates: {not: a list}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeUpdateManifest(tmp, manifestPath, 0, entry); err == nil {
+		t.Error("expected an error for a file that can't be parsed")
+	}
+}
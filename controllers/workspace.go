@@ -0,0 +1,248 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// workspacesDir is the directory, under the workspace directory given
+// to the controller (or the default temporary directory), in which
+// runs make their workspaces. Having a directory of its own means
+// sweeping it can't remove anything else on the volume.
+const workspacesDir = "image-automation-workspaces"
+
+// workspaces makes the directories that runs clone into, all under a
+// root directory of their own, and keeps track of those in use. A run
+// removes its directory when it's done; but if the controller is
+// killed mid-run (e.g., for using too much memory), the directory is
+// left behind, and these would eventually fill the disk. Sweeping
+// removes anything in the root that isn't in use.
+type workspaces struct {
+	root string
+	// maxSize is the most bytes a workspace may use; zero means no
+	// limit.
+	maxSize int64
+
+	// mu guards active, and is held while sweeping, so that a
+	// directory can't be made and then swept before it's recorded
+	// as in use.
+	mu     sync.Mutex
+	active map[string]struct{}
+}
+
+// newWorkspaces creates the root directory given, if necessary, for
+// workspaces to be made in, each using at most maxSize bytes.
+func newWorkspaces(root string, maxSize int64) (*workspaces, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create workspace directory: %w", err)
+	}
+	return &workspaces{root: root, maxSize: maxSize, active: make(map[string]struct{})}, nil
+}
+
+// create makes a directory for a run, with a name starting with the
+// prefix given. The function returned removes the directory; but if a
+// git operation on it was given up on (see runGitOperation), it's
+// kept, and counted as in use, until the operation is done with it.
+// Git operations run with the context returned are those counted (see
+// withGitOperations). A nil *workspaces makes the directory in the
+// default temporary directory, and doesn't keep track of it.
+func (w *workspaces) create(ctx context.Context, prefix string) (context.Context, string, func(), error) {
+	ctx = withGitOperations(ctx)
+	if w == nil {
+		dir, err := os.MkdirTemp("", prefix)
+		if err != nil {
+			return ctx, "", nil, err
+		}
+		return ctx, dir, func() {
+			whenGitOperationsDone(ctx, func() { os.RemoveAll(dir) })
+		}, nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	dir, err := os.MkdirTemp(w.root, prefix)
+	if err != nil {
+		return ctx, "", nil, err
+	}
+	w.active[dir] = struct{}{}
+	return ctx, dir, func() {
+		whenGitOperationsDone(ctx, func() {
+			os.RemoveAll(dir)
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			delete(w.active, dir)
+		})
+	}, nil
+}
+
+// gitOperationsKey is the key of the *gitOperations in the context
+// of a run.
+type gitOperationsKey struct{}
+
+// gitOperations counts the git operations going on in a run, so that
+// what they use -- the workspace, and the locks on the repository and
+// the branch pushed to -- isn't removed or given up from under one.
+type gitOperations struct {
+	mu      sync.Mutex
+	pending int
+	done    []func()
+}
+
+// withGitOperations gives a context in which the git operations run
+// are counted, or the context given if they already are.
+func withGitOperations(ctx context.Context) context.Context {
+	if gitOperationsFrom(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, gitOperationsKey{}, &gitOperations{})
+}
+
+// gitOperationsFrom gives the *gitOperations of the context given, or
+// nil if it has none.
+func gitOperationsFrom(ctx context.Context) *gitOperations {
+	ops, _ := ctx.Value(gitOperationsKey{}).(*gitOperations)
+	return ops
+}
+
+// whenGitOperationsDone calls the func given once the git operations
+// counted in the context given are done; at once, if none are going
+// on or they aren't counted.
+func whenGitOperationsDone(ctx context.Context, done func()) {
+	if ops := gitOperationsFrom(ctx); ops != nil {
+		ops.whenDone(done)
+		return
+	}
+	done()
+}
+
+// start counts an operation as going on.
+func (o *gitOperations) start() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pending++
+}
+
+// finish counts an operation as done, and calls the funcs given to
+// whenDone, in the order given, if it was the last.
+func (o *gitOperations) finish() {
+	o.mu.Lock()
+	o.pending--
+	var done []func()
+	if o.pending == 0 {
+		done, o.done = o.done, nil
+	}
+	o.mu.Unlock()
+	for _, f := range done {
+		f()
+	}
+}
+
+// whenDone calls the func given now if no operations are going on,
+// or else once the last of them finishes.
+func (o *gitOperations) whenDone(done func()) {
+	o.mu.Lock()
+	if o.pending > 0 {
+		o.done = append(o.done, done)
+		o.mu.Unlock()
+		return
+	}
+	o.mu.Unlock()
+	done()
+}
+
+// checkSize returns an error if the workspace given uses more than
+// the most a workspace may; e.g., because the repository cloned into
+// it is too large for the volume the workspaces are on.
+func (w *workspaces) checkSize(dir string) error {
+	if w == nil || w.maxSize <= 0 {
+		return nil
+	}
+	size, err := dirSize(dir)
+	if err != nil {
+		return err
+	}
+	if size > w.maxSize {
+		return fmt.Errorf("the working directory of the run uses %d bytes, more than the limit of %d bytes", size, w.maxSize)
+	}
+	return nil
+}
+
+// sweep removes everything in the root directory that isn't a
+// workspace in use, and gives the paths removed.
+func (w *workspaces) sweep() ([]string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	entries, err := os.ReadDir(w.root)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, entry := range entries {
+		path := filepath.Join(w.root, entry.Name())
+		if _, ok := w.active[path]; ok {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+// workspaceSweeper sweeps the workspaces when started, and then at
+// an interval, if it's more than zero.
+type workspaceSweeper struct {
+	workspaces *workspaces
+	interval   time.Duration
+}
+
+// Start sweeps until the context is done.
+func (s *workspaceSweeper) Start(ctx context.Context) error {
+	log := ctrl.Log.WithName("workspace-sweeper")
+	sweep := func(context.Context) {
+		removed, err := s.workspaces.sweep()
+		if len(removed) > 0 {
+			log.Info("removed workspaces left behind", "paths", removed)
+		}
+		if err != nil {
+			log.Error(err, "unable to sweep workspaces")
+		}
+	}
+	if s.interval <= 0 {
+		sweep(ctx)
+		<-ctx.Done()
+		return nil
+	}
+	wait.UntilWithContext(ctx, sweep, s.interval)
+	return nil
+}
+
+// NeedLeaderElection says that the sweeper runs whether or not this
+// instance is the leader, since the workspaces belong to it alone.
+func (s *workspaceSweeper) NeedLeaderElection() bool {
+	return false
+}
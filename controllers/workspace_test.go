@@ -0,0 +1,135 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestWorkspacesSweep(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "workspaces")
+	w, err := newWorkspaces(root, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a workspace left behind by a run that never finished
+	orphan := filepath.Join(root, "apps-repo123")
+	if err := os.MkdirAll(filepath.Join(orphan, "deploy"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	_, active, release, err := w.create(context.TODO(), "apps-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := w.sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, []string{orphan}) {
+		t.Errorf("expected only the workspace left behind to be removed, got %v", removed)
+	}
+	if _, err := os.Stat(active); err != nil {
+		t.Errorf("expected the workspace in use to be kept: %v", err)
+	}
+
+	release()
+	if _, err := os.Stat(active); !os.IsNotExist(err) {
+		t.Errorf("expected the workspace to be removed once released, got %v", err)
+	}
+	if removed, err := w.sweep(); err != nil || len(removed) != 0 {
+		t.Errorf("expected nothing to be left to sweep, got %v (%v)", removed, err)
+	}
+}
+
+func TestWorkspacesKeptForGitOperations(t *testing.T) {
+	w, err := newWorkspaces(filepath.Join(t.TempDir(), "workspaces"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, dir, release, err := w.create(context.TODO(), "apps-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an operation still writing to the workspace when it's given up on
+	opCtx, cancel := context.WithCancel(ctx)
+	unblock, finished := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(finished)
+		runGitOperation(opCtx, func() error {
+			<-unblock
+			return os.WriteFile(filepath.Join(dir, "late.yaml"), nil, 0o600)
+		})
+	}()
+	cancel()
+	<-finished
+	release()
+
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("expected the workspace to be kept while the operation is going on: %v", err)
+	}
+	if removed, err := w.sweep(); err != nil || len(removed) != 0 {
+		t.Errorf("expected the workspace not to be swept while the operation is going on, got %v (%v)", removed, err)
+	}
+
+	close(unblock)
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		_, err := os.Stat(dir)
+		return os.IsNotExist(err), nil
+	}); err != nil {
+		t.Error("expected the workspace to be removed once the operation is done")
+	}
+}
+
+func TestWorkspacesCheckSize(t *testing.T) {
+	w, err := newWorkspaces(filepath.Join(t.TempDir(), "workspaces"), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, dir, release, err := w.create(context.TODO(), "apps-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	if err := os.WriteFile(filepath.Join(dir, "small.yaml"), make([]byte, 512), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.checkSize(dir); err != nil {
+		t.Errorf("expected a workspace within the limit to pass, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "large.yaml"), make([]byte, 1024), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.checkSize(dir); err == nil {
+		t.Error("expected an error for a workspace over the limit")
+	}
+
+	var none *workspaces
+	if err := none.checkSize(dir); err != nil {
+		t.Errorf("expected no limit without workspaces, got %v", err)
+	}
+}
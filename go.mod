@@ -23,10 +23,18 @@ require (
 	github.com/go-logr/logr v0.4.0
 	github.com/google/go-containerregistry v0.6.0
 	github.com/libgit2/git2go/v31 v31.6.1
+	github.com/minio/minio-go/v7 v7.0.15
 	github.com/onsi/ginkgo v1.16.4
 	github.com/onsi/gomega v1.15.0
 	github.com/otiai10/copy v1.7.0
+	github.com/prometheus/client_golang v1.11.0
+	github.com/sergi/go-diff v1.1.0
 	github.com/spf13/pflag v1.0.5
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b
 	k8s.io/api v0.22.2
 	k8s.io/apimachinery v0.22.2
 	k8s.io/client-go v0.22.2
@@ -17,10 +17,18 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	flag "github.com/spf13/pflag"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -68,6 +76,34 @@ func main() {
 		leaderElectionOptions leaderelection.Options
 		watchAllNamespaces    bool
 		concurrent            int
+		requeueDependency     time.Duration
+		otlpEndpoint          string
+		otlpInsecure          bool
+		auditSinkAddr         string
+		reportSinkAddr        string
+		remoteProbeInterval   time.Duration
+		cloneCacheDir         string
+		cloneCacheMaxSize     int64
+		maxPushesPerHour      int
+		coalesceWindow        time.Duration
+		policyDebounce        time.Duration
+		maxFileSize           int64
+		maxDocuments          int
+		policyMetadataOnly    bool
+		prefetchLead          time.Duration
+		workspaceSweep        time.Duration
+		workspaceDir          string
+		workspaceMaxSize      int64
+		managedSSHTransport   bool
+		sshIdleTimeout        time.Duration
+		pushBackoff           time.Duration
+		maxPushBackoff        time.Duration
+		pushLeaseNamespace    string
+		webhookAddr           string
+		noCrossNamespaceRefs  bool
+		gcpWorkloadProvider   string
+		shardKeys             string
+		standbyShardKeys      string
 	)
 
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
@@ -75,7 +111,61 @@ func main() {
 	flag.StringVar(&healthAddr, "health-addr", ":9440", "The address the health endpoint binds to.")
 	flag.BoolVar(&watchAllNamespaces, "watch-all-namespaces", true,
 		"Watch for custom resources in all namespaces, if set to false it will only watch the runtime namespace.")
-	flag.IntVar(&concurrent, "concurrent", 4, "The number of concurrent resource reconciles.")
+	flag.IntVar(&concurrent, "concurrent", 4, "The number of automations that can be run concurrently. Automations that use the same GitRepository always take turns.")
+	flag.DurationVar(&requeueDependency, "requeue-dependency", 30*time.Second, "The interval at which failing dependencies are reevaluated.")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "",
+		"The address (host:port) of an OTLP gRPC receiver to which traces of automation runs are exported. Tracing is disabled when this is empty.")
+	flag.BoolVar(&otlpInsecure, "otlp-insecure", false, "Connect to the OTLP receiver without TLS.")
+	flag.StringVar(&auditSinkAddr, "audit-sink", "",
+		"Where to send a record of each push: the path of a file to append to, or an http(s) URL to POST to. No records are kept when this is empty.")
+	flag.StringVar(&reportSinkAddr, "report-sink", "",
+		"Where to send a JSON report of each automation run: an http(s) URL to POST to, or an s3://<endpoint>/<bucket>[/<prefix>] URL to write objects under. No reports are sent when this is empty.")
+	flag.DurationVar(&remoteProbeInterval, "git-probe-interval", 0,
+		"The interval at which the git repository of each automation is checked for being reachable with its credentials. Zero disables the checks.")
+	flag.StringVar(&cloneCacheDir, "clone-cache-dir", "",
+		"A directory (e.g., an emptyDir or persistent volume) in which to keep a copy of each git repository between runs, so that runs fetch only what's new. Each run clones afresh when this is empty.")
+	flag.Int64Var(&cloneCacheMaxSize, "clone-cache-max-size", 1<<30,
+		"The size in bytes beyond which the least recently used repositories are removed from the clone cache. Zero means no limit.")
+	flag.IntVar(&maxPushesPerHour, "max-pushes-per-hour", 0,
+		"The most pushes to make to any one git repository in an hour. Automations that would push more wait, and their updates are pushed together. Zero means no limit.")
+	flag.DurationVar(&coalesceWindow, "coalesce-window", 0,
+		"If more than zero, automations that use the same GitRepository and git settings are run together, in a single commit, and each run waits this long for others to join it. Zero turns this off.")
+	flag.DurationVar(&policyDebounce, "policy-debounce", 0,
+		"How long to wait after an image policy changes before running the automations it affects, so that changes to several policies are dealt with in one run.")
+	flag.Int64Var(&maxFileSize, "max-file-size", 10<<20,
+		"The size in bytes above which a file containing a marker is skipped in scanning a git repository for updates. Zero means no limit.")
+	flag.IntVar(&maxDocuments, "max-documents", 100000,
+		"The most YAML documents to parse in scanning a git repository for updates; files beyond that are skipped. Zero means no limit.")
+	flag.BoolVar(&policyMetadataOnly, "policy-watch-metadata-only", false,
+		"Watch and cache only the metadata of image policies, fetching the rest of a policy when it changes. This uses less memory when there are many image policies.")
+	flag.DurationVar(&prefetchLead, "prefetch-lead", 0,
+		"If more than zero, how long before each automation is due to run to fetch its git repository into the clone cache, so that the run itself has little to fetch. Needs --clone-cache-dir.")
+	flag.DurationVar(&workspaceSweep, "workspace-sweep-interval", 10*time.Minute,
+		"How often to remove the working directories of automation runs that are no longer going (e.g., because the controller was killed during them). They are also removed when the controller starts. Zero means only then.")
+	flag.StringVar(&workspaceDir, "workspace-dir", "",
+		"The directory (e.g., a persistent volume or a memory-backed emptyDir) in which automation runs clone git repositories. Defaults to the system's temporary directory.")
+	flag.Int64Var(&workspaceMaxSize, "workspace-max-size", 0,
+		"The most bytes the working directory of an automation run may use once the repository is checked out; a run using more fails. Zero means no limit.")
+	flag.BoolVar(&managedSSHTransport, "ssh-managed-transport", false,
+		"Use an SSH transport written in Go for git operations, rather than libssh2, so that automation runs connect to SSH remotes independently of each other.")
+	flag.DurationVar(&sshIdleTimeout, "ssh-connection-idle-timeout", time.Minute,
+		"With --ssh-managed-transport, how long to keep an SSH connection open after it was last used, so that later git operations with the same host and credentials (the fetch and push of a run, or later runs) reuse it. Zero means connections aren't kept.")
+	flag.DurationVar(&pushBackoff, "push-failure-backoff", 10*time.Second,
+		"How long to wait before trying again after a push fails. The wait doubles with each failure in a row, up to --max-push-failure-backoff.")
+	flag.DurationVar(&maxPushBackoff, "max-push-failure-backoff", 10*time.Minute,
+		"The longest to wait before trying again after pushes have failed repeatedly.")
+	flag.StringVar(&pushLeaseNamespace, "push-lease-namespace", "",
+		"If set, hold a Lease in this namespace for each branch pushed to, so that automations in other controllers (e.g., shards) pushing to the same branch take turns with those in this one. Usually the controller's own namespace.")
+	flag.StringVar(&webhookAddr, "webhook-addr", "",
+		"The address on which to serve signed requests to run an automation straight away (e.g., from a container registry or CI pipeline), at /hook/<namespace>/<name>. Requests are not served when this is empty.")
+	flag.BoolVar(&noCrossNamespaceRefs, "no-cross-namespace-refs", false,
+		"Refuse to run automations that refer to objects (e.g., dependencies or health gates) in other namespaces, so that tenants sharing a cluster can be kept apart.")
+	flag.StringVar(&gcpWorkloadProvider, "gcp-workload-identity-provider", "",
+		"The name of the workload identity provider (//iam.googleapis.com/projects/<number>/locations/global/workloadIdentityPools/<pool>/providers/<provider>) for the cluster's service accounts, with which automations giving a service account and a gcp identity get credentials.")
+	flag.StringVar(&shardKeys, "shard-keys", "",
+		"A comma-separated list of shard keys (the values of the label 'sharding.fluxcd.io/key' on automations; 'default' for those without it) for which to elect a leader with a Lease in the runtime namespace, in place of a single leader. Only the automations in the shards this controller leads are run here.")
+	flag.StringVar(&standbyShardKeys, "standby-shard-keys", "",
+		"A comma-separated list of shard keys for which this controller takes over once they have been without a leader for a lease duration; e.g., those listed in --shard-keys for other replicas.")
 	clientOptions.BindFlags(flag.CommandLine)
 	logOptions.BindFlags(flag.CommandLine)
 	leaderElectionOptions.BindFlags(flag.CommandLine)
@@ -84,6 +174,13 @@ func main() {
 	log := logger.NewLogger(logOptions)
 	ctrl.SetLogger(log)
 
+	if managedSSHTransport {
+		if err := controllers.UseManagedSSHTransport(sshIdleTimeout); err != nil {
+			setupLog.Error(err, "unable to use managed SSH transport")
+			os.Exit(1)
+		}
+	}
+
 	var eventRecorder *events.Recorder
 	if eventsAddr != "" {
 		if er, err := events.NewRecorder(eventsAddr, controllerName); err != nil {
@@ -94,21 +191,68 @@ func main() {
 		}
 	}
 
+	var tracerProvider *sdktrace.TracerProvider
+	if otlpEndpoint != "" {
+		tp, err := newTracerProvider(otlpEndpoint, otlpInsecure)
+		if err != nil {
+			setupLog.Error(err, "unable to create trace exporter")
+			os.Exit(1)
+		}
+		otel.SetTracerProvider(tp)
+		tracerProvider = tp
+	}
+
+	var auditSink controllers.AuditSink
+	if auditSinkAddr != "" {
+		if sink, err := controllers.NewAuditSink(auditSinkAddr); err != nil {
+			setupLog.Error(err, "unable to create audit sink")
+			os.Exit(1)
+		} else {
+			auditSink = sink
+		}
+	}
+
+	var reportSink controllers.ReportSink
+	if reportSinkAddr != "" {
+		if sink, err := controllers.NewReportSink(reportSinkAddr); err != nil {
+			setupLog.Error(err, "unable to create report sink")
+			os.Exit(1)
+		} else {
+			reportSink = sink
+		}
+	}
+
 	metricsRecorder := metrics.NewRecorder()
 	ctrlmetrics.Registry.MustRegister(metricsRecorder.Collectors()...)
+	automationMetrics := controllers.NewAutomationMetrics()
+	ctrlmetrics.Registry.MustRegister(automationMetrics.Collectors()...)
 
 	watchNamespace := ""
 	if !watchAllNamespaces {
 		watchNamespace = os.Getenv("RUNTIME_NAMESPACE")
 	}
 
+	// electing a leader for each shard takes the place of electing
+	// one for the whole controller
+	var shardElection *controllers.ShardElectionOptions
+	if shardKeys != "" || standbyShardKeys != "" {
+		shardElection = &controllers.ShardElectionOptions{
+			Shards:        splitList(shardKeys),
+			StandbyShards: splitList(standbyShardKeys),
+			Namespace:     os.Getenv("RUNTIME_NAMESPACE"),
+			LeaseDuration: leaderElectionOptions.LeaseDuration,
+			RenewDeadline: leaderElectionOptions.RenewDeadline,
+			RetryPeriod:   leaderElectionOptions.RetryPeriod,
+		}
+	}
+
 	restConfig := client.GetConfigOrDie(clientOptions)
 	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
 		Scheme:                        scheme,
 		MetricsBindAddress:            metricsAddr,
 		HealthProbeBindAddress:        healthAddr,
 		Port:                          9443,
-		LeaderElection:                leaderElectionOptions.Enable,
+		LeaderElection:                leaderElectionOptions.Enable && shardElection == nil,
 		LeaderElectionReleaseOnCancel: leaderElectionOptions.ReleaseOnCancel,
 		LeaseDuration:                 &leaderElectionOptions.LeaseDuration,
 		RenewDeadline:                 &leaderElectionOptions.RenewDeadline,
@@ -130,8 +274,32 @@ func main() {
 		EventRecorder:         mgr.GetEventRecorderFor(controllerName),
 		ExternalEventRecorder: eventRecorder,
 		MetricsRecorder:       metricsRecorder,
+		AutomationMetrics:     automationMetrics,
+		AuditSink:             auditSink,
+		ReportSink:            reportSink,
 	}).SetupWithManager(mgr, controllers.ImageUpdateAutomationReconcilerOptions{
-		MaxConcurrentReconciles: concurrent,
+		MaxConcurrentReconciles:     concurrent,
+		DependencyRequeueInterval:   requeueDependency,
+		RemoteProbeInterval:         remoteProbeInterval,
+		CloneCacheDir:               cloneCacheDir,
+		CloneCacheMaxSize:           cloneCacheMaxSize,
+		MaxPushesPerHour:            maxPushesPerHour,
+		CoalesceWindow:              coalesceWindow,
+		PolicyDebounce:              policyDebounce,
+		MaxFileSize:                 maxFileSize,
+		MaxDocuments:                maxDocuments,
+		MetadataOnlyPolicyWatch:     policyMetadataOnly,
+		PrefetchLead:                prefetchLead,
+		WorkspaceSweepInterval:      workspaceSweep,
+		WorkspaceDir:                workspaceDir,
+		WorkspaceMaxSize:            workspaceMaxSize,
+		PushFailureBackoff:          pushBackoff,
+		MaxPushFailureBackoff:       maxPushBackoff,
+		PushLeaseNamespace:          pushLeaseNamespace,
+		WebhookAddr:                 webhookAddr,
+		NoCrossNamespaceRefs:        noCrossNamespaceRefs,
+		GCPWorkloadIdentityProvider: gcpWorkloadProvider,
+		ShardElection:               shardElection,
 	}); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "ImageUpdateAutomation")
 		os.Exit(1)
@@ -139,8 +307,47 @@ func main() {
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	err = mgr.Start(ctrl.SetupSignalHandler())
+	if tracerProvider != nil {
+		// send any spans still buffered before exiting
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			setupLog.Error(err, "unable to flush traces")
+		}
+		cancel()
+	}
+	if err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
 }
+
+// splitList gives the non-empty, comma-separated items in the string
+// given.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// newTracerProvider creates a tracer provider that batches spans and
+// exports them to the OTLP receiver at the endpoint given.
+func newTracerProvider(endpoint string, insecure bool) (*sdktrace.TracerProvider, error) {
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(controllerName))),
+	), nil
+}
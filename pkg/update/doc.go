@@ -0,0 +1,58 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package update makes the changes to YAML files that image update
+// automation makes, so that other tools (e.g., command-line tools, or
+// admission controllers) can make exactly the same changes.
+//
+// Fields to update are marked with a comment naming an image policy,
+// optionally with a suffix saying which part of the image to use:
+//
+//	image: ghcr.io/stefanprodan/podinfo:5.0.0 # {"$imagepolicy": "flux-system:podinfo"}
+//	tag: 5.0.0 # {"$imagepolicy": "flux-system:podinfo:tag"}
+//
+// When a policy gives an image pinned to a digest (e.g.,
+// `podinfo:5.0.1@sha256:...`), a marker without a suffix gives the
+// image with the digest, and the suffix `:digest` gives the digest
+// alone. WithImageFormat, or the annotation ImageFormatAnnotation on
+// a policy, chooses whether such a marker writes the tag, the digest,
+// or both. The annotation AllowedPathsAnnotation on a policy
+// restricts the files in which its markers are heeded. With
+// WithDetectImages, image fields without a marker are updated too, if
+// the image they give is in the repository of a policy.
+//
+// The inputs to an update are a directory, the image policies that
+// can be referred to, and options (e.g., WithInclude) adjusting which
+// files are considered and how. Update changes the files in place;
+// UpdateWithSetters reads from one directory and writes to another:
+//
+//	result, err := update.Update("./clusters", policies,
+//		update.WithInclude("*.yaml"),
+//		update.WithMaxFileSize(1<<20))
+//
+// Only files with a value changed are written. The outcome is given
+// as a Result, which has the changes made in each file, and methods
+// giving them by object (Result.Objects) or by image
+// (Result.ImageUpdates), as well as the files left out of the update
+// and why (Result.Skipped).
+//
+// The functions, options and result types of this package are a
+// stable API: they will not change in ways that break callers, other
+// than with a new major version of the module. New options and new
+// fields in the result types may be added. ScreeningLocalReader and
+// SetAllCallback are the building blocks of an update and are exported
+// for use with kyaml directly; they are not covered by this promise.
+package update
@@ -18,10 +18,17 @@ package update
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
 	"github.com/go-logr/logr"
 	"sigs.k8s.io/kustomize/kyaml/kio"
 	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
@@ -37,12 +44,70 @@ import (
 type ScreeningLocalReader struct {
 	Token string
 	Path  string
+	// MarkerToken, if not empty, is the token that marks a field for
+	// update, when Token is broader than that. A file skipped is
+	// recorded as Marked if it contains MarkerToken (or Token, if
+	// MarkerToken is empty).
+	MarkerToken string
 
 	Trace logr.Logger
 
+	// Include, if not empty, gives glob patterns for the files to
+	// consider, relative to Path; see MatchGlob.
+	Include []string
+	// Exclude gives glob patterns for files to leave out, even if
+	// they match Include.
+	Exclude []string
+
+	// Ignore, if not nil, is used to leave out files and directories
+	// it matches. The paths given to the matcher are relative to
+	// IgnoreRoot, or to Path if IgnoreRoot is empty.
+	Ignore     gitignore.Matcher
+	IgnoreRoot string
+
+	// Only, if not nil, holds the only files to consider. The paths
+	// are slash-separated and relative to OnlyRoot, or to Path if
+	// OnlyRoot is empty.
+	Only     map[string]struct{}
+	OnlyRoot string
+
+	// Symlinks says what to do about a file that's a symlink to
+	// somewhere outside SymlinkRoot (or Path, if SymlinkRoot is
+	// empty); if empty, such files are skipped. Symlinks within it
+	// are followed.
+	Symlinks    SymlinkPolicy
+	SymlinkRoot string
+
+	// MaxFileSize, if more than zero, is the size in bytes above
+	// which a file is skipped without being parsed. Such a file is
+	// only looked through for the token, a piece at a time, and is
+	// passed over like any other if it doesn't contain it.
+	MaxFileSize int64
+	// MaxDocuments, if more than zero, limits the number of YAML
+	// documents parsed. Once it's reached, the remaining files are
+	// skipped.
+	MaxDocuments int
+
+	// Context, if not nil, is checked between one file and the next;
+	// once it's done, Read stops and returns its error.
+	Context context.Context
+
+	// relativePath is the directory the paths of the files read are
+	// relative to.
+	relativePath string
+	// modes holds the permissions of each file read, by relative
+	// path, so they can be given to the file when it's written.
+	modes map[string]os.FileMode
+
 	// This records the relative path of each file that passed
 	// screening (i.e., contained the token), but couldn't be parsed.
 	ProblemFiles []string
+	// This records each file skipped, because it couldn't be parsed
+	// or to bound the memory used, and why it was skipped.
+	Skipped []SkippedFile
+	// This records the relative path of each file that contained the
+	// token, or was skipped before it could be screened.
+	ScreenedFiles []string
 }
 
 // Read scans the .Path recursively for files that contain .Token, and
@@ -74,13 +139,41 @@ func (r *ScreeningLocalReader) Read() ([]*yaml.RNode, error) {
 	// or file yet so this must wait until the body of the filepath.Walk.
 	var relativePath string
 
-	tokenbytes := []byte(r.Token)
+	ignoreRoot := root
+	if r.IgnoreRoot != "" {
+		if ignoreRoot, err = filepath.Abs(r.IgnoreRoot); err != nil {
+			return nil, fmt.Errorf("ignore root cannot be made absolute: %w", err)
+		}
+	}
+	onlyRoot := root
+	if r.OnlyRoot != "" {
+		if onlyRoot, err = filepath.Abs(r.OnlyRoot); err != nil {
+			return nil, fmt.Errorf("only root cannot be made absolute: %w", err)
+		}
+	}
+	// Symlinks are resolved completely, so the root they're compared
+	// with must be as well.
+	symlinkRoot := root
+	if r.SymlinkRoot != "" {
+		if symlinkRoot, err = filepath.Abs(r.SymlinkRoot); err != nil {
+			return nil, fmt.Errorf("symlink root cannot be made absolute: %w", err)
+		}
+	}
+	if symlinkRoot, err = filepath.EvalSymlinks(symlinkRoot); err != nil {
+		return nil, fmt.Errorf("resolving symlink root: %w", err)
+	}
 
-	var result []*yaml.RNode
+	// The walk only collects the files to consider; reading,
+	// screening and parsing them is done by a pool of workers, since
+	// that is where the time goes in a large repository.
+	var files []screenedFile
 	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("walking path for files: %w", err)
 		}
+		if err := r.contextErr(); err != nil {
+			return err
+		}
 
 		if p == root {
 			if info.IsDir() {
@@ -90,6 +183,18 @@ func (r *ScreeningLocalReader) Read() ([]*yaml.RNode, error) {
 			relativePath = filepath.Dir(p)
 		}
 
+		if r.Ignore != nil {
+			if ignorePath, err := filepath.Rel(ignoreRoot, p); err == nil && ignorePath != "." {
+				if r.Ignore.Match(strings.Split(filepath.ToSlash(ignorePath), "/"), info.IsDir()) {
+					tracelog.Info("ignoring path", "path", ignorePath)
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+			}
+		}
+
 		if info.IsDir() {
 			return nil
 		}
@@ -98,44 +203,301 @@ func (r *ScreeningLocalReader) Read() ([]*yaml.RNode, error) {
 			return nil
 		}
 
-		// To check for the token, I need the file contents. This
-		// assumes the file is encoded as UTF8.
-		filebytes, err := os.ReadFile(p)
+		if r.Only != nil {
+			onlyPath, err := filepath.Rel(onlyRoot, p)
+			if err != nil {
+				return fmt.Errorf("relativising path: %w", err)
+			}
+			if _, ok := r.Only[filepath.ToSlash(onlyPath)]; !ok {
+				return nil
+			}
+		}
+
+		path, err := filepath.Rel(relativePath, p)
 		if err != nil {
-			return fmt.Errorf("reading YAML file: %w", err)
+			return fmt.Errorf("relativising path: %w", err)
 		}
 
-		if !bytes.Contains(filebytes, tokenbytes) {
+		if slashpath := filepath.ToSlash(path); (len(r.Include) > 0 && !matchAny(r.Include, slashpath)) || matchAny(r.Exclude, slashpath) {
+			tracelog.Info("skipping file excluded by patterns", "path", path)
 			return nil
 		}
 
-		path, err := filepath.Rel(relativePath, p)
-		if err != nil {
-			return fmt.Errorf("relativising path: %w", err)
+		file := screenedFile{abspath: p, path: path}
+		if info.Mode()&os.ModeSymlink != 0 {
+			// The walk doesn't follow symlinks, but reading (and
+			// later, writing) the file would; so a symlink that
+			// leads outside the tree is left alone, lest a file
+			// there be read or overwritten.
+			target, err := filepath.EvalSymlinks(p)
+			if err != nil {
+				tracelog.Info("skipping broken symlink", "path", path)
+				return nil
+			}
+			if !withinDir(symlinkRoot, target) {
+				if r.Symlinks == SymlinksFail {
+					return fmt.Errorf("%s is a symlink to %s, which is outside %s", path, target, symlinkRoot)
+				}
+				tracelog.Info("skipping symlink to outside the tree", "path", path, "target", target)
+				file.skipped = SkipSymlinkOutsideTree
+				files = append(files, file)
+				return nil
+			}
+			if info, err = os.Stat(target); err != nil {
+				return fmt.Errorf("following symlink: %w", err)
+			}
+			if info.IsDir() {
+				return nil
+			}
 		}
-		annotations := map[string]string{
-			kioutil.PathAnnotation: path,
+		file.mode = info.Mode().Perm()
+		if r.MaxFileSize > 0 && info.Size() > r.MaxFileSize {
+			tracelog.Info("skipping file larger than the limit", "path", path, "size", info.Size())
+			file.skipped = SkipTooLarge
 		}
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r.relativePath = relativePath
+	r.screenFiles(tracelog, files)
 
-		tracelog.Info("reading file", "path", path)
-		rdr := &kio.ByteReader{
-			Reader:         bytes.NewBuffer(filebytes),
-			SetAnnotations: annotations,
+	// The results are put together in the order the files were
+	// walked, so that the outcome doesn't depend on which worker
+	// finished first. The limit on documents is applied again here,
+	// in that order; the workers only stop parsing once it's clear
+	// the limit will be reached.
+	var result []*yaml.RNode
+	var limited bool
+	r.modes = make(map[string]os.FileMode)
+	for _, f := range files {
+		if f.err != nil {
+			return nil, f.err
 		}
+		if f.screened {
+			r.ScreenedFiles = append(r.ScreenedFiles, f.path)
+		}
+		if f.skipped == SkipDocumentLimit || (r.MaxDocuments > 0 && len(result)+len(f.nodes) > r.MaxDocuments) {
+			limited = true
+		}
+		switch {
+		case f.skipped == SkipTooLarge || f.skipped == SkipBinary || f.skipped == SkipSymlinkOutsideTree:
+			r.Skipped = append(r.Skipped, SkippedFile{Path: f.path, Reason: f.skipped, Marked: f.marked})
+		case limited && (f.skipped == SkipDocumentLimit || len(f.nodes) > 0):
+			r.Skipped = append(r.Skipped, SkippedFile{Path: f.path, Reason: SkipDocumentLimit, Marked: f.marked})
+		case f.problem:
+			r.ProblemFiles = append(r.ProblemFiles, f.path)
+			r.Skipped = append(r.Skipped, SkippedFile{Path: f.path, Reason: SkipParseError, Message: f.message, Marked: f.marked})
+		default:
+			result = append(result, f.nodes...)
+			r.modes[f.path] = f.mode
+		}
+	}
+	return result, nil
+}
+
+// contextErr gives the error of the reader's context, if it has one
+// and it's done.
+func (r *ScreeningLocalReader) contextErr() error {
+	if r.Context == nil {
+		return nil
+	}
+	return r.Context.Err()
+}
+
+// base gives the directory that the paths of the files read are
+// relative to, once they have been read.
+func (r *ScreeningLocalReader) base() string {
+	return r.relativePath
+}
+
+// fileMode gives the permissions of the file read at the relative
+// path given, if it was read.
+func (r *ScreeningLocalReader) fileMode(path string) (os.FileMode, bool) {
+	mode, ok := r.modes[path]
+	return mode, ok
+}
+
+// withinDir reports whether the absolute path p is the directory dir,
+// or within it.
+func withinDir(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// screenedFile is a file to be screened, and the outcome of
+// screening it.
+type screenedFile struct {
+	abspath, path string
+	mode          os.FileMode
+
+	nodes    []*yaml.RNode
+	screened bool
+	marked   bool
+	problem  bool
+	message  string
+	skipped  SkipReason
+	err      error
+}
+
+// screenFiles screens and parses each of the files given, using as
+// many workers as there are usable CPUs, and records the outcome
+// against each file.
+func (r *ScreeningLocalReader) screenFiles(tracelog logr.Logger, files []screenedFile) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(files) {
+		workers = len(files)
+	}
+	tokenbytes, markerbytes := []byte(r.Token), []byte(r.MarkerToken)
+	if r.MarkerToken == "" {
+		markerbytes = tokenbytes
+	}
+	var parsed int64 // the number of documents parsed so far
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				r.screenFile(tracelog, tokenbytes, markerbytes, &parsed, &files[i])
+			}
+		}()
+	}
+	for i := range files {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// binarySniffLen is how much of a file is looked at to decide whether
+// it is binary; this is the same as git uses.
+const binarySniffLen = 8000
 
-		nodes, err := rdr.Read()
-		// Having screened the file and decided it's worth examining,
-		// an error at this point is most unfortunate. However, it
-		// doesn't need to be the end of the matter; we can record
-		// this file as problematic, and continue.
+// screenFile reads the file given and, if it contains the token,
+// parses it. The count of documents parsed, which is shared by the
+// workers, is added to.
+func (r *ScreeningLocalReader) screenFile(tracelog logr.Logger, tokenbytes, markerbytes []byte, parsed *int64, f *screenedFile) {
+	if err := r.contextErr(); err != nil {
+		f.err = err
+		return
+	}
+	// A file too large to parse is still looked through for the
+	// token, so that it's only reported if it could need updating.
+	if f.skipped == SkipTooLarge {
+		found, err := fileContains(f.abspath, tokenbytes)
+		if err == nil && found && !bytes.Equal(markerbytes, tokenbytes) {
+			f.marked, err = fileContains(f.abspath, markerbytes)
+		} else {
+			f.marked = found
+		}
 		if err != nil {
-			tracelog.Info("problem file", "path", path)
-			r.ProblemFiles = append(r.ProblemFiles, path)
-			return nil
+			f.err = fmt.Errorf("reading YAML file: %w", err)
+			return
 		}
-		result = append(result, nodes...)
-		return nil
-	})
+		if !found {
+			f.skipped = ""
+			return
+		}
+	}
+	if f.skipped != "" {
+		f.screened = true
+		return
+	}
+
+	// To check for the token, I need the file contents. This
+	// assumes the file is encoded as UTF8.
+	filebytes, err := os.ReadFile(f.abspath)
+	if err != nil {
+		f.err = fmt.Errorf("reading YAML file: %w", err)
+		return
+	}
 
-	return result, err
+	if !bytes.Contains(filebytes, tokenbytes) {
+		return
+	}
+	f.screened = true
+	f.marked = bytes.Contains(filebytes, markerbytes)
+
+	// A NUL byte means the file is binary, whatever its name says.
+	head := filebytes
+	if len(head) > binarySniffLen {
+		head = head[:binarySniffLen]
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		tracelog.Info("skipping binary file", "path", f.path)
+		f.skipped = SkipBinary
+		return
+	}
+
+	if r.MaxDocuments > 0 && atomic.LoadInt64(parsed) >= int64(r.MaxDocuments) {
+		f.skipped = SkipDocumentLimit
+		return
+	}
+
+	annotations := map[string]string{
+		kioutil.PathAnnotation: f.path,
+	}
+
+	tracelog.Info("reading file", "path", f.path)
+	rdr := &kio.ByteReader{
+		Reader:         bytes.NewBuffer(filebytes),
+		SetAnnotations: annotations,
+	}
+
+	nodes, err := rdr.Read()
+	// Having screened the file and decided it's worth examining,
+	// an error at this point is most unfortunate. However, it
+	// doesn't need to be the end of the matter; we can record
+	// this file as problematic, and continue.
+	if err != nil {
+		tracelog.Info("problem file", "path", f.path, "error", err.Error())
+		f.problem = true
+		f.message = err.Error()
+		return
+	}
+	atomic.AddInt64(parsed, int64(len(nodes)))
+	f.nodes = nodes
+}
+
+// fileContainsBufferSize is how much of a file fileContains reads at
+// a time.
+const fileContainsBufferSize = 64 * 1024
+
+// fileContains reports whether the file at the path given contains
+// the token, reading it a piece at a time rather than all at once.
+func fileContains(path string, token []byte) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	buf := make([]byte, fileContainsBufferSize+len(token))
+	var kept int
+	for {
+		n, err := file.Read(buf[kept:])
+		window := buf[:kept+n]
+		if bytes.Contains(window, token) {
+			return true, nil
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		// the token may be split across reads, so the end of what's
+		// been read is kept to be looked at again with the next
+		tail := len(token) - 1
+		if tail > len(window) {
+			tail = len(window)
+		}
+		kept = copy(buf, window[len(window)-tail:])
+	}
 }
@@ -17,6 +17,13 @@ limitations under the License.
 package update
 
 import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
@@ -47,4 +54,236 @@ var _ = Describe("load YAMLs with ScreeningLocalReader", func() {
 			"otherns.yaml":       struct{}{},
 		}))
 	})
+
+	It("includes and excludes files according to patterns", func() {
+		r := ScreeningLocalReader{
+			Path:    "testdata/setters/original",
+			Token:   "$imagepolicy",
+			Include: []string{"*.yaml"},
+			Exclude: []string{"kustomization.yaml"},
+		}
+		nodes, err := r.Read()
+		Expect(err).ToNot(HaveOccurred())
+		filesSeen := map[string]struct{}{}
+		for i := range nodes {
+			path, _, err := kioutil.GetFileAnnotations(nodes[i])
+			Expect(err).ToNot(HaveOccurred())
+			filesSeen[path] = struct{}{}
+		}
+		Expect(filesSeen).To(Equal(map[string]struct{}{
+			"marked.yaml":  struct{}{},
+			"otherns.yaml": struct{}{},
+		}))
+	})
+
+	It("ignores files matched by ignore patterns relative to the ignore root", func() {
+		r := ScreeningLocalReader{
+			Path:       "testdata/setters/original",
+			Token:      "$imagepolicy",
+			IgnoreRoot: "testdata/setters",
+			Ignore: gitignore.NewMatcher([]gitignore.Pattern{
+				gitignore.ParsePattern("/original/marked.yaml", nil),
+				gitignore.ParsePattern("kustomization.yaml", nil),
+			}),
+		}
+		nodes, err := r.Read()
+		Expect(err).ToNot(HaveOccurred())
+		filesSeen := map[string]struct{}{}
+		for i := range nodes {
+			path, _, err := kioutil.GetFileAnnotations(nodes[i])
+			Expect(err).ToNot(HaveOccurred())
+			filesSeen[path] = struct{}{}
+		}
+		Expect(filesSeen).To(Equal(map[string]struct{}{
+			"otherns.yaml": struct{}{},
+		}))
+	})
+	It("considers only the files given, and records those containing the token", func() {
+		r := ScreeningLocalReader{
+			Path:     "testdata/setters/original",
+			Token:    "$imagepolicy",
+			OnlyRoot: "testdata/setters",
+			Only: map[string]struct{}{
+				"original/marked.yaml":   struct{}{},
+				"original/unmarked.yaml": struct{}{},
+				"original/missing.yaml":  struct{}{},
+			},
+		}
+		nodes, err := r.Read()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(len(nodes)).To(Equal(1))
+		Expect(r.ScreenedFiles).To(Equal([]string{"marked.yaml"}))
+	})
+
+	It("gives the files in the order they are walked, however they are screened", func() {
+		dir, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		var expected []string
+		for i := 0; i < 50; i++ {
+			name := fmt.Sprintf("file%02d.yaml", i)
+			body := fmt.Sprintf("kind: ConfigMap\nmetadata:\n  name: cm%d # {\"$imagepolicy\": \"ns:policy\"}\n", i)
+			if i == 25 {
+				body = "kind: [ # {\"$imagepolicy\": \"ns:policy\"}\n"
+			} else {
+				expected = append(expected, name)
+			}
+			Expect(os.WriteFile(filepath.Join(dir, name), []byte(body), 0644)).To(Succeed())
+		}
+
+		r := ScreeningLocalReader{
+			Path:  dir,
+			Token: "$imagepolicy",
+		}
+		nodes, err := r.Read()
+		Expect(err).ToNot(HaveOccurred())
+		var paths []string
+		for i := range nodes {
+			path, _, err := kioutil.GetFileAnnotations(nodes[i])
+			Expect(err).ToNot(HaveOccurred())
+			paths = append(paths, path)
+		}
+		Expect(paths).To(Equal(expected))
+		Expect(r.ProblemFiles).To(Equal([]string{"file25.yaml"}))
+		Expect(len(r.Skipped)).To(Equal(1))
+		Expect(r.Skipped[0].Path).To(Equal("file25.yaml"))
+		Expect(r.Skipped[0].Reason).To(Equal(SkipParseError))
+		Expect(r.Skipped[0].Message).ToNot(BeEmpty())
+	})
+	It("skips files that are too large or binary, and those beyond the document limit", func() {
+		dir, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		doc := func(name string) string {
+			return fmt.Sprintf("kind: ConfigMap\nmetadata:\n  name: %s # {\"$imagepolicy\": \"ns:policy\"}\n", name)
+		}
+		for name, body := range map[string]string{
+			"a.yaml":        doc("a") + "---\n" + doc("a2"),
+			"b-large.yaml":  doc("large") + strings.Repeat("# padding\n", 100),
+			"b-plain.yaml":  strings.Repeat("# no markers here\n", 100),
+			"c-binary.yaml": doc("binary") + "\x00",
+			"d.yaml":        doc("d"),
+			"e.yaml":        doc("e") + "---\n" + doc("e2"),
+			"f.yaml":        doc("f"),
+		} {
+			Expect(os.WriteFile(filepath.Join(dir, name), []byte(body), 0644)).To(Succeed())
+		}
+
+		r := ScreeningLocalReader{
+			Path:         dir,
+			Token:        "$imagepolicy",
+			MaxFileSize:  500,
+			MaxDocuments: 4,
+		}
+		nodes, err := r.Read()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(len(nodes)).To(Equal(3))
+		Expect(r.Skipped).To(Equal([]SkippedFile{
+			{Path: "b-large.yaml", Reason: SkipTooLarge, Marked: true},
+			{Path: "c-binary.yaml", Reason: SkipBinary, Marked: true},
+			{Path: "e.yaml", Reason: SkipDocumentLimit, Marked: true},
+			{Path: "f.yaml", Reason: SkipDocumentLimit, Marked: true},
+		}))
+		Expect(r.ScreenedFiles).ToNot(ContainElement("b-plain.yaml"))
+	})
+
+	It("records whether files skipped contain the marker token, when screening for another", func() {
+		dir, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		marked := "kind: Deployment\nspec:\n  image: app:v1 # {\"$imagepolicy\": \"ns:policy\"}\n"
+		unmarked := "kind: Deployment\nspec:\n  image: app:v1\n"
+		for name, body := range map[string]string{
+			"a-large-marked.yaml":   marked + strings.Repeat("# padding\n", 100),
+			"b-large-unmarked.yaml": unmarked + strings.Repeat("# padding\n", 100),
+			"c-binary.yaml":         unmarked + "\x00",
+		} {
+			Expect(os.WriteFile(filepath.Join(dir, name), []byte(body), 0644)).To(Succeed())
+		}
+
+		r := ScreeningLocalReader{
+			Path:        dir,
+			Token:       "image",
+			MarkerToken: "$imagepolicy",
+			MaxFileSize: 500,
+		}
+		_, err = r.Read()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(r.Skipped).To(Equal([]SkippedFile{
+			{Path: "a-large-marked.yaml", Reason: SkipTooLarge, Marked: true},
+			{Path: "b-large-unmarked.yaml", Reason: SkipTooLarge},
+			{Path: "c-binary.yaml", Reason: SkipBinary},
+		}))
+	})
+
+	It("finds a token split across the pieces of a file read", func() {
+		dir, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		token := []byte("$imagepolicy")
+		for _, at := range []int{0, fileContainsBufferSize - 5, fileContainsBufferSize + 100} {
+			body := append(bytes.Repeat([]byte{'#'}, at), token...)
+			body = append(body, bytes.Repeat([]byte{'#'}, fileContainsBufferSize)...)
+			path := filepath.Join(dir, "file.yaml")
+			Expect(os.WriteFile(path, body, 0644)).To(Succeed())
+			Expect(fileContains(path, token)).To(BeTrue())
+			Expect(fileContains(path, []byte("$imagepolicies"))).To(BeFalse())
+		}
+	})
+
+	It("follows symlinks within the tree, and skips or fails on those leading outside it", func() {
+		outside, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(outside)
+		repo, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(repo)
+
+		doc := "kind: ConfigMap\nmetadata:\n  name: cm # {\"$imagepolicy\": \"ns:policy\"}\n"
+		Expect(os.WriteFile(filepath.Join(outside, "secret.yaml"), []byte(doc), 0644)).To(Succeed())
+		dir := filepath.Join(repo, "deploy")
+		Expect(os.MkdirAll(filepath.Join(repo, "base"), 0755)).To(Succeed())
+		Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(repo, "base", "app.yaml"), []byte(doc), 0644)).To(Succeed())
+		Expect(os.Symlink("../base/app.yaml", filepath.Join(dir, "app.yaml"))).To(Succeed())
+		Expect(os.Symlink(filepath.Join(outside, "secret.yaml"), filepath.Join(dir, "escape.yaml"))).To(Succeed())
+		Expect(os.Symlink("missing.yaml", filepath.Join(dir, "broken.yaml"))).To(Succeed())
+
+		r := ScreeningLocalReader{
+			Path:        dir,
+			Token:       "$imagepolicy",
+			SymlinkRoot: repo,
+		}
+		nodes, err := r.Read()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(len(nodes)).To(Equal(1))
+		path, _, err := kioutil.GetFileAnnotations(nodes[0])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(path).To(Equal("app.yaml"))
+		Expect(r.Skipped).To(Equal([]SkippedFile{
+			{Path: "escape.yaml", Reason: SkipSymlinkOutsideTree},
+		}))
+
+		// without a root given, the tree is the path being read
+		r = ScreeningLocalReader{
+			Path:  dir,
+			Token: "$imagepolicy",
+		}
+		nodes, err = r.Read()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(nodes).To(BeEmpty())
+		Expect(len(r.Skipped)).To(Equal(2))
+
+		r = ScreeningLocalReader{
+			Path:        dir,
+			Token:       "$imagepolicy",
+			SymlinkRoot: repo,
+			Symlinks:    SymlinksFail,
+		}
+		_, err = r.Read()
+		Expect(err).To(HaveOccurred())
+	})
 })
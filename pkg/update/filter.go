@@ -17,7 +17,11 @@ limitations under the License.
 package update
 
 import (
+	"encoding/json"
+	"strings"
+
 	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/kube-openapi/pkg/validation/spec"
 	"sigs.k8s.io/kustomize/kyaml/fieldmeta"
 	"sigs.k8s.io/kustomize/kyaml/openapi"
@@ -50,6 +54,22 @@ type SetAllCallback struct {
 	SettersSchema *spec.Schema
 	Callback      func(setter, oldValue, newValue string)
 	Trace         logr.Logger
+
+	// Edited, if not nil, is called with each field set, once its
+	// value (and perhaps its style) has been changed, along with the
+	// value and style it had before.
+	Edited func(field *yaml.Node, oldValue string, oldStyle yaml.Style)
+
+	// Allowed, if not nil, is called with the name of the setter for
+	// each field found, and the field is left as it is if it returns
+	// false.
+	Allowed func(setter string) bool
+
+	// Detect, if not nil, is called with the image given by each
+	// image field without a marker -- the image of a container, or an
+	// image named in a Kustomization -- and gives the name of the
+	// setter for the image policy to update it with, if there is one.
+	Detect func(image string) (setter string, ok bool)
 }
 
 func (s *SetAllCallback) TraceOrDiscard() logr.Logger {
@@ -60,7 +80,13 @@ func (s *SetAllCallback) TraceOrDiscard() logr.Logger {
 }
 
 func (s *SetAllCallback) Filter(object *yaml.RNode) (*yaml.RNode, error) {
-	return object, accept(s, object, "", s.SettersSchema)
+	if err := accept(s, object, "", s.SettersSchema); err != nil {
+		return object, err
+	}
+	if s.Detect != nil {
+		return object, s.detectKustomizationImages(object)
+	}
+	return object, nil
 }
 
 // visitor is provided to accept to walk the AST.
@@ -119,8 +145,13 @@ func (s *SetAllCallback) set(field *yaml.RNode, ext *setters2.CliExtension, sch
 		return false, nil
 	}
 
+	if s.Allowed != nil && !s.Allowed(ext.Setter.Name) {
+		s.TraceOrDiscard().Info("setter not allowed here", "setter", ext.Setter.Name)
+		return false, nil
+	}
+
 	// this has a full setter, set its value
-	old := field.YNode().Value
+	old, oldStyle := field.YNode().Value, field.YNode().Style
 	field.YNode().Value = ext.Setter.Value
 	s.TraceOrDiscard().Info("applying setter", "setter", ext.Setter.Name, "old", old, "new", ext.Setter.Value)
 	s.Callback(ext.Setter.Name, old, ext.Setter.Value)
@@ -130,12 +161,18 @@ func (s *SetAllCallback) set(field *yaml.RNode, ext *setters2.CliExtension, sch
 	if len(sch.Type) > 0 {
 		yaml.FormatNonStringStyle(field.YNode(), *sch)
 	}
+	if s.Edited != nil {
+		s.Edited(field.YNode(), old, oldStyle)
+	}
 	return true, nil
 }
 
 // visitScalar
 func (s *SetAllCallback) visitScalar(object *yaml.RNode, p string, fieldSchema *openapi.ResourceSchema) error {
 	if fieldSchema == nil {
+		if s.Detect != nil && isContainerImage(p) {
+			return s.detect(object, object.YNode().Value, "")
+		}
 		return nil
 	}
 	// get the openAPI for this field describing how to apply the setter
@@ -152,3 +189,135 @@ func (s *SetAllCallback) visitScalar(object *yaml.RNode, p string, fieldSchema *
 	_, err = s.set(object, ext, fieldSchema.Schema)
 	return err
 }
+
+// containerImageFields are the fields, in a pod spec, holding lists
+// of containers.
+var containerImageFields = []string{".containers.image", ".initContainers.image", ".ephemeralContainers.image"}
+
+// isContainerImage reports whether the path given (as given to
+// visitScalar) is that of the image of a container, in any kind of
+// object that has a pod spec.
+func isContainerImage(p string) bool {
+	for _, suffix := range containerImageFields {
+		if strings.HasSuffix(p, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// detect sets the field given, which refers to the image given, with
+// the setter Detect gives for the image, with the suffix given; e.g.,
+// `:tag` for a field holding only the tag.
+func (s *SetAllCallback) detect(field *yaml.RNode, image, suffix string) error {
+	setter, ok := s.Detect(image)
+	if !ok {
+		return nil
+	}
+	def, ok := s.SettersSchema.Definitions[fieldmeta.SetterDefinitionPrefix+setter+suffix]
+	if !ok {
+		return nil
+	}
+	ext, err := setters2.GetExtFromSchema(&def)
+	if err != nil || ext == nil {
+		return err
+	}
+	s.TraceOrDiscard().Info("detected image field", "image", image, "setter", ext.Setter.Name)
+	_, err = s.set(field, ext, &def)
+	return err
+}
+
+// detectKustomizationImages sets the tag and digest of each image
+// listed in a Kustomization, either that of kustomize or that of
+// Flux, in the fields of its own they are given in. Only fields that
+// are there already are set, and not those with a marker, which are
+// set (or not) by visitScalar.
+func (s *SetAllCallback) detectKustomizationImages(object *yaml.RNode) error {
+	var images *yaml.RNode
+	var err error
+	switch apiVersion := object.GetApiVersion(); {
+	case object.GetKind() != "Kustomization":
+		return nil
+	case apiVersion == "" || strings.HasPrefix(apiVersion, "kustomize.config.k8s.io/"):
+		images, err = object.Pipe(yaml.Lookup("images"))
+	case strings.HasPrefix(apiVersion, "kustomize.toolkit.fluxcd.io/"):
+		images, err = object.Pipe(yaml.Lookup("spec", "images"))
+	default:
+		return nil
+	}
+	if err != nil || images == nil || images.YNode().Kind != yaml.SequenceNode {
+		return err
+	}
+	return images.VisitElements(func(image *yaml.RNode) error {
+		if image.YNode().Kind != yaml.MappingNode {
+			return nil
+		}
+		// the image written is given by newName, if it's there
+		var name string
+		for _, field := range []string{"newName", "name"} {
+			if node := image.Field(field); node != nil && node.Value.YNode().Kind == yaml.ScalarNode {
+				name = node.Value.YNode().Value
+				break
+			}
+		}
+		if name == "" {
+			return nil
+		}
+		for _, field := range []struct{ name, suffix string }{{"newTag", ":tag"}, {"digest", ":digest"}} {
+			node := image.Field(field.name)
+			if node == nil || node.Value.YNode().Kind != yaml.ScalarNode || getSchema(node.Value, s.SettersSchema) != nil {
+				continue
+			}
+			if err := s.detect(node.Value, name, field.suffix); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// markerCollector is a visitor that records the policies named by the
+// markers it comes across, whether or not there's a setter for them.
+type markerCollector struct {
+	policies map[types.NamespacedName]struct{}
+}
+
+func (m *markerCollector) visitScalar(object *yaml.RNode, _ string, _ *openapi.ResourceSchema) error {
+	for _, comment := range []string{object.YNode().LineComment, object.YNode().HeadComment} {
+		if policy, ok := markedPolicy(comment); ok {
+			m.policies[policy] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// markedPolicies gives the policies named by markers in the nodes
+// given.
+func markedPolicies(nodes []*yaml.RNode) (map[types.NamespacedName]struct{}, error) {
+	m := &markerCollector{policies: make(map[types.NamespacedName]struct{})}
+	var schema spec.Schema
+	for i := range nodes {
+		if err := accept(m, nodes[i], "", &schema); err != nil {
+			return nil, err
+		}
+	}
+	return m.policies, nil
+}
+
+// markedPolicy gives the policy named by a marker comment, e.g.,
+//
+//	# {"$imagepolicy": "automation-ns:foo:tag"}
+//
+// Comments that aren't markers are passed over, as they are when
+// setting values.
+func markedPolicy(comment string) (types.NamespacedName, bool) {
+	var marker map[string]string
+	if err := json.Unmarshal([]byte(strings.TrimLeft(comment, "#")), &marker); err != nil {
+		return types.NamespacedName{}, false
+	}
+	parts := strings.SplitN(marker[SetterShortHand], ":", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return types.NamespacedName{}, false
+	}
+	return types.NamespacedName{Namespace: parts[0], Name: parts[1]}, true
+}
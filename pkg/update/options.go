@@ -0,0 +1,330 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/types"
+
+	imagev1_reflect "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+)
+
+// Option is a function that adjusts how an update is carried out;
+// e.g., which files are considered.
+type Option func(*options)
+
+type options struct {
+	include    []string
+	exclude    []string
+	ignore     gitignore.Matcher
+	ignoreRoot string
+
+	maxFileSize  int64
+	maxDocuments int
+
+	only     map[string]struct{}
+	onlyRoot string
+
+	lookup PolicyLookup
+
+	symlinks    SymlinkPolicy
+	symlinkRoot string
+
+	imageFormat ImageFormat
+	rewrites    []RegistryRewrite
+
+	allowedPathsRoot string
+
+	detectImages bool
+
+	ctx context.Context
+
+	trace logr.Logger
+}
+
+// PolicyLookup gives the image policy named, or nil if there is no
+// such policy.
+type PolicyLookup func(name types.NamespacedName) (*imagev1_reflect.ImagePolicy, error)
+
+func makeOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithInclude restricts the update to files matching at least one
+// of the glob patterns given. See MatchGlob for the form of the
+// patterns.
+func WithInclude(patterns ...string) Option {
+	return func(o *options) {
+		o.include = append(o.include, patterns...)
+	}
+}
+
+// WithExclude leaves out of the update any file matching one of the
+// glob patterns given, even if it is included by WithInclude. See
+// MatchGlob for the form of the patterns.
+func WithExclude(patterns ...string) Option {
+	return func(o *options) {
+		o.exclude = append(o.exclude, patterns...)
+	}
+}
+
+// WithIgnore leaves out of the update any file or directory matched
+// by the gitignore-style patterns given. The patterns are taken to be
+// relative to the directory `root`, which need not be the directory
+// being updated; e.g., it can be the root of a git repository.
+func WithIgnore(root string, patterns []gitignore.Pattern) Option {
+	return func(o *options) {
+		o.ignoreRoot = root
+		o.ignore = gitignore.NewMatcher(patterns)
+	}
+}
+
+// WithOnlyFiles restricts the update to the files given, which are
+// relative to the directory `root`; as with WithIgnore, this need not
+// be the directory being updated. The other options still apply to
+// the files given. This is for updating incrementally, when the files
+// that could need updating are already known.
+func WithOnlyFiles(root string, files []string) Option {
+	return func(o *options) {
+		o.onlyRoot = root
+		o.only = make(map[string]struct{}, len(files))
+		for _, file := range files {
+			o.only[filepath.ToSlash(file)] = struct{}{}
+		}
+	}
+}
+
+// WithMaxFileSize leaves out of the update any file larger than the
+// number of bytes given, without parsing it. Such a file is only read
+// a piece at a time to look for the marker token, and if it has it,
+// is reported in Result.Skipped. Zero means no limit.
+func WithMaxFileSize(size int64) Option {
+	return func(o *options) {
+		o.maxFileSize = size
+	}
+}
+
+// WithMaxDocuments limits the number of YAML documents parsed in an
+// update to the number given. Once the limit is reached, the
+// remaining files are left out of the update, and reported in
+// Result.Skipped. Zero means no limit.
+func WithMaxDocuments(n int) Option {
+	return func(o *options) {
+		o.maxDocuments = n
+	}
+}
+
+// WithPolicyLookup looks up the policies named by markers that are
+// not among the policies given to the update, so that the caller
+// need only give the policies it expects to be referred to. Each
+// policy is looked up at most once.
+func WithPolicyLookup(lookup PolicyLookup) Option {
+	return func(o *options) {
+		o.lookup = lookup
+	}
+}
+
+// SymlinkPolicy says what to do about a file that's a symlink to
+// somewhere outside the tree being updated.
+type SymlinkPolicy string
+
+const (
+	// SymlinksSkip leaves such files out of the update, and reports
+	// them in Result.Skipped. This is the default.
+	SymlinksSkip SymlinkPolicy = "Skip"
+	// SymlinksFail fails the update when there's such a file.
+	SymlinksFail SymlinkPolicy = "Fail"
+)
+
+// WithSymlinks says what to do about files that are symlinks to
+// somewhere outside the directory `root` (e.g., the root of a git
+// repository), which need not be the directory being updated. Without
+// this option, symlinks to outside the directory being updated are
+// skipped. Symlinks within the root are followed.
+func WithSymlinks(root string, policy SymlinkPolicy) Option {
+	return func(o *options) {
+		o.symlinkRoot = root
+		o.symlinks = policy
+	}
+}
+
+// ImageFormat says how markers without a suffix write images.
+type ImageFormat string
+
+const (
+	// ImageFormatTag writes images as `name:tag`.
+	ImageFormatTag ImageFormat = "Tag"
+	// ImageFormatDigest writes images as `name@digest`, if the policy
+	// gives a digest.
+	ImageFormatDigest ImageFormat = "Digest"
+	// ImageFormatTagAndDigest writes images as `name:tag@digest`, if
+	// the policy gives a digest.
+	ImageFormatTagAndDigest ImageFormat = "TagAndDigest"
+)
+
+// ImageFormatAnnotation is the annotation with which an image policy
+// can be given a format of its own, which takes precedence over that
+// given with WithImageFormat.
+const ImageFormatAnnotation = "image.toolkit.fluxcd.io/image-format"
+
+// WithImageFormat says how markers without a suffix write images.
+// Without this option, or with an empty format, images are written as
+// the policy gives them. A format that needs a part of the image the
+// policy doesn't give (e.g., a digest) also writes the image as given.
+func WithImageFormat(format ImageFormat) Option {
+	return func(o *options) {
+		o.imageFormat = format
+	}
+}
+
+// RegistryRewrite maps images from a registry, or a repository within
+// one, to another, when they are written.
+type RegistryRewrite struct {
+	// From gives the registry of the images to rewrite, optionally
+	// followed by a path within it; e.g., `docker.io` or
+	// `ghcr.io/org`.
+	From string
+	// To gives what to write in place of From.
+	To string
+}
+
+// WithRegistryRewrites has the names of images written with the
+// registry (or repository) changed by the first of the rewrites given
+// that matches. Images that don't give a registry are taken to be in
+// `docker.io`, and are written with their full repository; e.g.,
+// `nginx` is in the repository `library/nginx`. The rewrites apply to
+// markers without a suffix and those with the suffix `:name`.
+func WithRegistryRewrites(rewrites ...RegistryRewrite) Option {
+	return func(o *options) {
+		o.rewrites = append(o.rewrites, rewrites...)
+	}
+}
+
+// AllowedPathsAnnotation is the annotation with which an image policy
+// can be restricted to updating the files matching the glob patterns
+// it gives, separated by commas; e.g., `apps/team-a/**`. Markers for
+// the policy in other files are left as they are, and the files are
+// reported in Result.Skipped. See MatchGlob for the form of the
+// patterns, and WithAllowedPathsRoot for what they are relative to.
+const AllowedPathsAnnotation = "image.toolkit.fluxcd.io/allowed-paths"
+
+// WithAllowedPathsRoot says that the patterns given by
+// AllowedPathsAnnotation are relative to the directory `root`; as
+// with WithIgnore, this need not be the directory being updated.
+// Without this option, they are relative to the directory being
+// updated.
+func WithAllowedPathsRoot(root string) Option {
+	return func(o *options) {
+		o.allowedPathsRoot = root
+	}
+}
+
+// WithDetectImages has image fields updated without a marker, when
+// the image they give is in the repository of exactly one of the
+// image policies: the image of each container, and the `newTag` and
+// `digest` of each image in a Kustomization (either kustomize's or
+// Flux's). The repository of a policy is that of its latest image,
+// or that image with the registry rewritten (see
+// WithRegistryRewrites). The fields are set as if they had a marker
+// without a suffix, or with the suffix `:tag` or `:digest`
+// respectively; a field with a marker is set as the marker says.
+// Since files are screened for the word `image`, rather than for the
+// marker token, more files are read with this option.
+func WithDetectImages(detect bool) Option {
+	return func(o *options) {
+		o.detectImages = detect
+	}
+}
+
+// WithContext gives a context which, once it's done, stops the update
+// between one file or document and the next, with the context's
+// error. Files are not written once it's stopped.
+func WithContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+// WithLogger gives the logger to which Update traces what it does.
+// UpdateWithSetters is given a logger directly, and ignores this
+// option.
+func WithLogger(tracelog logr.Logger) Option {
+	return func(o *options) {
+		o.trace = tracelog
+	}
+}
+
+// MatchGlob reports whether the slash-separated relative path `p`
+// matches the glob pattern given. A pattern without a slash is
+// matched against the last element of the path, so e.g., `*.yaml`
+// matches YAML files in any directory. Otherwise, the pattern is
+// matched element by element against the whole path, with `**`
+// matching any number (including zero) of path elements. Elements
+// are matched using the syntax of `path.Match`.
+func MatchGlob(pattern, p string) bool {
+	pattern = strings.TrimPrefix(pattern, "./")
+	p = strings.TrimPrefix(p, "./")
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(p))
+		return ok
+	}
+	return matchElements(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(p, "/"))
+}
+
+func matchElements(pattern, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// try to match the rest of the pattern at every
+			// possible point in the remaining elements
+			for i := 0; i <= len(elems); i++ {
+				if matchElements(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
+
+// matchAny reports whether the path `p` matches any of the patterns
+// given.
+func matchAny(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if MatchGlob(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("glob patterns", func() {
+	DescribeTable("matching paths",
+		func(pattern, path string, expected bool) {
+			Expect(MatchGlob(pattern, path)).To(Equal(expected))
+		},
+		Entry("file name in top directory", "*.yaml", "deploy.yaml", true),
+		Entry("file name in subdirectory", "*.yaml", "apps/deploy.yaml", true),
+		Entry("file name not matching", "*.yml", "apps/deploy.yaml", false),
+		Entry("full path", "apps/*.yaml", "apps/deploy.yaml", true),
+		Entry("full path, too deep", "apps/*.yaml", "apps/foo/deploy.yaml", false),
+		Entry("double star, no directories", "apps/**/deploy.yaml", "apps/deploy.yaml", true),
+		Entry("double star, several directories", "apps/**/deploy.yaml", "apps/foo/bar/deploy.yaml", true),
+		Entry("trailing double star", "vendor/**", "vendor/chart/values.yaml", true),
+		Entry("leading dot slash", "./apps/*.yaml", "apps/deploy.yaml", true),
+		Entry("different directory", "infra/**", "apps/deploy.yaml", false),
+	)
+})
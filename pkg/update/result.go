@@ -1,6 +1,8 @@
 package update
 
 import (
+	"sort"
+
 	"github.com/google/go-containerregistry/pkg/name"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
@@ -60,21 +62,114 @@ type ObjectIdentifier struct {
 // the images, regardless of object) are available via methods.
 type Result struct {
 	Files map[string]FileResult
+	// Matched counts the fields marked with a setter for one of the
+	// policies given, whether or not their values were changed.
+	Matched int
+	// MatchedPolicies holds the policies named by the setters counted
+	// in Matched.
+	MatchedPolicies map[types.NamespacedName]struct{}
+	// MarkedPolicies holds the policies named by markers in the files
+	// read, whether or not they were given (or looked up) and have an
+	// image.
+	MarkedPolicies map[types.NamespacedName]struct{}
+	// Skipped lists the files that were left out of the update,
+	// because they couldn't be parsed or to bound the resources it
+	// uses, in the order they were found.
+	Skipped []SkippedFile
+	// ScreenedFiles lists the files that contained the marker token,
+	// or were skipped before they could be looked at, in the order
+	// they were found. Only these files can need updating, until
+	// they or other files are changed.
+	ScreenedFiles []string
+}
+
+// SkipReason says why a file was left out of an update.
+type SkipReason string
+
+const (
+	// SkipTooLarge is given for a file that contains the token
+	// screened for, but is larger than the limit set with
+	// WithMaxFileSize. A larger file without the token isn't skipped,
+	// since it isn't parsed anyway.
+	SkipTooLarge SkipReason = "TooLarge"
+	// SkipBinary is given for a file that contains the marker token
+	// but looks to be binary, and therefore can't be YAML.
+	SkipBinary SkipReason = "Binary"
+	// SkipDocumentLimit is given for a file that would have taken the
+	// number of documents parsed over the limit set with
+	// WithMaxDocuments.
+	SkipDocumentLimit SkipReason = "DocumentLimit"
+	// SkipSymlinkOutsideTree is given for a file that's a symlink to
+	// somewhere outside the tree being updated; see WithSymlinks.
+	SkipSymlinkOutsideTree SkipReason = "SymlinkOutsideTree"
+	// SkipParseError is given for a file that contains the marker
+	// token but can't be parsed as YAML. The rest of the files are
+	// updated regardless.
+	SkipParseError SkipReason = "ParseError"
+	// SkipPathNotAllowed is given for a file with markers for an
+	// image policy that isn't allowed to update it; see
+	// AllowedPathsAnnotation. The file is still updated for other
+	// policies, and is reported once for each policy refused.
+	SkipPathNotAllowed SkipReason = "PathNotAllowed"
+)
+
+// SkippedFile records a file left out of an update.
+type SkippedFile struct {
+	// Path is the path of the file, relative to the path updated.
+	Path   string
+	Reason SkipReason
+	// Message gives more detail, if there is any; e.g., the error
+	// from parsing the file.
+	Message string
+	// Marked says whether the file contains the marker token, and so
+	// most likely has markers that went unapplied. A file skipped
+	// without it (e.g., one read when detecting images, or a symlink
+	// to outside the tree, which isn't read) may have had nothing to
+	// update.
+	Marked bool
 }
 
 // FileResult gives the updates in a particular file.
 type FileResult struct {
 	Objects map[ObjectIdentifier][]ImageRef
+	// Changes lists each field value changed in the file, in the
+	// order they appear.
+	Changes []Change
+}
+
+// Change records a single field value changed by an update.
+type Change struct {
+	// Object identifies the object in which the field appears.
+	Object ObjectIdentifier
+	// Setter names the marker that led to the change; e.g.,
+	// "automation-ns:policy:tag".
+	Setter string
+	// OldValue is the value of the field before the update; e.g.,
+	// "v1.0.0".
+	OldValue string
+	// NewValue is the value of the field after the update; e.g.,
+	// "v1.0.1".
+	NewValue string
+	// Image is the image ref from which the new value was taken.
+	Image ImageRef
+}
+
+// String gives the old and new values of the field; e.g.,
+// "app:v1.0.0 -> app:v1.0.1".
+func (c Change) String() string {
+	return c.OldValue + " -> " + c.NewValue
 }
 
 // Images returns all the images that were involved in at least one
-// update.
+// update, in the order they're first found going by file name, then
+// object.
 func (r Result) Images() []ImageRef {
 	seen := make(map[ImageRef]struct{})
 	var result []ImageRef
-	for _, file := range r.Files {
-		for _, images := range file.Objects {
-			for _, ref := range images {
+	for _, name := range r.fileNames() {
+		file := r.Files[name]
+		for _, id := range sortedObjects(file.Objects) {
+			for _, ref := range file.Objects[id] {
 				if _, ok := seen[ref]; !ok {
 					seen[ref] = struct{}{}
 					result = append(result, ref)
@@ -86,13 +181,93 @@ func (r Result) Images() []ImageRef {
 }
 
 // Objects returns a map of all the objects against the images updated
-// within, regardless of which file they appear in.
+// within, regardless of which file they appear in. The images for an
+// object in more than one file are in order of file name.
 func (r Result) Objects() map[ObjectIdentifier][]ImageRef {
 	result := make(map[ObjectIdentifier][]ImageRef)
-	for _, file := range r.Files {
-		for res, refs := range file.Objects {
+	for _, name := range r.fileNames() {
+		for res, refs := range r.Files[name].Objects {
 			result[res] = append(result[res], refs...)
 		}
 	}
 	return result
 }
+
+// Changes returns all the field values changed by the update,
+// ordered by file name, then by their position in the file.
+func (r Result) Changes() []Change {
+	var result []Change
+	for _, file := range r.fileNames() {
+		result = append(result, r.Files[file].Changes...)
+	}
+	return result
+}
+
+// ImageUpdate gives the changes made using a particular image.
+type ImageUpdate struct {
+	Image ImageRef
+	// Files lists the files changed using the image, sorted.
+	Files []string
+	// Changes lists the field values changed using the image, ordered
+	// by file name, then by their position in the file.
+	Changes []Change
+}
+
+// ImageUpdates returns the changes made by the update by image, in
+// the order the images are first found going by file name, then
+// position in the file.
+func (r Result) ImageUpdates() []ImageUpdate {
+	index := make(map[ImageRef]int)
+	var result []ImageUpdate
+	for _, file := range r.fileNames() {
+		for _, change := range r.Files[file].Changes {
+			i, ok := index[change.Image]
+			if !ok {
+				i = len(result)
+				index[change.Image] = i
+				result = append(result, ImageUpdate{Image: change.Image})
+			}
+			update := &result[i]
+			if n := len(update.Files); n == 0 || update.Files[n-1] != file {
+				update.Files = append(update.Files, file)
+			}
+			update.Changes = append(update.Changes, change)
+		}
+	}
+	return result
+}
+
+// fileNames gives the names of the files in the result, sorted, so
+// that what's derived from the result is the same from one run to the
+// next.
+func (r Result) fileNames() []string {
+	files := make([]string, 0, len(r.Files))
+	for file := range r.Files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// sortedObjects gives the objects in the map given, sorted by API
+// version, kind, namespace and name.
+func sortedObjects(objects map[ObjectIdentifier][]ImageRef) []ObjectIdentifier {
+	ids := make([]ObjectIdentifier, 0, len(objects))
+	for id := range objects {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := ids[i], ids[j]
+		switch {
+		case a.APIVersion != b.APIVersion:
+			return a.APIVersion < b.APIVersion
+		case a.Kind != b.Kind:
+			return a.Kind < b.Kind
+		case a.Namespace != b.Namespace:
+			return a.Namespace < b.Namespace
+		default:
+			return a.Name < b.Name
+		}
+	})
+	return ids
+}
@@ -81,6 +81,20 @@ var _ = Describe("update results", func() {
 		}))
 	})
 
+	It("gives images in the same order each time", func() {
+		result.Files["bar.yaml"].Objects[objectNames[1]][0] = mustRef("first:v1.0")
+		result.Files["foo.yaml"].Objects[objectNames[0]] = append(result.Files["foo.yaml"].Objects[objectNames[0]], mustRef("another:v3.0"))
+		expected := []ImageRef{
+			mustRef("first:v1.0"),
+			mustRef("other:v2.0"),
+			mustRef("image:v1.0"),
+			mustRef("another:v3.0"),
+		}
+		for i := 0; i < 10; i++ {
+			Expect(result.Images()).To(Equal(expected))
+		}
+	})
+
 	It("collects images by object", func() {
 		Expect(result.Objects()).To(Equal(map[ObjectIdentifier][]ImageRef{
 			objectNames[0]: {
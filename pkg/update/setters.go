@@ -17,7 +17,10 @@ limitations under the License.
 package update
 
 import (
+	"context"
 	"fmt"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/go-logr/logr"
@@ -37,8 +40,8 @@ import (
 
 const (
 	// SetterShortHand is a shorthand that can be used to mark
-	// setters; instead of
-	// # { "$ref": "#/definitions/
+	// setters; i.e., `# {"$imagepolicy": "ns:name"}` instead of
+	// `# {"$ref": "#/definitions/io.k8s.cli.setters.ns:name"}`.
 	SetterShortHand = "$imagepolicy"
 )
 
@@ -50,10 +53,25 @@ func init() {
 	openapi.SuppressBuiltInSchemaUse()
 }
 
+// Update updates, in place, the YAML files under `path` that contain
+// a marker for one of the image policies given (or looked up; see
+// WithPolicyLookup), and gives the result. The options given can
+// narrow down which files are considered.
+func Update(path string, policies []imagev1_reflect.ImagePolicy, opts ...Option) (Result, error) {
+	tracelog := makeOptions(opts).trace
+	if tracelog == nil {
+		tracelog = logr.Discard()
+	}
+	return UpdateWithSetters(tracelog, path, path, policies, opts...)
+}
+
 // UpdateWithSetters takes all YAML files from `inpath`, updates any
 // that contain an "in scope" image policy marker, and writes files it
-// updated (and only those files) back to `outpath`.
-func UpdateWithSetters(tracelog logr.Logger, inpath, outpath string, policies []imagev1_reflect.ImagePolicy) (Result, error) {
+// updated (and only those files) back to `outpath`. The options given
+// can narrow down which files are considered.
+func UpdateWithSetters(tracelog logr.Logger, inpath, outpath string, policies []imagev1_reflect.ImagePolicy, opts ...Option) (Result, error) {
+	o := makeOptions(opts)
+
 	// the OpenAPI schema is a package variable in kyaml/openapi. In
 	// lieu of being able to isolate invocations (per
 	// https://github.com/kubernetes-sigs/kustomize/issues/3058), I
@@ -103,11 +121,19 @@ func UpdateWithSetters(tracelog logr.Logger, inpath, outpath string, policies []
 	// we will get from `setAll` which keeps track of those as it
 	// iterates.
 	imageRefs := make(map[string]imageRef)
-	setAllCallback := func(file, setterName string, node *yaml.RNode) {
+	setAllCallback := func(file, setterName, oldValue, newValue string, node *yaml.RNode) {
 		ref, ok := imageRefs[setterName]
 		if !ok {
 			return
 		}
+		result.Matched++
+		if result.MatchedPolicies == nil {
+			result.MatchedPolicies = make(map[types.NamespacedName]struct{})
+		}
+		result.MatchedPolicies[ref.policy] = struct{}{}
+		if newValue == oldValue {
+			return
+		}
 
 		meta, err := node.GetMeta()
 		if err != nil {
@@ -120,8 +146,16 @@ func UpdateWithSetters(tracelog logr.Logger, inpath, outpath string, policies []
 			fileres = FileResult{
 				Objects: make(map[ObjectIdentifier][]ImageRef),
 			}
-			result.Files[file] = fileres
 		}
+		fileres.Changes = append(fileres.Changes, Change{
+			Object:   oid,
+			Setter:   setterName,
+			OldValue: oldValue,
+			NewValue: newValue,
+			Image:    ref,
+		})
+		result.Files[file] = fileres
+
 		objres, ok := fileres.Objects[oid]
 		for _, n := range objres {
 			if n == ref {
@@ -132,10 +166,35 @@ func UpdateWithSetters(tracelog logr.Logger, inpath, outpath string, policies []
 		fileres.Objects[oid] = objres
 	}
 
+	// The policies restricted to updating some files give the
+	// patterns the files must match.
+	allowedPaths := make(map[types.NamespacedName][]string)
+
+	// To detect image fields without a marker, the repository of each
+	// policy (and its rewritten name, if any) gives the setter for
+	// the policy; a repository with more than one policy is left out.
+	detectable := make(map[string]string)
+	detectRepository := func(repo, setter string) {
+		if other, ok := detectable[repo]; ok && other != setter {
+			detectable[repo] = ""
+			return
+		}
+		detectable[repo] = setter
+	}
+
 	defs := map[string]spec.Schema{}
-	for _, policy := range policies {
+	addPolicy := func(policy imagev1_reflect.ImagePolicy) error {
 		if policy.Status.LatestImage == "" {
-			continue
+			return nil
+		}
+		if annotated, ok := policy.GetAnnotations()[AllowedPathsAnnotation]; ok {
+			patterns := []string{}
+			for _, pattern := range strings.Split(annotated, ",") {
+				if pattern = strings.TrimSpace(pattern); pattern != "" {
+					patterns = append(patterns, pattern)
+				}
+			}
+			allowedPaths[types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}] = patterns
 		}
 		// Using strict validation would mean any image that omits the
 		// registry would be rejected, so that can't be used
@@ -146,7 +205,7 @@ func UpdateWithSetters(tracelog logr.Logger, inpath, outpath string, policies []
 		image := policy.Status.LatestImage
 		r, err := name.ParseReference(image, name.WeakValidation)
 		if err != nil {
-			return Result{}, fmt.Errorf("encountered invalid image ref %q: %w", policy.Status.LatestImage, err)
+			return fmt.Errorf("encountered invalid image ref %q: %w", policy.Status.LatestImage, err)
 		}
 		ref := imageRef{
 			Reference: r,
@@ -156,83 +215,300 @@ func UpdateWithSetters(tracelog logr.Logger, inpath, outpath string, policies []
 			},
 		}
 
+		// An image may be given pinned to a digest, with or without a
+		// tag; e.g., `podinfo:5.0.1@sha256:...`. The parts other than
+		// the digest are those of the image without it.
+		base, digest := image, ""
+		if d, ok := r.(name.Digest); ok {
+			digest = d.DigestStr()
+			base = strings.TrimSuffix(image, "@"+digest)
+		}
 		tag := ref.Identifier()
+		hasTag := true
+		if digest != "" {
+			t, err := name.NewTag(base, name.WeakValidation)
+			if err != nil {
+				return fmt.Errorf("encountered invalid image ref %q: %w", policy.Status.LatestImage, err)
+			}
+			tag = t.TagStr()
+			// with weak validation, an image without a tag is given
+			// the tag `latest`, which isn't wanted here
+			hasTag = strings.HasSuffix(base, ":"+tag)
+		}
 		// annoyingly, neither the library imported above, nor an
 		// alternative I found, will yield the original image name;
 		// this is an easy way to get it
-		name := strings.TrimSuffix(image, ":"+tag)
-
+		name := strings.TrimSuffix(base, ":"+tag)
+		if rewritten, ok := rewriteName(o.rewrites, ref.Context()); ok {
+			image = rewritten + strings.TrimPrefix(image, name)
+			name = rewritten
+		}
 		imageSetter := fmt.Sprintf("%s:%s", policy.GetNamespace(), policy.GetName())
+		detectRepository(ref.Context().Name(), imageSetter)
+		if repo, ok := repositoryName(name); ok {
+			detectRepository(repo, imageSetter)
+		}
+
+		format := o.imageFormat
+		if annotated, ok := policy.GetAnnotations()[ImageFormatAnnotation]; ok {
+			format = ImageFormat(annotated)
+		}
+		formatted, err := formatImage(format, image, name, tag, hasTag, digest)
+		if err != nil {
+			return fmt.Errorf("image policy %s/%s: %w", policy.GetNamespace(), policy.GetName(), err)
+		}
+
 		tracelog.Info("adding setter", "name", imageSetter)
-		defs[fieldmeta.SetterDefinitionPrefix+imageSetter] = setterSchema(imageSetter, policy.Status.LatestImage)
+		defs[fieldmeta.SetterDefinitionPrefix+imageSetter] = setterSchema(imageSetter, formatted)
 		imageRefs[imageSetter] = ref
 
-		tagSetter := imageSetter + ":tag"
-		tracelog.Info("adding setter", "name", tagSetter)
-		defs[fieldmeta.SetterDefinitionPrefix+tagSetter] = setterSchema(tagSetter, tag)
-		imageRefs[tagSetter] = ref
+		if hasTag {
+			tagSetter := imageSetter + ":tag"
+			tracelog.Info("adding setter", "name", tagSetter)
+			defs[fieldmeta.SetterDefinitionPrefix+tagSetter] = setterSchema(tagSetter, tag)
+			imageRefs[tagSetter] = ref
+		}
 
 		// Context().Name() gives the image repository _as supplied_
 		nameSetter := imageSetter + ":name"
 		tracelog.Info("adding setter", "name", nameSetter)
 		defs[fieldmeta.SetterDefinitionPrefix+nameSetter] = setterSchema(nameSetter, name)
 		imageRefs[nameSetter] = ref
+
+		if hasTag {
+			// a Helm chart in an OCI repository is tagged with its
+			// version, but with any `+` replaced by `_`, since a tag
+			// can't have a `+`; this gives the version as it would be
+			// written in a HelmRelease or Chart.yaml
+			versionSetter := imageSetter + ":version"
+			tracelog.Info("adding setter", "name", versionSetter)
+			defs[fieldmeta.SetterDefinitionPrefix+versionSetter] = setterSchema(versionSetter, chartVersion(tag))
+			imageRefs[versionSetter] = ref
+		}
+
+		// the digest, for fields that pin an image by its digest
+		// rather than (or as well as) its tag
+		if digest != "" {
+			digestSetter := imageSetter + ":digest"
+			tracelog.Info("adding setter", "name", digestSetter)
+			defs[fieldmeta.SetterDefinitionPrefix+digestSetter] = setterSchema(digestSetter, digest)
+			imageRefs[digestSetter] = ref
+		}
+		return nil
+	}
+
+	given := make(map[types.NamespacedName]bool, len(policies))
+	for _, policy := range policies {
+		given[types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}] = true
+		if err := addPolicy(policy); err != nil {
+			return Result{}, err
+		}
 	}
 
+	// Before setting values, the markers in the files read are
+	// collected, and the policies they name that weren't given are
+	// looked up, if there's a means to.
+	lookupMarked := kio.FilterFunc(func(nodes []*yaml.RNode) ([]*yaml.RNode, error) {
+		marked, err := markedPolicies(nodes)
+		if err != nil {
+			return nil, err
+		}
+		result.MarkedPolicies = marked
+		if o.lookup == nil {
+			return nodes, nil
+		}
+		var missing []types.NamespacedName
+		for policy := range marked {
+			if !given[policy] {
+				missing = append(missing, policy)
+			}
+		}
+		sort.Slice(missing, func(i, j int) bool {
+			if missing[i].Namespace != missing[j].Namespace {
+				return missing[i].Namespace < missing[j].Namespace
+			}
+			return missing[i].Name < missing[j].Name
+		})
+		for _, policyName := range missing {
+			given[policyName] = true
+			tracelog.Info("looking up policy", "name", policyName.String())
+			policy, err := o.lookup(policyName)
+			if err != nil {
+				return nil, err
+			}
+			if policy != nil {
+				if err := addPolicy(*policy); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return nodes, nil
+	})
+
 	settersSchema.Definitions = defs
 
+	var detect func(string) (string, bool)
+	markerToken := fmt.Sprintf("%q", SetterShortHand)
+	token := markerToken
+	if o.detectImages {
+		detect = func(image string) (string, bool) {
+			repo, ok := repositoryName(image)
+			if !ok {
+				return "", false
+			}
+			setter := detectable[repo]
+			return setter, setter != ""
+		}
+		// every image field has `image` in its name
+		token = "image"
+	}
+
 	// get ready with the reader and writer
 	reader := &ScreeningLocalReader{
-		Path:  inpath,
-		Token: fmt.Sprintf("%q", SetterShortHand),
-		Trace: tracelog,
+		Path:        inpath,
+		Token:       token,
+		MarkerToken: markerToken,
+		Trace:       tracelog,
+		Include:     o.include,
+		Exclude:     o.exclude,
+
+		Ignore:     o.ignore,
+		IgnoreRoot: o.ignoreRoot,
+
+		MaxFileSize:  o.maxFileSize,
+		MaxDocuments: o.maxDocuments,
+
+		Only:     o.only,
+		OnlyRoot: o.onlyRoot,
+
+		Symlinks:    o.symlinks,
+		SymlinkRoot: o.symlinkRoot,
+
+		Context: o.ctx,
 	}
-	writer := &kio.LocalPackageWriter{
-		PackagePath: outpath,
+
+	// A field marked for a policy restricted to some files is set
+	// only if the file it's in is one of them. The files refused are
+	// reported as skipped, once for each policy.
+	var notAllowed []SkippedFile
+	refused := make(map[string]bool)
+	allowed := func(file, setterName string) bool {
+		ref, ok := imageRefs[setterName]
+		if !ok {
+			return true
+		}
+		patterns, ok := allowedPaths[ref.policy]
+		if !ok {
+			return true
+		}
+		rel, ok := file, true
+		if o.allowedPathsRoot != "" {
+			rel, ok = relativeTo(o.allowedPathsRoot, filepath.Join(reader.base(), file))
+		}
+		if ok && matchAny(patterns, filepath.ToSlash(rel)) {
+			return true
+		}
+		if key := file + "\x00" + ref.policy.String(); !refused[key] {
+			refused[key] = true
+			notAllowed = append(notAllowed, SkippedFile{
+				Path:    file,
+				Reason:  SkipPathNotAllowed,
+				Message: fmt.Sprintf("image policy %s is not allowed to update this file", ref.policy),
+				Marked:  true,
+			})
+		}
+		return false
+	}
+
+	// Files are written by editing the values changed in place, so
+	// that everything else in them stays as it was.
+	edits := fileEdits{}
+	writer := &preservingWriter{
+		inpath:  reader.base,
+		mode:    reader.fileMode,
+		outpath: outpath,
+		edits:   edits,
+		trace:   tracelog,
 	}
 
 	pipeline := kio.Pipeline{
 		Inputs:  []kio.Reader{reader},
 		Outputs: []kio.Writer{writer},
 		Filters: []kio.Filter{
-			setAll(&settersSchema, tracelog, setAllCallback),
+			lookupMarked,
+			setAll(o.ctx, &settersSchema, tracelog, setAllCallback, allowed, detect, edits),
 		},
 	}
 
 	// go!
 	err := pipeline.Execute()
 	if err != nil {
+		// the pipeline wraps errors so they can't be unwrapped
+		if o.ctx != nil && o.ctx.Err() != nil {
+			return Result{}, o.ctx.Err()
+		}
 		return Result{}, err
 	}
+	result.Skipped = append(reader.Skipped, notAllowed...)
+	result.ScreenedFiles = reader.ScreenedFiles
 	return result, nil
 }
 
+// chartVersion gives the version of a Helm chart from the tag it has
+// in an OCI repository.
+func chartVersion(tag string) string {
+	return strings.ReplaceAll(tag, "_", "+")
+}
+
 // setAll returns a kio.Filter using the supplied SetAllCallback
 // (dealing with individual nodes), amd calling the given callback
-// whenever a field value is changed, and returning only nodes from
-// files with changed nodes. This is based on
+// for each field with a setter, whether or not its value is changed,
+// and returning only nodes from files with changed nodes. A field is
+// left alone if `allowed` returns false for its file and setter. If
+// `detect` is not nil, image fields without a setter are set with the
+// setter it gives (see SetAllCallback.Detect). Each value changed is
+// recorded in `edits`. If `ctx` is not nil, it's checked before each
+// node, and its error returned once it's done. This is based on
 // [`SetAll`](https://github.com/kubernetes-sigs/kustomize/blob/kyaml/v0.10.16/kyaml/setters2/set.go#L503
 // from kyaml/kio.
-func setAll(schema *spec.Schema, tracelog logr.Logger, callback func(file, setterName string, node *yaml.RNode)) kio.Filter {
+func setAll(ctx context.Context, schema *spec.Schema, tracelog logr.Logger, callback func(file, setterName, oldValue, newValue string, node *yaml.RNode), allowed func(file, setterName string) bool, detect func(image string) (string, bool), edits fileEdits) kio.Filter {
 	filter := &SetAllCallback{
 		SettersSchema: schema,
 		Trace:         tracelog,
+		Detect:        detect,
 	}
 	return kio.FilterFunc(
 		func(nodes []*yaml.RNode) ([]*yaml.RNode, error) {
 			filesToUpdate := sets.String{}
 			for i := range nodes {
-				path, _, err := kioutil.GetFileAnnotations(nodes[i])
+				if ctx != nil && ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				path, index, err := kioutil.GetFileAnnotations(nodes[i])
 				if err != nil {
 					return nil, err
 				}
 
 				filter.Callback = func(setter, oldValue, newValue string) {
+					callback(path, setter, oldValue, newValue, nodes[i])
 					if newValue != oldValue {
-						callback(path, setter, nodes[i])
 						filesToUpdate.Insert(path)
 					}
 				}
+				filter.Allowed = func(setter string) bool {
+					return allowed(path, setter)
+				}
+				filter.Edited = func(field *yaml.Node, oldValue string, oldStyle yaml.Style) {
+					edits[path] = append(edits[path], fieldEdit{
+						index:    index,
+						line:     field.Line,
+						column:   field.Column,
+						oldValue: oldValue,
+						newValue: field.Value,
+						oldStyle: oldStyle,
+						newStyle: field.Style,
+					})
+				}
 				_, err = filter.Filter(nodes[i])
 				if err != nil {
 					return nil, err
@@ -253,6 +529,76 @@ func setAll(schema *spec.Schema, tracelog logr.Logger, callback func(file, sette
 		})
 }
 
+// relativeTo gives the path p relative to the directory root, and
+// true; or false if it's not within root.
+func relativeTo(root, p string) (string, bool) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", false
+	}
+	if p, err = filepath.Abs(p); err != nil || !withinDir(root, p) {
+		return "", false
+	}
+	rel, err := filepath.Rel(root, p)
+	return rel, err == nil
+}
+
+// repositoryName gives the full name of the repository of the image
+// given, by which image fields are matched to image policies when
+// detecting them; e.g., `index.docker.io/library/nginx` for `nginx`.
+func repositoryName(image string) (string, bool) {
+	ref, err := name.ParseReference(image, name.WeakValidation)
+	if err != nil {
+		return "", false
+	}
+	return ref.Context().Name(), true
+}
+
+// rewriteName gives the name of the image repository given as
+// rewritten by the first of the rewrites that matches it, and true; or
+// false if none matches.
+func rewriteName(rewrites []RegistryRewrite, repo name.Repository) (string, bool) {
+	full := repo.RegistryStr() + "/" + repo.RepositoryStr()
+	for _, rewrite := range rewrites {
+		from := strings.TrimSuffix(rewrite.From, "/")
+		// Docker Hub goes by both names; the library uses this one
+		if from == "docker.io" || strings.HasPrefix(from, "docker.io/") {
+			from = name.DefaultRegistry + strings.TrimPrefix(from, "docker.io")
+		}
+		if full == from || strings.HasPrefix(full, from+"/") {
+			return strings.TrimSuffix(rewrite.To, "/") + strings.TrimPrefix(full, from), true
+		}
+	}
+	return "", false
+}
+
+// formatImage gives the image to write for a marker without a suffix,
+// in the format given, from the image as given by the policy and its
+// parts. A format needing a part the image doesn't have gives the
+// image as given.
+func formatImage(format ImageFormat, image, name, tag string, hasTag bool, digest string) (string, error) {
+	switch format {
+	case "":
+		return image, nil
+	case ImageFormatTag:
+		if hasTag {
+			return name + ":" + tag, nil
+		}
+		return image, nil
+	case ImageFormatDigest:
+		if digest != "" {
+			return name + "@" + digest, nil
+		}
+		return image, nil
+	case ImageFormatTagAndDigest:
+		if hasTag && digest != "" {
+			return name + ":" + tag + "@" + digest, nil
+		}
+		return image, nil
+	}
+	return "", fmt.Errorf("unknown image format %q", format)
+}
+
 func setterSchema(name, value string) spec.Schema {
 	schema := spec.StringProperty()
 	schema.Extensions = map[string]interface{}{}
@@ -0,0 +1,217 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package testenv helps to test where markers are placed in a
+// repository, by making the updates an automation would make to a
+// fixture directory, and comparing the outcome with golden files. It
+// is meant for the tests of repositories updated by automation; e.g.,
+//
+//	func TestMarkers(t *testing.T) {
+//		policies := []imagev1_reflect.ImagePolicy{
+//			testenv.Policy("flux-system", "podinfo", "ghcr.io/stefanprodan/podinfo:5.0.1"),
+//		}
+//		tree := testenv.Update(t, "testdata/clusters", policies)
+//		testenv.ExpectAllMarkersMatched(t, tree.Result)
+//		testenv.ExpectGolden(t, tree.Dir, "testdata/golden")
+//	}
+//
+// Running the tests with the environment variable UPDATE_GOLDEN set
+// (e.g., `UPDATE_GOLDEN=1 go test ./...`) rewrites the golden files
+// with the outcome, for when a change to it is intended.
+package testenv
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	imagev1_reflect "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+
+	"github.com/fluxcd/image-automation-controller/pkg/test"
+	"github.com/fluxcd/image-automation-controller/pkg/update"
+)
+
+// UpdateGoldenEnv is the environment variable which, if set to
+// anything, has ExpectGolden rewrite the golden files rather than
+// compare with them.
+const UpdateGoldenEnv = "UPDATE_GOLDEN"
+
+// Tree is the outcome of updating a fixture directory.
+type Tree struct {
+	// Dir is a copy of the fixture directory, with the updates made.
+	Dir string
+	// Result records the updates made.
+	Result update.Result
+}
+
+// Policy gives an image policy with the namespace, name and latest
+// image given, to pass to Update.
+func Policy(namespace, name, latestImage string) imagev1_reflect.ImagePolicy {
+	return imagev1_reflect.ImagePolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+		Status: imagev1_reflect.ImagePolicyStatus{
+			LatestImage: latestImage,
+		},
+	}
+}
+
+// Update copies the fixture directory given to a temporary directory,
+// and makes the updates to it that an automation with the policies and
+// options given would make. The fixture directory itself is left
+// alone. The test fails straight away if the updates can't be made.
+func Update(t testing.TB, fixture string, policies []imagev1_reflect.ImagePolicy, opts ...update.Option) Tree {
+	t.Helper()
+	dir := t.TempDir()
+	if err := copyTree(fixture, dir); err != nil {
+		t.Fatalf("unable to copy fixture %s: %v", fixture, err)
+	}
+	result, err := update.Update(dir, policies, opts...)
+	if err != nil {
+		t.Fatalf("unable to update fixture %s: %v", fixture, err)
+	}
+	return Tree{Dir: dir, Result: result}
+}
+
+// ExpectGolden fails the test if the files in the directory given
+// differ from those in the golden directory given, reporting each
+// difference. Files and directories with names starting with a dot
+// are not compared. If the environment variable named by
+// UpdateGoldenEnv is set, the golden directory is replaced with a copy
+// of the directory given instead.
+func ExpectGolden(t testing.TB, dir, golden string) {
+	t.Helper()
+	if os.Getenv(UpdateGoldenEnv) != "" {
+		if err := os.RemoveAll(golden); err != nil {
+			t.Fatalf("unable to remove golden files: %v", err)
+		}
+		if err := copyTree(dir, golden); err != nil {
+			t.Fatalf("unable to write golden files: %v", err)
+		}
+		t.Logf("rewrote golden files in %s", golden)
+		return
+	}
+	if info, err := os.Stat(golden); err != nil || !info.IsDir() {
+		t.Fatalf("golden directory %s is missing; set %s to write it", golden, UpdateGoldenEnv)
+	}
+
+	actualOnly, goldenOnly, different := test.DiffDirectories(dir, golden)
+	for _, p := range actualOnly {
+		t.Errorf("%s is not in the golden files", strings.TrimPrefix(p, "/"))
+	}
+	for _, p := range goldenOnly {
+		t.Errorf("%s is in the golden files, but missing", strings.TrimPrefix(p, "/"))
+	}
+	for _, diff := range different {
+		p := strings.TrimPrefix(diff.Path(), "/")
+		actual, _ := os.ReadFile(filepath.Join(dir, p))
+		expected, _ := os.ReadFile(filepath.Join(golden, p))
+		t.Errorf("%s differs from the golden file:\n--- got\n%s\n--- expected\n%s", p, actual, expected)
+	}
+}
+
+// UnmatchedMarkers gives the policies named by markers in the files
+// updated for which no policy with an image was given, in order of
+// namespace then name. These are usually mistakes in the markers.
+func UnmatchedMarkers(result update.Result) []types.NamespacedName {
+	var unmatched []types.NamespacedName
+	for policy := range result.MarkedPolicies {
+		if _, ok := result.MatchedPolicies[policy]; !ok {
+			unmatched = append(unmatched, policy)
+		}
+	}
+	sort.Slice(unmatched, func(i, j int) bool {
+		if unmatched[i].Namespace != unmatched[j].Namespace {
+			return unmatched[i].Namespace < unmatched[j].Namespace
+		}
+		return unmatched[i].Name < unmatched[j].Name
+	})
+	return unmatched
+}
+
+// ExpectAllMarkersMatched fails the test if any marker names a policy
+// that wasn't given, or that had no image.
+func ExpectAllMarkersMatched(t testing.TB, result update.Result) {
+	t.Helper()
+	for _, policy := range UnmatchedMarkers(result) {
+		t.Errorf("a marker refers to the policy %s, which was not given or has no image", policy)
+	}
+}
+
+// ExpectNoneSkipped fails the test if any file with a marker was
+// skipped, e.g., because it couldn't be parsed.
+func ExpectNoneSkipped(t testing.TB, result update.Result) {
+	t.Helper()
+	for _, skipped := range result.Skipped {
+		if skipped.Marked {
+			t.Errorf("%s was skipped (%s): %s", skipped.Path, skipped.Reason, skipped.Message)
+		}
+	}
+}
+
+// copyTree copies the directory src to dst, which is created if it
+// doesn't exist. Symlinks are copied as symlinks.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(p, target, info.Mode().Perm())
+		}
+		return fmt.Errorf("%s is not a regular file, directory or symlink", p)
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testenv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	imagev1_reflect "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+)
+
+// recorder is a testing.TB that records errors rather than failing.
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestUpdateGolden(t *testing.T) {
+	policies := []imagev1_reflect.ImagePolicy{
+		Policy("apps", "podinfo", "ghcr.io/stefanprodan/podinfo:5.0.1"),
+	}
+	tree := Update(t, "testdata/fixture", policies)
+	ExpectAllMarkersMatched(t, tree.Result)
+	ExpectNoneSkipped(t, tree.Result)
+	ExpectGolden(t, tree.Dir, "testdata/golden")
+
+	if _, err := os.Stat(filepath.Join(tree.Dir, "apps", "kustomization.yaml")); err != nil {
+		t.Errorf("expected files without markers to be copied: %v", err)
+	}
+	original, err := os.ReadFile("testdata/fixture/apps/deployment.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if golden, _ := os.ReadFile("testdata/golden/apps/deployment.yaml"); string(original) == string(golden) {
+		t.Error("expected the fixture to be left alone")
+	}
+}
+
+func TestExpectGoldenReportsDifferences(t *testing.T) {
+	tree := Update(t, "testdata/fixture", []imagev1_reflect.ImagePolicy{
+		Policy("apps", "podinfo", "ghcr.io/stefanprodan/podinfo:6.0.0"),
+	})
+	if err := os.WriteFile(filepath.Join(tree.Dir, "extra.yaml"), []byte("kind: ConfigMap\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := &recorder{TB: t}
+	ExpectGolden(r, tree.Dir, "testdata/golden")
+	if len(r.errors) != 2 {
+		t.Errorf("expected a changed file and an extra file to be reported, got %q", r.errors)
+	}
+}
+
+func TestUnmatchedMarkers(t *testing.T) {
+	tree := Update(t, "testdata/fixture", []imagev1_reflect.ImagePolicy{
+		Policy("apps", "other", "ghcr.io/stefanprodan/podinfo:6.0.0"),
+	})
+	expected := []types.NamespacedName{{Namespace: "apps", Name: "podinfo"}}
+	if unmatched := UnmatchedMarkers(tree.Result); !reflect.DeepEqual(unmatched, expected) {
+		t.Errorf("expected unmatched markers %v, got %v", expected, unmatched)
+	}
+	r := &recorder{TB: t}
+	ExpectAllMarkersMatched(r, tree.Result)
+	if len(r.errors) != 1 {
+		t.Errorf("expected the unmatched marker to be reported, got %q", r.errors)
+	}
+}
+
+func TestUpdateGoldenFiles(t *testing.T) {
+	tree := Update(t, "testdata/fixture", []imagev1_reflect.ImagePolicy{
+		Policy("apps", "podinfo", "ghcr.io/stefanprodan/podinfo:5.0.1"),
+	})
+	golden := filepath.Join(t.TempDir(), "golden")
+	os.Setenv(UpdateGoldenEnv, "1")
+	ExpectGolden(t, tree.Dir, golden)
+	os.Unsetenv(UpdateGoldenEnv)
+	ExpectGolden(t, tree.Dir, golden)
+}
@@ -17,12 +17,15 @@ limitations under the License.
 package update
 
 import (
+	"context"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/go-logr/logr"
 	"github.com/google/go-containerregistry/pkg/name"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -93,6 +96,182 @@ var _ = Describe("Update image via kyaml setters2", func() {
 		test.ExpectMatchingDirectories(tmp, "testdata/setters/expected")
 	})
 
+	It("updates Helm chart versions from the tags of an OCI repository", func() {
+		tmp, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmp)
+
+		chartPolicies := []imagev1_reflect.ImagePolicy{
+			{
+				ObjectMeta: metav1.ObjectMeta{ // name matches marker used in testdata/charts/{original,expected}
+					Namespace: "automation-ns",
+					Name:      "chart",
+				},
+				Status: imagev1_reflect.ImagePolicyStatus{
+					LatestImage: "index.repo.fake/charts/podinfo:6.0.1_build.1",
+				},
+			},
+		}
+
+		result, err := UpdateWithSetters(logr.Discard(), "testdata/charts/original", tmp, chartPolicies)
+		Expect(err).ToNot(HaveOccurred())
+		test.ExpectMatchingDirectories(tmp, "testdata/charts/expected")
+		Expect(result.Files).To(HaveLen(2))
+		Expect(result.Files["Chart.yaml"].Changes[0].String()).To(Equal("6.0.0 -> 6.0.1+build.1"))
+	})
+
+	It("updates images pinned to a digest", func() {
+		tmp, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmp)
+
+		digestPolicies := []imagev1_reflect.ImagePolicy{
+			{
+				ObjectMeta: metav1.ObjectMeta{ // name matches marker used in testdata/digest/{original,expected}
+					Namespace: "automation-ns",
+					Name:      "pinned",
+				},
+				Status: imagev1_reflect.ImagePolicyStatus{
+					LatestImage: "index.repo.fake/updated:v1.0.1@sha256:5ff0d07fa13a42bd3e0ef1a4ba87f9ec1c5e8f0ac6e09ab0d3b6c1fdd4e1a3b2",
+				},
+			},
+		}
+
+		result, err := UpdateWithSetters(logr.Discard(), "testdata/digest/original", tmp, digestPolicies)
+		Expect(err).ToNot(HaveOccurred())
+		test.ExpectMatchingDirectories(tmp, "testdata/digest/expected")
+		Expect(result.Files["deployment.yaml"].Changes).To(HaveLen(3))
+	})
+
+	It("leaves out the tag of an image pinned to a digest without one", func() {
+		tmp, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmp)
+
+		digestPolicies := []imagev1_reflect.ImagePolicy{
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "automation-ns",
+					Name:      "pinned",
+				},
+				Status: imagev1_reflect.ImagePolicyStatus{
+					LatestImage: "index.repo.fake/updated@sha256:5ff0d07fa13a42bd3e0ef1a4ba87f9ec1c5e8f0ac6e09ab0d3b6c1fdd4e1a3b2",
+				},
+			},
+		}
+
+		result, err := UpdateWithSetters(logr.Discard(), "testdata/digest/original", tmp, digestPolicies)
+		Expect(err).ToNot(HaveOccurred())
+		var setters []string
+		for _, change := range result.Files["deployment.yaml"].Changes {
+			setters = append(setters, change.Setter)
+		}
+		Expect(setters).To(ConsistOf("automation-ns:pinned", "automation-ns:pinned:digest"))
+	})
+
+	DescribeTable("writes images in the format asked for",
+		func(format ImageFormat, annotated string, expected string) {
+			tmp, err := os.MkdirTemp("", "gotest")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(tmp)
+
+			policy := imagev1_reflect.ImagePolicy{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "automation-ns",
+					Name:      "pinned",
+				},
+				Status: imagev1_reflect.ImagePolicyStatus{
+					LatestImage: "index.repo.fake/updated:v1.0.1@sha256:5ff0d07fa13a42bd3e0ef1a4ba87f9ec1c5e8f0ac6e09ab0d3b6c1fdd4e1a3b2",
+				},
+			}
+			if annotated != "" {
+				policy.SetAnnotations(map[string]string{ImageFormatAnnotation: annotated})
+			}
+			result, err := UpdateWithSetters(logr.Discard(), "testdata/digest/original", tmp,
+				[]imagev1_reflect.ImagePolicy{policy}, WithImageFormat(format))
+			Expect(err).ToNot(HaveOccurred())
+			var written string
+			for _, change := range result.Files["deployment.yaml"].Changes {
+				if change.Setter == "automation-ns:pinned" {
+					written = change.NewValue
+				}
+			}
+			Expect(written).To(Equal(expected))
+		},
+		Entry("as given", ImageFormat(""), "", "index.repo.fake/updated:v1.0.1@sha256:5ff0d07fa13a42bd3e0ef1a4ba87f9ec1c5e8f0ac6e09ab0d3b6c1fdd4e1a3b2"),
+		Entry("tag", ImageFormatTag, "", "index.repo.fake/updated:v1.0.1"),
+		Entry("digest", ImageFormatDigest, "", "index.repo.fake/updated@sha256:5ff0d07fa13a42bd3e0ef1a4ba87f9ec1c5e8f0ac6e09ab0d3b6c1fdd4e1a3b2"),
+		Entry("tag and digest", ImageFormatTagAndDigest, "", "index.repo.fake/updated:v1.0.1@sha256:5ff0d07fa13a42bd3e0ef1a4ba87f9ec1c5e8f0ac6e09ab0d3b6c1fdd4e1a3b2"),
+		Entry("annotated on the policy", ImageFormatDigest, "Tag", "index.repo.fake/updated:v1.0.1"),
+	)
+
+	It("writes images without a digest as given when asked for a digest", func() {
+		tmp, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmp)
+
+		_, err = UpdateWithSetters(logr.Discard(), "testdata/setters/original", tmp, policies, WithImageFormat(ImageFormatDigest))
+		Expect(err).ToNot(HaveOccurred())
+		test.ExpectMatchingDirectories(tmp, "testdata/setters/expected")
+	})
+
+	It("fails for an image policy with an unknown format", func() {
+		tmp, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmp)
+
+		policy := policies[0]
+		policy.SetAnnotations(map[string]string{ImageFormatAnnotation: "Sha"})
+		_, err = UpdateWithSetters(logr.Discard(), "testdata/setters/original", tmp, []imagev1_reflect.ImagePolicy{policy})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rewrites the registry of images written", func() {
+		tmp, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmp)
+
+		policy := imagev1_reflect.ImagePolicy{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "automation-ns",
+				Name:      "pinned",
+			},
+			Status: imagev1_reflect.ImagePolicyStatus{
+				LatestImage: "index.repo.fake/updated:v1.0.1@sha256:5ff0d07fa13a42bd3e0ef1a4ba87f9ec1c5e8f0ac6e09ab0d3b6c1fdd4e1a3b2",
+			},
+		}
+		result, err := UpdateWithSetters(logr.Discard(), "testdata/digest/original", tmp,
+			[]imagev1_reflect.ImagePolicy{policy},
+			WithImageFormat(ImageFormatTag),
+			WithRegistryRewrites(
+				RegistryRewrite{From: "docker.io", To: "mirror.example.com/dockerhub"},
+				RegistryRewrite{From: "index.repo.fake", To: "mirror.example.com/fake"},
+			))
+		Expect(err).ToNot(HaveOccurred())
+		written := make(map[string]string)
+		for _, change := range result.Files["deployment.yaml"].Changes {
+			written[change.Setter] = change.NewValue
+		}
+		Expect(written).To(HaveKeyWithValue("automation-ns:pinned", "mirror.example.com/fake/updated:v1.0.1"))
+		Expect(written).To(HaveKeyWithValue("automation-ns:pinned:name", "mirror.example.com/fake/updated"))
+		Expect(written).To(HaveKeyWithValue("automation-ns:pinned:tag", "v1.0.1"))
+	})
+
+	DescribeTable("rewriting registries",
+		func(image, from, to, expected string) {
+			ref, err := name.ParseReference(image, name.WeakValidation)
+			Expect(err).ToNot(HaveOccurred())
+			rewritten, ok := rewriteName([]RegistryRewrite{{From: from, To: to}}, ref.Context())
+			Expect(ok).To(Equal(expected != ""))
+			Expect(rewritten).To(Equal(expected))
+		},
+		Entry("implied Docker Hub", "nginx:1.21.1", "docker.io", "mirror.example.com/dockerhub", "mirror.example.com/dockerhub/library/nginx"),
+		Entry("explicit Docker Hub", "docker.io/fluxcd/flux:1.0", "docker.io", "mirror.example.com", "mirror.example.com/fluxcd/flux"),
+		Entry("repository path", "ghcr.io/org/app:v1", "ghcr.io/org", "mirror.example.com/org-mirror", "mirror.example.com/org-mirror/app"),
+		Entry("path not on a boundary", "ghcr.io/organisation/app:v1", "ghcr.io/org", "mirror.example.com", ""),
+		Entry("other registry", "quay.io/org/app:v1", "docker.io", "mirror.example.com", ""),
+	)
+
 	It("gives the result of the updates", func() {
 		tmp, err := os.MkdirTemp("", "gotest")
 		Expect(err).ToNot(HaveOccurred())
@@ -131,6 +310,22 @@ var _ = Describe("Update image via kyaml setters2", func() {
 							expectedImageRef,
 						},
 					},
+					Changes: []Change{
+						{
+							Object:   kustomizeResourceID,
+							Setter:   "automation-ns:policy:name",
+							OldValue: "replaced",
+							NewValue: "index.repo.fake/updated",
+							Image:    expectedImageRef,
+						},
+						{
+							Object:   kustomizeResourceID,
+							Setter:   "automation-ns:policy:tag",
+							OldValue: "v1",
+							NewValue: "v1.0.1",
+							Image:    expectedImageRef,
+						},
+					},
 				},
 				"marked.yaml": {
 					Objects: map[ObjectIdentifier][]ImageRef{
@@ -138,10 +333,198 @@ var _ = Describe("Update image via kyaml setters2", func() {
 							expectedImageRef,
 						},
 					},
+					Changes: []Change{
+						{
+							Object:   markedResourceID,
+							Setter:   "automation-ns:policy",
+							OldValue: "image:v1.0.0",
+							NewValue: "index.repo.fake/updated:v1.0.1",
+							Image:    expectedImageRef,
+						},
+					},
 				},
 			},
+			Matched: 4,
+			MatchedPolicies: map[types.NamespacedName]struct{}{
+				{Namespace: "automation-ns", Name: "policy"}:    {},
+				{Namespace: "automation-ns", Name: "unchanged"}: {},
+			},
+			MarkedPolicies: map[types.NamespacedName]struct{}{
+				{Namespace: "automation-ns", Name: "policy"}:    {},
+				{Namespace: "automation-ns", Name: "unchanged"}: {},
+				{Namespace: "other-namespace", Name: "policy"}:  {},
+			},
+			ScreenedFiles: []string{"kustomization.yaml", "marked.yaml", "otherns.yaml"},
 		}
 
 		Expect(result).To(Equal(expectedResult))
+		Expect(result.Changes()).To(Equal(append(
+			expectedResult.Files["kustomization.yaml"].Changes,
+			expectedResult.Files["marked.yaml"].Changes...)))
+		Expect(result.Files["marked.yaml"].Changes[0].String()).To(Equal("image:v1.0.0 -> index.repo.fake/updated:v1.0.1"))
+	})
+
+	It("updates files in place", func() {
+		tmp, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmp)
+
+		for _, name := range []string{"kustomization.yaml", "marked.yaml", "otherns.yaml", "unmarked.yaml"} {
+			original, err := os.ReadFile(filepath.Join("testdata/setters/original", name))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.WriteFile(filepath.Join(tmp, name), original, 0644)).To(Succeed())
+		}
+
+		result, err := Update(tmp, policies)
+		Expect(err).ToNot(HaveOccurred())
+		for name, dir := range map[string]string{
+			"kustomization.yaml": "expected",
+			"marked.yaml":        "expected",
+			"otherns.yaml":       "original",
+		} {
+			written, err := os.ReadFile(filepath.Join(tmp, name))
+			Expect(err).ToNot(HaveOccurred())
+			expected, err := os.ReadFile(filepath.Join("testdata/setters", dir, name))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(written)).To(Equal(string(expected)))
+		}
+
+		updates := result.ImageUpdates()
+		Expect(updates).To(HaveLen(1))
+		Expect(updates[0].Image.Policy()).To(Equal(types.NamespacedName{Namespace: "automation-ns", Name: "policy"}))
+		Expect(updates[0].Files).To(Equal([]string{"kustomization.yaml", "marked.yaml"}))
+		Expect(updates[0].Changes).To(Equal(result.Changes()))
+	})
+
+	It("looks up the policies named by markers that weren't given", func() {
+		tmp, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmp)
+
+		var looked []types.NamespacedName
+		lookup := func(name types.NamespacedName) (*imagev1_reflect.ImagePolicy, error) {
+			looked = append(looked, name)
+			if name.Namespace != "automation-ns" {
+				return nil, nil
+			}
+			for i := range policies {
+				if policies[i].Name == name.Name {
+					return &policies[i], nil
+				}
+			}
+			return nil, nil
+		}
+
+		result, err := UpdateWithSetters(logr.Discard(), "testdata/setters/original", tmp, policies[1:], WithPolicyLookup(lookup))
+		Expect(err).ToNot(HaveOccurred())
+		test.ExpectMatchingDirectories(tmp, "testdata/setters/expected")
+		Expect(looked).To(Equal([]types.NamespacedName{
+			{Namespace: "automation-ns", Name: "policy"},
+			{Namespace: "other-namespace", Name: "policy"},
+		}))
+		Expect(result.MatchedPolicies).To(HaveLen(2))
+	})
+
+	It("updates the other files when a file can't be parsed", func() {
+		tmp, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmp)
+
+		good := "kind: ConfigMap\ndata:\n  image: image:v1.0.0 # {\"$imagepolicy\": \"automation-ns:policy\"}\n"
+		bad := good + "  - not: a mapping\n"
+		Expect(os.WriteFile(filepath.Join(tmp, "bad.yaml"), []byte(bad), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(tmp, "good.yaml"), []byte(good), 0644)).To(Succeed())
+
+		result, err := UpdateWithSetters(logr.Discard(), tmp, tmp, policies)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Files).To(HaveKey("good.yaml"))
+		Expect(result.Skipped).To(HaveLen(1))
+		Expect(result.Skipped[0].Path).To(Equal("bad.yaml"))
+		Expect(result.Skipped[0].Reason).To(Equal(SkipParseError))
+		Expect(result.Skipped[0].Message).To(ContainSubstring("yaml"))
+
+		written, err := os.ReadFile(filepath.Join(tmp, "bad.yaml"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(written)).To(Equal(bad))
+	})
+
+	It("stops, without writing files, once the context is done", func() {
+		tmp, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmp)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = UpdateWithSetters(logr.Discard(), "testdata/setters/original", tmp, policies, WithContext(ctx))
+		Expect(err).To(MatchError(context.Canceled))
+		written, err := os.ReadDir(tmp)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(written).To(BeEmpty())
+	})
+
+	It("updates only the files an image policy is allowed to", func() {
+		tmp, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmp)
+
+		marked := "kind: ConfigMap\ndata:\n  image: image:v1.0.0 # {\"$imagepolicy\": \"automation-ns:policy\"}\n"
+		for _, dir := range []string{"team-a", "team-b"} {
+			Expect(os.MkdirAll(filepath.Join(tmp, "apps", dir), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(tmp, "apps", dir, "config.yaml"), []byte(marked), 0644)).To(Succeed())
+		}
+
+		policy := *policies[0].DeepCopy()
+		policy.SetAnnotations(map[string]string{AllowedPathsAnnotation: "apps/team-a/**, apps/shared/*.yaml"})
+		apps := filepath.Join(tmp, "apps")
+		result, err := UpdateWithSetters(logr.Discard(), apps, apps, []imagev1_reflect.ImagePolicy{policy},
+			WithAllowedPathsRoot(tmp))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Files).To(HaveLen(1))
+		Expect(result.Files).To(HaveKey("team-a/config.yaml"))
+		Expect(result.Skipped).To(Equal([]SkippedFile{{
+			Path:    "team-b/config.yaml",
+			Reason:  SkipPathNotAllowed,
+			Message: "image policy automation-ns/policy is not allowed to update this file",
+			Marked:  true,
+		}}))
+
+		written, err := os.ReadFile(filepath.Join(tmp, "apps", "team-b", "config.yaml"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(written)).To(Equal(marked))
+
+		// without a root, the patterns are relative to the path updated
+		result, err = UpdateWithSetters(logr.Discard(), apps, apps, []imagev1_reflect.ImagePolicy{policy})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Files).To(BeEmpty())
+		Expect(result.Skipped).To(HaveLen(2))
+	})
+
+	It("updates image fields without markers when asked to detect them", func() {
+		tmp, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmp)
+
+		result, err := UpdateWithSetters(logr.Discard(), "testdata/detect/original", tmp, policies, WithDetectImages(true))
+		Expect(err).ToNot(HaveOccurred())
+		test.ExpectMatchingDirectories(tmp, "testdata/detect/expected")
+		Expect(result.Files).To(HaveLen(3))
+		Expect(result.Files["kustomization.yaml"].Changes).To(HaveLen(1))
+		Expect(result.Files["kustomization.yaml"].Changes[0].Setter).To(Equal("automation-ns:policy:tag"))
+	})
+
+	It("leaves alone image fields in the repository of more than one policy", func() {
+		tmp, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmp)
+
+		other := *policies[0].DeepCopy()
+		other.Name = "other"
+		other.Status.LatestImage = "index.repo.fake/updated:v2.0.0"
+		result, err := UpdateWithSetters(logr.Discard(), "testdata/detect/original", tmp,
+			append([]imagev1_reflect.ImagePolicy{other}, policies...), WithDetectImages(true))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Files).To(HaveLen(1))
+		Expect(result.Files["deployment.yaml"].Changes).To(HaveLen(1))
+		Expect(result.Files["deployment.yaml"].Changes[0].Setter).To(Equal("automation-ns:unchanged"))
 	})
 })
@@ -0,0 +1,463 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// fieldEdit records a scalar value changed by a setter, and where the
+// value was in the document it was read from.
+type fieldEdit struct {
+	// index is the index annotation of the document
+	index string
+	// line and column give the start of the value in the document,
+	// counting from one, as the YAML parser does
+	line, column int
+
+	oldValue, newValue string
+	oldStyle, newStyle yaml.Style
+}
+
+// fileEdits holds the edits made to each file, by path.
+type fileEdits map[string][]fieldEdit
+
+// preservingWriter is a kio.Writer that writes each file by changing
+// only the values that were edited in the original, so that comments,
+// anchors, quoting, indentation and so on are left exactly as they
+// were. A document that can't be edited this way is written out from
+// its node, leaving the rest of the file as it was; and a file for
+// which the result would not read back the same as the nodes given
+// is written out in full, as kio.LocalPackageWriter would. Either
+// way, the file written is given the permissions and line endings of
+// the file read; and a file is not written at all if it would be
+// unchanged.
+type preservingWriter struct {
+	// inpath gives the directory the paths of the files read are
+	// relative to; it's a func since it's only known once the files
+	// have been read.
+	inpath func() string
+	// mode gives the permissions of the file read at a path, if
+	// known.
+	mode    func(path string) (os.FileMode, bool)
+	outpath string
+	edits   fileEdits
+	trace   logr.Logger
+}
+
+func (w *preservingWriter) Write(nodes []*yaml.RNode) error {
+	byFile := make(map[string][]*yaml.RNode)
+	var paths []string
+	for _, node := range nodes {
+		path, _, err := kioutil.GetFileAnnotations(node)
+		if err != nil {
+			return err
+		}
+		if _, ok := byFile[path]; !ok {
+			paths = append(paths, path)
+		}
+		byFile[path] = append(byFile[path], node)
+	}
+	sort.Strings(paths)
+
+	outpath := w.outpath
+	if info, err := os.Stat(outpath); err != nil {
+		return err
+	} else if !info.IsDir() {
+		outpath = filepath.Dir(outpath)
+	}
+
+	var unwrapped []*yaml.RNode
+	for _, path := range paths {
+		// items unwrapped from a list have no path of their own, and
+		// are given one by kio.LocalPackageWriter
+		if path == "" {
+			unwrapped = byFile[path]
+			continue
+		}
+		contents, err := w.contents(path, byFile[path])
+		if err != nil {
+			return err
+		}
+		outfile := filepath.Join(outpath, path)
+		// Writing a file that hasn't changed would only disturb its
+		// modification time.
+		if existing, err := os.ReadFile(outfile); err == nil && bytes.Equal(existing, contents) {
+			w.trace.Info("file unchanged; not writing it", "path", path)
+			if err := w.keepMode(path, outfile); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(outfile), 0o700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(outfile, contents, 0o600); err != nil {
+			return err
+		}
+		if err := w.keepMode(path, outfile); err != nil {
+			return err
+		}
+	}
+	if len(unwrapped) == 0 {
+		return nil
+	}
+	return kio.LocalPackageWriter{PackagePath: outpath}.Write(unwrapped)
+}
+
+// contents gives what the file at the path given, made up of the
+// nodes given, should contain once updated.
+func (w *preservingWriter) contents(path string, nodes []*yaml.RNode) ([]byte, error) {
+	original, err := os.ReadFile(filepath.Join(w.inpath(), path))
+	if err != nil {
+		return nil, fmt.Errorf("reading file to update: %w", err)
+	}
+	edits := w.edits[path]
+	if len(edits) == 0 {
+		return original, nil
+	}
+	want, err := serialize(nodes)
+	if err != nil {
+		return nil, err
+	}
+	if edited := editFile(path, original, edits, want); edited != nil {
+		return edited, nil
+	}
+	if edited := editDocuments(path, original, edits, nodes, want); edited != nil {
+		w.trace.Info("unable to edit file in place; writing out the documents changed", "path", path)
+		return edited, nil
+	}
+	w.trace.Info("unable to edit file in place; writing it out in full", "path", path)
+	// kyaml always writes LF line endings
+	if usesCRLF(original) {
+		want = bytes.ReplaceAll(want, []byte("\n"), []byte("\r\n"))
+	}
+	return want, nil
+}
+
+// usesCRLF reports whether the file contents given use Windows line
+// endings, going by the first line.
+func usesCRLF(contents []byte) bool {
+	i := bytes.IndexByte(contents, '\n')
+	return i > 0 && contents[i-1] == '\r'
+}
+
+// keepMode gives the file written at outfile the permissions of the
+// file read at path. Writing to an existing file leaves its mode
+// alone, but a file written afresh (e.g., to a different output
+// directory) would otherwise lose its executable bit, say.
+func (w *preservingWriter) keepMode(path, outfile string) error {
+	if w.mode == nil {
+		return nil
+	}
+	mode, ok := w.mode(path)
+	if !ok {
+		return nil
+	}
+	info, err := os.Stat(outfile)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm() == mode {
+		return nil
+	}
+	return os.Chmod(outfile, mode)
+}
+
+// editFile gives the original contents of the file at the path given
+// with the edits made, or nil if that can't be done faithfully; i.e.,
+// so that the result reads the same as want, the nodes of the file
+// serialized.
+func editFile(path string, original []byte, edits []fieldEdit, want []byte) []byte {
+	edited, ok := applyEdits(original, edits)
+	if !ok {
+		return nil
+	}
+	reader := &kio.ByteReader{
+		Reader:         bytes.NewReader(edited),
+		SetAnnotations: map[string]string{kioutil.PathAnnotation: path},
+	}
+	reread, err := reader.Read()
+	if err != nil {
+		return nil
+	}
+	got, err := serialize(reread)
+	if err != nil || !bytes.Equal(got, want) {
+		return nil
+	}
+	return edited
+}
+
+// editDocuments gives the original contents of the file at the path
+// given, with each document that has edits either edited in place, or
+// if that can't be done faithfully, written out from its node. The
+// other documents, and the separators between documents, are left as
+// they were. It returns nil if the result would not read the same as
+// want, the nodes of the file serialized.
+func editDocuments(path string, original []byte, edits []fieldEdit, nodes []*yaml.RNode, want []byte) []byte {
+	docs, ok := documents(original)
+	if !ok {
+		return nil
+	}
+	byIndex := make(map[string]*yaml.RNode, len(nodes))
+	for _, node := range nodes {
+		_, index, err := kioutil.GetFileAnnotations(node)
+		if err != nil {
+			return nil
+		}
+		byIndex[index] = node
+	}
+	crlf := usesCRLF(original)
+
+	var edited bytes.Buffer
+	last := 0
+	for _, doc := range docs {
+		var docEdits []fieldEdit
+		for _, edit := range edits {
+			if edit.index == doc.index {
+				// the document is edited on its own, as the
+				// first in a file
+				edit.index = "0"
+				docEdits = append(docEdits, edit)
+			}
+		}
+		if len(docEdits) == 0 {
+			continue
+		}
+		node, ok := byIndex[doc.index]
+		if !ok {
+			return nil
+		}
+		wantDoc, err := serialize([]*yaml.RNode{node})
+		if err != nil {
+			return nil
+		}
+		text := editFile(path, original[doc.start:doc.end], docEdits, wantDoc)
+		if text == nil {
+			text = wantDoc
+			if crlf {
+				text = bytes.ReplaceAll(text, []byte("\n"), []byte("\r\n"))
+			}
+		}
+		edited.Write(original[last:doc.start])
+		edited.Write(text)
+		last = doc.end
+	}
+	edited.Write(original[last:])
+
+	reader := &kio.ByteReader{
+		Reader:         bytes.NewReader(edited.Bytes()),
+		SetAnnotations: map[string]string{kioutil.PathAnnotation: path},
+	}
+	reread, err := reader.Read()
+	if err != nil {
+		return nil
+	}
+	got, err := serialize(reread)
+	if err != nil || !bytes.Equal(got, want) {
+		return nil
+	}
+	return edited.Bytes()
+}
+
+// serialize writes out the nodes given as kio.LocalPackageWriter
+// would, for comparison.
+func serialize(nodes []*yaml.RNode) ([]byte, error) {
+	sorted := make([]*yaml.RNode, len(nodes))
+	copy(sorted, nodes)
+	if err := kioutil.SortNodes(sorted); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err := kio.ByteWriter{
+		Writer:           &buf,
+		ClearAnnotations: []string{kioutil.PathAnnotation},
+	}.Write(sorted)
+	return buf.Bytes(), err
+}
+
+// applyEdits makes the edits given to the file contents given. It
+// reports false if an edit can't be made; e.g., because the value
+// isn't found where it's expected.
+func applyEdits(original []byte, edits []fieldEdit) ([]byte, bool) {
+	docs, ok := documents(original)
+	if !ok {
+		return nil, false
+	}
+	starts := make(map[string]int, len(docs))
+	for _, doc := range docs {
+		starts[doc.index] = doc.line
+	}
+	lineOffsets := []int{0}
+	for i, b := range original {
+		if b == '\n' {
+			lineOffsets = append(lineOffsets, i+1)
+		}
+	}
+
+	type replacement struct {
+		start, end int
+		text       string
+	}
+	var replacements []replacement
+	for _, edit := range edits {
+		start, ok := starts[edit.index]
+		if !ok || edit.line < 1 || edit.column < 1 {
+			return nil, false
+		}
+		line := start + edit.line - 1
+		if line > len(lineOffsets) {
+			return nil, false
+		}
+		offset := lineOffsets[line-1]
+		// the column counts characters, not bytes
+		for col := 1; col < edit.column; col++ {
+			if offset >= len(original) || original[offset] == '\n' {
+				return nil, false
+			}
+			_, size := utf8.DecodeRune(original[offset:])
+			offset += size
+		}
+		oldText, ok := scalarText(edit.oldValue, edit.oldStyle)
+		if !ok || !bytes.HasPrefix(original[offset:], []byte(oldText)) {
+			return nil, false
+		}
+		newText, ok := scalarText(edit.newValue, edit.newStyle)
+		if !ok {
+			return nil, false
+		}
+		replacements = append(replacements, replacement{start: offset, end: offset + len(oldText), text: newText})
+	}
+
+	// making the replacements from the end backwards leaves the
+	// offsets of those before as they were
+	sort.Slice(replacements, func(i, j int) bool {
+		return replacements[i].start > replacements[j].start
+	})
+	edited := append([]byte(nil), original...)
+	for i, r := range replacements {
+		if i > 0 && r.end > replacements[i-1].start {
+			return nil, false
+		}
+		edited = append(edited[:r.start], append([]byte(r.text), edited[r.end:]...)...)
+	}
+	return edited, true
+}
+
+// scalarText gives the text of a single-line scalar with the value and
+// style given, as it appears in a file. It reports false for styles
+// that can span lines, or are tagged, or for values it can't be sure
+// of writing in the style.
+func scalarText(value string, style yaml.Style) (string, bool) {
+	if strings.ContainsAny(value, "\n\r") {
+		return "", false
+	}
+	switch style {
+	case 0:
+		return value, true
+	case yaml.SingleQuotedStyle:
+		return "'" + strings.ReplaceAll(value, "'", "''") + "'", true
+	case yaml.DoubleQuotedStyle:
+		if strings.ContainsAny(value, "\"\\") || !strconv.CanBackquote(value) {
+			return "", false
+		}
+		return "\"" + value + "\"", true
+	default:
+		return "", false
+	}
+}
+
+// document gives where a YAML document is in a file.
+type document struct {
+	// index is the index annotation kio.ByteReader gives the document
+	index string
+	// start and end are the offsets of the bytes of the document,
+	// which don't include the separator following it
+	start, end int
+	// line is the line the document starts on, counting from one
+	line int
+}
+
+// documents splits the file contents given into documents, as
+// kio.ByteReader does, and gives those that kio.ByteReader would
+// read, in order. It reports false if the file is a list that
+// kio.ByteReader would unwrap, since its items don't map to documents.
+func documents(contents []byte) ([]document, bool) {
+	// kio.ByteReader splits the contents, with CRLF line endings
+	// replaced with LF, at each "\n---\n". Since the split doesn't
+	// overlap, a line following a separator can't be one itself.
+	var parts []document
+	start, line, partLine := 0, 1, 1
+	afterSeparator := false
+	for offset := 0; offset < len(contents); {
+		end := bytes.IndexByte(contents[offset:], '\n')
+		if end < 0 {
+			break
+		}
+		end += offset
+		text := bytes.TrimSuffix(contents[offset:end], []byte("\r"))
+		if offset > 0 && !afterSeparator && string(text) == "---" {
+			parts = append(parts, document{start: start, end: offset, line: partLine})
+			start, partLine = end+1, line+1
+			afterSeparator = true
+		} else {
+			afterSeparator = false
+		}
+		offset = end + 1
+		line++
+	}
+	parts = append(parts, document{start: start, end: len(contents), line: partLine})
+
+	var docs []document
+	index := 0
+	for _, part := range parts {
+		node := &yaml.Node{}
+		value := strings.ReplaceAll(string(contents[part.start:part.end]), "\r\n", "\n")
+		err := yaml.NewDecoder(strings.NewReader(value)).Decode(node)
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return nil, false
+		}
+		if yaml.IsYNodeEmptyDoc(node) || yaml.IsMissingOrNull(yaml.NewRNode(node)) {
+			continue
+		}
+		if len(parts) == 1 {
+			if meta, err := yaml.NewRNode(node).GetMeta(); err == nil && (meta.Kind == kio.ResourceListKind || meta.Kind == "List") {
+				return nil, false
+			}
+		}
+		part.index = strconv.Itoa(index)
+		docs = append(docs, part)
+		index++
+	}
+	return docs, true
+}
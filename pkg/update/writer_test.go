@@ -0,0 +1,232 @@
+/*
+Copyright 2021 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	imagev1_reflect "github.com/fluxcd/image-reflector-controller/api/v1beta1"
+)
+
+var _ = Describe("writing updated files", func() {
+	policies := []imagev1_reflect.ImagePolicy{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "automation-ns", Name: "policy"},
+			Status:     imagev1_reflect.ImagePolicyStatus{LatestImage: "index.repo.fake/updated:v1.0.1"},
+		},
+	}
+
+	update := func(original string) string {
+		dir, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "file.yaml")
+		Expect(os.WriteFile(file, []byte(original), 0644)).To(Succeed())
+		_, err = UpdateWithSetters(logr.Discard(), dir, dir, policies)
+		Expect(err).ToNot(HaveOccurred())
+		updated, err := os.ReadFile(file)
+		Expect(err).ToNot(HaveOccurred())
+		return string(updated)
+	}
+
+	It("changes only the values updated, leaving the formatting as it was", func() {
+		original := `# a comment at the top
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name:   foo   # odd spacing
+  labels: &labels {app: foo, tier: "web"}
+spec:
+  selector:
+    matchLabels: *labels
+  template:
+    metadata:
+      annotations:
+        description: >
+          A folded scalar, which is
+          written out differently by kyaml.
+    spec:
+      containers:
+      - name: c
+        image: "image:v1.0.0"   # {"$imagepolicy": "automation-ns:policy"}
+      - name: d
+        image: 'v1.0.0' # {"$imagepolicy": "automation-ns:policy:tag"}
+---
+kind: ConfigMap
+metadata: {name: bar}
+data:
+    tag: v1.0.0 # {"$imagepolicy": "automation-ns:policy:tag"}
+`
+		expected := strings.NewReplacer(
+			`"image:v1.0.0"`, `"index.repo.fake/updated:v1.0.1"`,
+			`'v1.0.0'`, `'v1.0.1'`,
+			`tag: v1.0.0`, `tag: v1.0.1`,
+		).Replace(original)
+		Expect(update(original)).To(Equal(expected))
+	})
+
+	It("writes out only the documents it can't edit in place", func() {
+		first := `---
+# the first document
+kind: ConfigMap
+metadata: {name: a}
+data:
+    image: image:v1.0.0 # {"$imagepolicy": "automation-ns:policy"}
+---
+`
+		second := `# the second, with a tagged value
+kind: ConfigMap
+metadata:
+    name: b
+data:
+    image: !!str image:v1.0.0 # {"$imagepolicy": "automation-ns:policy"}
+`
+		third := `---
+kind: ConfigMap
+metadata:
+      name: c
+`
+		updated := update(first + second + third)
+		Expect(updated).To(HavePrefix(strings.Replace(first, "image:v1.0.0", "index.repo.fake/updated:v1.0.1", 1)))
+		Expect(updated).To(HaveSuffix(third))
+		Expect(updated).To(ContainSubstring(`# the second, with a tagged value
+kind: ConfigMap
+metadata:
+  name: b
+data:
+  image: !!str index.repo.fake/updated:v1.0.1 # {"$imagepolicy": "automation-ns:policy"}
+`))
+	})
+
+	It("keeps Windows line endings", func() {
+		original := "kind: ConfigMap\r\nmetadata:\r\n  name: foo\r\ndata:\r\n  image: image:v1.0.0 # {\"$imagepolicy\": \"automation-ns:policy\"}\r\n"
+		expected := strings.Replace(original, "image:v1.0.0", "index.repo.fake/updated:v1.0.1", 1)
+		Expect(update(original)).To(Equal(expected))
+
+		// and when the file is written out in full
+		original = strings.Replace(original, "image: image", "image: !!str image", 1)
+		updated := update(original)
+		Expect(updated).To(ContainSubstring("index.repo.fake/updated:v1.0.1"))
+		Expect(strings.Count(updated, "\r\n")).To(Equal(strings.Count(updated, "\n")))
+	})
+
+	It("writes out the file in full when it can't be edited in place", func() {
+		// a tagged value isn't edited in place
+		original := `kind: ConfigMap
+metadata:
+    name: foo
+data:
+    image: !!str image:v1.0.0 # {"$imagepolicy": "automation-ns:policy"}
+`
+		updated := update(original)
+		Expect(updated).To(ContainSubstring("index.repo.fake/updated:v1.0.1"))
+		Expect(updated).To(ContainSubstring("\n  name: foo\n"))
+	})
+
+	It("keeps the permissions of files written to another directory", func() {
+		indir, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(indir)
+		outdir, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(outdir)
+
+		files := map[string]string{
+			"edited.yaml":    "kind: ConfigMap\ndata:\n  image: image:v1.0.0 # {\"$imagepolicy\": \"automation-ns:policy\"}\n",
+			"rewritten.yaml": "kind: ConfigMap\ndata:\n  image: !!str image:v1.0.0 # {\"$imagepolicy\": \"automation-ns:policy\"}\n",
+		}
+		for name, contents := range files {
+			file := filepath.Join(indir, name)
+			Expect(os.WriteFile(file, []byte(contents), 0755)).To(Succeed())
+			// the umask may have taken bits away
+			Expect(os.Chmod(file, 0755)).To(Succeed())
+		}
+		_, err = UpdateWithSetters(logr.Discard(), indir, outdir, policies)
+		Expect(err).ToNot(HaveOccurred())
+		for name := range files {
+			info, err := os.Stat(filepath.Join(outdir, name))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0755)), name)
+		}
+	})
+
+	It("leaves files that would be unchanged alone", func() {
+		dir, err := os.MkdirTemp("", "gotest")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		// one with a value already up to date, and one with no values
+		// for the setters; both formatted as kyaml wouldn't
+		files := map[string]string{
+			"current.yaml":  "kind: ConfigMap\ndata:\n    image: index.repo.fake/updated:v1.0.1 # {\"$imagepolicy\": \"automation-ns:policy\"}\n",
+			"unmarked.yaml": "kind: ConfigMap\ndata:\n    image: image:v1.0.0 # {\"$imagepolicy\": \"other-ns:policy\"}\n",
+		}
+		past := time.Now().Add(-time.Hour).Truncate(time.Second)
+		for name, contents := range files {
+			file := filepath.Join(dir, name)
+			Expect(os.WriteFile(file, []byte(contents), 0644)).To(Succeed())
+			Expect(os.Chtimes(file, past, past)).To(Succeed())
+		}
+		_, err = UpdateWithSetters(logr.Discard(), dir, dir, policies)
+		Expect(err).ToNot(HaveOccurred())
+		for name, contents := range files {
+			file := filepath.Join(dir, name)
+			written, err := os.ReadFile(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(written)).To(Equal(contents))
+			info, err := os.Stat(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.ModTime()).To(Equal(past), name)
+		}
+	})
+
+	It("splits files into documents as kio.ByteReader does", func() {
+		for _, contents := range []string{
+			"a: 1\n",
+			"---\na: 1\n---\nb: 2\n",
+			"a: 1\n---\n---\nb: 2\n",
+			"a: 1\n---\n\n---\nb: 2\n---\n",
+			"a: 1\r\n---\r\nb: 2\r\n",
+			"a: 1\n--- # not a separator\nb: 2\n",
+			"a: 1\n---",
+		} {
+			docs, ok := documents([]byte(contents))
+			Expect(ok).To(BeTrue(), contents)
+			nodes, err := (&kio.ByteReader{Reader: strings.NewReader(contents), OmitReaderAnnotations: true}).Read()
+			Expect(err).ToNot(HaveOccurred(), contents)
+			Expect(docs).To(HaveLen(len(nodes)), contents)
+			for i, doc := range docs {
+				Expect(doc.index).To(Equal(strconv.Itoa(i)))
+				// each document reads the same on its own
+				node, err := yaml.Parse(contents[doc.start:doc.end])
+				Expect(err).ToNot(HaveOccurred(), contents)
+				Expect(node.MustString()).To(Equal(nodes[i].MustString()), contents)
+			}
+		}
+	})
+})